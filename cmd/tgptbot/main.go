@@ -1,6 +1,11 @@
 package main
 
-import "telegram-chatgpt-bot/internal/bot"
+import (
+	// embed the timezone database for project timezones on minimal images
+	_ "time/tzdata"
+
+	"telegram-chatgpt-bot/internal/bot"
+)
 
 func main() {
 	bot.Run()
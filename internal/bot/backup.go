@@ -0,0 +1,76 @@
+package bot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"telegram-chatgpt-bot/internal/handler"
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// defaultBackupInterval is used when TBOT_BACKUP_DIR is set without
+// TBOT_BACKUP_INTERVAL.
+const defaultBackupInterval = 24 * time.Hour
+
+// backupConfig reads TBOT_BACKUP_DIR and TBOT_BACKUP_INTERVAL. An empty dir
+// disables scheduled backups.
+func backupConfig() (dir string, interval time.Duration) {
+	dir = strings.TrimSpace(os.Getenv("TBOT_BACKUP_DIR"))
+	interval = defaultBackupInterval
+	if v := strings.TrimSpace(os.Getenv("TBOT_BACKUP_INTERVAL")); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			interval = d
+		} else {
+			logging.Log.Warn().Str("value", v).Msg("invalid TBOT_BACKUP_INTERVAL")
+		}
+	}
+	return dir, interval
+}
+
+// runBackups writes a database snapshot to dir every interval.
+func runBackups(ctx context.Context, dir string, interval time.Duration) {
+	ticker := newTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			path, err := writeBackup(dir, now())
+			if err != nil {
+				logging.Log.Error().Err(err).Str("dir", dir).Msg("scheduled backup failed")
+				continue
+			}
+			logging.Log.Info().Str("event", "backup_written").Str("path", path).Msg("database backup written")
+		}
+	}
+}
+
+// writeBackup writes a snapshot taken at t into dir. The snapshot is written
+// to a temporary file first, so an interrupted backup never looks complete.
+func writeBackup(dir string, t time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, ".backup-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if err := storage.Snapshot(f); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, handler.BackupFileName(t))
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
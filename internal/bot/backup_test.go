@@ -0,0 +1,41 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+func TestWriteBackup(t *testing.T) {
+	if err := storage.Init(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("storage init: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "backups")
+	path, err := writeBackup(dir, time.Date(2024, 6, 3, 8, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("writeBackup: %v", err)
+	}
+	if want := filepath.Join(dir, "bot-20240603-083000.db"); path != want {
+		t.Fatalf("path = %q, want %q", path, want)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("backup dir holds %v, %v; want only the backup", entries, err)
+	}
+
+	storage.Close()
+	if err := storage.Init(path); err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	if ok, err := storage.ProjectExists("demo"); err != nil || !ok {
+		t.Fatalf("project in backup = %v, %v", ok, err)
+	}
+}
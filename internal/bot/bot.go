@@ -2,20 +2,31 @@ package bot
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 
 	tg "github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 
+	"telegram-chatgpt-bot/internal/config"
 	"telegram-chatgpt-bot/internal/crypt"
 	"telegram-chatgpt-bot/internal/handler"
 	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/metrics"
 	"telegram-chatgpt-bot/internal/storage"
 )
 
 // Run starts the Telegram bot and listens for updates.
 func Run() {
+	// report every configuration problem at once instead of failing on the
+	// first missing variable
+	if err := config.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	logging.Init()
 	handler.Init()
 	logging.Log.Info().Msg("starting bot")
@@ -25,6 +36,9 @@ func Run() {
 	if err := storage.Init("bot.db"); err != nil {
 		logging.Log.Fatal().Err(err).Msg("storage init")
 	}
+	if err := handler.RestoreSetup(); err != nil {
+		logging.Log.Error().Err(err).Msg("failed to restore setup wizards")
+	}
 
 	// create Telegram API client
 	botToken := os.Getenv("TBOT_TELEGRAM_KEY")
@@ -32,9 +46,14 @@ func Run() {
 		logging.Log.Fatal().Msg("TBOT_TELEGRAM_KEY env var is required")
 	}
 
-	b, err := tg.New(botToken, tg.WithDefaultHandler(func(ctx context.Context, b *tg.Bot, upd *models.Update) {
+	opts := []tg.Option{tg.WithDefaultHandler(func(ctx context.Context, b *tg.Bot, upd *models.Update) {
 		handler.HandleUpdate(ctx, b, upd)
-	}))
+	})}
+	if url := strings.TrimSpace(os.Getenv("TBOT_TELEGRAM_API_URL")); url != "" {
+		// a local Bot API server lets the bot download files up to 2000 MB
+		opts = append(opts, tg.WithServerURL(url))
+	}
+	b, err := tg.New(botToken, opts...)
 	if err != nil {
 		logging.Log.Fatal().Err(err).Msg("failed to create bot")
 	}
@@ -46,7 +65,23 @@ func Run() {
 	if err != nil {
 		logging.Log.Fatal().Err(err).Msg("failed to get bot info")
 	}
+	handler.SetBotIdentity(me.ID, me.Username)
 	logging.Log.Info().Str("event", "bot_start").Str("username", me.Username).Msg("bot started")
 
+	if addr := os.Getenv("TBOT_METRICS_ADDR"); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				logging.Log.Error().Err(err).Msg("metrics server stopped")
+			}
+		}()
+	}
+
+	go runScheduler(ctx, b)
+	if dir, interval := backupConfig(); dir != "" {
+		logging.Log.Info().Str("dir", dir).Dur("interval", interval).Msg("scheduled backups enabled")
+		go runBackups(ctx, dir, interval)
+	}
 	b.Start(ctx)
 }
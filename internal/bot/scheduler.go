@@ -0,0 +1,59 @@
+package bot
+
+import (
+	"context"
+	"time"
+
+	"telegram-chatgpt-bot/internal/cron"
+	"telegram-chatgpt-bot/internal/handler"
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+var (
+	// wrappers for easier testing
+	now          = time.Now
+	newTicker    = time.NewTicker
+	fireSchedule = handler.HandleScheduled
+)
+
+// runScheduler checks the stored schedules every few seconds and fires the
+// ones matching the current minute. Schedules are read from storage on each
+// check, so they survive restarts and pick up changes immediately.
+func runScheduler(ctx context.Context, b handler.Bot) {
+	ticker := newTicker(15 * time.Second)
+	defer ticker.Stop()
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			minute := now().Truncate(time.Minute)
+			if minute.Equal(last) {
+				continue
+			}
+			last = minute
+			runDueSchedules(ctx, b, minute)
+		}
+	}
+}
+
+// runDueSchedules fires every schedule matching t.
+func runDueSchedules(ctx context.Context, b handler.Bot, t time.Time) {
+	items, err := storage.ListSchedules()
+	if err != nil {
+		logging.Log.Error().Err(err).Msg("failed to load schedules")
+		return
+	}
+	for _, s := range items {
+		spec, err := cron.Parse(s.Cron)
+		if err != nil {
+			logging.Log.Warn().Err(err).Uint64("schedule_id", s.ID).Msg("invalid stored schedule")
+			continue
+		}
+		if spec.Matches(t) {
+			go fireSchedule(ctx, b, s)
+		}
+	}
+}
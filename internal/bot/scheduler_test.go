@@ -0,0 +1,76 @@
+package bot
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"telegram-chatgpt-bot/internal/handler"
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+func TestRunDueSchedules(t *testing.T) {
+	logging.Init()
+	if err := storage.Init(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("storage init: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	storage.AddSchedule(storage.Schedule{ChatID: 1, Cron: "0 8 * * *", Prompt: "morning"})
+	storage.AddSchedule(storage.Schedule{ChatID: 1, Cron: "0 20 * * *", Prompt: "evening"})
+
+	fired := make(chan string, 2)
+	orig := fireSchedule
+	fireSchedule = func(ctx context.Context, b handler.Bot, s storage.Schedule) { fired <- s.Prompt }
+	defer func() { fireSchedule = orig }()
+
+	runDueSchedules(context.Background(), nil, time.Date(2024, 6, 3, 8, 0, 0, 0, time.Local))
+	select {
+	case p := <-fired:
+		if p != "morning" {
+			t.Fatalf("fired %q, want morning", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("due schedule not fired")
+	}
+	select {
+	case p := <-fired:
+		t.Fatalf("unexpected schedule fired: %q", p)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRunScheduler_FakeClock(t *testing.T) {
+	logging.Init()
+	if err := storage.Init(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("storage init: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	storage.AddSchedule(storage.Schedule{ChatID: 1, Cron: "30 7 * * *", Prompt: "plan"})
+
+	fired := make(chan string, 1)
+	origFire, origNow, origTicker := fireSchedule, now, newTicker
+	fireSchedule = func(ctx context.Context, b handler.Bot, s storage.Schedule) { fired <- s.Prompt }
+	now = func() time.Time { return time.Date(2024, 6, 3, 7, 30, 12, 0, time.Local) }
+	newTicker = func(d time.Duration) *time.Ticker { return time.NewTicker(time.Millisecond) }
+	defer func() { fireSchedule, now, newTicker = origFire, origNow, origTicker }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() { runScheduler(ctx, nil); close(stopped) }()
+	defer func() { cancel(); <-stopped }()
+	select {
+	case p := <-fired:
+		if p != "plan" {
+			t.Fatalf("fired %q, want plan", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("due schedule not fired")
+	}
+	select {
+	case <-fired:
+		t.Fatal("schedule fired twice in the same minute")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
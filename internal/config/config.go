@@ -0,0 +1,160 @@
+// Package config validates the environment variables of the bot before any
+// component starts, so every misconfiguration is reported at once.
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ValidationError lists every problem found in the environment.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("invalid configuration:")
+	for _, p := range e.Problems {
+		sb.WriteString("\n  - ")
+		sb.WriteString(p)
+	}
+	return sb.String()
+}
+
+// Validate checks the required and optional environment variables and
+// returns a *ValidationError describing all problems, or nil.
+func Validate() error {
+	var problems []string
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, name := range []string{"TBOT_TELEGRAM_KEY", "TBOT_CHATGPT_KEY"} {
+		if strings.TrimSpace(os.Getenv(name)) == "" {
+			add("%s is required", name)
+		}
+	}
+	if v := os.Getenv("TBOT_MASTER_KEY"); v == "" {
+		add("TBOT_MASTER_KEY is required (base64-encoded 32 bytes)")
+	} else if key, err := base64.StdEncoding.DecodeString(v); err != nil {
+		add("TBOT_MASTER_KEY is not valid base64: %v", err)
+	} else if len(key) != 32 {
+		add("TBOT_MASTER_KEY must decode to 32 bytes, got %d", len(key))
+	}
+
+	for _, name := range []string{"TBOT_ALLOWED_USER_IDS", "TBOT_ADMIN_USER_IDS"} {
+		for _, p := range strings.Split(os.Getenv(name), ",") {
+			s := strings.TrimSpace(p)
+			if s == "" {
+				continue
+			}
+			if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+				add("%s: invalid user id %q", name, s)
+			}
+		}
+	}
+
+	if v := os.Getenv("TBOT_METRICS_ADDR"); v != "" {
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			add("TBOT_METRICS_ADDR: %v", err)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("TBOT_TELEGRAM_API_URL")); v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("TBOT_TELEGRAM_API_URL: %q is not an http(s) URL such as http://localhost:8081", v)
+		}
+	}
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if _, err := zerolog.ParseLevel(strings.ToLower(v)); err != nil {
+			add("LOG_LEVEL: unknown level %q", v)
+		}
+	}
+	checkOneOf(add, "LOG_FORMAT", "json", "console")
+	checkOneOf(add, "TBOT_DEFAULT_REASONING", "minimal", "low", "medium", "high")
+	checkOneOf(add, "TBOT_DEFAULT_WEBSEARCH", "high", "medium", "low", "off")
+	checkOneOf(add, "TBOT_AUDIT", "on", "off")
+	checkOneOf(add, "TBOT_TRANSCRIBE_PROVIDER", "openai")
+
+	if v := strings.TrimSpace(os.Getenv("TBOT_MODEL_INPUT_LIMITS")); v != "" {
+		for _, p := range strings.Split(v, ",") {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				continue
+			}
+			model, val, ok := strings.Cut(p, "=")
+			if n, err := strconv.Atoi(strings.TrimSpace(val)); !ok || strings.TrimSpace(model) == "" || err != nil || n <= 0 {
+				add("TBOT_MODEL_INPUT_LIMITS: invalid entry %q, want model=tokens", p)
+			}
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("TBOT_SEARCH_COUNTRY")); v != "" {
+		if len(v) != 2 || strings.Trim(strings.ToUpper(v), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			add("TBOT_SEARCH_COUNTRY: %q is not a two-letter country code", v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("TBOT_SEARCH_TIMEZONE")); v != "" {
+		if _, err := time.LoadLocation(v); err != nil || v == "Local" {
+			add("TBOT_SEARCH_TIMEZONE: unknown timezone %q", v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("TBOT_BACKUP_INTERVAL")); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			add("TBOT_BACKUP_INTERVAL: %q is not a positive duration such as 24h", v)
+		} else if strings.TrimSpace(os.Getenv("TBOT_BACKUP_DIR")) == "" {
+			add("TBOT_BACKUP_INTERVAL is set but TBOT_BACKUP_DIR is empty")
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("TBOT_MAX_CONCURRENT")); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			add("TBOT_MAX_CONCURRENT: %q is not a non-negative integer", v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("TBOT_REQUEST_TIMEOUT")); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			add("TBOT_REQUEST_TIMEOUT: %q is not a positive duration such as 5m", v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("TBOT_PROGRESS_DELAY")); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			add("TBOT_PROGRESS_DELAY: %q is not a duration such as 3s", v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("TBOT_LOG_CHANNEL_ID")); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err != nil || n == 0 {
+			add("TBOT_LOG_CHANNEL_ID: %q is not a chat id such as -1001234567890", v)
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("TBOT_SEND_RETRIES")); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			add("TBOT_SEND_RETRIES: %q is not a non-negative integer", v)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// checkOneOf reports the env var when it is set to a value outside allowed.
+func checkOneOf(add func(string, ...any), name string, allowed ...string) {
+	v := strings.ToLower(strings.TrimSpace(os.Getenv(name)))
+	if v == "" {
+		return
+	}
+	for _, a := range allowed {
+		if v == a {
+			return
+		}
+	}
+	add("%s: %q is not one of %s", name, v, strings.Join(allowed, ", "))
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var validKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+// setValidEnv sets the required vars and clears the optional ones.
+func setValidEnv(t *testing.T) {
+	t.Setenv("TBOT_TELEGRAM_KEY", "123:abc")
+	t.Setenv("TBOT_CHATGPT_KEY", "sk-test")
+	t.Setenv("TBOT_MASTER_KEY", validKey)
+	for _, name := range []string{
+		"TBOT_ALLOWED_USER_IDS", "TBOT_ADMIN_USER_IDS", "TBOT_METRICS_ADDR",
+		"LOG_LEVEL", "LOG_FORMAT", "TBOT_DEFAULT_REASONING", "TBOT_DEFAULT_WEBSEARCH",
+		"TBOT_AUDIT", "TBOT_MODEL_INPUT_LIMITS", "TBOT_MAX_CONCURRENT",
+		"TBOT_SEARCH_COUNTRY", "TBOT_SEARCH_TIMEZONE", "TBOT_TRANSCRIBE_PROVIDER",
+		"TBOT_BACKUP_DIR", "TBOT_BACKUP_INTERVAL", "TBOT_SEND_RETRIES",
+		"TBOT_PROGRESS_DELAY", "TBOT_REQUEST_TIMEOUT", "TBOT_LOG_CHANNEL_ID",
+		"TBOT_TELEGRAM_API_URL",
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestValidateValid(t *testing.T) {
+	setValidEnv(t)
+	t.Setenv("TBOT_ALLOWED_USER_IDS", "1, 2,")
+	t.Setenv("TBOT_METRICS_ADDR", ":9090")
+	t.Setenv("LOG_LEVEL", "DEBUG")
+	t.Setenv("LOG_FORMAT", "console")
+	t.Setenv("TBOT_DEFAULT_REASONING", "high")
+	t.Setenv("TBOT_MODEL_INPUT_LIMITS", "gpt-5=272000,default=128000")
+	t.Setenv("TBOT_MAX_CONCURRENT", "0")
+	t.Setenv("TBOT_SEND_RETRIES", "5")
+	t.Setenv("TBOT_PROGRESS_DELAY", "3s")
+	t.Setenv("TBOT_REQUEST_TIMEOUT", "5m")
+	t.Setenv("TBOT_LOG_CHANNEL_ID", "-1001234567890")
+	t.Setenv("TBOT_TELEGRAM_API_URL", "http://localhost:8081")
+	t.Setenv("TBOT_SEARCH_COUNTRY", "us")
+	t.Setenv("TBOT_SEARCH_TIMEZONE", "America/New_York")
+	t.Setenv("TBOT_BACKUP_DIR", "/backups")
+	t.Setenv("TBOT_BACKUP_INTERVAL", "12h")
+	if err := Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+}
+
+func TestValidateMissing(t *testing.T) {
+	setValidEnv(t)
+	t.Setenv("TBOT_TELEGRAM_KEY", "")
+	t.Setenv("TBOT_CHATGPT_KEY", " ")
+	t.Setenv("TBOT_MASTER_KEY", "")
+	err := Validate()
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Validate() = %v, want *ValidationError", err)
+	}
+	if len(verr.Problems) != 3 {
+		t.Fatalf("problems = %q", verr.Problems)
+	}
+	for _, name := range []string{"TBOT_TELEGRAM_KEY", "TBOT_CHATGPT_KEY", "TBOT_MASTER_KEY"} {
+		if !strings.Contains(err.Error(), name+" is required") {
+			t.Errorf("report does not mention %s:\n%s", name, err)
+		}
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	cases := []struct {
+		name, value, want string
+	}{
+		{"TBOT_MASTER_KEY", "not base64!", "not valid base64"},
+		{"TBOT_MASTER_KEY", base64.StdEncoding.EncodeToString([]byte("short")), "must decode to 32 bytes, got 5"},
+		{"TBOT_ALLOWED_USER_IDS", "1,abc", `invalid user id "abc"`},
+		{"TBOT_ADMIN_USER_IDS", "x", `invalid user id "x"`},
+		{"TBOT_METRICS_ADDR", "9090", "TBOT_METRICS_ADDR"},
+		{"LOG_LEVEL", "loud", `unknown level "loud"`},
+		{"LOG_FORMAT", "xml", `"xml" is not one of json, console`},
+		{"TBOT_DEFAULT_REASONING", "max", "TBOT_DEFAULT_REASONING"},
+		{"TBOT_DEFAULT_WEBSEARCH", "on", "TBOT_DEFAULT_WEBSEARCH"},
+		{"TBOT_AUDIT", "yes", "TBOT_AUDIT"},
+		{"TBOT_TRANSCRIBE_PROVIDER", "deepgram", `"deepgram" is not one of openai`},
+		{"TBOT_MODEL_INPUT_LIMITS", "gpt-5:1000", `invalid entry "gpt-5:1000"`},
+		{"TBOT_MODEL_INPUT_LIMITS", "gpt-5=0", `invalid entry "gpt-5=0"`},
+		{"TBOT_MAX_CONCURRENT", "-1", "not a non-negative integer"},
+		{"TBOT_SEND_RETRIES", "x", `"x" is not a non-negative integer`},
+		{"TBOT_PROGRESS_DELAY", "-1s", `"-1s" is not a duration`},
+		{"TBOT_REQUEST_TIMEOUT", "0s", `"0s" is not a positive duration`},
+		{"TBOT_LOG_CHANNEL_ID", "@audit", `"@audit" is not a chat id`},
+		{"TBOT_TELEGRAM_API_URL", "localhost:8081", `"localhost:8081" is not an http(s) URL`},
+		{"TBOT_BACKUP_INTERVAL", "daily", `"daily" is not a positive duration`},
+		{"TBOT_BACKUP_INTERVAL", "6h", "TBOT_BACKUP_DIR is empty"},
+		{"TBOT_SEARCH_COUNTRY", "USA", `"USA" is not a two-letter country code`},
+		{"TBOT_SEARCH_TIMEZONE", "Mars/Olympus", `unknown timezone "Mars/Olympus"`},
+	}
+	for _, c := range cases {
+		t.Run(c.name+"="+c.value, func(t *testing.T) {
+			setValidEnv(t)
+			t.Setenv(c.name, c.value)
+			err := Validate()
+			if err == nil {
+				t.Fatal("Validate() = nil")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("report %q does not contain %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	setValidEnv(t)
+	t.Setenv("TBOT_CHATGPT_KEY", "")
+	t.Setenv("TBOT_ALLOWED_USER_IDS", "abc")
+	t.Setenv("TBOT_MAX_CONCURRENT", "many")
+	err := Validate()
+	want := "invalid configuration:\n" +
+		"  - TBOT_CHATGPT_KEY is required\n" +
+		"  - TBOT_ALLOWED_USER_IDS: invalid user id \"abc\"\n" +
+		"  - TBOT_MAX_CONCURRENT: \"many\" is not a non-negative integer"
+	if err == nil || err.Error() != want {
+		t.Fatalf("report = %v, want\n%s", err, want)
+	}
+}
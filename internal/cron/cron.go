@@ -0,0 +1,103 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec is a parsed five-field cron expression
+// (minute hour day-of-month month day-of-week).
+type Spec struct {
+	minute, hour, dom, month, dow [64]bool
+	domAny, dowAny                bool
+}
+
+type fieldRange struct{ min, max int }
+
+var fieldRanges = [5]fieldRange{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, 0 and 7 are Sunday
+}
+
+// Parse parses a standard five-field cron expression. Each field accepts "*",
+// numbers, ranges ("1-5"), lists ("1,3,5") and steps ("*/15", "0-30/10").
+func Parse(expr string) (Spec, error) {
+	var s Spec
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return s, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	targets := [5]*[64]bool{&s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	for i, f := range fields {
+		if err := parseField(f, fieldRanges[i], targets[i]); err != nil {
+			return s, fmt.Errorf("field %q: %w", f, err)
+		}
+	}
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+	return s, nil
+}
+
+func parseField(f string, r fieldRange, set *[64]bool) error {
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid step")
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := r.min, r.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			a, err1 := strconv.Atoi(bounds[0])
+			b, err2 := strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil || a > b {
+				return fmt.Errorf("invalid range")
+			}
+			lo, hi = a, b
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return fmt.Errorf("invalid value")
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = r.max
+			}
+		}
+		if lo < r.min || hi > r.max {
+			return fmt.Errorf("value out of range %d-%d", r.min, r.max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// Matches reports whether t falls into a minute selected by the spec. As in
+// classic cron, when both day fields are restricted either one may match.
+func (s Spec) Matches(t time.Time) bool {
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+	domOK := s.dom[t.Day()]
+	dowOK := s.dow[int(t.Weekday())]
+	if s.domAny || s.dowAny {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
@@ -0,0 +1,43 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "a * * * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := Parse(expr); err == nil {
+			t.Fatalf("Parse(%q) should fail", expr)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	mon := time.Date(2024, 6, 3, 8, 30, 0, 0, time.UTC) // Monday
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{"* * * * *", true},
+		{"30 8 * * *", true},
+		{"0 8 * * *", false},
+		{"*/15 * * * *", true},
+		{"*/20 * * * *", false},
+		{"30 8 * * 1-5", true},
+		{"30 8 * * 0,6", false},
+		{"30 8 * * 7", false},
+		{"30 8 3 6 *", true},
+		{"30 8 1 * 1", true},
+		{"30 8 1 * 2", false},
+	}
+	for _, tc := range cases {
+		spec, err := Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tc.expr, err)
+		}
+		if got := spec.Matches(mon); got != tc.want {
+			t.Fatalf("%q matches = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
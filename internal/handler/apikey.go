@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"errors"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// projectAPIKey returns the OpenAI API key requests of proj are billed to:
+// the project's own key set with /setkey, or the global TBOT_CHATGPT_KEY.
+func projectAPIKey(proj string) string {
+	if proj == "" {
+		return chatGPTKey
+	}
+	encrypted, err := storage.LoadProjectAPIKey(proj)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			logging.Log.Error().Err(err).Str("project", proj).Msg("failed to load api key")
+		}
+		return chatGPTKey
+	}
+	key, err := decryptAPIKey(encrypted)
+	if err != nil || key == "" {
+		logging.Log.Error().Err(err).Str("project", proj).Msg("failed to decrypt api key, using the global key")
+		return chatGPTKey
+	}
+	return key
+}
+
+// maskAPIKey hides all but the last four characters of key.
+func maskAPIKey(key string) string {
+	r := []rune(key)
+	if len(r) <= 8 {
+		// too short to reveal anything without giving most of it away
+		return "****"
+	}
+	return "****" + string(r[len(r)-4:])
+}
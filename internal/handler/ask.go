@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	openai "github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/responses"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/metrics"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+const askUsage = "Usage: /ask <projectName> [--history] <question>"
+
+// handleAsk sends a one-off question to a project chosen by name, using its
+// model, instruction, reasoning effort and web search regardless of the topic
+// mapping. With --history the project history is replayed and the exchange is
+// stored in it; by default the history is neither read nor written.
+func handleAsk(ctx context.Context, b Bot, msg *models.Message, args string) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	log := logging.Ctx(ctx)
+	fields, question := splitFields(args, 1)
+	useHistory := false
+	if f, rest := splitFields(question, 1); len(f) == 1 && f[0] == "--history" {
+		useHistory = true
+		question = rest
+	}
+	if len(fields) == 0 || strings.TrimSpace(question) == "" {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: askUsage})
+		return
+	}
+	proj := fields[0]
+	if exists, err := projectExists(proj); err != nil || !exists {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+		return
+	}
+	if underMaintenance(ctx, b, msg) || overMonthlyBudget(ctx, b, msg, proj) {
+		return
+	}
+	model, err := storage.LoadProjectModel(proj)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Error().Err(err).Str("project", proj).Msg("failed to load model")
+	}
+	if model == "" {
+		model = defaultModel
+	}
+	model = projectRouteModel(ctx, proj, model, question)
+	webSearchSetting, _ := storage.LoadProjectWebSearch(proj)
+	searchDomains, _ := storage.LoadProjectSearchDomains(proj)
+	reasoningEffort, _ := storage.LoadProjectReasoning(proj)
+	cfg := loadProjectConfig(proj)
+	if useHistory {
+		cfg.HistoryLimit, _ = storage.LoadHistoryLimit(proj)
+		cfg.History, _ = storage.LoadProjectHistory(proj)
+		if budget, _ := storage.LoadTokenBudget(proj); cfg.HistoryLimit > 0 && budget > 0 {
+			cfg.History = cfg.History[historyOverflow(cfg.History, budget):]
+		}
+	}
+	userName := msg.From.Username
+	if userName == "" {
+		userName = msg.From.FirstName
+	}
+	inputs, records := buildInputs(ctx, cfg, messageData{
+		UserID:    msg.From.ID,
+		UserName:  userName,
+		ChatID:    msg.Chat.ID,
+		MessageID: msg.ID,
+		When:      time.Now(),
+		Text:      question,
+	})
+
+	metrics.Inc(metrics.ChatGPTRequests)
+	log.Info().Str("event", "chatgpt_ask_request").Str("project", proj).Str("model", model).Bool("history", useHistory).Str("snippet", logging.Snippet(question, 30)).Msg("sending project question to ChatGPT")
+	params := responses.ResponseNewParams{
+		Model:     openai.ResponsesModel(model),
+		Input:     responses.ResponseNewParamsInputUnion{OfInputItemList: inputs},
+		Tools:     webSearchTools(webSearchSetting, searchDomains),
+		Reasoning: openai.ReasoningParam{Effort: reasoningEffortToConst(reasoningEffort)},
+	}
+	timeout := projectTimeout(proj)
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	var resp responseResult
+	release, err := requestSlots.acquire(reqCtx, nil)
+	if err == nil {
+		resp, err = openAIResponses(reqCtx, newOpenAIClient(proj), params)
+		release()
+	}
+	cancel()
+	reply := redactReply(ctx, proj, resp.Text)
+	recordUsage(ctx, proj, resp)
+	if err != nil {
+		metrics.Inc(metrics.ChatGPTErrors)
+		log.Error().Err(err).Msg("chatgpt ask request failed")
+		reply = classifyOpenAIError(err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			reply = timeoutText(timeout)
+		}
+	} else if strings.TrimSpace(reply) == "" {
+		log.Warn().Str("event", "chatgpt_empty_response").Str("project", proj).Str("model", model).Msg("model returned an empty response")
+		reply = emptyReplyText
+	} else if useHistory && cfg.HistoryLimit > 0 {
+		records = append(records, storage.HistoryMessage{
+			Role:      string(responses.EasyInputMessageRoleAssistant),
+			WhoName:   assistantName(proj, model),
+			When:      time.Now().Unix(),
+			Content:   reply,
+			ChatID:    msg.Chat.ID,
+			MessageID: msg.ID,
+		})
+		if _, err := appendHistory(proj, cfg.HistoryLimit, records...); err != nil {
+			log.Error().Err(err).Msg("failed to store exchange in history")
+		}
+	}
+	entry := storage.AuditEntry{UserID: msg.From.ID, Model: model, Prompt: question, Reply: reply, IsError: err != nil}
+	recordAudit(ctx, proj, entry)
+	// the copy is posted once the user has the answer
+	defer sendLogCopy(ctx, b, proj, msg.From, entry)
+	var replyTo *models.ReplyParameters
+	if msg.ID != 0 {
+		replyTo = &models.ReplyParameters{MessageID: msg.ID}
+	}
+	for _, chunk := range splitMessage(reply, 4000) {
+		sent, err := b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: chunk, ReplyParameters: replyTo})
+		if err != nil {
+			log.Error().Err(err).Msg("failed to send chunk")
+			return
+		}
+		replyTo = &models.ReplyParameters{MessageID: sent.ID}
+	}
+}
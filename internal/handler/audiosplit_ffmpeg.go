@@ -0,0 +1,59 @@
+//go:build ffmpeg
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// audioChunkSeconds is the length of each chunk. Re-encoded as 64 kbps mono
+// MP3, ten minutes stay well below maxTranscribeBytes.
+const audioChunkSeconds = 600
+
+func init() {
+	splitAudio = ffmpegSplitAudio
+}
+
+// ffmpegSplitAudio cuts audio into audioChunkSeconds long MP3 pieces with the
+// ffmpeg binary found in PATH.
+func ffmpegSplitAudio(ctx context.Context, audio []byte) ([][]byte, error) {
+	dir, err := os.MkdirTemp("", "tgptbot-audio-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "input")
+	if err := os.WriteFile(in, audio, 0600); err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-nostdin", "-loglevel", "error",
+		"-i", in, "-vn", "-ac", "1", "-b:a", "64k",
+		"-f", "segment", "-segment_time", strconv.Itoa(audioChunkSeconds),
+		filepath.Join(dir, "chunk%04d.mp3"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, out)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "chunk*.mp3"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	chunks := make([][]byte, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, data)
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("ffmpeg produced no audio")
+	}
+	return chunks, nil
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// auditEnabled enables the per-project audit log, set by TBOT_AUDIT=on.
+var auditEnabled bool
+
+// recordAudit appends a request and its reply to the project audit log when
+// auditing is enabled. Failures are logged and otherwise ignored.
+func recordAudit(ctx context.Context, proj string, e storage.AuditEntry) {
+	if !auditEnabled {
+		return
+	}
+	e.When = time.Now().Unix()
+	if err := appendAudit(proj, e); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Str("project", proj).Msg("failed to append audit entry")
+	}
+}
+
+// auditPrompt describes the full user input of a request for the audit log.
+func auditPrompt(text, transcribed string, hasImage bool) string {
+	prompt := text
+	if transcribed != "" {
+		if prompt != "" {
+			prompt += "\n"
+		}
+		prompt += "(Audio transcription)\n" + transcribed
+	}
+	if hasImage {
+		if prompt != "" {
+			prompt += "\n"
+		}
+		prompt += "(Image attached)"
+	}
+	return prompt
+}
+
+// sendAuditExport sends the audit log of proj as a JSON Lines document.
+func sendAuditExport(ctx context.Context, b Bot, msg *models.Message, proj string) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	entries, err := storage.LoadAudit(proj)
+	if err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+		return
+	}
+	if len(entries) == 0 {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "No audit entries."})
+		return
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Export error: " + err.Error()})
+			return
+		}
+	}
+	if _, err := b.SendDocument(ctx, &tg.SendDocumentParams{
+		ChatID:          chatID,
+		MessageThreadID: topicID,
+		Document:        &models.InputFileUpload{Filename: "audit-" + proj + ".jsonl", Data: &buf},
+	}); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("failed to send audit export")
+		return
+	}
+	logging.Ctx(ctx).Info().Str("event", "audit_export").Str("project", proj).Int("entries", len(entries)).Msg("audit log exported")
+}
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// maxBackupUpload is the largest document the Bot API lets bots upload.
+const maxBackupUpload = 50 << 20
+
+// BackupFileName names a database snapshot taken at t.
+func BackupFileName(t time.Time) string {
+	return "bot-" + t.UTC().Format("20060102-150405") + ".db"
+}
+
+// sendBackup sends a snapshot of the database as a document.
+func sendBackup(ctx context.Context, b Bot, msg *models.Message) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	var buf bytes.Buffer
+	if err := storage.Snapshot(&buf); err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Backup error: " + err.Error()})
+		return
+	}
+	size := buf.Len()
+	if size > maxBackupUpload {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("The database is %d MB, too large to send (limit %d MB). Use TBOT_BACKUP_DIR for scheduled backups instead.", size>>20, maxBackupUpload>>20)})
+		return
+	}
+	if _, err := b.SendDocument(ctx, &tg.SendDocumentParams{
+		ChatID:          chatID,
+		MessageThreadID: topicID,
+		Document:        &models.InputFileUpload{Filename: BackupFileName(time.Now()), Data: &buf},
+	}); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("failed to send backup")
+		return
+	}
+	logging.Ctx(ctx).Info().Str("event", "backup_sent").Int("bytes", size).Msg("database backup sent")
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+const (
+	// minBatchWindow and maxBatchWindow bound /setbatch, in seconds.
+	minBatchWindow = 1
+	maxBatchWindow = 60
+	// minDedupWindow and maxDedupWindow bound /setdedup, in seconds.
+	minDedupWindow = 1
+	maxDedupWindow = 600
+)
+
+// batchKey identifies the messages of one user in one topic.
+type batchKey struct {
+	chatID  int64
+	topicID int
+	userID  int64
+}
+
+// messageBatch collects the messages of a user until the batching window
+// passes without a new one. The last message is the one answered.
+type messageBatch struct {
+	ctx   context.Context
+	b     Bot
+	msg   *models.Message
+	texts []string
+	timer *time.Timer
+}
+
+var (
+	batchMu sync.Mutex
+	batches = map[batchKey]*messageBatch{}
+	// batchUnit is the unit of the configured window; tests shorten it
+	batchUnit = time.Second
+)
+
+func batchKeyOf(msg *models.Message) batchKey {
+	key := batchKey{chatID: msg.Chat.ID, topicID: msg.MessageThreadID}
+	if msg.From != nil {
+		key.userID = msg.From.ID
+	}
+	return key
+}
+
+// batchMessage adds a text message to the batching window of its project and
+// reports whether it was queued. Other messages are not queued; they flush a
+// pending batch of the same user first, so the order is kept.
+func batchMessage(ctx context.Context, b Bot, msg *models.Message, text string) bool {
+	key := batchKeyOf(msg)
+	if text == "" || len(msg.Photo) > 0 || audioFileID(msg) != "" {
+		flushBatch(key)
+		return false
+	}
+	proj, err := messageProject(msg)
+	if err != nil {
+		flushBatch(key)
+		return false
+	}
+	seconds, err := storage.LoadProjectBatchWindow(proj)
+	if err != nil || seconds <= 0 {
+		flushBatch(key)
+		return false
+	}
+	window := time.Duration(seconds) * batchUnit
+
+	batchMu.Lock()
+	defer batchMu.Unlock()
+	mb, ok := batches[key]
+	if ok {
+		// the window restarts with every message of the burst
+		mb.timer.Reset(window)
+	} else {
+		mb = &messageBatch{}
+		batches[key] = mb
+		mb.timer = time.AfterFunc(window, func() { flushBatch(key) })
+	}
+	mb.ctx, mb.b, mb.msg = ctx, b, msg
+	mb.texts = append(mb.texts, text)
+	return true
+}
+
+// flushBatch sends the pending batch of key, if any, as one combined request.
+func flushBatch(key batchKey) {
+	batchMu.Lock()
+	mb, ok := batches[key]
+	if ok {
+		delete(batches, key)
+		mb.timer.Stop()
+	}
+	batchMu.Unlock()
+	if !ok {
+		return
+	}
+	combined := *mb.msg
+	combined.Text = strings.Join(mb.texts, "\n")
+	combined.Caption = ""
+	logging.Ctx(mb.ctx).Info().Str("event", "batch_flushed").Int("messages", len(mb.texts)).Msg("batched messages sent as one request")
+	processMessage(mb.ctx, mb.b, &combined, combined.Text, 0, "")
+}
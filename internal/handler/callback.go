@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"context"
+	"strings"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+)
+
+// callbackHandler handles a button press whose callback data starts with the
+// handler's registered prefix. arg is the data after "prefix:". The returned
+// text is shown to the user as the callback answer; empty shows nothing.
+type callbackHandler func(ctx context.Context, b Bot, cq *models.CallbackQuery, arg string) string
+
+// callbackHandlers routes callback data by its prefix, the part before ':'.
+var callbackHandlers = map[string]callbackHandler{
+	"feedback": handleFeedbackCallback,
+	"confirm":  handleConfirmCallback,
+}
+
+// handleCallback dispatches an inline button press to its registered handler.
+// Every query is answered, even unknown ones, so the client stops showing a
+// progress indicator.
+func handleCallback(ctx context.Context, b Bot, cq *models.CallbackQuery) {
+	ctx = logging.WithUser(ctx, cq.From.ID)
+	log := logging.Ctx(ctx)
+	text := ""
+	if len(allowedUsers) > 0 && !allowedUsers[cq.From.ID] {
+		text = "Not allowed."
+	} else {
+		prefix, arg, _ := strings.Cut(cq.Data, ":")
+		if h, ok := callbackHandlers[prefix]; ok {
+			text = h(ctx, b, cq, arg)
+		} else {
+			log.Warn().Str("data", cq.Data).Msg("unhandled callback query")
+		}
+	}
+	if _, err := b.AnswerCallbackQuery(ctx, &tg.AnswerCallbackQueryParams{CallbackQueryID: cq.ID, Text: text}); err != nil {
+		log.Error().Err(err).Msg("failed to answer callback query")
+	}
+}
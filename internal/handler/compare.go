@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	openai "github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/responses"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/metrics"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+const compareUsage = "Usage: /compare <modelA> <modelB> <question>"
+
+// handleCompare asks the project mapped to the current topic the same
+// question with two models at once and posts both answers labeled by model.
+// The project instruction, reasoning effort and web search are reused; the
+// history is neither read nor written.
+func handleCompare(ctx context.Context, b Bot, msg *models.Message, args string) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	log := logging.Ctx(ctx)
+	fields, question := splitFields(args, 2)
+	if len(fields) < 2 || strings.TrimSpace(question) == "" {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: compareUsage})
+		return
+	}
+	proj, err := messageProject(msg)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Error().Err(err).Msg("failed to load topic mapping")
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Topic is not mapped to a project."})
+		return
+	}
+	if underMaintenance(ctx, b, msg) || overMonthlyBudget(ctx, b, msg, proj) {
+		return
+	}
+	webSearchSetting, _ := storage.LoadProjectWebSearch(proj)
+	searchDomains, _ := storage.LoadProjectSearchDomains(proj)
+	reasoningEffort, _ := storage.LoadProjectReasoning(proj)
+	userName := msg.From.Username
+	if userName == "" {
+		userName = msg.From.FirstName
+	}
+	inputs, _ := buildInputs(ctx, loadProjectConfig(proj), messageData{
+		UserID:    msg.From.ID,
+		UserName:  userName,
+		ChatID:    msg.Chat.ID,
+		MessageID: msg.ID,
+		When:      time.Now(),
+		Text:      question,
+	})
+
+	type compareResult struct {
+		model string
+		reply string
+		entry storage.AuditEntry
+	}
+	// answers are posted from this goroutine in the order they arrive, so a
+	// slow or failing model does not hold back the other one
+	results := make(chan compareResult, 2)
+	timeout := projectTimeout(proj)
+	for _, model := range fields {
+		go func(model string) {
+			metrics.Inc(metrics.ChatGPTRequests)
+			log.Info().Str("event", "chatgpt_compare_request").Str("project", proj).Str("model", model).Str("snippet", logging.Snippet(question, 30)).Msg("sending comparison to ChatGPT")
+			params := responses.ResponseNewParams{
+				Model:     openai.ResponsesModel(model),
+				Input:     responses.ResponseNewParamsInputUnion{OfInputItemList: inputs},
+				Tools:     webSearchTools(webSearchSetting, searchDomains),
+				Reasoning: openai.ReasoningParam{Effort: reasoningEffortToConst(reasoningEffort)},
+			}
+			reqCtx, cancel := context.WithTimeout(ctx, timeout)
+			var resp responseResult
+			release, err := requestSlots.acquire(reqCtx, nil)
+			if err == nil {
+				resp, err = openAIResponses(reqCtx, newOpenAIClient(proj), params)
+				release()
+			}
+			cancel()
+			recordUsage(ctx, proj, resp)
+			reply := redactReply(ctx, proj, resp.Text)
+			if err != nil {
+				metrics.Inc(metrics.ChatGPTErrors)
+				log.Error().Err(err).Str("model", model).Msg("chatgpt compare request failed")
+				reply = classifyOpenAIError(err)
+				if errors.Is(err, context.DeadlineExceeded) {
+					reply = timeoutText(timeout)
+				}
+			} else if strings.TrimSpace(reply) == "" {
+				reply = emptyReplyText
+			}
+			entry := storage.AuditEntry{UserID: msg.From.ID, Model: model, Prompt: question, Reply: reply, IsError: err != nil}
+			recordAudit(ctx, proj, entry)
+			results <- compareResult{model: model, reply: reply, entry: entry}
+		}(model)
+	}
+
+	for range fields {
+		res := <-results
+		var replyTo *models.ReplyParameters
+		if msg.ID != 0 {
+			replyTo = &models.ReplyParameters{MessageID: msg.ID}
+		}
+		for _, chunk := range splitMessage("["+res.model+"]\n"+res.reply, 4000) {
+			sent, err := b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: chunk, ReplyParameters: replyTo})
+			if err != nil {
+				log.Error().Err(err).Msg("failed to send chunk")
+				break
+			}
+			replyTo = &models.ReplyParameters{MessageID: sent.ID}
+		}
+		sendLogCopy(ctx, b, proj, msg.From, res.entry)
+	}
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// maxImportBytes bounds the configuration document read by /importall.
+const maxImportBytes = 1 << 20
+
+// pendingImport holds the import mode of admins who ran /importall and have
+// not sent the document yet.
+var pendingImport = map[int64]string{}
+
+// configFileName names a configuration export taken at t.
+func configFileName(t time.Time) string {
+	return "config-" + t.UTC().Format("20060102-150405") + ".json"
+}
+
+// sendConfigExport sends the configuration of all projects and mappings as a
+// JSON document.
+func sendConfigExport(ctx context.Context, b Bot, msg *models.Message, withKeys bool) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	cfg, err := storage.ExportConfig(withKeys)
+	if err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Export error: " + err.Error()})
+		return
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Export error: " + err.Error()})
+		return
+	}
+	if _, err := b.SendDocument(ctx, &tg.SendDocumentParams{
+		ChatID:          chatID,
+		MessageThreadID: topicID,
+		Document:        &models.InputFileUpload{Filename: configFileName(time.Now()), Data: bytes.NewReader(data)},
+	}); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("failed to send config export")
+		return
+	}
+	logging.Ctx(ctx).Info().Str("event", "config_export").Int("projects", len(cfg.Projects)).Int("mappings", len(cfg.Mappings)).Bool("with_keys", withKeys).Msg("configuration exported")
+}
+
+// readConfigImport returns the configuration document sent as a file or as
+// the message text.
+func readConfigImport(ctx context.Context, b Bot, msg *models.Message) ([]byte, error) {
+	if msg.Document == nil {
+		return []byte(msg.Text), nil
+	}
+	if msg.Document.FileSize > maxImportBytes {
+		return nil, fmt.Errorf("the file is larger than %d KB", maxImportBytes>>10)
+	}
+	file, err := b.GetFile(ctx, &tg.GetFileParams{FileID: msg.Document.FileID})
+	if err != nil {
+		return nil, err
+	}
+	return downloadFile(b.FileDownloadLink(file))
+}
+
+// handleConfigImport applies the configuration document in msg. mode is
+// "merge" or "replace".
+func handleConfigImport(ctx context.Context, b Bot, msg *models.Message, mode string) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	data, err := readConfigImport(ctx, b, msg)
+	if err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Import error: " + err.Error()})
+		return
+	}
+	var cfg storage.ConfigExport
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Import error: invalid document: " + err.Error()})
+		return
+	}
+	if err := storage.ImportConfig(cfg, mode == "replace"); err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Import error: " + err.Error()})
+		return
+	}
+	b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Imported %d projects and %d mappings (%s).", len(cfg.Projects), len(cfg.Mappings), mode)})
+	logging.Ctx(ctx).Info().Str("event", "config_import").Str("mode", mode).Int("projects", len(cfg.Projects)).Int("mappings", len(cfg.Mappings)).Msg("configuration imported")
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// confirmAction performs a confirmed destructive action on a project and
+// returns the text reporting the result.
+type confirmAction func(ctx context.Context, proj string) string
+
+// confirmActions lists the actions that can be confirmed with the buttons of
+// askConfirm, keyed by the action name carried in the callback data.
+var confirmActions = map[string]confirmAction{
+	"clearhistory": clearHistoryAction,
+}
+
+// confirmCancel is the pseudo action of the Cancel button.
+const confirmCancel = "cancel"
+
+// maxCallbackData is the Telegram limit for callback data in bytes.
+const maxCallbackData = 64
+
+// askConfirm sends text with Confirm/Cancel buttons for action on proj. Only
+// the user with userID may press them. The callback data has the form
+// "confirm:<action>:<userID>:<project>".
+func askConfirm(ctx context.Context, b Bot, chatID int64, topicID int, userID int64, action, proj, text string) {
+	data := func(a string) string {
+		return fmt.Sprintf("confirm:%s:%d:%s", a, userID, proj)
+	}
+	if len(data(action)) > maxCallbackData {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project name is too long to confirm with buttons."})
+		return
+	}
+	b.SendMessage(ctx, &tg.SendMessageParams{
+		ChatID:          chatID,
+		MessageThreadID: topicID,
+		Text:            text,
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{{
+			{Text: "Confirm", CallbackData: data(action)},
+			{Text: "Cancel", CallbackData: data(confirmCancel)},
+		}}},
+	})
+}
+
+// handleConfirmCallback runs or cancels the action of a confirmation message
+// and replaces the message text with the outcome, which also drops the
+// buttons.
+func handleConfirmCallback(ctx context.Context, b Bot, cq *models.CallbackQuery, arg string) string {
+	action, rest, _ := strings.Cut(arg, ":")
+	uid, proj, _ := strings.Cut(rest, ":")
+	userID, err := strconv.ParseInt(uid, 10, 64)
+	if err != nil || proj == "" {
+		return ""
+	}
+	if cq.From.ID != userID {
+		return "Only the user who started this can confirm it."
+	}
+	var result string
+	if action == confirmCancel {
+		result = "Cancelled."
+	} else if run, ok := confirmActions[action]; ok {
+		result = run(ctx, proj)
+	} else {
+		return ""
+	}
+	if m := cq.Message.Message; m != nil {
+		if _, err := b.EditMessageText(ctx, &tg.EditMessageTextParams{ChatID: m.Chat.ID, MessageID: m.ID, Text: result}); err != nil {
+			logging.Ctx(ctx).Error().Err(err).Msg("failed to update confirmation message")
+		}
+	}
+	return ""
+}
+
+// askClearHistory asks the sender of msg to confirm clearing the history of
+// proj.
+func askClearHistory(ctx context.Context, b Bot, msg *models.Message, proj string) {
+	count, _ := storage.CountProjectHistory(proj)
+	askConfirm(ctx, b, msg.Chat.ID, msg.MessageThreadID, msg.From.ID, "clearhistory", proj, fmt.Sprintf("The %d messages will be removed from the '%s' project.", count, proj))
+	logging.Ctx(ctx).Info().Str("event", "clear_history_request").Str("project", proj).Int("count", count).Msg("clear history requested")
+}
+
+// clearHistoryAction removes all stored history messages of proj.
+func clearHistoryAction(ctx context.Context, proj string) string {
+	unlock := lockHistory(proj)
+	removed, err := clearProjectHistory(proj)
+	unlock()
+	if err != nil {
+		return "Clear error: " + err.Error()
+	}
+	logging.Ctx(ctx).Info().Str("event", "clear_history").Str("project", proj).Int("removed", removed).Msg("history cleared")
+	return fmt.Sprintf("Cleared %d messages from project '%s'.", removed, proj)
+}
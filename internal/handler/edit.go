@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// handleEditedMessage re-runs the latest prompt of a topic after its author
+// edited it, replacing the earlier answer both in the chat and in the history.
+// It only applies to projects with edit re-run enabled.
+func handleEditedMessage(ctx context.Context, b Bot, msg *models.Message) {
+	if msg.From == nil {
+		return
+	}
+	ctx = logging.WithUser(ctx, msg.From.ID)
+	if len(allowedUsers) > 0 && !allowedUsers[msg.From.ID] {
+		return
+	}
+	text := msg.Text
+	if text == "" {
+		text = msg.Caption
+	}
+	if text == "" {
+		return
+	}
+	if _, _, ok := parseCommand(msg); ok {
+		return
+	}
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	proj, err := messageProject(msg)
+	if err != nil {
+		return
+	}
+	if setting, _ := storage.LoadProjectEditRerun(proj); setting != "on" {
+		return
+	}
+	last, ok, err := storage.LoadLastReply(chatID, topicID)
+	if err != nil || !ok || last.MessageID != msg.ID {
+		return
+	}
+	log := logging.Ctx(ctx)
+	unlock := lockHistory(proj)
+	removed, err := removeHistoryByMessage(proj, chatID, msg.ID)
+	unlock()
+	if err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Remove error: " + err.Error()})
+		return
+	}
+	// the new answer reuses the first message of the old one, so the other
+	// chunks would be left behind
+	for _, id := range last.ChunkIDs {
+		if _, err := b.DeleteMessage(ctx, &tg.DeleteMessageParams{ChatID: chatID, MessageID: id}); err != nil {
+			log.Warn().Err(err).Int("message_id", id).Msg("failed to delete reply chunk")
+		}
+	}
+	log.Info().Str("event", "edit_rerun").Str("project", proj).Int("message_id", msg.ID).Int("removed", removed).Msg("re-running edited prompt")
+	processMessage(ctx, b, msg, text, last.ReplyID, "")
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// Callback data of the feedback buttons under assistant replies. The project
+// the reply belongs to follows after another ':', as a reply redirected to
+// another topic can not be traced back through the topic mapping.
+const (
+	feedbackUpData   = "feedback:up"
+	feedbackDownData = "feedback:down"
+)
+
+// feedbackKeyboard returns the 👍/👎 buttons attached to assistant replies of
+// proj. The project is left out when it does not fit into the callback data.
+func feedbackKeyboard(proj string) *models.InlineKeyboardMarkup {
+	up, down := feedbackUpData, feedbackDownData
+	if len(feedbackDownData)+1+len(proj) <= maxCallbackData {
+		up, down = up+":"+proj, down+":"+proj
+	}
+	return &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{{
+		{Text: "👍", CallbackData: up},
+		{Text: "👎", CallbackData: down},
+	}}}
+}
+
+// handleFeedbackCallback stores the rating of the reply the pressed button
+// belongs to.
+func handleFeedbackCallback(ctx context.Context, b Bot, cq *models.CallbackQuery, arg string) string {
+	rating, proj, _ := strings.Cut(arg, ":")
+	if rating != "up" && rating != "down" {
+		return ""
+	}
+	m := cq.Message.Message
+	if m == nil {
+		return "This message is no longer available."
+	}
+	if proj == "" {
+		// buttons from before the project was part of the data
+		var err error
+		if proj, err = routedProject(m.Chat, m.MessageThreadID, cq.From.ID); err != nil {
+			return "Topic is not mapped to a project."
+		}
+	} else if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+		return "Project not found."
+	}
+	if err := saveFeedback(proj, m.ID, rating); err != nil {
+		return "Save error: " + err.Error()
+	}
+	logging.Ctx(ctx).Info().Str("event", "feedback").Str("project", proj).Int("message_id", m.ID).Str("rating", rating).Msg("reply rated")
+	return "Thanks for the feedback!"
+}
@@ -0,0 +1,15 @@
+package handler
+
+import "strings"
+
+// maxFooterLen is the longest reply footer /setfooter accepts.
+const maxFooterLen = 200
+
+// expandFooter fills the {model} and {project} placeholders of a reply
+// footer.
+func expandFooter(footer, proj, model string) string {
+	if footer == "" {
+		return ""
+	}
+	return strings.NewReplacer("{model}", model, "{project}", proj).Replace(footer)
+}
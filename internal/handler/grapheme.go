@@ -0,0 +1,60 @@
+package handler
+
+import "unicode"
+
+const (
+	zeroWidthJoiner = '\u200d'
+	keycapCombining = '\u20e3'
+)
+
+// extendsCluster reports whether r continues the grapheme cluster before it:
+// combining marks, variation selectors, emoji modifiers and keycaps.
+func extendsCluster(r rune) bool {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc):
+		return true
+	case r >= 0xfe00 && r <= 0xfe0f, r >= 0xe0020 && r <= 0xe007f:
+		// variation selectors and emoji tag characters
+		return true
+	case r >= 0x1f3fb && r <= 0x1f3ff:
+		// emoji skin tone modifiers
+		return true
+	case r == keycapCombining:
+		return true
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// truncateGraphemes returns the first n user-perceived characters of s. It
+// approximates grapheme clusters: combining characters, emoji modifiers,
+// zero-width-joiner sequences and flag pairs stay with their base character.
+func truncateGraphemes(s string, n int) string {
+	clusters := 0
+	var prev rune
+	flagOpen := false // the current cluster is a single regional indicator
+	for i, r := range s {
+		newCluster := true
+		switch {
+		case i == 0:
+		case prev == zeroWidthJoiner, r == zeroWidthJoiner, extendsCluster(r):
+			newCluster = false
+		case flagOpen && isRegionalIndicator(r):
+			newCluster = false
+		}
+		if newCluster {
+			if clusters == n {
+				return s[:i]
+			}
+			clusters++
+			flagOpen = isRegionalIndicator(r)
+		} else if isRegionalIndicator(r) {
+			flagOpen = false
+		}
+		prev = r
+	}
+	return s
+}
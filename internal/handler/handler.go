@@ -1,14 +1,18 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	tg "github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
@@ -18,24 +22,51 @@ import (
 	"github.com/openai/openai-go/v2/responses"
 	"github.com/openai/openai-go/v2/shared/constant"
 
+	"telegram-chatgpt-bot/internal/cron"
+	"telegram-chatgpt-bot/internal/crypt"
 	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/metrics"
 	"telegram-chatgpt-bot/internal/storage"
 )
 
-const (
-	defaultModel = "gpt-5"
-)
+const defaultSummaryModel = "gpt-5-nano"
+
+// historyPageSize is the number of messages shown per /historymessages page.
+const historyPageSize = 20
 
 var (
 	pendingRule       = map[int64]string{}
 	pendingModel      = map[int64]string{}
 	pendingHistLimit  = map[int64]string{}
-	pendingClearHist  = map[int64]string{}
 	pendingWebSearch  = map[int64]string{}
 	pendingReasoning  = map[int64]string{}
 	pendingTranscribe = map[int64]string{}
+	pendingBudget     = map[int64]string{}
+	pendingSummarize  = map[int64]string{}
+	pendingPreprocess = map[int64]string{}
+	pendingSumModel   = map[int64]string{}
+	pendingBusyMode   = map[int64]string{}
+	pendingImageCache = map[int64]string{}
+	pendingSetup      = map[setupKey]storage.SetupState{}
+	pendingEditRerun  = map[int64]string{}
+	pendingTyping     = map[int64]string{}
+	pendingVoiceReply = map[int64]string{}
+	pendingWelcome    = map[int64]string{}
+	pendingStops      = map[int64]string{}
+	pendingJSONSchema = map[int64]string{}
+	pendingTimezone   = map[int64]string{}
+	pendingDomains    = map[int64]string{}
+	pendingDetail     = map[int64]string{}
+	pendingFooter     = map[int64]string{}
+	pendingAPIKey     = map[int64]string{}
 	allowedUsers      map[int64]bool
+	adminUsers        map[int64]bool
 	chatGPTKey        string
+	summaryModel      = defaultSummaryModel
+	defaultModel      = "gpt-5"
+	// fallbackModel is retried when a project model is unavailable and the
+	// project has no fallback of its own; empty disables the retry
+	fallbackModel string
 
 	// wrappers around storage functions for easier testing
 	saveProject            = storage.SaveProject
@@ -49,18 +80,96 @@ var (
 	saveProjectTranscribe  = storage.SaveProjectTranscribe
 	saveHistoryLimit       = storage.SaveHistoryLimit
 	clearProjectHistory    = storage.ClearProjectHistory
+	moveProjectHistory     = storage.MoveProjectHistory
+	saveTokenBudget        = storage.SaveTokenBudget
+	saveAutoSummarize      = storage.SaveProjectAutoSummarize
+	replaceOldestHistory   = storage.ReplaceOldestHistory
+	addSchedule            = storage.AddSchedule
+	saveProjectPreprocess  = storage.SaveProjectPreprocess
+	removeLastHistory      = storage.RemoveLastHistoryMessages
+	undoLastExchange       = storage.UndoLastExchange
+	saveSummaryModel       = storage.SaveProjectSummaryModel
+	saveProjectBusyMode    = storage.SaveProjectBusyMode
+	saveImageCacheTTL      = storage.SaveImageCacheTTL
+	deleteSchedule         = storage.DeleteSchedule
+	saveSetupState         = storage.SaveSetupState
+	deleteSetupState       = storage.DeleteSetupState
+	saveProjectEditRerun   = storage.SaveProjectEditRerun
+	removeHistoryByMessage = storage.RemoveHistoryByMessageID
+	saveProjectTyping      = storage.SaveProjectTyping
+	saveProjectVoiceReply  = storage.SaveProjectVoiceReply
+	saveShowReasoning      = storage.SaveProjectShowReasoning
+	saveMentionOnly        = storage.SaveProjectMentionOnly
+	saveCitations          = storage.SaveProjectCitations
+	saveChaining           = storage.SaveProjectChaining
+	saveChunkNumbers       = storage.SaveProjectChunkNumbers
+	saveImageDetail        = storage.SaveProjectImageDetail
+	saveInstructionRole    = storage.SaveProjectInstructionRole
+	saveInjectTime         = storage.SaveProjectInjectTime
+	saveMirrorLanguage     = storage.SaveProjectMirrorLanguage
+	saveAssistantName      = storage.SaveAssistantName
+	saveMetaFormat         = storage.SaveProjectMetaFormat
+	saveStickers           = storage.SaveProjectStickers
+	saveAnimations         = storage.SaveProjectAnimations
+	saveModelRoute         = storage.SaveProjectModelRoute
+	deleteModelRoute       = storage.DeleteProjectModelRoute
+	addRedaction           = storage.AddProjectRedaction
+	clearRedactions        = storage.DeleteProjectRedactions
+	saveDescription        = storage.SaveProjectDescription
+	deleteDescription      = storage.DeleteProjectDescription
+	deleteMetaFormat       = storage.DeleteProjectMetaFormat
+	deleteAssistantName    = storage.DeleteAssistantName
+	saveProjectFooter      = storage.SaveProjectFooter
+	saveSearchDomains      = storage.SaveProjectSearchDomains
+	deleteSearchDomains    = storage.DeleteProjectSearchDomains
+	saveProjectFallback    = storage.SaveProjectFallback
+	deleteProjectFallback  = storage.DeleteProjectFallback
+	saveHistoryMaxLen      = storage.SaveHistoryMaxLen
+	deleteHistoryMaxLen    = storage.DeleteHistoryMaxLen
+	saveImageResize        = storage.SaveImageResize
+	deleteImageResize      = storage.DeleteImageResize
+	saveProjectTimeout     = storage.SaveProjectTimeout
+	deleteProjectTimeout   = storage.DeleteProjectTimeout
+	saveBatchWindow        = storage.SaveProjectBatchWindow
+	deleteBatchWindow      = storage.DeleteProjectBatchWindow
+	saveDedupWindow        = storage.SaveProjectDedupWindow
+	deleteDedupWindow      = storage.DeleteProjectDedupWindow
+	saveMonthlyBudget      = storage.SaveProjectMonthlyBudget
+	deleteMonthlyBudget    = storage.DeleteProjectMonthlyBudget
+	saveProjectWelcome     = storage.SaveProjectWelcome
+	loadProjectWelcome     = storage.LoadProjectWelcome
+	saveProjectStops       = storage.SaveProjectStops
+	deleteProjectStops     = storage.DeleteProjectStops
+	saveJSONMode           = storage.SaveProjectJSONMode
+	saveJSONSchema         = storage.SaveProjectJSONSchema
+	deleteJSONSchema       = storage.DeleteProjectJSONSchema
+	saveProjectTimezone    = storage.SaveProjectTimezone
+	appendAudit            = storage.AppendAudit
+	saveFeedback           = storage.SaveFeedback
+	saveReplyTopic         = storage.SaveReplyTopic
+	deleteReplyTopic       = storage.DeleteReplyTopic
+	saveProjectAPIKey      = storage.SaveProjectAPIKey
+	setUserCurrentProject  = storage.SetUserCurrentProject
+	deleteProjectAPIKey    = storage.DeleteProjectAPIKey
+	encryptAPIKey          = crypt.Encrypt
+	decryptAPIKey          = crypt.Decrypt
 
 	// wrappers around OpenAI functions for easier testing
-	newOpenAIClient = func() *openai.Client {
-		c := openai.NewClient(option.WithAPIKey(chatGPTKey))
+	newOpenAIClient = func(proj string) *openai.Client {
+		return openAIClientWithKey(projectAPIKey(proj))
+	}
+	openAIClientWithKey = func(key string) *openai.Client {
+		c := openai.NewClient(option.WithAPIKey(key))
 		return &c
 	}
-	openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-		resp, err := client.Responses.New(context.Background(), params)
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		resp, err := client.Responses.New(ctx, params)
 		if err != nil {
-			return "", err
+			return responseResult{}, err
 		}
-		return resp.OutputText(), nil
+		metrics.Add(metrics.OpenAIInputTokens, resp.Usage.InputTokens)
+		metrics.Add(metrics.OpenAIOutputTokens, resp.Usage.OutputTokens)
+		return newResponseResult(resp), nil
 	}
 	openAITranscribe = func(client *openai.Client, r io.Reader) (string, error) {
 		tResp, err := client.Audio.Transcriptions.New(context.Background(), openai.AudioTranscriptionNewParams{
@@ -72,6 +181,19 @@ var (
 		}
 		return tResp.Text, nil
 	}
+	openAITTS = func(client *openai.Client, text string) ([]byte, error) {
+		resp, err := client.Audio.Speech.New(context.Background(), openai.AudioSpeechNewParams{
+			Input:          text,
+			Model:          openai.SpeechModelGPT4oMiniTTS,
+			Voice:          openai.AudioSpeechNewParamsVoiceAlloy,
+			ResponseFormat: openai.AudioSpeechNewParamsResponseFormatOpus,
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return io.ReadAll(resp.Body)
+	}
 	httpGetFunc = http.Get
 	newTicker   = time.NewTicker
 )
@@ -79,18 +201,63 @@ var (
 // Init parses the allowed user ids from the environment.
 func Init() {
 	parseAllowedUsers()
+	adminUsers = parseUserIDs("TBOT_ADMIN_USER_IDS")
 	chatGPTKey = os.Getenv("TBOT_CHATGPT_KEY")
 	if chatGPTKey == "" {
 		logging.Log.Fatal().Msg("TBOT_CHATGPT_KEY env var is required")
 	}
+	if m := strings.TrimSpace(os.Getenv("TBOT_SUMMARY_MODEL")); m != "" {
+		summaryModel = m
+	}
+	fallbackModel = strings.TrimSpace(os.Getenv("TBOT_FALLBACK_MODEL"))
+	loadSearchLocation()
+	loadProjectDefaults()
+	loadModelInputLimits()
+	loadMaxConcurrent()
+	loadSendRetries()
+	loadProgressDelay()
+	loadRequestTimeout()
+	loadTranscriber()
+	loadTelegramAPI()
+	loadLogChannel()
+	auditEnabled = strings.EqualFold(strings.TrimSpace(os.Getenv("TBOT_AUDIT")), "on")
+}
+
+// loadProjectDefaults reads the settings applied to new projects from the
+// TBOT_DEFAULT_* env vars. Invalid values are ignored with a warning.
+func loadProjectDefaults() {
+	if m := strings.TrimSpace(os.Getenv("TBOT_DEFAULT_MODEL")); m != "" {
+		defaultModel = m
+	}
+	d := storage.ProjectDefaults{Model: defaultModel}
+	switch v := strings.ToLower(strings.TrimSpace(os.Getenv("TBOT_DEFAULT_REASONING"))); v {
+	case "":
+	case "minimal", "low", "medium", "high":
+		d.Reasoning = v
+	default:
+		logging.Log.Warn().Str("value", v).Msg("invalid TBOT_DEFAULT_REASONING")
+	}
+	switch v := strings.ToLower(strings.TrimSpace(os.Getenv("TBOT_DEFAULT_WEBSEARCH"))); v {
+	case "":
+	case "high", "medium", "low", "off":
+		d.WebSearch = v
+	default:
+		logging.Log.Warn().Str("value", v).Msg("invalid TBOT_DEFAULT_WEBSEARCH")
+	}
+	storage.SetProjectDefaults(d)
 }
 
 func parseAllowedUsers() {
-	idsEnv := os.Getenv("TBOT_ALLOWED_USER_IDS")
+	allowedUsers = parseUserIDs("TBOT_ALLOWED_USER_IDS")
+}
+
+// parseUserIDs reads a comma separated list of user ids from the env var.
+func parseUserIDs(env string) map[int64]bool {
+	idsEnv := os.Getenv(env)
 	if idsEnv == "" {
-		return
+		return nil
 	}
-	allowedUsers = make(map[int64]bool)
+	ids := make(map[int64]bool)
 	for _, p := range strings.Split(idsEnv, ",") {
 		s := strings.TrimSpace(p)
 		if s == "" {
@@ -98,11 +265,25 @@ func parseAllowedUsers() {
 		}
 		id, err := strconv.ParseInt(s, 10, 64)
 		if err != nil {
-			logging.Log.Warn().Str("user_id", s).Msg("invalid user id in TBOT_ALLOWED_USER_IDS")
+			logging.Log.Warn().Str("user_id", s).Msg("invalid user id in " + env)
 			continue
 		}
-		allowedUsers[id] = true
+		ids[id] = true
+	}
+	return ids
+}
+
+// isAdmin reports whether the user may run admin commands. Admins are listed
+// in TBOT_ADMIN_USER_IDS; without it every allowed user is an admin. When
+// neither list is configured nobody is.
+func isAdmin(from *models.User) bool {
+	if from == nil {
+		return false
+	}
+	if len(adminUsers) > 0 {
+		return adminUsers[from.ID]
 	}
+	return allowedUsers[from.ID]
 }
 
 // Bot wraps the telegram bot methods used by the handler.
@@ -111,13 +292,33 @@ type Bot interface {
 	GetFile(ctx context.Context, params *tg.GetFileParams) (*models.File, error)
 	FileDownloadLink(file *models.File) string
 	EditMessageText(ctx context.Context, params *tg.EditMessageTextParams) (*models.Message, error)
+	SendChatAction(ctx context.Context, params *tg.SendChatActionParams) (bool, error)
+	SendVoice(ctx context.Context, params *tg.SendVoiceParams) (*models.Message, error)
+	PinChatMessage(ctx context.Context, params *tg.PinChatMessageParams) (bool, error)
+	UnpinChatMessage(ctx context.Context, params *tg.UnpinChatMessageParams) (bool, error)
+	SendDocument(ctx context.Context, params *tg.SendDocumentParams) (*models.Message, error)
+	AnswerCallbackQuery(ctx context.Context, params *tg.AnswerCallbackQueryParams) (bool, error)
+	DeleteMessage(ctx context.Context, params *tg.DeleteMessageParams) (bool, error)
+	AnswerInlineQuery(ctx context.Context, params *tg.AnswerInlineQueryParams) (bool, error)
 }
 
 // HandleUpdate processes a Telegram update.
 func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 	ctx = logging.Context(ctx)
+	b = withSendRetry(b)
 
 	if upd.CallbackQuery != nil {
+		handleCallback(ctx, b, upd.CallbackQuery)
+		return
+	}
+
+	if upd.EditedMessage != nil {
+		handleEditedMessage(ctx, b, upd.EditedMessage)
+		return
+	}
+
+	if upd.InlineQuery != nil {
+		handleInlineQuery(ctx, b, upd.InlineQuery)
 		return
 	}
 
@@ -125,6 +326,7 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 		return
 	}
 	msg := upd.Message
+	metrics.Inc(metrics.TelegramRequests)
 	chatID := msg.Chat.ID
 	topicID := msg.MessageThreadID
 	if msg.From != nil {
@@ -146,13 +348,18 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 
 	// Command handlers
 	if cmd, args, ok := parseCommand(msg); ok {
+		// messages collected before the command are answered first
+		flushBatch(batchKeyOf(msg))
 		switch cmd {
 		case "newproject":
 			if args == "" {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /newproject <projectName>"})
 				return
 			}
-			if err := saveProject(args); err != nil {
+			if err := saveProject(args); errors.Is(err, storage.ErrProjectExists) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project '" + args + "' already exists."})
+				return
+			} else if err != nil {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save failed: " + err.Error()})
 				return
 			}
@@ -161,21 +368,43 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 			return
 
 		case "settopic":
-			proj := args
-			if proj == "" {
-				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /settopic <projectName>"})
+			var proj string
+			create, valid := false, true
+			for _, f := range strings.Fields(args) {
+				switch {
+				case f == "--create":
+					create = true
+				case proj == "":
+					proj = f
+				default:
+					valid = false
+				}
+			}
+			if proj == "" || !valid {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /settopic <projectName> [--create]"})
 				return
 			}
-			if exists, err := projectExists(proj); err != nil || !exists {
+			exists, err := projectExists(proj)
+			if err != nil || !exists && !create {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
 				return
 			}
+			// --create registers a missing project so it can be mapped in one step
+			if !exists {
+				if err := saveProject(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save failed: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project '" + proj + "' registered."})
+				log.Info().Str("event", "new_project").Str("project", proj).Msg("project registered")
+			}
 			if err := mapTopic(chatID, topicID, proj); err != nil {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Failed to map topic: " + err.Error()})
 				return
 			}
 			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Topic mapped to project '" + proj + "'."})
 			log.Info().Str("event", "map_topic").Int64("chat_id", chatID).Int("topic_id", int(topicID)).Str("project", proj).Msg("topic mapped")
+			postWelcome(ctx, b, chatID, topicID, proj)
 			return
 
 		case "unsettopic":
@@ -192,15 +421,25 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 			return
 
 		case "setmodel":
-			proj := args
+			proj, model, _ := strings.Cut(args, " ")
+			model = strings.TrimSpace(model)
 			if proj == "" {
-				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setmodel <projectName>"})
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setmodel <projectName> [modelName]"})
 				return
 			}
 			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
 				return
 			}
+			if model != "" {
+				if err := saveProjectModel(proj, model); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' uses model '%s'.", proj, model)})
+				log.Info().Str("event", "set_model").Str("project", proj).Str("model", model).Msg("model set")
+				return
+			}
 			pendingModel[msg.From.ID] = proj
 			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter model name"})
 			log.Info().Str("event", "model_request").Str("project", proj).Msg("model requested")
@@ -216,11 +455,145 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
 				return
 			}
+			// messages in forum topics implicitly reply to the topic creation message
+			if reply := msg.ReplyToMessage; reply != nil && reply.ForumTopicCreated == nil {
+				instr := strings.TrimSpace(reply.Text)
+				if instr == "" {
+					instr = strings.TrimSpace(reply.Caption)
+				}
+				if instr == "" {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "The replied message has no text to use as instruction."})
+					return
+				}
+				if err := saveProjectInstruction(proj, instr); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Instruction saved."})
+				log.Info().Str("event", "set_rule").Str("project", proj).Msg("instruction saved from reply")
+				return
+			}
 			pendingRule[msg.From.ID] = proj
 			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter your custom instruction"})
 			log.Info().Str("event", "rule_request").Str("project", proj).Msg("rule requested")
 			return
 
+		case "setwelcome":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setwelcome <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingWelcome[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter the welcome message posted when a topic is mapped to the project (\"off\" to remove it)"})
+			log.Info().Str("event", "welcome_request").Str("project", proj).Msg("welcome requested")
+			return
+
+		case "footer":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /footer <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			footer, _ := storage.LoadProjectFooter(proj)
+			if footer == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("No footer set for project '%s'.", proj)})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Footer for project '%s':\n%s", proj, footer)})
+			return
+
+		case "setfooter":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setfooter <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingFooter[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter the footer added to every reply. {model} and {project} are replaced with the model and project name (\"off\" to remove it)"})
+			log.Info().Str("event", "footer_request").Str("project", proj).Msg("footer requested")
+			return
+
+		case "keystatus":
+			if !isAdmin(msg.From) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Admins only."})
+				return
+			}
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /keystatus <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			encrypted, err := storage.LoadProjectAPIKey(proj)
+			if errors.Is(err, storage.ErrNotFound) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' uses the global API key.", proj)})
+				return
+			}
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+				return
+			}
+			key, err := decryptAPIKey(encrypted)
+			if err != nil || key == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("The API key of project '%s' cannot be decrypted, so the global key is used. Set it again with /setkey.", proj)})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' uses its own API key %s.", proj, maskAPIKey(key))})
+			return
+
+		case "deletekey":
+			if !isAdmin(msg.From) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Admins only."})
+				return
+			}
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /deletekey <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if err := deleteProjectAPIKey(proj); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' now uses the global API key.", proj)})
+			log.Info().Str("event", "delete_api_key").Str("project", proj).Msg("api key removed")
+			return
+
+		case "setkey":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setkey <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingAPIKey[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter the OpenAI API key for this project (\"off\" to use the global key). The message is deleted after reading."})
+			log.Info().Str("event", "api_key_request").Str("project", proj).Msg("api key requested")
+			return
+
 		case "showrule":
 			proj := args
 			if proj == "" {
@@ -228,13 +601,126 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 				return
 			}
 			instr, err := storage.LoadProjectInstruction(proj)
-			if err != nil || instr == "" {
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+			} else if instr == "" {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("No instruction set for project '%s'.", proj)})
 			} else {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Instruction for project '%s':\n%s", proj, instr)})
 			}
 			return
 
+		case "instructionrole":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /instructionrole <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			role, _ := storage.LoadProjectInstructionRole(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Instruction for project '%s' is sent as %s.", proj, role)})
+			return
+
+		case "setinstructionrole":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" || val == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setinstructionrole <projectName> system|developer"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "system" && val != "developer" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: system, developer."})
+				return
+			}
+			if err := saveInstructionRole(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Instruction role for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_instruction_role").Str("project", proj).Str("role", val).Msg("instruction role set")
+			return
+
+		case "injecttime":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /injecttime <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			setting, _ := storage.LoadProjectInjectTime(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Current time injection for project '%s' is %s.", proj, setting)})
+			return
+
+		case "setinjecttime":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" || val == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setinjecttime <projectName> on|off"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "on" && val != "off" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+				return
+			}
+			if err := saveInjectTime(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Current time injection for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_inject_time").Str("project", proj).Str("setting", val).Msg("inject time set")
+			return
+
+		case "mirrorlanguage":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /mirrorlanguage <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			setting, _ := storage.LoadProjectMirrorLanguage(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Reply language mirroring for project '%s' is %s.", proj, setting)})
+			return
+
+		case "setmirrorlanguage":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" || val == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setmirrorlanguage <projectName> on|off"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "on" && val != "off" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+				return
+			}
+			if err := saveMirrorLanguage(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Reply language mirroring for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_mirror_language").Str("project", proj).Str("setting", val).Msg("mirror language set")
+			return
+
 		case "websearch":
 			proj := args
 			if proj == "" {
@@ -264,6 +750,27 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 			log.Info().Str("event", "websearch_request").Str("project", proj).Msg("websearch requested")
 			return
 
+		case "model":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /model <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			model, err := storage.LoadProjectModel(proj)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+				return
+			}
+			if model == "" {
+				model = defaultModel
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' uses model '%s'.", proj, model)})
+			return
+
 		case "reasoning":
 			proj := args
 			if proj == "" {
@@ -293,6 +800,35 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 			log.Info().Str("event", "reasoning_request").Str("project", proj).Msg("reasoning requested")
 			return
 
+		case "imagedetail":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /imagedetail <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			detail, _ := storage.LoadProjectImageDetail(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Image detail for project '%s' is %s.", proj, detail)})
+			return
+
+		case "setimagedetail":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setimagedetail <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingDetail[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter image detail (auto, low, high)."})
+			log.Info().Str("event", "image_detail_request").Str("project", proj).Msg("image detail requested")
+			return
+
 		case "transcribe":
 			proj := args
 			if proj == "" {
@@ -322,85 +858,1918 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 			log.Info().Str("event", "transcribe_request").Str("project", proj).Msg("transcribe requested")
 			return
 
-		case "history":
+		case "editrerun":
 			proj := args
 			if proj == "" {
-				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /history <projectName>"})
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /editrerun <projectName>"})
 				return
 			}
 			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
 				return
 			}
-			limit, _ := storage.LoadHistoryLimit(proj)
-			count, _ := storage.CountProjectHistory(proj)
-			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("For project '%s' history limit is %d and there are %d stored messages.", proj, limit, count)})
+			setting, _ := storage.LoadProjectEditRerun(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Re-running edited prompts for project '%s' is %s.", proj, setting)})
 			return
 
-		case "historymessages":
+		case "seteditrerun":
 			proj := args
 			if proj == "" {
-				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /historymessages <projectName>"})
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /seteditrerun <projectName>"})
 				return
 			}
 			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
 				return
 			}
-			hist, err := storage.LoadProjectHistory(proj)
-			if err != nil || len(hist) == 0 {
-				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "No stored messages."})
+			pendingEditRerun[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Re-run the last prompt when it is edited? (on, off)"})
+			log.Info().Str("event", "edit_rerun_request").Str("project", proj).Msg("edit rerun requested")
+			return
+
+		case "typing":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /typing <projectName>"})
 				return
 			}
-			var sb strings.Builder
-			for _, h := range hist {
-				when := time.Unix(h.When, 0).Format("15:04:05 02.01.2006")
-				snippet := []rune(h.Content)
-				if len(snippet) > 30 {
-					snippet = snippet[:30]
-				}
-				fmt.Fprintf(&sb, "%s %s:\n%s\n\n", when, h.WhoName, string(snippet))
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
 			}
-			out := strings.TrimSpace(sb.String())
-			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: out})
+			setting, _ := storage.LoadProjectTyping(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Typing indicator for project '%s' is %s.", proj, setting)})
 			return
 
-		case "sethistorylimit":
+		case "settyping":
 			proj := args
 			if proj == "" {
-				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /sethistorylimit <projectName>"})
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /settyping <projectName>"})
 				return
 			}
 			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
 				return
 			}
-			pendingHistLimit[msg.From.ID] = proj
-			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter new history limit (0 to disable)."})
-			log.Info().Str("event", "history_limit_request").Str("project", proj).Msg("history limit requested")
+			pendingTyping[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Show typing indicator while waiting for the answer? (on, off)"})
+			log.Info().Str("event", "typing_request").Str("project", proj).Msg("typing requested")
 			return
 
-		case "clearhistory":
+		case "voicereply":
 			proj := args
 			if proj == "" {
-				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /clearhistory <projectName>"})
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /voicereply <projectName>"})
 				return
 			}
 			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
 				return
 			}
-			count, _ := storage.CountProjectHistory(proj)
-			pendingClearHist[msg.From.ID] = proj
-			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("The %d messages will be removed from the '%s' project. Please type the word 'confirm' to continue.", count, proj)})
-			log.Info().Str("event", "clear_history_request").Str("project", proj).Int("count", count).Msg("clear history requested")
+			setting, _ := storage.LoadProjectVoiceReply(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Voice replies for project '%s' are %s.", proj, setting)})
 			return
 
-		case "listprojects":
-			projs, _ := storage.ListProjects()
-			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Projects: " + strings.Join(projs, ", ")})
-			return
-		}
+		case "setvoicereply":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setvoicereply <projectName> [on|off]"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "" {
+				setVoiceReply(ctx, b, chatID, topicID, proj, val)
+				return
+			}
+			pendingVoiceReply[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Also send replies as voice messages? (on, off)"})
+			log.Info().Str("event", "voice_reply_request").Str("project", proj).Msg("voice reply requested")
+			return
+
+		case "showreasoning":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /showreasoning <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			setting, _ := storage.LoadProjectShowReasoning(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Reasoning summary for project '%s' is %s.", proj, setting)})
+			return
+
+		case "searchdomains":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /searchdomains <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			domains, err := storage.LoadProjectSearchDomains(proj)
+			if errors.Is(err, storage.ErrNotFound) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Web search for project '%s' is not limited to any domains.", proj)})
+				return
+			}
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Web search for project '%s' is limited to: %s", proj, strings.Join(domains, ", "))})
+			return
+
+		case "setsearchdomains":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setsearchdomains <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingDomains[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Enter up to %d domains web search may use, separated by spaces or commas (\"off\" to allow all)", maxSearchDomains)})
+			log.Info().Str("event", "search_domains_request").Str("project", proj).Msg("search domains requested")
+			return
+
+		case "chunknumbers":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /chunknumbers <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			setting, _ := storage.LoadProjectChunkNumbers(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Continuation numbering for project '%s' is %s.", proj, setting)})
+			return
+
+		case "setchunknumbers":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" || val == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setchunknumbers <projectName> on|off"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "on" && val != "off" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+				return
+			}
+			if err := saveChunkNumbers(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Continuation numbering for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_chunk_numbers").Str("project", proj).Str("setting", val).Msg("chunk numbers set")
+			return
+
+		case "citations":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /citations <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			setting, _ := storage.LoadProjectCitations(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Sources footer for project '%s' is %s.", proj, setting)})
+			return
+
+		case "setcitations":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" || val == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setcitations <projectName> on|off"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "on" && val != "off" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+				return
+			}
+			if err := saveCitations(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Sources footer for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_citations").Str("project", proj).Str("setting", val).Msg("citations set")
+			return
+
+		case "stickers":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /stickers <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			setting, _ := storage.LoadProjectStickers(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Sticker answers for project '%s' is %s.", proj, setting)})
+			return
+
+		case "setstickers":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" || val == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setstickers <projectName> on|off"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "on" && val != "off" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+				return
+			}
+			if err := saveStickers(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Sticker answers for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_stickers").Str("project", proj).Str("setting", val).Msg("stickers set")
+			return
+
+		case "gifs":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /gifs <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			setting, _ := storage.LoadProjectAnimations(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("GIF answers for project '%s' is %s.", proj, setting)})
+			return
+
+		case "setgifs":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" || val == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setgifs <projectName> on|off"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "on" && val != "off" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+				return
+			}
+			if err := saveAnimations(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("GIF answers for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_gifs").Str("project", proj).Str("setting", val).Msg("gifs set")
+			return
+
+		case "chaining":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /chaining <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			setting, _ := storage.LoadProjectChaining(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Response chaining for project '%s' is %s.", proj, setting)})
+			return
+
+		case "setchaining":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" || val == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setchaining <projectName> on|off"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "on" && val != "off" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+				return
+			}
+			if err := saveChaining(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			// switching chaining on or off always starts a new server-side conversation
+			if err := storage.DeleteLastResponseID(proj); err != nil {
+				log.Error().Err(err).Str("project", proj).Msg("failed to reset response chain")
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Response chaining for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_chaining").Str("project", proj).Str("setting", val).Msg("chaining set")
+			return
+
+		case "setshowreasoning":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" || val == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setshowreasoning <projectName> on|off"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "on" && val != "off" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+				return
+			}
+			if err := saveShowReasoning(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Reasoning summary for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_show_reasoning").Str("project", proj).Str("setting", val).Msg("show reasoning set")
+			return
+
+		case "mentiononly":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /mentiononly <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			setting, _ := storage.LoadProjectMentionOnly(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Mention-only mode for project '%s' is %s.", proj, setting)})
+			return
+
+		case "setmentiononly":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" || val == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setmentiononly <projectName> on|off"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "on" && val != "off" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+				return
+			}
+			if err := saveMentionOnly(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Mention-only mode for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_mention_only").Str("project", proj).Str("setting", val).Msg("mention only set")
+			return
+
+		case "penalties", "setpenalties":
+			// the Responses API has no frequency or presence penalty, and
+			// unknown request fields are rejected
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Frequency and presence penalties are not supported by the Responses API."})
+			return
+
+		case "jsonmode":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /jsonmode <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			setting, _ := storage.LoadProjectJSONMode(proj)
+			text := fmt.Sprintf("JSON mode for project '%s' is %s.", proj, setting)
+			if schema, _ := storage.LoadProjectJSONSchema(proj); schema != "" {
+				text += "\nSchema: " + schema
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: text})
+			return
+
+		case "setjsonmode":
+			proj, val, _ := strings.Cut(args, " ")
+			val = strings.ToLower(strings.TrimSpace(val))
+			if proj == "" || val == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setjsonmode <projectName> on|off"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if val != "on" && val != "off" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+				return
+			}
+			if err := saveJSONMode(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("JSON mode for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_json_mode").Str("project", proj).Str("setting", val).Msg("json mode set")
+			return
+
+		case "setjsonschema":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setjsonschema <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingJSONSchema[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter the JSON schema replies must follow (\"off\" to accept any JSON object)"})
+			log.Info().Str("event", "json_schema_request").Str("project", proj).Msg("json schema requested")
+			return
+
+		case "stop":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /stop <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			stops, err := storage.LoadProjectStops(proj)
+			if errors.Is(err, storage.ErrNotFound) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("No stop sequences set for project '%s'.", proj)})
+				return
+			}
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Stop sequences for project '%s': %s.", proj, formatStops(stops))})
+			return
+
+		case "setstop":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setstop <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingStops[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Enter up to %d stop sequences separated by commas. The bot cuts each reply before the first of them after it arrives; the model still writes the whole answer.", maxStops)})
+			log.Info().Str("event", "stops_request").Str("project", proj).Msg("stop sequences requested")
+			return
+
+		case "clearstop":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /clearstop <projectName>"})
+				return
+			}
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if err := deleteProjectStops(proj); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Stop sequences for project '%s' cleared.", proj)})
+			log.Info().Str("event", "clear_stops").Str("project", proj).Msg("stop sequences cleared")
+			return
+
+		case "seed", "setseed":
+			// the Responses API has no sampling seed, and unknown request
+			// fields are rejected
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Sampling seeds are not supported by the Responses API."})
+			return
+
+		case "topics":
+			var (
+				mappings []storage.Mapping
+				err      error
+			)
+			if args == "" {
+				if !isAdmin(msg.From) {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /topics <projectName>"})
+					return
+				}
+				mappings, err = storage.ListMappings()
+			} else {
+				if exists, err := storage.ProjectExists(args); err != nil || !exists {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+					return
+				}
+				mappings, err = storage.ListProjectMappings(args)
+			}
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+				return
+			}
+			if len(mappings) == 0 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "No mapped topics."})
+				return
+			}
+			var sb strings.Builder
+			for _, m := range mappings {
+				if args == "" {
+					fmt.Fprintf(&sb, "chat %d, topic %d: %s\n", m.ChatID, m.TopicID, m.Project)
+				} else {
+					fmt.Fprintf(&sb, "chat %d, topic %d\n", m.ChatID, m.TopicID)
+				}
+			}
+			for _, chunk := range splitMessage(strings.TrimSpace(sb.String()), 4000) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: chunk})
+			}
+			return
+
+		case "replytopic":
+			proj, err := storage.GetMappedProject(chatID, topicID)
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Topic is not mapped to a project."})
+				return
+			}
+			target, err := storage.LoadReplyTopic(chatID, topicID)
+			if errors.Is(err, storage.ErrNotFound) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Questions to project '%s' in this topic are answered here.", proj)})
+				return
+			}
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Questions to project '%s' in this topic are answered in topic %d.", proj, target)})
+			return
+
+		case "setreplytopic":
+			if args == "" || len(strings.Fields(args)) != 1 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setreplytopic <topicID|off>"})
+				return
+			}
+			proj, err := storage.GetMappedProject(chatID, topicID)
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Topic is not mapped to a project."})
+				return
+			}
+			if strings.EqualFold(args, "off") {
+				if err := deleteReplyTopic(chatID, topicID); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Questions to project '%s' in this topic are now answered here.", proj)})
+				log.Info().Str("event", "clear_reply_topic").Str("project", proj).Msg("reply topic cleared")
+				return
+			}
+			target, err := strconv.Atoi(args)
+			if err != nil || target < 0 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter a non-negative topic id."})
+				return
+			}
+			if err := saveReplyTopic(chatID, topicID, target); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Questions to project '%s' in this topic are now answered in topic %d.", proj, target)})
+			log.Info().Str("event", "set_reply_topic").Str("project", proj).Int("topic_id", target).Msg("reply topic set")
+			return
+
+		case "fallback":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /fallback <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if fb := projectFallback(proj); fb != "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' falls back to model '%s'.", proj, fb)})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' has no fallback model.", proj)})
+			return
+
+		case "setfallback":
+			fields := strings.Fields(args)
+			if len(fields) != 2 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setfallback <projectName> <model|off>"})
+				return
+			}
+			proj := fields[0]
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if strings.EqualFold(fields[1], "off") {
+				if err := deleteProjectFallback(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Fallback model for project '%s' cleared.", proj)})
+				log.Info().Str("event", "clear_fallback").Str("project", proj).Msg("fallback cleared")
+				return
+			}
+			if err := saveProjectFallback(proj, fields[1]); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' falls back to model '%s'.", proj, fields[1])})
+			log.Info().Str("event", "set_fallback").Str("project", proj).Str("model", fields[1]).Msg("fallback set")
+			return
+
+		case "redactions":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /redactions <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			patterns, err := storage.LoadProjectRedactions(proj)
+			if err != nil || len(patterns) == 0 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' has no redaction rules.", proj)})
+				return
+			}
+			var sb strings.Builder
+			fmt.Fprintf(&sb, "Redaction rules for project '%s':", proj)
+			for i, p := range patterns {
+				fmt.Fprintf(&sb, "\n%d. %s", i+1, p)
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: sb.String()})
+			return
+
+		case "addredaction":
+			proj, pattern, _ := strings.Cut(args, " ")
+			pattern = strings.TrimSpace(pattern)
+			if proj == "" || pattern == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /addredaction <projectName> <pattern>"})
+				return
+			}
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if _, err := regexp.Compile(pattern); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Invalid regex: " + err.Error()})
+				return
+			}
+			n, err := addRedaction(proj, pattern)
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Redaction rule %d added to project '%s'.", n, proj)})
+			log.Info().Str("event", "add_redaction").Str("project", proj).Int("rules", n).Msg("redaction rule added")
+			return
+
+		case "clearredactions":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /clearredactions <projectName>"})
+				return
+			}
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if err := clearRedactions(proj); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' has no redaction rules.", proj)})
+			log.Info().Str("event", "clear_redactions").Str("project", proj).Msg("redaction rules cleared")
+			return
+
+		case "automodel":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /automodel <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			r, err := storage.LoadProjectModelRoute(proj)
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Model routing for project '%s' is off.", proj)})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: modelRouteText(proj, r)})
+			return
+
+		case "setautomodel":
+			fields := strings.Fields(args)
+			usage := "Usage: /setautomodel <projectName> on <shortModel> <longModel> <threshold> or /setautomodel <projectName> off"
+			if len(fields) < 2 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: usage})
+				return
+			}
+			proj := fields[0]
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			switch {
+			case len(fields) == 2 && strings.EqualFold(fields[1], "off"):
+				if err := deleteModelRoute(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Model routing for project '%s' is off.", proj)})
+				log.Info().Str("event", "clear_model_route").Str("project", proj).Msg("model routing cleared")
+				return
+			case len(fields) != 5 || !strings.EqualFold(fields[1], "on"):
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: usage})
+				return
+			}
+			threshold, err := strconv.Atoi(fields[4])
+			if err != nil || threshold <= 0 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter a positive number of characters."})
+				return
+			}
+			r := storage.ModelRoute{Short: fields[2], Long: fields[3], Threshold: threshold}
+			if err := saveModelRoute(proj, r); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: modelRouteText(proj, r)})
+			log.Info().Str("event", "set_model_route").Str("project", proj).Str("short", r.Short).Str("long", r.Long).Int("threshold", threshold).Msg("model routing set")
+			return
+
+		case "name":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /name <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			name, _ := storage.LoadAssistantName(proj)
+			if name == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' stores replies as ChatGPT with the model name.", proj)})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' stores replies as '%s'.", proj, name)})
+			return
+
+		case "setname":
+			proj, name, _ := strings.Cut(args, " ")
+			name = strings.TrimSpace(name)
+			if proj == "" || name == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setname <projectName> <displayName|off>"})
+				return
+			}
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if strings.EqualFold(name, "off") {
+				if err := deleteAssistantName(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' stores replies as ChatGPT with the model name.", proj)})
+				log.Info().Str("event", "clear_assistant_name").Str("project", proj).Msg("assistant name cleared")
+				return
+			}
+			if utf8.RuneCountInString(name) > maxAssistantName || strings.ContainsAny(name, "\r\n") {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Please enter a single-line name of at most %d characters.", maxAssistantName)})
+				return
+			}
+			if err := saveAssistantName(proj, name); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' stores replies as '%s'.", proj, name)})
+			log.Info().Str("event", "set_assistant_name").Str("project", proj).Str("name", name).Msg("assistant name set")
+			return
+
+		case "description":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /description <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			desc, _ := storage.LoadProjectDescription(proj)
+			if desc == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' has no description.", proj)})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s': %s", proj, desc)})
+			return
+
+		case "setdescription":
+			proj, desc, _ := strings.Cut(args, " ")
+			desc = strings.TrimSpace(desc)
+			if proj == "" || desc == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setdescription <projectName> <description|off>"})
+				return
+			}
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if strings.EqualFold(desc, "off") {
+				if err := deleteDescription(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' has no description.", proj)})
+				log.Info().Str("event", "clear_description").Str("project", proj).Msg("project description cleared")
+				return
+			}
+			if utf8.RuneCountInString(desc) > maxDescription || strings.ContainsAny(desc, "\r\n") {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Please enter a single-line description of at most %d characters.", maxDescription)})
+				return
+			}
+			if err := saveDescription(proj, desc); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Description of project '%s' saved.", proj)})
+			log.Info().Str("event", "set_description").Str("project", proj).Msg("project description set")
+			return
+
+		case "metaformat":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /metaformat <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			format, _ := storage.LoadProjectMetaFormat(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: metaFormatText(proj, format)})
+			return
+
+		case "setmetaformat":
+			proj, format, _ := strings.Cut(args, " ")
+			format = strings.TrimSpace(format)
+			if proj == "" || format == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setmetaformat <projectName> <template|none|default>"})
+				return
+			}
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if strings.EqualFold(format, "default") {
+				if err := deleteMetaFormat(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: metaFormatText(proj, "")})
+				log.Info().Str("event", "clear_meta_format").Str("project", proj).Msg("metadata format cleared")
+				return
+			}
+			if strings.EqualFold(format, noMetaFormat) {
+				format = noMetaFormat
+			} else if utf8.RuneCountInString(format) > maxMetaFormat || strings.ContainsAny(format, "\r\n") {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Please enter a single-line template of at most %d characters.", maxMetaFormat)})
+				return
+			}
+			if err := saveMetaFormat(proj, format); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: metaFormatText(proj, format)})
+			log.Info().Str("event", "set_meta_format").Str("project", proj).Str("format", format).Msg("metadata format set")
+			return
+
+		case "timezone":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /timezone <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Timezone for project '%s' is %s.", proj, projectLocation(proj))})
+			return
+
+		case "settimezone":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /settimezone <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingTimezone[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter an IANA timezone name, e.g. Europe/Helsinki"})
+			log.Info().Str("event", "timezone_request").Str("project", proj).Msg("timezone requested")
+			return
+
+		case "busymode":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /busymode <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			mode, _ := storage.LoadProjectBusyMode(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Busy mode for project '%s' is %s.", proj, mode)})
+			return
+
+		case "setbusymode":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setbusymode <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingBusyMode[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter busy mode for messages sent while a request runs (queue, reject)."})
+			log.Info().Str("event", "busy_mode_request").Str("project", proj).Msg("busy mode requested")
+			return
+
+		case "imagecache":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /imagecache <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			ttl, _ := storage.LoadImageCacheTTL(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Image answer cache TTL for project '%s' is %d minutes.", proj, ttl)})
+			return
+
+		case "setimagecache":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setimagecache <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingImageCache[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter image answer cache TTL in minutes (0 to disable)."})
+			log.Info().Str("event", "image_cache_request").Str("project", proj).Msg("image cache requested")
+			return
+
+		case "history":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /history <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			limit, _ := storage.LoadHistoryLimit(proj)
+			count, _ := storage.CountProjectHistory(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("For project '%s' history limit is %d and there are %d stored messages.", proj, limit, count)})
+			return
+
+		case "historymessages":
+			fields := strings.Fields(args)
+			if len(fields) < 1 || len(fields) > 2 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /historymessages <projectName> [page]"})
+				return
+			}
+			proj := fields[0]
+			page := 1
+			if len(fields) == 2 {
+				n, err := strconv.Atoi(fields[1])
+				if err != nil || n <= 0 {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter a positive page number."})
+					return
+				}
+				page = n
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			hist, err := storage.LoadProjectHistory(proj)
+			if err != nil || len(hist) == 0 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "No stored messages."})
+				return
+			}
+			pages := (len(hist) + historyPageSize - 1) / historyPageSize
+			if page > pages {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Page must be between 1 and %d.", pages)})
+				return
+			}
+			start := (page - 1) * historyPageSize
+			end := min(start+historyPageSize, len(hist))
+			loc := projectLocation(proj)
+			var sb strings.Builder
+			for _, h := range hist[start:end] {
+				when := formatUnix(h.When, loc, "15:04:05 02.01.2006")
+				fmt.Fprintf(&sb, "%s %s:\n%s\n\n", when, h.WhoName, truncateGraphemes(h.Content, 30))
+			}
+			if pages > 1 {
+				fmt.Fprintf(&sb, "Page %d/%d", page, pages)
+			}
+			out := strings.TrimSpace(sb.String())
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: out})
+			return
+
+		case "sethistorylimit":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /sethistorylimit <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingHistLimit[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter new history limit (0 to disable)."})
+			log.Info().Str("event", "history_limit_request").Str("project", proj).Msg("history limit requested")
+			return
+
+		case "historymaxlen":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /historymaxlen <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			n, err := storage.LoadHistoryMaxLen(proj)
+			if errors.Is(err, storage.ErrNotFound) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' stores history messages in full.", proj)})
+				return
+			}
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' stores at most %d characters per history message.", proj, n)})
+			return
+
+		case "sethistorymaxlen":
+			fields := strings.Fields(args)
+			if len(fields) != 2 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /sethistorymaxlen <projectName> <chars|off>"})
+				return
+			}
+			proj := fields[0]
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if strings.EqualFold(fields[1], "off") {
+				if err := deleteHistoryMaxLen(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' stores history messages in full.", proj)})
+				log.Info().Str("event", "clear_history_max_len").Str("project", proj).Msg("history max length cleared")
+				return
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n <= len([]rune(truncatedMarker)) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Please enter a number greater than %d, or off.", len([]rune(truncatedMarker)))})
+				return
+			}
+			if err := saveHistoryMaxLen(proj, n); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' stores at most %d characters per history message.", proj, n)})
+			log.Info().Str("event", "set_history_max_len").Str("project", proj).Int("max_len", n).Msg("history max length set")
+			return
+
+		case "imageresize":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /imageresize <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			n, err := storage.LoadImageResize(proj)
+			if errors.Is(err, storage.ErrNotFound) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' sends images at their original size.", proj)})
+				return
+			}
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' downscales images to at most %d pixels.", proj, n)})
+			return
+
+		case "setimageresize":
+			fields := strings.Fields(args)
+			if len(fields) != 2 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setimageresize <projectName> <pixels|off>"})
+				return
+			}
+			proj := fields[0]
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if strings.EqualFold(fields[1], "off") {
+				if err := deleteImageResize(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' sends images at their original size.", proj)})
+				log.Info().Str("event", "clear_image_resize").Str("project", proj).Msg("image resize cleared")
+				return
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < minImageResize {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Please enter a number of pixels of at least %d, or off.", minImageResize)})
+				return
+			}
+			if err := saveImageResize(proj, n); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' downscales images to at most %d pixels.", proj, n)})
+			log.Info().Str("event", "set_image_resize").Str("project", proj).Int("max_dim", n).Msg("image resize set")
+			return
+
+		case "timeout":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /timeout <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			seconds, err := storage.LoadProjectTimeout(proj)
+			if errors.Is(err, storage.ErrNotFound) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' uses the global request timeout of %d seconds.", proj, int(requestTimeout.Seconds()))})
+				return
+			}
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Requests of project '%s' time out after %d seconds.", proj, seconds)})
+			return
+
+		case "settimeout":
+			fields := strings.Fields(args)
+			if len(fields) != 2 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /settimeout <projectName> <seconds|off>"})
+				return
+			}
+			proj := fields[0]
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if strings.EqualFold(fields[1], "off") {
+				if err := deleteProjectTimeout(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' uses the global request timeout of %d seconds.", proj, int(requestTimeout.Seconds()))})
+				log.Info().Str("event", "clear_timeout").Str("project", proj).Msg("request timeout cleared")
+				return
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < minProjectTimeout || n > maxProjectTimeout {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Please enter a number of seconds between %d and %d, or off.", minProjectTimeout, maxProjectTimeout)})
+				return
+			}
+			if err := saveProjectTimeout(proj, n); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Requests of project '%s' time out after %d seconds.", proj, n)})
+			log.Info().Str("event", "set_timeout").Str("project", proj).Int("seconds", n).Msg("request timeout set")
+			return
+
+		case "batch":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /batch <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			seconds, err := storage.LoadProjectBatchWindow(proj)
+			if errors.Is(err, storage.ErrNotFound) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' answers every message on its own.", proj)})
+				return
+			}
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' combines messages sent within %d seconds of each other.", proj, seconds)})
+			return
+
+		case "setbatch":
+			fields := strings.Fields(args)
+			if len(fields) != 2 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setbatch <projectName> <seconds|off>"})
+				return
+			}
+			proj := fields[0]
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if strings.EqualFold(fields[1], "off") {
+				if err := deleteBatchWindow(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' answers every message on its own.", proj)})
+				log.Info().Str("event", "clear_batch_window").Str("project", proj).Msg("batch window cleared")
+				return
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < minBatchWindow || n > maxBatchWindow {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Please enter a number of seconds between %d and %d, or off.", minBatchWindow, maxBatchWindow)})
+				return
+			}
+			if err := saveBatchWindow(proj, n); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' combines messages sent within %d seconds of each other.", proj, n)})
+			log.Info().Str("event", "set_batch_window").Str("project", proj).Int("seconds", n).Msg("batch window set")
+			return
+
+		case "dedup":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /dedup <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			seconds, err := storage.LoadProjectDedupWindow(proj)
+			if errors.Is(err, storage.ErrNotFound) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' stores every message in history.", proj)})
+				return
+			}
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Load error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' skips a message repeated within %d seconds.", proj, seconds)})
+			return
+
+		case "setdedup":
+			fields := strings.Fields(args)
+			if len(fields) != 2 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setdedup <projectName> <seconds|off>"})
+				return
+			}
+			proj := fields[0]
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if strings.EqualFold(fields[1], "off") {
+				if err := deleteDedupWindow(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' stores every message in history.", proj)})
+				log.Info().Str("event", "clear_dedup_window").Str("project", proj).Msg("dedup window cleared")
+				return
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < minDedupWindow || n > maxDedupWindow {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Please enter a number of seconds between %d and %d, or off.", minDedupWindow, maxDedupWindow)})
+				return
+			}
+			if err := saveDedupWindow(proj, n); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' skips a message repeated within %d seconds.", proj, n)})
+			log.Info().Str("event", "set_dedup_window").Str("project", proj).Int("seconds", n).Msg("dedup window set")
+			return
+
+		case "limits":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /limits <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			month := currentMonth()
+			used, _ := storage.LoadMonthlyUsage(proj, month)
+			text := fmt.Sprintf("Project '%s' used %d tokens in %s.", proj, used, month)
+			if budget, err := storage.LoadProjectMonthlyBudget(proj); err == nil && budget > 0 {
+				text += fmt.Sprintf(" Monthly budget: %d tokens, %d left.", budget, max(budget-used, 0))
+			} else {
+				text += " No monthly budget is set."
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: text})
+			return
+
+		case "setbudget":
+			fields := strings.Fields(args)
+			if len(fields) != 2 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setbudget <projectName> <tokens|off>"})
+				return
+			}
+			proj := fields[0]
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			if strings.EqualFold(fields[1], "off") {
+				if err := deleteMonthlyBudget(proj); err != nil {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+					return
+				}
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' has no monthly budget.", proj)})
+				log.Info().Str("event", "clear_monthly_budget").Str("project", proj).Msg("monthly budget cleared")
+				return
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n <= 0 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter a positive number of tokens, or off."})
+				return
+			}
+			if err := saveMonthlyBudget(proj, n); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Monthly budget for project '%s' set to %d tokens.", proj, n)})
+			log.Info().Str("event", "set_monthly_budget").Str("project", proj).Int("tokens", n).Msg("monthly budget set")
+			return
+
+		case "tokenbudget":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /tokenbudget <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			budget, _ := storage.LoadTokenBudget(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("History token budget for project '%s' is %d.", proj, budget)})
+			return
+
+		case "settokenbudget":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /settokenbudget <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingBudget[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter history token budget (0 to disable)."})
+			log.Info().Str("event", "token_budget_request").Str("project", proj).Msg("token budget requested")
+			return
+
+		case "autosummarize":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /autosummarize <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			setting, _ := storage.LoadProjectAutoSummarize(proj)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("History auto-summarize for project '%s' is %s.", proj, setting)})
+			return
+
+		case "setautosummarize":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setautosummarize <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingSummarize[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Summarize history that exceeds the token budget? (on, off)"})
+			log.Info().Str("event", "autosummarize_request").Str("project", proj).Msg("autosummarize requested")
+			return
+
+		case "preprocess":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /preprocess <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			rules, _ := storage.LoadProjectPreprocess(proj)
+			if out := formatPreprocessRules(rules); out != "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Preprocessing rules for project '%s':\n%s", proj, out)})
+			} else {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("No preprocessing rules for project '%s'.", proj)})
+			}
+			return
+
+		case "setpreprocess":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setpreprocess <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingPreprocess[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: preprocessHelp})
+			log.Info().Str("event", "preprocess_request").Str("project", proj).Msg("preprocess requested")
+			return
+
+		case "summarymodel":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /summarymodel <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' summarizes history with model '%s'.", proj, summarizerModel(proj))})
+			return
+
+		case "setsummarymodel":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /setsummarymodel <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			pendingSumModel[msg.From.ID] = proj
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Enter summary model name (default to use the global setting)."})
+			log.Info().Str("event", "summary_model_request").Str("project", proj).Msg("summary model requested")
+			return
+
+		case "clearhistory":
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /clearhistory <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			askClearHistory(ctx, b, msg, proj)
+			return
+
+		case "cleartopic":
+			proj, err := messageProject(msg)
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Topic is not mapped to a project."})
+				return
+			}
+			askClearHistory(ctx, b, msg, proj)
+			return
+
+		case "movehistory":
+			fields := strings.Fields(args)
+			if len(fields) < 2 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /movehistory <src> <dst> [--replace] [--clear]"})
+				return
+			}
+			src, dst := fields[0], fields[1]
+			var replace, clearSrc bool
+			for _, f := range fields[2:] {
+				switch f {
+				case "--replace":
+					replace = true
+				case "--clear":
+					clearSrc = true
+				default:
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /movehistory <src> <dst> [--replace] [--clear]"})
+					return
+				}
+			}
+			if src == dst {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Source and destination must differ."})
+				return
+			}
+			for _, p := range []string{src, dst} {
+				if exists, err := projectExists(p); err != nil || !exists {
+					b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' not found.", p)})
+					return
+				}
+			}
+			unlock := lockHistory(src, dst)
+			moved, err := moveProjectHistory(src, dst, replace, clearSrc)
+			unlock()
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Move error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Moved %d messages from '%s' to '%s'.", moved, src, dst)})
+			log.Info().Str("event", "move_history").Str("src", src).Str("dst", dst).Bool("replace", replace).Bool("clear", clearSrc).Int("moved", moved).Msg("history moved")
+			return
+
+		case "schedule":
+			fields, prompt := splitFields(args, 5)
+			if len(fields) < 5 || prompt == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /schedule <min> <hour> <day> <month> <weekday> <prompt>"})
+				return
+			}
+			expr := strings.Join(fields, " ")
+			if _, err := cron.Parse(expr); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Invalid schedule: " + err.Error()})
+				return
+			}
+			if _, err := storage.GetMappedProject(chatID, topicID); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Topic is not mapped to a project."})
+				return
+			}
+			userName := msg.From.Username
+			if userName == "" {
+				userName = msg.From.FirstName
+			}
+			id, err := addSchedule(storage.Schedule{
+				ChatID:   chatID,
+				TopicID:  topicID,
+				Cron:     expr,
+				Prompt:   prompt,
+				UserID:   msg.From.ID,
+				UserName: userName,
+			})
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Schedule #%d added: %s", id, expr)})
+			log.Info().Str("event", "add_schedule").Uint64("schedule_id", id).Str("cron", expr).Msg("schedule added")
+			return
+
+		case "schedules":
+			items, _ := storage.ListSchedules()
+			var sb strings.Builder
+			for _, it := range items {
+				if it.ChatID != chatID || it.TopicID != topicID {
+					continue
+				}
+				fmt.Fprintf(&sb, "#%d %s\n%s\n\n", it.ID, it.Cron, logging.Snippet(it.Prompt, 50))
+			}
+			out := strings.TrimSpace(sb.String())
+			if out == "" {
+				out = "No schedules in this topic."
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: out})
+			return
+
+		case "unschedule":
+			id, err := strconv.ParseUint(args, 10, 64)
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /unschedule <id>"})
+				return
+			}
+			found := false
+			items, _ := storage.ListSchedules()
+			for _, it := range items {
+				if it.ID == id && it.ChatID == chatID {
+					found = true
+				}
+			}
+			if !found {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Schedule not found."})
+				return
+			}
+			if err := deleteSchedule(id); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Delete error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Schedule #%d removed.", id)})
+			log.Info().Str("event", "remove_schedule").Uint64("schedule_id", id).Msg("schedule removed")
+			return
+
+		case "raw":
+			handleRaw(ctx, b, msg, args)
+			return
+
+		case "translate":
+			handleTranslate(ctx, b, msg, args)
+			return
+
+		case "use":
+			handleUse(ctx, b, msg, args)
+			return
+
+		case "think", "quick":
+			if args == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Usage: /%s <question>", cmd)})
+				return
+			}
+			effort := "high"
+			if cmd == "quick" {
+				effort = "minimal"
+			}
+			log.Info().Str("event", "reasoning_override").Str("effort", effort).Msg("one-off reasoning effort")
+			processMessage(ctx, b, msg, args, 0, effort)
+			return
+
+		case "ask":
+			handleAsk(ctx, b, msg, args)
+			return
+
+		case "compare":
+			handleCompare(ctx, b, msg, args)
+			return
+
+		case "preview":
+			handlePreview(ctx, b, msg, args)
+			return
+
+		case "retry":
+			proj, err := messageProject(msg)
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Topic is not mapped to a project."})
+				return
+			}
+			unlock := lockHistory(proj)
+			hist, _ := storage.LoadProjectHistory(proj)
+			prompt, replies := trailingExchange(hist)
+			if len(prompt) == 0 || len(replies) == 0 || !replies[len(replies)-1].IsError {
+				unlock()
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Nothing to retry."})
+				return
+			}
+			_, err = undoLastExchange(proj)
+			unlock()
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Retry error: " + err.Error()})
+				return
+			}
+			log.Info().Str("event", "retry").Str("project", proj).Int("prompt_messages", len(prompt)).Msg("retrying failed request")
+			retried := retryMessage(msg, prompt)
+			processMessage(ctx, b, retried, retried.Text, 0, "")
+			return
+
+		case "undo":
+			proj, err := messageProject(msg)
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Topic is not mapped to a project."})
+				return
+			}
+			unlock := lockHistory(proj)
+			n, err := undoLastExchange(proj)
+			unlock()
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Undo error: " + err.Error()})
+				return
+			}
+			if n == 0 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Nothing to undo."})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Removed the last exchange (%d messages) from history.", n)})
+			log.Info().Str("event", "undo").Str("project", proj).Int("removed", n).Msg("last exchange removed")
+			return
+
+		case "metrics":
+			if !isAdmin(msg.From) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Admins only."})
+				return
+			}
+			data, err := metrics.JSON()
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Metrics error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: string(data)})
+			return
+
+		case "audit":
+			if !isAdmin(msg.From) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Admins only."})
+				return
+			}
+			proj := args
+			if proj == "" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /audit <projectName>"})
+				return
+			}
+			if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			sendAuditExport(ctx, b, msg, proj)
+			return
+
+		case "backup":
+			if !isAdmin(msg.From) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Admins only."})
+				return
+			}
+			sendBackup(ctx, b, msg)
+			return
+
+		case "pin":
+			handlePin(ctx, b, msg, false)
+			return
+
+		case "unpin":
+			handlePin(ctx, b, msg, true)
+			return
+
+		case "maintenance":
+			if !isAdmin(msg.From) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Admins only."})
+				return
+			}
+			handleMaintenance(ctx, b, msg, args)
+			return
+
+		case "exportall":
+			if !isAdmin(msg.From) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Admins only."})
+				return
+			}
+			if args != "" && args != "--with-keys" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /exportall [--with-keys]"})
+				return
+			}
+			sendConfigExport(ctx, b, msg, args == "--with-keys")
+			return
+
+		case "importall":
+			if !isAdmin(msg.From) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Admins only."})
+				return
+			}
+			mode := strings.ToLower(args)
+			if mode == "" {
+				mode = "merge"
+			}
+			if mode != "merge" && mode != "replace" {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /importall [merge|replace]"})
+				return
+			}
+			pendingImport[msg.From.ID] = mode
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Send the file produced by /exportall (mode: %s).", mode)})
+			log.Info().Str("event", "config_import_request").Str("mode", mode).Msg("configuration import requested")
+			return
+
+		case "compact":
+			if !isAdmin(msg.From) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Admins only."})
+				return
+			}
+			before, err := storage.FileSize()
+			if err == nil {
+				err = storage.Compact(storage.Path() + ".compact")
+			}
+			var after int64
+			if err == nil {
+				after, err = storage.FileSize()
+			}
+			if err != nil {
+				log.Error().Err(err).Msg("failed to compact database")
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Compaction error: " + err.Error()})
+				return
+			}
+			log.Info().Str("event", "db_compacted").Int64("before", before).Int64("after", after).Msg("database compacted")
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Database compacted: %d → %d bytes.", before, after)})
+			return
+
+		case "stats":
+			if !isAdmin(msg.From) {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Admins only."})
+				return
+			}
+			st, err := storage.GlobalStats()
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Stats error: " + err.Error()})
+				return
+			}
+			text := fmt.Sprintf("Projects: %d\nMapped topics: %d\nHistory messages: %d\nDatabase size: %d bytes", st.Projects, st.MappedTopics, st.HistoryMessages, st.DBSize)
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: text})
+			return
+
+		case "forget":
+			fields := strings.Fields(args)
+			if len(fields) != 2 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /forget <projectName> <n>"})
+				return
+			}
+			proj := fields[0]
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n <= 0 {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter a positive number of messages."})
+				return
+			}
+			if exists, err := projectExists(proj); err != nil || !exists {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+				return
+			}
+			unlock := lockHistory(proj)
+			removed, err := removeLastHistory(proj, n)
+			unlock()
+			if err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Forget error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Removed the last %d messages from project '%s'.", removed, proj)})
+			log.Info().Str("event", "forget_history").Str("project", proj).Int("removed", removed).Msg("recent history removed")
+			return
+
+		case "setup":
+			if strings.EqualFold(args, "cancel") {
+				cancelSetup(ctx, b, msg)
+				return
+			}
+			startSetup(ctx, b, msg)
+			return
+
+		case "listprojects":
+			handleListProjects(ctx, b, chatID, topicID, args)
+			return
+		}
+	}
+
+	if msg.Text != "" && handleSetupStep(ctx, b, msg) {
+		return
 	}
 
 	if proj, ok := pendingModel[msg.From.ID]; ok && msg.Text != "" {
@@ -415,6 +2784,98 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 		return
 	}
 
+	if proj, ok := pendingSumModel[msg.From.ID]; ok && msg.Text != "" {
+		model := strings.TrimSpace(msg.Text)
+		delete(pendingSumModel, msg.From.ID)
+		if strings.EqualFold(model, "default") {
+			model = ""
+		}
+		if err := saveSummaryModel(proj, model); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' summarizes history with model '%s'.", proj, summarizerModel(proj))})
+		log.Info().Str("event", "set_summary_model").Str("project", proj).Str("model", model).Msg("summary model set")
+		return
+	}
+
+	if proj, ok := pendingWelcome[msg.From.ID]; ok && msg.Text != "" {
+		text := strings.TrimSpace(msg.Text)
+		delete(pendingWelcome, msg.From.ID)
+		if strings.EqualFold(text, "off") {
+			text = ""
+		}
+		if err := saveProjectWelcome(proj, text); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Welcome message saved."})
+		log.Info().Str("event", "set_welcome").Str("project", proj).Msg("welcome saved")
+		return
+	}
+
+	if mode, ok := pendingImport[msg.From.ID]; ok && (msg.Document != nil || msg.Text != "") {
+		delete(pendingImport, msg.From.ID)
+		handleConfigImport(ctx, b, msg, mode)
+		return
+	}
+
+	if proj, ok := pendingAPIKey[msg.From.ID]; ok && msg.Text != "" {
+		key := strings.TrimSpace(msg.Text)
+		delete(pendingAPIKey, msg.From.ID)
+		// the key should not stay readable in the chat
+		if _, err := b.DeleteMessage(ctx, &tg.DeleteMessageParams{ChatID: chatID, MessageID: msg.ID}); err != nil {
+			log.Warn().Err(err).Msg("failed to delete api key message")
+		}
+		if strings.EqualFold(key, "off") {
+			if err := deleteProjectAPIKey(proj); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Project '%s' now uses the global API key.", proj)})
+			log.Info().Str("event", "delete_api_key").Str("project", proj).Msg("api key removed")
+			return
+		}
+		if strings.ContainsAny(key, " \t\n") {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "An API key cannot contain spaces."})
+			return
+		}
+		encrypted, err := encryptAPIKey(key)
+		if err == nil {
+			err = saveProjectAPIKey(proj, encrypted)
+		}
+		if err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("API key for project '%s' saved.", proj)})
+		log.Info().Str("event", "set_api_key").Str("project", proj).Msg("api key saved")
+		return
+	}
+
+	if proj, ok := pendingFooter[msg.From.ID]; ok && msg.Text != "" {
+		footer := strings.TrimSpace(msg.Text)
+		delete(pendingFooter, msg.From.ID)
+		if strings.EqualFold(footer, "off") {
+			footer = ""
+		}
+		if n := utf8.RuneCountInString(footer); n > maxFooterLen {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("The footer is %d characters long; the limit is %d.", n, maxFooterLen)})
+			return
+		}
+		if err := saveProjectFooter(proj, footer); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		if footer == "" {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Footer removed."})
+		} else {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Footer saved."})
+		}
+		log.Info().Str("event", "set_footer").Str("project", proj).Msg("footer saved")
+		return
+	}
+
 	if proj, ok := pendingRule[msg.From.ID]; ok && msg.Text != "" {
 		instr := strings.TrimSpace(msg.Text)
 		delete(pendingRule, msg.From.ID)
@@ -461,113 +2922,483 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 		return
 	}
 
-	if proj, ok := pendingTranscribe[msg.From.ID]; ok && msg.Text != "" {
+	if proj, ok := pendingDetail[msg.From.ID]; ok && msg.Text != "" {
+		val := strings.ToLower(strings.TrimSpace(msg.Text))
+		delete(pendingDetail, msg.From.ID)
+		switch val {
+		case "auto", "low", "high":
+			if err := saveImageDetail(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Image detail for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_image_detail").Str("project", proj).Str("detail", val).Msg("image detail set")
+		default:
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: auto, low, high."})
+		}
+		return
+	}
+
+	if proj, ok := pendingTranscribe[msg.From.ID]; ok && msg.Text != "" {
+		val := strings.ToLower(strings.TrimSpace(msg.Text))
+		delete(pendingTranscribe, msg.From.ID)
+		switch val {
+		case "on", "off":
+			if err := saveProjectTranscribe(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Audio transcription for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_transcribe").Str("project", proj).Str("setting", val).Msg("transcribe set")
+		default:
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+		}
+		return
+	}
+
+	if proj, ok := pendingEditRerun[msg.From.ID]; ok && msg.Text != "" {
+		val := strings.ToLower(strings.TrimSpace(msg.Text))
+		delete(pendingEditRerun, msg.From.ID)
+		switch val {
+		case "on", "off":
+			if err := saveProjectEditRerun(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Re-running edited prompts for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_edit_rerun").Str("project", proj).Str("setting", val).Msg("edit rerun set")
+		default:
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+		}
+		return
+	}
+
+	if proj, ok := pendingTyping[msg.From.ID]; ok && msg.Text != "" {
+		val := strings.ToLower(strings.TrimSpace(msg.Text))
+		delete(pendingTyping, msg.From.ID)
+		switch val {
+		case "on", "off":
+			if err := saveProjectTyping(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Typing indicator for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_typing").Str("project", proj).Str("setting", val).Msg("typing set")
+		default:
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+		}
+		return
+	}
+
+	if proj, ok := pendingVoiceReply[msg.From.ID]; ok && msg.Text != "" {
+		delete(pendingVoiceReply, msg.From.ID)
+		setVoiceReply(ctx, b, chatID, topicID, proj, strings.ToLower(strings.TrimSpace(msg.Text)))
+		return
+	}
+
+	if proj, ok := pendingJSONSchema[msg.From.ID]; ok && msg.Text != "" {
+		val := strings.TrimSpace(msg.Text)
+		delete(pendingJSONSchema, msg.From.ID)
+		if strings.EqualFold(val, "off") {
+			if err := deleteJSONSchema(proj); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("JSON schema for project '%s' cleared.", proj)})
+			log.Info().Str("event", "clear_json_schema").Str("project", proj).Msg("json schema cleared")
+			return
+		}
+		schema, err := parseJSONSchema(val)
+		if err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Invalid schema: " + err.Error()})
+			return
+		}
+		if err := saveJSONSchema(proj, schema); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("JSON schema for project '%s' saved.", proj)})
+		log.Info().Str("event", "set_json_schema").Str("project", proj).Msg("json schema set")
+		return
+	}
+
+	if proj, ok := pendingStops[msg.From.ID]; ok && msg.Text != "" {
+		delete(pendingStops, msg.From.ID)
+		stops, err := parseStops(msg.Text)
+		if err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Please enter 1 to %d non-empty stop sequences separated by commas.", maxStops)})
+			return
+		}
+		if err := saveProjectStops(proj, stops); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Stop sequences for project '%s' set to %s.", proj, formatStops(stops))})
+		log.Info().Str("event", "set_stops").Str("project", proj).Int("count", len(stops)).Msg("stop sequences set")
+		return
+	}
+
+	if proj, ok := pendingDomains[msg.From.ID]; ok && msg.Text != "" {
+		val := strings.TrimSpace(msg.Text)
+		delete(pendingDomains, msg.From.ID)
+		if strings.EqualFold(val, "off") {
+			if err := deleteSearchDomains(proj); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Web search for project '%s' may use any domain.", proj)})
+			log.Info().Str("event", "clear_search_domains").Str("project", proj).Msg("search domains cleared")
+			return
+		}
+		domains, err := parseSearchDomains(val)
+		if err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Invalid domains: " + err.Error()})
+			return
+		}
+		if err := saveSearchDomains(proj, domains); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Web search for project '%s' is limited to: %s", proj, strings.Join(domains, ", "))})
+		log.Info().Str("event", "set_search_domains").Str("project", proj).Strs("domains", domains).Msg("search domains set")
+		return
+	}
+
+	if proj, ok := pendingTimezone[msg.From.ID]; ok && msg.Text != "" {
+		val := strings.TrimSpace(msg.Text)
+		delete(pendingTimezone, msg.From.ID)
+		if _, err := time.LoadLocation(val); err != nil || val == "" || val == "Local" {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Unknown timezone. Use an IANA name such as Europe/Helsinki or UTC."})
+			return
+		}
+		if err := saveProjectTimezone(proj, val); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Timezone for project '%s' set to %s.", proj, val)})
+		log.Info().Str("event", "set_timezone").Str("project", proj).Str("timezone", val).Msg("timezone set")
+		return
+	}
+
+	if proj, ok := pendingBusyMode[msg.From.ID]; ok && msg.Text != "" {
+		val := strings.ToLower(strings.TrimSpace(msg.Text))
+		delete(pendingBusyMode, msg.From.ID)
+		switch val {
+		case "queue", "reject":
+			if err := saveProjectBusyMode(proj, val); err != nil {
+				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+				return
+			}
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Busy mode for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_busy_mode").Str("project", proj).Str("mode", val).Msg("busy mode set")
+		default:
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: queue, reject."})
+		}
+		return
+	}
+
+	if proj, ok := pendingImageCache[msg.From.ID]; ok && msg.Text != "" {
+		ttlStr := strings.TrimSpace(msg.Text)
+		delete(pendingImageCache, msg.From.ID)
+		ttl, err := strconv.Atoi(ttlStr)
+		if err != nil || ttl < 0 {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter a non-negative integer."})
+			return
+		}
+		if err := saveImageCacheTTL(proj, ttl); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Image answer cache TTL for project '%s' set to %d minutes.", proj, ttl)})
+		log.Info().Str("event", "set_image_cache").Str("project", proj).Int("ttl", ttl).Msg("image cache set")
+		return
+	}
+
+	if proj, ok := pendingHistLimit[msg.From.ID]; ok && msg.Text != "" {
+		limitStr := strings.TrimSpace(msg.Text)
+		delete(pendingHistLimit, msg.From.ID)
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter a non-negative integer."})
+			return
+		}
+		if err := saveHistoryLimit(proj, limit); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("History limit for project '%s' set to %d.", proj, limit)})
+		log.Info().Str("event", "set_history_limit").Str("project", proj).Int("limit", limit).Msg("history limit set")
+		return
+	}
+
+	if proj, ok := pendingBudget[msg.From.ID]; ok && msg.Text != "" {
+		budgetStr := strings.TrimSpace(msg.Text)
+		delete(pendingBudget, msg.From.ID)
+		budget, err := strconv.Atoi(budgetStr)
+		if err != nil || budget < 0 {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter a non-negative integer."})
+			return
+		}
+		if err := saveTokenBudget(proj, budget); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("History token budget for project '%s' set to %d.", proj, budget)})
+		log.Info().Str("event", "set_token_budget").Str("project", proj).Int("budget", budget).Msg("token budget set")
+		return
+	}
+
+	if proj, ok := pendingSummarize[msg.From.ID]; ok && msg.Text != "" {
 		val := strings.ToLower(strings.TrimSpace(msg.Text))
-		delete(pendingTranscribe, msg.From.ID)
+		delete(pendingSummarize, msg.From.ID)
 		switch val {
 		case "on", "off":
-			if err := saveProjectTranscribe(proj, val); err != nil {
+			if err := saveAutoSummarize(proj, val); err != nil {
 				b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
 				return
 			}
-			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Audio transcription for project '%s' set to %s.", proj, val)})
-			log.Info().Str("event", "set_transcribe").Str("project", proj).Str("setting", val).Msg("transcribe set")
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("History auto-summarize for project '%s' set to %s.", proj, val)})
+			log.Info().Str("event", "set_autosummarize").Str("project", proj).Str("setting", val).Msg("autosummarize set")
 		default:
 			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
 		}
 		return
 	}
 
-	if proj, ok := pendingHistLimit[msg.From.ID]; ok && msg.Text != "" {
-		limitStr := strings.TrimSpace(msg.Text)
-		delete(pendingHistLimit, msg.From.ID)
-		limit, err := strconv.Atoi(limitStr)
-		if err != nil || limit < 0 {
-			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter a non-negative integer."})
+	if proj, ok := pendingPreprocess[msg.From.ID]; ok && msg.Text != "" {
+		delete(pendingPreprocess, msg.From.ID)
+		rules, err := parsePreprocessRules(msg.Text)
+		if err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Invalid rules: " + err.Error()})
 			return
 		}
-		if err := saveHistoryLimit(proj, limit); err != nil {
+		if err := saveProjectPreprocess(proj, rules); err != nil {
 			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
 			return
 		}
-		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("History limit for project '%s' set to %d.", proj, limit)})
-		log.Info().Str("event", "set_history_limit").Str("project", proj).Int("limit", limit).Msg("history limit set")
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Preprocessing rules for project '%s' saved.", proj)})
+		log.Info().Str("event", "set_preprocess").Str("project", proj).Int("replacements", len(rules.Replacements)).Msg("preprocess set")
 		return
 	}
 
-	if proj, ok := pendingClearHist[msg.From.ID]; ok && msg.Text != "" {
-		resp := strings.ToLower(strings.TrimSpace(msg.Text))
-		delete(pendingClearHist, msg.From.ID)
-		if resp != "confirm" {
-			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Cancelled."})
-			return
-		}
-		removed, err := clearProjectHistory(proj)
-		if err != nil {
-			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Clear error: " + err.Error()})
-			return
-		}
-		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Cleared %d messages from project '%s'.", removed, proj)})
-		log.Info().Str("event", "clear_history").Str("project", proj).Int("removed", removed).Msg("history cleared")
+	if text == "" && len(msg.Photo) == 0 && audioFileID(msg) == "" && msg.Sticker == nil && msg.Animation == nil {
+		return
+	}
+
+	if ignoredInGroup(ctx, msg) {
+		log.Info().Str("event", "not_mentioned").Msg("message not addressed to the bot ignored")
 		return
 	}
+	text = stripBotMention(text)
 
-	if text == "" && len(msg.Photo) == 0 && msg.Voice == nil && msg.Audio == nil {
+	if batchMessage(ctx, b, msg, text) {
+		return
+	}
+	processMessage(ctx, b, msg, text, 0, "")
+}
+
+// HandleScheduled sends a scheduled prompt through the regular message path as
+// if its author had posted it in the scheduled topic.
+func HandleScheduled(ctx context.Context, b Bot, s storage.Schedule) {
+	ctx = logging.WithUser(logging.Context(ctx), s.UserID)
+	b = withSendRetry(b)
+	logging.Ctx(ctx).Info().Str("event", "schedule_fire").Uint64("schedule_id", s.ID).Int64("chat_id", s.ChatID).Int("topic_id", s.TopicID).Msg("running scheduled prompt")
+	msg := &models.Message{
+		Text:            s.Prompt,
+		Chat:            models.Chat{ID: s.ChatID},
+		MessageThreadID: s.TopicID,
+		From:            &models.User{ID: s.UserID, Username: s.UserName},
+	}
+	processMessage(ctx, b, msg, s.Prompt, 0, "")
+}
+
+// postWelcome posts the project welcome message into a freshly mapped topic
+// and pins it. Without pin permission the message stays unpinned.
+func postWelcome(ctx context.Context, b Bot, chatID int64, topicID int, proj string) {
+	log := logging.Ctx(ctx)
+	text, err := loadProjectWelcome(proj)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Error().Err(err).Str("project", proj).Msg("failed to load welcome message")
 		return
 	}
+	if text == "" {
+		return
+	}
+	sent, err := b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: text})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to post welcome message")
+		return
+	}
+	if _, err := b.PinChatMessage(ctx, &tg.PinChatMessageParams{ChatID: chatID, MessageID: sent.ID, DisableNotification: true}); err != nil {
+		log.Warn().Err(err).Str("project", proj).Msg("could not pin welcome message")
+	}
+}
+
+// maxSpeechInput is the number of characters of a reply spoken in a voice
+// reply, below the 4096 the speech API accepts.
+const maxSpeechInput = 4000
+
+// maxStops is the number of stop sequences a project may have.
+const maxStops = 4
+
+// cutAtStop returns reply up to the earliest of the stop sequences. The
+// Responses API has no stop parameter, so replies are cut after they arrive.
+func cutAtStop(reply string, stops []string) string {
+	end := len(reply)
+	for _, s := range stops {
+		if i := strings.Index(reply[:end], s); i >= 0 {
+			end = i
+		}
+	}
+	return reply[:end]
+}
+
+// parseStops reads up to maxStops comma-separated stop sequences from s.
+func parseStops(s string) ([]string, error) {
+	var stops []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			return nil, fmt.Errorf("empty stop sequence")
+		}
+		stops = append(stops, f)
+	}
+	if len(stops) > maxStops {
+		return nil, fmt.Errorf("at most %d stop sequences are allowed", maxStops)
+	}
+	return stops, nil
+}
+
+// formatStops quotes stop sequences for display.
+func formatStops(stops []string) string {
+	quoted := make([]string, len(stops))
+	for i, s := range stops {
+		quoted[i] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// setVoiceReply validates and stores the voice reply setting of a project.
+func setVoiceReply(ctx context.Context, b Bot, chatID int64, topicID int, proj, val string) {
+	switch val {
+	case "on", "off":
+		if err := saveProjectVoiceReply(proj, val); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Voice replies for project '%s' set to %s.", proj, val)})
+		logging.Ctx(ctx).Info().Str("event", "set_voice_reply").Str("project", proj).Str("setting", val).Msg("voice reply set")
+	default:
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Please enter one of: on, off."})
+	}
+}
+
+// processMessage forwards a regular message to the project mapped to its topic
+// and replies with the model answer. A non-zero replyID makes it reuse that
+// earlier bot reply instead of sending a new message. A non-empty effort
+// replaces the project's reasoning effort for this request only.
+func processMessage(ctx context.Context, b Bot, msg *models.Message, text string, replyID int, effort string) {
+	chatID := msg.Chat.ID
+	topicID := msg.MessageThreadID
+	log := logging.Ctx(ctx)
 
-	proj, err := storage.GetMappedProject(chatID, topicID)
+	proj, err := messageProject(msg)
 	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Error().Err(err).Msg("failed to load topic mapping")
+		}
+		return
+	}
+	stickerText, thumbFileID := mediaInput(msg, proj)
+	if text == "" && stickerText == "" && thumbFileID == "" && (msg.Sticker != nil || msg.Animation != nil) {
+		log.Info().Str("event", "media_ignored").Str("project", proj).Msg("sticker or GIF not answered by the project")
+		return
+	}
+	if underMaintenance(ctx, b, msg) || overMonthlyBudget(ctx, b, msg, proj) {
+		return
+	}
+	busyMode, _ := storage.LoadProjectBusyMode(proj)
+	release, ok := acquireTopic(chatID, topicID, busyMode)
+	if !ok {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: busyReply})
+		log.Info().Str("event", "topic_busy").Str("project", proj).Msg("request rejected while another is in flight")
 		return
 	}
+	defer release()
+	if rules, _ := storage.LoadProjectPreprocess(proj); text != "" {
+		text = preprocessText(text, rules)
+	}
+	if stickerText != "" {
+		text = strings.TrimSpace(text + "\n" + stickerText)
+	}
+	imageFileID := thumbFileID
+	if len(msg.Photo) > 0 {
+		imageFileID = msg.Photo[len(msg.Photo)-1].FileID
+	}
+	hasImage := imageFileID != ""
 	model, err := storage.LoadProjectModel(proj)
-	if err != nil || model == "" {
-		model = defaultModel
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Error().Err(err).Str("project", proj).Msg("failed to load model")
 	}
-	instr, _ := storage.LoadProjectInstruction(proj)
-	inputs := responses.ResponseInputParam{}
-	if instr != "" {
-		inputs = append(inputs, responses.ResponseInputItemParamOfMessage(instr, responses.EasyInputMessageRoleSystem))
+	if model == "" {
+		model = defaultModel
 	}
 	limit, _ := storage.LoadHistoryLimit(proj)
 	hist, _ := storage.LoadProjectHistory(proj)
 	webSearchSetting, _ := storage.LoadProjectWebSearch(proj)
 	reasoningEffort, _ := storage.LoadProjectReasoning(proj)
+	if effort != "" {
+		reasoningEffort = effort
+	}
 	transcribeSetting, _ := storage.LoadProjectTranscribe(proj)
-	client := newOpenAIClient()
-	if limit > 0 && len(hist) > 0 {
-		for _, h := range hist {
-			if h.Content == "" {
-				continue
-			}
-			when := time.Unix(h.When, 0).Format("2006-01-02 15:04:05")
-			prefix := fmt.Sprintf("%s %s:\n", when, h.WhoName)
-			inputs = append(inputs, responses.ResponseInputItemParamOfMessage(prefix+h.Content, responses.EasyInputMessageRole(h.Role)))
-		}
+	typingSetting, _ := storage.LoadProjectTyping(proj)
+	voiceReplySetting, _ := storage.LoadProjectVoiceReply(proj)
+	showReasoningSetting, _ := storage.LoadProjectShowReasoning(proj)
+	citationsSetting, _ := storage.LoadProjectCitations(proj)
+	chunkNumbersSetting, _ := storage.LoadProjectChunkNumbers(proj)
+	footer, _ := storage.LoadProjectFooter(proj)
+	searchDomains, _ := storage.LoadProjectSearchDomains(proj)
+	stops, _ := storage.LoadProjectStops(proj)
+	jsonModeSetting, _ := storage.LoadProjectJSONMode(proj)
+	jsonSchema, _ := storage.LoadProjectJSONSchema(proj)
+	jsonMode := jsonModeSetting == "on"
+	// the answer may be redirected to another topic of the chat
+	replyTopic := topicID
+	if t, err := storage.LoadReplyTopic(chatID, topicID); err == nil {
+		replyTopic = t
+	}
+	client := newOpenAIClient(proj)
+	if budget, _ := storage.LoadTokenBudget(proj); limit > 0 && budget > 0 {
+		hist = fitHistoryBudget(ctx, client, proj, hist, budget)
 	}
 	userName := msg.From.Username
 	if userName == "" {
 		userName = msg.From.FirstName
 	}
-	now := time.Now()
 	var transcribed string
-	if transcribeSetting == "on" && (msg.Voice != nil || msg.Audio != nil) {
-		fileID := ""
-		if msg.Voice != nil {
-			fileID = msg.Voice.FileID
-		} else if msg.Audio != nil {
-			fileID = msg.Audio.FileID
-		}
-		file, err := b.GetFile(ctx, &tg.GetFileParams{FileID: fileID})
-		if err != nil {
+	audioID := audioFileID(msg)
+	audioTooLarge := false
+	rejectAudio := func(size, limit int64) {
+		audioTooLarge = true
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("This audio is too large to transcribe (limit %d MB).", limit>>20)})
+		log.Warn().Str("event", "audio_too_large").Str("project", proj).Int64("bytes", size).Msg("audio rejected before transcription")
+	}
+	if transcribeSetting == "on" && audioID != "" {
+		// Telegram refuses to hand out larger files, so they are rejected
+		// before asking for them
+		if size := audioFileSize(msg); size > maxDownloadBytes {
+			rejectAudio(size, maxDownloadBytes)
+		} else if file, err := b.GetFile(ctx, &tg.GetFileParams{FileID: audioID}); err != nil {
 			log.Error().Err(err).Msg("failed to get audio file")
 		} else {
 			url := b.FileDownloadLink(file)
 			resp, err := httpGetFunc(url)
 			if err == nil {
 				defer resp.Body.Close()
-				tText, err := openAITranscribe(client, resp.Body)
-				if err != nil {
+				tText, err := transcribeAudio(ctx, proj, resp.Body, resp.ContentLength)
+				if errors.Is(err, errAudioTooLarge) {
+					rejectAudio(resp.ContentLength, maxTranscribeBytes)
+				} else if err != nil {
 					log.Error().Err(err).Msg("transcription failed")
 				} else {
 					transcribed = tText
@@ -577,125 +3408,259 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 			}
 		}
 	}
-	var parts responses.ResponseInputMessageContentListParam
-	if limit > 0 {
-		meta := fmt.Sprintf("%s %s:", now.Format("2006-01-02 15:04:05"), userName)
-		if text != "" {
-			meta += "\n" + text
-		}
-		if transcribed != "" {
-			meta += "\n(Audio transcription)\n" + transcribed
-		}
-		parts = append(parts, responses.ResponseInputContentParamOfInputText(meta))
-	} else {
-		if text != "" {
-			parts = append(parts, responses.ResponseInputContentParamOfInputText(text))
-		}
-		if transcribed != "" {
-			parts = append(parts, responses.ResponseInputContentParamOfInputText("(Audio transcription)\n"+transcribed))
+	if audioTooLarge && text == "" && !hasImage {
+		return
+	}
+	if audioID != "" && transcribed == "" && text == "" && !hasImage {
+		// the audio was all there was to send
+		notice := "Could not transcribe the audio."
+		if transcribeSetting != "on" {
+			notice = fmt.Sprintf("Audio transcription is off for project '%s'. Turn it on with /settranscribe.", proj)
 		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: notice})
+		log.Info().Str("event", "audio_not_transcribed").Str("project", proj).Str("transcribe", transcribeSetting).Msg("audio-only message not sent")
+		return
 	}
-	if len(msg.Photo) > 0 {
-		fileID := msg.Photo[len(msg.Photo)-1].FileID
-		file, err := b.GetFile(ctx, &tg.GetFileParams{FileID: fileID})
+	var imageURL, cacheKey, cachedReply string
+	if hasImage {
+		file, err := b.GetFile(ctx, &tg.GetFileParams{FileID: imageFileID})
 		if err != nil {
 			log.Error().Err(err).Msg("failed to get file")
 		} else {
 			url := b.FileDownloadLink(file)
-			img := responses.ResponseInputImageParam{
-				Detail:   responses.ResponseInputImageDetailAuto,
-				ImageURL: openai.String(url),
-			}
-			parts = append(parts, responses.ResponseInputContentUnionParam{OfInputImage: &img})
-		}
-	}
-	inputs = append(inputs, responses.ResponseInputItemParamOfMessage(parts, responses.EasyInputMessageRoleUser))
-	if limit > 0 {
-		whenUnix := now.Unix()
-		if text != "" {
-			storage.AddHistoryMessage(proj, storage.HistoryMessage{
-				Role:    string(responses.EasyInputMessageRoleUser),
-				WhoID:   msg.From.ID,
-				WhoName: userName,
-				When:    whenUnix,
-				Content: text,
-			})
-		}
-		if transcribed != "" {
-			storage.AddHistoryMessage(proj, storage.HistoryMessage{
-				Role:    string(responses.EasyInputMessageRoleUser),
-				WhoID:   msg.From.ID,
-				WhoName: userName,
-				When:    whenUnix,
-				Content: "(Transcribed audio) " + transcribed,
-			})
+			imageURL = url
+			ttl, _ := storage.LoadImageCacheTTL(proj)
+			maxDim, _ := storage.LoadImageResize(proj)
+			if ttl > 0 || maxDim > 0 {
+				if data, err := downloadFile(url); err != nil {
+					log.Error().Err(err).Msg("failed to download image")
+				} else {
+					if ttl > 0 {
+						cacheKey = imageCacheKey(data, text)
+						if reply, ok, _ := storage.LoadCachedAnswer(proj, cacheKey, time.Duration(ttl)*time.Minute); ok {
+							cachedReply = reply
+							log.Info().Str("event", "image_cache_hit").Str("project", proj).Msg("answer served from image cache")
+						}
+					}
+					if maxDim > 0 && cachedReply == "" {
+						// the original URL is still sent when the image cannot be decoded
+						if small, ok, err := downscaleImage(data, maxDim); err != nil {
+							log.Warn().Err(err).Str("project", proj).Msg("failed to downscale image, sending original")
+						} else if ok {
+							imageURL = jpegDataURL(small)
+							log.Info().Str("event", "image_downscaled").Str("project", proj).Int("original_bytes", len(data)).Int("bytes", len(small)).Msg("image downscaled")
+						}
+					}
+				}
+			}
 		}
-		if len(msg.Photo) > 0 {
-			storage.AddHistoryMessage(proj, storage.HistoryMessage{
-				Role:    string(responses.EasyInputMessageRoleUser),
-				WhoID:   msg.From.ID,
-				WhoName: userName,
-				When:    whenUnix,
-				Content: "(User has attached some image)",
-			})
+	}
+	model = projectRouteModel(ctx, proj, model, strings.TrimSpace(text+"\n"+transcribed))
+	cfg := loadProjectConfig(proj)
+	cfg.HistoryLimit, cfg.History = limit, hist
+	// a chained request continues the previous response on the server, which
+	// already holds the instruction and the earlier turns
+	chainingSetting, _ := storage.LoadProjectChaining(proj)
+	var previousID string
+	if chainingSetting == "on" {
+		if id, err := storage.LoadLastResponseID(proj); err == nil && id != "" {
+			previousID = id
+			cfg.History, cfg.Instruction, cfg.MirrorLanguage = nil, "", false
 		}
 	}
+	inputs, records := buildInputs(ctx, cfg, messageData{
+		UserID:      msg.From.ID,
+		UserName:    userName,
+		ChatID:      chatID,
+		MessageID:   msg.ID,
+		When:        time.Now(),
+		Text:        text,
+		Transcribed: transcribed,
+		HasImage:    hasImage,
+		ImageURL:    imageURL,
+		ImageFileID: imageFileID,
+		AudioFileID: audioID,
+	})
+	if inputTokens, maxTokens := estimateInputTokens(inputs), inputLimit(model); inputTokens > maxTokens {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Your message plus history is too large (~%d tokens). Try /forget or reduce the history limit.", inputTokens)})
+		log.Warn().Str("event", "input_too_large").Str("project", proj).Str("model", model).Int("tokens", inputTokens).Int("limit", maxTokens).Msg("request exceeds model input limit")
+		return
+	}
+	// the reply to a prompt skipped as a duplicate is not stored either, so
+	// history keeps alternating between prompts and replies
+	duplicate, err := appendHistory(proj, 0, records...)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to store prompt in history")
+	}
+	metrics.Inc(metrics.ChatGPTRequests)
 	log.Info().Str("event", "chatgpt_request").Str("project", proj).Str("model", model).Str("snippet", logging.Snippet(text, 30)).Msg("sending to ChatGPT")
 
 	// send initial progress message and keep its ID for further edits
-	progressMsg, _ := b.SendMessage(ctx, &tg.SendMessageParams{
+	progressParams := &tg.SendMessageParams{
 		ChatID:          chatID,
-		MessageThreadID: topicID,
+		MessageThreadID: replyTopic,
 		Text:            "Sending to ChatGPT...",
-		ReplyParameters: &models.ReplyParameters{MessageID: msg.ID},
-	})
+	}
+	if msg.ID != 0 && replyTopic == topicID {
+		progressParams.ReplyParameters = &models.ReplyParameters{MessageID: msg.ID}
+	}
+	// rememberReply records the messages that answer msg, so an edit of msg
+	// can re-run it in place
+	rememberReply := func(id int, chunkIDs ...int) {
+		if msg.ID == 0 {
+			return
+		}
+		if err := storage.SaveLastReply(chatID, topicID, storage.LastReply{MessageID: msg.ID, ReplyID: id, ChunkIDs: chunkIDs}); err != nil {
+			log.Error().Err(err).Msg("failed to store reply id")
+		}
+	}
+	// without a progress message the answer is sent fresh at the end
+	var progressMsg *models.Message
+	postProgress := func() {
+		sent, err := b.SendMessage(ctx, progressParams)
+		if err != nil || sent == nil {
+			log.Error().Err(err).Msg("failed to send progress message")
+			return
+		}
+		progressMsg = sent
+		rememberReply(sent.ID)
+	}
+	// progressC fires when a delayed progress message is due
+	var progressC <-chan time.Time
+	if replyID != 0 {
+		progressMsg = &models.Message{ID: replyID}
+		if _, err := b.EditMessageText(ctx, &tg.EditMessageTextParams{ChatID: chatID, MessageID: replyID, Text: progressParams.Text}); err != nil {
+			log.Error().Err(err).Msg("failed to edit previous reply")
+		}
+		rememberReply(replyID)
+	} else if progressDelay > 0 {
+		progressTimer := time.NewTimer(progressDelay)
+		defer progressTimer.Stop()
+		progressC = progressTimer.C
+	} else {
+		postProgress()
+	}
+	editProgress := func(text string) {
+		if progressMsg == nil {
+			// a delayed progress message is posted early to show the status
+			if progressC != nil {
+				progressC = nil
+				progressParams.Text = text
+				postProgress()
+			}
+			return
+		}
+		if _, err := b.EditMessageText(ctx, &tg.EditMessageTextParams{ChatID: chatID, MessageID: progressMsg.ID, Text: text}); err != nil {
+			log.Error().Err(err).Msg("failed to edit progress message")
+		}
+	}
 
 	type gptResult struct {
-		reply string
-		err   error
+		reply     string
+		reasoning string
+		citations []citation
+		model     string
+		id        string
+		err       error
 	}
 	resultCh := make(chan gptResult, 1)
 
+	// the deadline also ends the wait below when the request ignores it, and
+	// covers the time spent queued for a slot
+	timeout := projectTimeout(proj)
+	reqCtx, cancelReq := context.WithTimeout(ctx, timeout)
+	defer cancelReq()
+
+	releaseSlot := func() {}
+	var slotErr error
+	if cachedReply == "" {
+		var release func()
+		release, slotErr = requestSlots.acquire(reqCtx, func(pos int) {
+			editProgress(fmt.Sprintf("Queued (position %d)...", pos))
+			log.Info().Str("event", "request_queued").Str("project", proj).Int("position", pos).Msg("request queued")
+		})
+		if slotErr == nil {
+			releaseSlot = release
+		}
+	}
+
 	// run ChatGPT request asynchronously
 	go func() {
-		var tools []responses.ToolUnionParam
-		if webSearchSetting != "off" {
-			size := responses.WebSearchToolSearchContextSizeHigh
-			switch webSearchSetting {
-			case "medium":
-				size = responses.WebSearchToolSearchContextSizeMedium
-			case "low":
-				size = responses.WebSearchToolSearchContextSizeLow
-			case "high":
-				size = responses.WebSearchToolSearchContextSizeHigh
-			}
-			tools = append(tools, responses.ToolUnionParam{
-				OfWebSearchPreview: &responses.WebSearchToolParam{
-					Type:              responses.WebSearchToolTypeWebSearchPreview,
-					SearchContextSize: size,
-					UserLocation: responses.WebSearchToolUserLocationParam{
-						City:     param.NewOpt("Oulu"),
-						Country:  param.NewOpt("FI"),
-						Timezone: param.NewOpt("Europe/Helsinki"),
-						Type:     constant.ValueOf[constant.Approximate](),
-					},
-				},
-			})
+		defer releaseSlot()
+		if slotErr != nil {
+			// reqCtx is done; the wait below reports the timeout
+			return
+		}
+		if cachedReply != "" {
+			resultCh <- gptResult{reply: cachedReply, model: model}
+			return
 		}
 		params := responses.ResponseNewParams{
 			Model:     openai.ResponsesModel(model),
 			Input:     responses.ResponseNewParamsInputUnion{OfInputItemList: inputs},
-			Tools:     tools,
+			Tools:     webSearchTools(webSearchSetting, searchDomains),
 			Reasoning: openai.ReasoningParam{Effort: reasoningEffortToConst(reasoningEffort)},
 		}
-		reply, err := openAIResponses(client, params)
+		if showReasoningSetting == "on" {
+			params.Reasoning.Summary = openai.ReasoningSummaryAuto
+		}
+		if previousID != "" {
+			params.PreviousResponseID = openai.String(previousID)
+		}
+		if jsonMode {
+			params.Text = jsonTextConfig(jsonSchema)
+		}
+		answeredBy := model
+		resp, err := openAIResponses(reqCtx, client, params)
+		if fb := projectFallback(proj); err != nil && fb != "" && fb != model && isModelUnavailable(err) {
+			log.Warn().Err(err).Str("project", proj).Str("model", model).Str("fallback", fb).Msg("model unavailable, retrying with fallback")
+			params.Model = openai.ResponsesModel(fb)
+			answeredBy = fb
+			resp, err = openAIResponses(reqCtx, client, params)
+		}
 		if err != nil {
-			resultCh <- gptResult{reply: "OpenAI error: " + err.Error(), err: err}
+			metrics.Inc(metrics.ChatGPTErrors)
+			resultCh <- gptResult{reply: classifyOpenAIError(err), model: answeredBy, err: err}
 			return
 		}
-		resultCh <- gptResult{reply: reply}
+		recordUsage(ctx, proj, resp)
+		if jsonMode && !validJSON(resp.Text) {
+			log.Warn().Str("event", "invalid_json_reply").Str("project", proj).Str("model", answeredBy).Msg("reply is not valid JSON, retrying once")
+			resp, err = openAIResponses(reqCtx, client, params)
+			if err != nil {
+				metrics.Inc(metrics.ChatGPTErrors)
+				resultCh <- gptResult{reply: classifyOpenAIError(err), model: answeredBy, err: err}
+				return
+			}
+			recordUsage(ctx, proj, resp)
+			if !validJSON(resp.Text) {
+				metrics.Inc(metrics.ChatGPTErrors)
+				resultCh <- gptResult{reply: invalidJSONText, model: answeredBy, err: errInvalidJSON}
+				return
+			}
+		}
+		reply := resp.Text
+		if !jsonMode {
+			// a cut could leave the JSON unparseable
+			reply = cutAtStop(reply, stops)
+		}
+		resultCh <- gptResult{reply: reply, reasoning: resp.ReasoningSummary, citations: resp.Citations, model: answeredBy, id: resp.ID}
 	}()
 
+	// the typing action expires after about five seconds, so keep renewing it
+	sendTyping := func() {
+		if _, err := b.SendChatAction(ctx, &tg.SendChatActionParams{ChatID: chatID, MessageThreadID: replyTopic, Action: models.ChatActionTyping}); err != nil {
+			log.Error().Err(err).Msg("failed to send typing action")
+		}
+	}
+	var typingC <-chan time.Time
+	if typingSetting == "on" {
+		sendTyping()
+		typingTicker := newTicker(4 * time.Second)
+		defer typingTicker.Stop()
+		typingC = typingTicker.C
+	}
+
 	ticker := newTicker(10 * time.Second)
 	start := time.Now()
 	var res gptResult
@@ -704,81 +3669,302 @@ func HandleUpdate(ctx context.Context, b Bot, upd *models.Update) {
 		case res = <-resultCh:
 			ticker.Stop()
 			goto done
+		case <-typingC:
+			sendTyping()
+		case <-progressC:
+			progressC = nil
+			postProgress()
+		case <-reqCtx.Done():
+			ticker.Stop()
+			if !errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+				return
+			}
+			// the prompt stays in history, but no reply is stored
+			metrics.Inc(metrics.ChatGPTErrors)
+			notice := timeoutText(timeout)
+			if progressMsg != nil {
+				b.EditMessageText(ctx, &tg.EditMessageTextParams{ChatID: chatID, MessageID: progressMsg.ID, Text: notice})
+			} else {
+				progressParams.Text = notice
+				if sent, err := b.SendMessage(ctx, progressParams); err == nil && sent != nil {
+					rememberReply(sent.ID)
+				}
+			}
+			log.Warn().Str("event", "chatgpt_timeout").Str("project", proj).Str("model", model).Dur("timeout", timeout).Msg("chatgpt request timed out")
+			return
 		case <-ticker.C:
 			elapsed := int(time.Since(start).Seconds())
-			_, err := b.EditMessageText(ctx, &tg.EditMessageTextParams{
-				ChatID:    chatID,
-				MessageID: progressMsg.ID,
-				Text:      fmt.Sprintf("Waiting %d seconds for ChatGPT answer...", elapsed),
-			})
-			if err != nil {
-				log.Error().Err(err).Msg("failed to edit progress message")
-			}
+			editProgress(fmt.Sprintf("Waiting %d seconds for ChatGPT answer...", elapsed))
 		}
 	}
 
 done:
+	if chainingSetting == "on" {
+		// a failed request may refer to an expired response, so the next one
+		// starts over from the local history
+		if res.err != nil && previousID != "" {
+			if err := storage.DeleteLastResponseID(proj); err != nil {
+				log.Error().Err(err).Str("project", proj).Msg("failed to reset response chain")
+			}
+		} else if res.err == nil && res.id != "" {
+			if err := storage.SaveLastResponseID(proj, res.id); err != nil {
+				log.Error().Err(err).Str("project", proj).Msg("failed to store response id")
+			}
+		}
+	}
 	if res.err != nil {
-		b.EditMessageText(ctx, &tg.EditMessageTextParams{
-			ChatID:    chatID,
-			MessageID: progressMsg.ID,
-			Text:      res.reply,
-		})
-		if limit > 0 {
-			storage.AddHistoryMessage(proj, storage.HistoryMessage{
-				Role:    string(responses.EasyInputMessageRoleAssistant),
-				WhoID:   0,
-				WhoName: "ChatGPT " + model,
-				When:    time.Now().Unix(),
-				Content: res.reply,
+		if progressMsg != nil {
+			b.EditMessageText(ctx, &tg.EditMessageTextParams{
+				ChatID:    chatID,
+				MessageID: progressMsg.ID,
+				Text:      res.reply,
 			})
-			storage.TrimProjectHistory(proj, limit)
+		} else {
+			progressParams.Text = res.reply
+			if sent, err := b.SendMessage(ctx, progressParams); err == nil && sent != nil {
+				rememberReply(sent.ID)
+			}
+		}
+		if limit > 0 && !duplicate {
+			if _, err := appendHistory(proj, limit, storage.HistoryMessage{
+				Role:      string(responses.EasyInputMessageRoleAssistant),
+				WhoID:     0,
+				WhoName:   assistantName(proj, model),
+				When:      time.Now().Unix(),
+				Content:   res.reply,
+				IsError:   true,
+				ChatID:    chatID,
+				MessageID: msg.ID,
+			}); err != nil {
+				log.Error().Err(err).Msg("failed to store reply in history")
+			}
 		}
+		entry := storage.AuditEntry{UserID: msg.From.ID, Model: model, Prompt: auditPrompt(text, transcribed, hasImage), Reply: res.reply, IsError: true}
+		recordAudit(ctx, proj, entry)
+		sendLogCopy(ctx, b, proj, msg.From, entry)
 		log.Error().Err(res.err).Msg("chatgpt request failed")
 		return
 	}
 
-	reply := res.reply
+	reply := redactReply(ctx, proj, res.reply)
+	entry := storage.AuditEntry{UserID: msg.From.ID, Model: res.model, Prompt: auditPrompt(text, transcribed, hasImage), Reply: reply}
+	recordAudit(ctx, proj, entry)
+	// the copy is posted once the user has the answer
+	defer sendLogCopy(ctx, b, proj, msg.From, entry)
+	if strings.TrimSpace(reply) == "" {
+		// e.g. only tool calls or a refusal; the progress message must not
+		// be left waiting, and there is nothing worth keeping in history
+		log.Warn().Str("event", "chatgpt_empty_response").Str("project", proj).Str("model", res.model).Msg("model returned an empty response")
+		if progressMsg != nil {
+			b.EditMessageText(ctx, &tg.EditMessageTextParams{ChatID: chatID, MessageID: progressMsg.ID, Text: emptyReplyText})
+		} else {
+			progressParams.Text = emptyReplyText
+			if sent, err := b.SendMessage(ctx, progressParams); err == nil && sent != nil {
+				rememberReply(sent.ID)
+			}
+		}
+		return
+	}
 	log.Info().Str("event", "chatgpt_response").Str("project", proj).Str("snippet", logging.Snippet(reply, 30)).Msg("received from ChatGPT")
+	if cacheKey != "" && cachedReply == "" {
+		if err := storage.SaveCachedAnswer(proj, cacheKey, reply); err != nil {
+			log.Error().Err(err).Msg("failed to cache image answer")
+		}
+	}
 
 	const maxMessageLen = 4000
-	chunks := splitMessage(reply, maxMessageLen)
+	shown := reply
+	// a JSON reply is sent as it is, so it still parses when copied
+	if citationsSetting == "on" && !jsonMode {
+		shown += sourcesFooter(res.citations)
+	}
+	if res.model != model && !jsonMode {
+		shown += fmt.Sprintf("\n\n(answered by %s because %s was unavailable)", res.model, model)
+	}
+	replyFooter := expandFooter(footer, proj, res.model)
+	if jsonMode {
+		replyFooter = ""
+	}
+	chunks := replyChunks(shown, replyFooter, maxMessageLen, chunkNumbersSetting == "on" && !jsonMode)
 	if len(chunks) == 0 {
 		return
 	}
-	firstMsg, err := b.EditMessageText(ctx, &tg.EditMessageTextParams{
-		ChatID:    chatID,
-		MessageID: progressMsg.ID,
-		Text:      chunks[0],
-	})
-	if err != nil {
+	if showReasoningSetting == "on" && res.reasoning != "" {
+		// the summary goes above the answer, so the progress message gives
+		// way and the answer is sent fresh below the summary
+		if progressMsg != nil {
+			if _, err := b.DeleteMessage(ctx, &tg.DeleteMessageParams{ChatID: chatID, MessageID: progressMsg.ID}); err != nil {
+				log.Warn().Err(err).Msg("failed to delete progress message")
+			}
+			progressMsg = nil
+		}
+		replyTo := 0
+		if progressParams.ReplyParameters != nil {
+			replyTo = progressParams.ReplyParameters.MessageID
+		}
+		sendReasoningSummary(ctx, b, chatID, replyTopic, replyTo, res.reasoning)
+	}
+	// the feedback buttons go under the last chunk of the reply
+	var markup models.ReplyMarkup
+	if len(chunks) == 1 {
+		markup = feedbackKeyboard(proj)
+	}
+	var firstMsg *models.Message
+	if progressMsg != nil {
+		firstMsg, err = b.EditMessageText(ctx, &tg.EditMessageTextParams{
+			ChatID:      chatID,
+			MessageID:   progressMsg.ID,
+			Text:        chunks[0],
+			ReplyMarkup: markup,
+		})
+	} else {
+		progressParams.Text = chunks[0]
+		progressParams.ReplyMarkup = markup
+		firstMsg, err = b.SendMessage(ctx, progressParams)
+		if err == nil && firstMsg != nil {
+			rememberReply(firstMsg.ID)
+		}
+	}
+	if err != nil || firstMsg == nil {
 		log.Error().Err(err).Msg("failed to send first chunk")
 		return
 	}
 	lastID := firstMsg.ID
-	for _, chunk := range chunks[1:] {
-		sentMsg, err := b.SendMessage(ctx, &tg.SendMessageParams{
+	var chunkIDs []int
+	for i, chunk := range chunks[1:] {
+		params := &tg.SendMessageParams{
 			ChatID:          chatID,
-			MessageThreadID: topicID,
+			MessageThreadID: replyTopic,
 			Text:            chunk,
 			ReplyParameters: &models.ReplyParameters{MessageID: lastID},
-		})
+		}
+		if i == len(chunks)-2 {
+			params.ReplyMarkup = feedbackKeyboard(proj)
+		}
+		sentMsg, err := b.SendMessage(ctx, params)
 		if err != nil {
 			log.Error().Err(err).Msg("failed to send chunk")
+			rememberReply(firstMsg.ID, chunkIDs...)
 			return
 		}
 		lastID = sentMsg.ID
+		chunkIDs = append(chunkIDs, sentMsg.ID)
 	}
-	if limit > 0 {
-		storage.AddHistoryMessage(proj, storage.HistoryMessage{
-			Role:    string(responses.EasyInputMessageRoleAssistant),
-			WhoID:   0,
-			WhoName: "ChatGPT " + model,
-			When:    time.Now().Unix(),
-			Content: reply,
-		})
-		storage.TrimProjectHistory(proj, limit)
+	if len(chunkIDs) > 0 {
+		rememberReply(firstMsg.ID, chunkIDs...)
+	}
+	if voiceReplySetting == "on" {
+		// the reply is spoken without the footer and sources added for
+		// display, cut to stay within the TTS input limit
+		audio, err := openAITTS(client, truncateGraphemes(reply, maxSpeechInput))
+		if err != nil {
+			log.Error().Err(err).Msg("speech synthesis failed")
+		} else if _, err := b.SendVoice(ctx, &tg.SendVoiceParams{
+			ChatID:          chatID,
+			MessageThreadID: replyTopic,
+			Voice:           &models.InputFileUpload{Filename: "reply.ogg", Data: bytes.NewReader(audio)},
+			ReplyParameters: &models.ReplyParameters{MessageID: firstMsg.ID},
+		}); err != nil {
+			log.Error().Err(err).Msg("failed to send voice reply")
+		}
+	}
+	if limit > 0 && !duplicate {
+		if _, err := appendHistory(proj, limit, storage.HistoryMessage{
+			Role:      string(responses.EasyInputMessageRoleAssistant),
+			WhoID:     0,
+			WhoName:   assistantName(proj, res.model),
+			When:      time.Now().Unix(),
+			Content:   reply,
+			ChatID:    chatID,
+			MessageID: msg.ID,
+		}); err != nil {
+			log.Error().Err(err).Msg("failed to store reply in history")
+		}
+	}
+}
+
+// webSearchLocation is the approximate user location sent with web searches.
+type webSearchLocation struct {
+	City     string
+	Country  string
+	Timezone string
+}
+
+// searchLocation is configured by the TBOT_SEARCH_* env vars. Empty fields
+// are not sent.
+var searchLocation webSearchLocation
+
+// loadSearchLocation reads TBOT_SEARCH_CITY, TBOT_SEARCH_COUNTRY and
+// TBOT_SEARCH_TIMEZONE. Invalid countries and timezones are ignored with a
+// warning.
+func loadSearchLocation() {
+	loc := webSearchLocation{City: strings.TrimSpace(os.Getenv("TBOT_SEARCH_CITY"))}
+	if v := strings.ToUpper(strings.TrimSpace(os.Getenv("TBOT_SEARCH_COUNTRY"))); v != "" {
+		if len(v) == 2 && strings.Trim(v, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == "" {
+			loc.Country = v
+		} else {
+			logging.Log.Warn().Str("value", v).Msg("invalid TBOT_SEARCH_COUNTRY")
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("TBOT_SEARCH_TIMEZONE")); v != "" {
+		if _, err := time.LoadLocation(v); err == nil && v != "Local" {
+			loc.Timezone = v
+		} else {
+			logging.Log.Warn().Str("value", v).Msg("invalid TBOT_SEARCH_TIMEZONE")
+		}
+	}
+	searchLocation = loc
+}
+
+// projectFallback returns the model retried when the model of proj is
+// unavailable: the project fallback, or TBOT_FALLBACK_MODEL.
+func projectFallback(proj string) string {
+	if fb, err := storage.LoadProjectFallback(proj); err == nil && fb != "" {
+		return fb
+	}
+	return fallbackModel
+}
+
+// webSearchTools returns the web search tool for a project web search
+// setting, or no tools when it is "off". A non-empty domains list limits the
+// search to those sites.
+func webSearchTools(setting string, domains []string) []responses.ToolUnionParam {
+	if setting == "off" {
+		return nil
+	}
+	size := responses.WebSearchToolSearchContextSizeHigh
+	switch setting {
+	case "medium":
+		size = responses.WebSearchToolSearchContextSizeMedium
+	case "low":
+		size = responses.WebSearchToolSearchContextSizeLow
+	case "high":
+		size = responses.WebSearchToolSearchContextSizeHigh
+	}
+	tool := &responses.WebSearchToolParam{
+		Type:              responses.WebSearchToolTypeWebSearchPreview,
+		SearchContextSize: size,
+	}
+	if searchLocation != (webSearchLocation{}) {
+		loc := responses.WebSearchToolUserLocationParam{Type: constant.ValueOf[constant.Approximate]()}
+		if searchLocation.City != "" {
+			loc.City = param.NewOpt(searchLocation.City)
+		}
+		if searchLocation.Country != "" {
+			loc.Country = param.NewOpt(searchLocation.Country)
+		}
+		if searchLocation.Timezone != "" {
+			loc.Timezone = param.NewOpt(searchLocation.Timezone)
+		}
+		tool.UserLocation = loc
+	}
+	if len(domains) > 0 {
+		// only the web_search tool accepts domain filters, and the SDK has no
+		// field for them yet
+		tool.Type = "web_search"
+		tool.SetExtraFields(map[string]any{"filters": map[string]any{"allowed_domains": domains}})
 	}
+	return []responses.ToolUnionParam{{OfWebSearchPreview: tool}}
 }
 
 func parseCommand(msg *models.Message) (cmd, args string, ok bool) {
@@ -795,6 +3981,55 @@ func parseCommand(msg *models.Message) (cmd, args string, ok bool) {
 	return "", "", false
 }
 
+// splitFields returns the first n whitespace separated fields of s and the
+// remaining text with its inner formatting preserved.
+func splitFields(s string, n int) ([]string, string) {
+	var fields []string
+	rest := strings.TrimSpace(s)
+	for len(fields) < n && rest != "" {
+		i := strings.IndexAny(rest, " \t\n")
+		if i < 0 {
+			fields = append(fields, rest)
+			rest = ""
+			break
+		}
+		fields = append(fields, rest[:i])
+		rest = strings.TrimSpace(rest[i:])
+	}
+	return fields, rest
+}
+
+// replyChunks splits a reply into messages of at most size characters. The
+// footer is kept whole at the end of the last chunk, or sent as a chunk of its
+// own when it does not fit. With numbered, every continuation chunk is
+// prefixed with "(continued N/M)", for which room is reserved in each chunk.
+func replyChunks(text, footer string, size int, numbered bool) []string {
+	chunks := appendFooter(splitMessage(text, size), footer, size)
+	if !numbered || len(chunks) < 2 {
+		return chunks
+	}
+	const prefixReserve = 32
+	chunks = appendFooter(splitMessage(text, size-prefixReserve), footer, size-prefixReserve)
+	for i := 1; i < len(chunks); i++ {
+		chunks[i] = fmt.Sprintf("(continued %d/%d)\n", i+1, len(chunks)) + chunks[i]
+	}
+	return chunks
+}
+
+// appendFooter adds footer to the last chunk when it fits within size and as
+// a separate chunk otherwise.
+func appendFooter(chunks []string, footer string, size int) []string {
+	if footer == "" || len(chunks) == 0 {
+		return chunks
+	}
+	last := len(chunks) - 1
+	if utf8.RuneCountInString(chunks[last])+utf8.RuneCountInString("\n\n"+footer) <= size {
+		chunks[last] += "\n\n" + footer
+		return chunks
+	}
+	return append(chunks, footer)
+}
+
 func splitMessage(text string, size int) []string {
 	runes := []rune(text)
 	if len(runes) == 0 {
@@ -829,6 +4064,37 @@ func chatName(name string) string {
 	return name
 }
 
+// historyInputRole maps a stored history role to the role used when replaying
+// it. Tool outputs have no call to attach to, so they are replayed as developer
+// messages. Unknown roles are reported as not ok.
+func historyInputRole(role string) (responses.EasyInputMessageRole, bool) {
+	switch role {
+	case storage.RoleUser:
+		return responses.EasyInputMessageRoleUser, true
+	case storage.RoleAssistant:
+		return responses.EasyInputMessageRoleAssistant, true
+	case storage.RoleSystem:
+		return responses.EasyInputMessageRoleSystem, true
+	case storage.RoleDeveloper, storage.RoleTool:
+		return responses.EasyInputMessageRoleDeveloper, true
+	default:
+		return "", false
+	}
+}
+
+// imageDetailToConst converts an image detail setting to the API value.
+// Unknown values fall back to auto.
+func imageDetailToConst(val string) responses.ResponseInputImageDetail {
+	switch val {
+	case "low":
+		return responses.ResponseInputImageDetailLow
+	case "high":
+		return responses.ResponseInputImageDetailHigh
+	default:
+		return responses.ResponseInputImageDetailAuto
+	}
+}
+
 func reasoningEffortToConst(val string) openai.ReasoningEffort {
 	switch val {
 	case "minimal":
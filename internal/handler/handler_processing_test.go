@@ -1,13 +1,25 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"net/http"
+	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,14 +37,27 @@ type testBot struct {
 	sent       []string
 	sentParams []tg.SendMessageParams
 	edits      []tg.EditMessageTextParams
+	actions    []tg.SendChatActionParams
+	voices     []tg.SendVoiceParams
+	pins       []tg.PinChatMessageParams
+	unpins     []tg.UnpinChatMessageParams
+	documents  []tg.SendDocumentParams
+	answers    []tg.AnswerCallbackQueryParams
+	inline     []tg.AnswerInlineQueryParams
+	deleted    []tg.DeleteMessageParams
+	pinErr     error
 	getFile    func(ctx context.Context, params *tg.GetFileParams) (*models.File, error)
 	fileLink   func(file *models.File) string
 	edit       func(ctx context.Context, params *tg.EditMessageTextParams) (*models.Message, error)
+	send       func(ctx context.Context, params *tg.SendMessageParams) (*models.Message, error)
 }
 
 func (b *testBot) SendMessage(ctx context.Context, params *tg.SendMessageParams) (*models.Message, error) {
 	b.sent = append(b.sent, params.Text)
 	b.sentParams = append(b.sentParams, *params)
+	if b.send != nil {
+		return b.send(ctx, params)
+	}
 	id := 1
 	if params.ReplyParameters != nil {
 		id = params.ReplyParameters.MessageID + 1
@@ -54,6 +79,52 @@ func (b *testBot) FileDownloadLink(file *models.File) string {
 	return "http://example.com/file"
 }
 
+func (b *testBot) SendChatAction(ctx context.Context, params *tg.SendChatActionParams) (bool, error) {
+	b.actions = append(b.actions, *params)
+	return true, nil
+}
+
+func (b *testBot) SendVoice(ctx context.Context, params *tg.SendVoiceParams) (*models.Message, error) {
+	b.voices = append(b.voices, *params)
+	return &models.Message{ID: 100}, nil
+}
+
+func (b *testBot) AnswerCallbackQuery(ctx context.Context, params *tg.AnswerCallbackQueryParams) (bool, error) {
+	b.answers = append(b.answers, *params)
+	return true, nil
+}
+
+func (b *testBot) AnswerInlineQuery(ctx context.Context, params *tg.AnswerInlineQueryParams) (bool, error) {
+	b.inline = append(b.inline, *params)
+	return true, nil
+}
+
+func (b *testBot) DeleteMessage(ctx context.Context, params *tg.DeleteMessageParams) (bool, error) {
+	b.deleted = append(b.deleted, *params)
+	return true, nil
+}
+
+func (b *testBot) SendDocument(ctx context.Context, params *tg.SendDocumentParams) (*models.Message, error) {
+	b.documents = append(b.documents, *params)
+	return &models.Message{ID: 101}, nil
+}
+
+func (b *testBot) PinChatMessage(ctx context.Context, params *tg.PinChatMessageParams) (bool, error) {
+	if b.pinErr != nil {
+		return false, b.pinErr
+	}
+	b.pins = append(b.pins, *params)
+	return true, nil
+}
+
+func (b *testBot) UnpinChatMessage(ctx context.Context, params *tg.UnpinChatMessageParams) (bool, error) {
+	if b.pinErr != nil {
+		return false, b.pinErr
+	}
+	b.unpins = append(b.unpins, *params)
+	return true, nil
+}
+
 func (b *testBot) EditMessageText(ctx context.Context, params *tg.EditMessageTextParams) (*models.Message, error) {
 	b.edits = append(b.edits, *params)
 	if b.edit != nil {
@@ -76,9 +147,9 @@ func TestHandleUpdate_EmptyMessageNoMedia(t *testing.T) {
 	b := &testBot{}
 	called := false
 	origResp := openAIResponses
-	openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
 		called = true
-		return "", nil
+		return responseResult{}, nil
 	}
 	defer func() { openAIResponses = origResp }()
 
@@ -98,9 +169,9 @@ func TestHandleUpdate_ProjectRetrievalFails(t *testing.T) {
 	b := &testBot{}
 	called := false
 	origResp := openAIResponses
-	openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
 		called = true
-		return "", nil
+		return responseResult{}, nil
 	}
 	defer func() { openAIResponses = origResp }()
 
@@ -128,10 +199,10 @@ func TestHandleUpdate_DefaultModel(t *testing.T) {
 	var model string
 	origNew := newOpenAIClient
 	origResp := openAIResponses
-	newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-	openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
 		model = string(params.Model)
-		return "ok", nil
+		return responseResult{Text: "ok"}, nil
 	}
 	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
 
@@ -159,10 +230,10 @@ func TestHandleUpdate_SystemInstruction(t *testing.T) {
 	var paramsCapture responses.ResponseNewParams
 	origNew := newOpenAIClient
 	origResp := openAIResponses
-	newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-	openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
 		paramsCapture = params
-		return "ok", nil
+		return responseResult{Text: "ok"}, nil
 	}
 	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
 
@@ -190,7 +261,7 @@ func TestHandleUpdate_SystemInstruction(t *testing.T) {
 	}
 }
 
-func TestHandleUpdate_AudioTranscription(t *testing.T) {
+func TestHandleUpdate_InstructionRole(t *testing.T) {
 	logging.Init()
 	initStore2(t)
 	chatGPTKey = "x"
@@ -200,94 +271,48 @@ func TestHandleUpdate_AudioTranscription(t *testing.T) {
 	if err := storage.MapTopic(1, 0, "demo"); err != nil {
 		t.Fatalf("map topic: %v", err)
 	}
-	if err := storage.SaveProjectTranscribe("demo", "on"); err != nil {
-		t.Fatalf("save transcribe: %v", err)
+	if err := storage.SaveProjectInstruction("demo", "sys"); err != nil {
+		t.Fatalf("save instruction: %v", err)
 	}
 
-	t.Run("success", func(t *testing.T) {
-		var transcribed bool
-		var paramsCapture responses.ResponseNewParams
-		origNew := newOpenAIClient
-		origResp := openAIResponses
-		origTrans := openAITranscribe
-		origHTTP := httpGetFunc
-		newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-		openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-			paramsCapture = params
-			return "ok", nil
-		}
-		openAITranscribe = func(client *openai.Client, r io.Reader) (string, error) {
-			transcribed = true
-			return "voice text", nil
-		}
-		httpGetFunc = func(url string) (*http.Response, error) {
-			return &http.Response{Body: io.NopCloser(strings.NewReader("audio"))}, nil
-		}
-		defer func() {
-			newOpenAIClient = origNew
-			openAIResponses = origResp
-			openAITranscribe = origTrans
-			httpGetFunc = origHTTP
-		}()
-
-		upd := &models.Update{Message: &models.Message{
-			Text:  "hello",
-			Voice: &models.Voice{FileID: "v1"},
-			Chat:  models.Chat{ID: 1},
-			From:  &models.User{ID: 1},
-		}}
-		HandleUpdate(context.Background(), &testBot{}, upd)
-		if !transcribed {
-			t.Fatal("transcription not called")
-		}
-		user := paramsCapture.Input.OfInputItemList[len(paramsCapture.Input.OfInputItemList)-1].OfMessage
-		cont := user.Content.OfInputItemContentList
-		if len(cont) < 2 {
-			t.Fatalf("expected transcription in content, got %v", cont)
-		}
-		if txt := cont[1].OfInputText.Text; !strings.Contains(txt, "voice text") {
-			t.Fatalf("transcription text missing: %q", txt)
-		}
-	})
+	var paramsCapture responses.ResponseNewParams
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		paramsCapture = params
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
 
-	t.Run("download error", func(t *testing.T) {
-		var transcribed bool
-		origNew := newOpenAIClient
-		origResp := openAIResponses
-		origTrans := openAITranscribe
-		origHTTP := httpGetFunc
-		newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-		openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-			return "ok", nil
-		}
-		openAITranscribe = func(client *openai.Client, r io.Reader) (string, error) {
-			transcribed = true
-			return "voice text", nil
-		}
-		httpGetFunc = func(url string) (*http.Response, error) {
-			return nil, io.EOF
+	for _, tc := range []struct {
+		setting string
+		want    responses.EasyInputMessageRole
+	}{
+		{"developer", responses.EasyInputMessageRoleDeveloper},
+		{"system", responses.EasyInputMessageRoleSystem},
+	} {
+		b := &testBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/setinstructionrole demo "+tc.setting))
+		if want := fmt.Sprintf("Instruction role for project 'demo' set to %s.", tc.setting); b.sent[len(b.sent)-1] != want {
+			t.Fatalf("set reply = %q, want %q", b.sent[len(b.sent)-1], want)
 		}
-		defer func() {
-			newOpenAIClient = origNew
-			openAIResponses = origResp
-			openAITranscribe = origTrans
-			httpGetFunc = origHTTP
-		}()
-
-		upd := &models.Update{Message: &models.Message{
-			Text:  "hello",
-			Voice: &models.Voice{FileID: "v1"},
-			Chat:  models.Chat{ID: 1},
-			From:  &models.User{ID: 1},
-		}}
+		upd := &models.Update{Message: &models.Message{Text: "hello", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
 		HandleUpdate(context.Background(), &testBot{}, upd)
-		if transcribed {
-			t.Fatal("transcription should not be called on download error")
+		first := paramsCapture.Input.OfInputItemList[0].OfMessage
+		if first == nil || first.Role != tc.want || first.Content.OfString.Value != "sys" {
+			t.Fatalf("%s: first input = %+v", tc.setting, first)
 		}
-	})
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setinstructionrole demo user"))
+	if got := b.sent[len(b.sent)-1]; got != "Please enter one of: system, developer." {
+		t.Fatalf("invalid reply = %q", got)
+	}
 }
 
-func TestHandleUpdate_PhotoAttachment(t *testing.T) {
+func TestHandleUpdate_InjectTime(t *testing.T) {
 	logging.Init()
 	initStore2(t)
 	chatGPTKey = "x"
@@ -298,70 +323,66 @@ func TestHandleUpdate_PhotoAttachment(t *testing.T) {
 		t.Fatalf("map topic: %v", err)
 	}
 
-	t.Run("success", func(t *testing.T) {
-		var paramsCapture responses.ResponseNewParams
-		origNew := newOpenAIClient
-		origResp := openAIResponses
-		newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-		openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-			paramsCapture = params
-			return "ok", nil
-		}
-		defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+	var paramsCapture responses.ResponseNewParams
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		paramsCapture = params
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
 
-		b := &testBot{}
-		upd := &models.Update{Message: &models.Message{
-			Photo: []models.PhotoSize{{FileID: "p1"}},
-			Chat:  models.Chat{ID: 1},
-			From:  &models.User{ID: 1},
-		}}
-		HandleUpdate(context.Background(), b, upd)
-		user := paramsCapture.Input.OfInputItemList[len(paramsCapture.Input.OfInputItemList)-1].OfMessage
-		cont := user.Content.OfInputItemContentList
-		hasImg := false
-		for _, c := range cont {
-			if c.OfInputImage != nil {
-				hasImg = true
+	timeInput := func() *responses.EasyInputMessageParam {
+		upd := &models.Update{Message: &models.Message{Text: "what day is it?", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+		HandleUpdate(context.Background(), &testBot{}, upd)
+		for _, in := range paramsCapture.Input.OfInputItemList {
+			if m := in.OfMessage; m != nil && strings.HasPrefix(m.Content.OfString.Value, "Current date/time: ") {
+				return m
 			}
 		}
-		if !hasImg {
-			t.Fatal("expected image content")
-		}
-	})
+		return nil
+	}
 
-	t.Run("getfile error", func(t *testing.T) {
-		var paramsCapture responses.ResponseNewParams
-		origNew := newOpenAIClient
-		origResp := openAIResponses
-		newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-		openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-			paramsCapture = params
-			return "ok", nil
-		}
-		defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+	if m := timeInput(); m != nil {
+		t.Fatalf("time injected while off: %+v", m)
+	}
 
-		b := &testBot{
-			getFile: func(ctx context.Context, params *tg.GetFileParams) (*models.File, error) {
-				return nil, io.EOF
-			},
-		}
-		upd := &models.Update{Message: &models.Message{
-			Photo: []models.PhotoSize{{FileID: "p1"}},
-			Chat:  models.Chat{ID: 1},
-			From:  &models.User{ID: 1},
-		}}
-		HandleUpdate(context.Background(), b, upd)
-		user := paramsCapture.Input.OfInputItemList[len(paramsCapture.Input.OfInputItemList)-1].OfMessage
-		cont := user.Content.OfInputItemContentList
-		for _, c := range cont {
-			if c.OfInputImage != nil {
-				t.Fatal("image should not be included on error")
-			}
-		}
-	})
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setinjecttime demo on"))
+	if got := b.sent[len(b.sent)-1]; got != "Current time injection for project 'demo' set to on." {
+		t.Fatalf("set reply = %q", got)
+	}
+	m := timeInput()
+	if m == nil {
+		t.Fatal("time not injected while on")
+	}
+	if m.Role != responses.EasyInputMessageRoleSystem {
+		t.Fatalf("time message role = %s, want system", m.Role)
+	}
+	stamp := strings.TrimPrefix(m.Content.OfString.Value, "Current date/time: ")
+	if _, err := time.Parse(currentTimeLayout, stamp); err != nil {
+		t.Fatalf("time message %q: %v", stamp, err)
+	}
+
+	HandleUpdate(context.Background(), b, cmdUpdate("/setinjecttime demo off"))
+	if m := timeInput(); m != nil {
+		t.Fatalf("time injected after turning off: %+v", m)
+	}
 }
 
-func TestHandleUpdate_HistoryRecording(t *testing.T) {
+// fakeTranscriber records the audio it was asked to transcribe.
+type fakeTranscriber struct {
+	audio string
+}
+
+func (f *fakeTranscriber) Transcribe(ctx context.Context, proj string, audio io.Reader) (string, error) {
+	data, err := io.ReadAll(audio)
+	f.audio = string(data)
+	return "fake transcript", err
+}
+
+func TestTranscribeProvider(t *testing.T) {
 	logging.Init()
 	initStore2(t)
 	chatGPTKey = "x"
@@ -371,52 +392,70 @@ func TestHandleUpdate_HistoryRecording(t *testing.T) {
 	if err := storage.MapTopic(1, 0, "demo"); err != nil {
 		t.Fatalf("map topic: %v", err)
 	}
-	if err := storage.SaveHistoryLimit("demo", 10); err != nil {
-		t.Fatalf("save history limit: %v", err)
-	}
 	if err := storage.SaveProjectTranscribe("demo", "on"); err != nil {
 		t.Fatalf("save transcribe: %v", err)
 	}
 
+	fake := &fakeTranscriber{}
+	var paramsCapture responses.ResponseNewParams
 	origNew := newOpenAIClient
 	origResp := openAIResponses
 	origTrans := openAITranscribe
 	origHTTP := httpGetFunc
-	newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-	openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-		return "reply", nil
+	origTranscriber := transcriber
+	transcribers["fake"] = func() Transcriber { return fake }
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		paramsCapture = params
+		return responseResult{Text: "ok"}, nil
 	}
 	openAITranscribe = func(client *openai.Client, r io.Reader) (string, error) {
-		return "voice text", nil
+		t.Fatal("OpenAI transcription called instead of the configured provider")
+		return "", nil
 	}
 	httpGetFunc = func(url string) (*http.Response, error) {
-		return &http.Response{Body: io.NopCloser(strings.NewReader("audio"))}, nil
+		return &http.Response{Body: io.NopCloser(strings.NewReader("audio bytes"))}, nil
 	}
 	defer func() {
+		delete(transcribers, "fake")
 		newOpenAIClient = origNew
 		openAIResponses = origResp
 		openAITranscribe = origTrans
 		httpGetFunc = origHTTP
+		transcriber = origTranscriber
 	}()
 
+	t.Setenv("TBOT_TRANSCRIBE_PROVIDER", "Fake")
+	loadTranscriber()
+	if transcriber != fake {
+		t.Fatalf("transcriber = %T, want fake", transcriber)
+	}
+
 	upd := &models.Update{Message: &models.Message{
-		Text:  "hi",
-		Voice: &models.Voice{FileID: "v"},
-		Photo: []models.PhotoSize{{FileID: "p"}},
+		Voice: &models.Voice{FileID: "v1"},
 		Chat:  models.Chat{ID: 1},
 		From:  &models.User{ID: 1},
 	}}
 	HandleUpdate(context.Background(), &testBot{}, upd)
-	hist, err := storage.LoadProjectHistory("demo")
-	if err != nil {
-		t.Fatalf("load history: %v", err)
+	if fake.audio != "audio bytes" {
+		t.Fatalf("fake got audio %q", fake.audio)
 	}
-	if len(hist) != 4 {
-		t.Fatalf("expected 4 history messages, got %d", len(hist))
+	user := paramsCapture.Input.OfInputItemList[len(paramsCapture.Input.OfInputItemList)-1].OfMessage
+	cont := user.Content.OfInputItemContentList
+	if len(cont) == 0 || !strings.Contains(cont[len(cont)-1].OfInputText.Text, "fake transcript") {
+		t.Fatalf("transcript missing from input: %v", cont)
+	}
+
+	// unknown providers keep the previous transcriber
+	t.Setenv("TBOT_TRANSCRIBE_PROVIDER", "nope")
+	transcriber = openAITranscriber{}
+	loadTranscriber()
+	if _, ok := transcriber.(openAITranscriber); !ok {
+		t.Fatalf("transcriber = %T after unknown provider, want OpenAI", transcriber)
 	}
 }
 
-func TestHandleUpdate_HistoryTrim(t *testing.T) {
+func TestAudioSizeGuard(t *testing.T) {
 	logging.Init()
 	initStore2(t)
 	chatGPTKey = "x"
@@ -426,38 +465,90 @@ func TestHandleUpdate_HistoryTrim(t *testing.T) {
 	if err := storage.MapTopic(1, 0, "demo"); err != nil {
 		t.Fatalf("map topic: %v", err)
 	}
-	if err := storage.SaveHistoryLimit("demo", 3); err != nil {
-		t.Fatalf("save history limit: %v", err)
+	if err := storage.SaveProjectTranscribe("demo", "on"); err != nil {
+		t.Fatalf("save transcribe: %v", err)
 	}
 
+	calls := 0
 	origNew := newOpenAIClient
 	origResp := openAIResponses
-	newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-	count := 0
-	openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-		count++
-		return "r" + strconv.Itoa(count), nil
+	origHTTP := httpGetFunc
+	origTranscriber := transcriber
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		calls++
+		return responseResult{Text: "ok"}, nil
 	}
-	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+	httpGetFunc = func(url string) (*http.Response, error) {
+		return &http.Response{ContentLength: maxTranscribeBytes + 1, Body: io.NopCloser(strings.NewReader("huge"))}, nil
+	}
+	fake := &fakeTranscriber{}
+	transcriber = fake
+	origSplit := splitAudio
+	splitAudio = nil
+	defer func() {
+		newOpenAIClient = origNew
+		openAIResponses = origResp
+		httpGetFunc = origHTTP
+		transcriber = origTranscriber
+		splitAudio = origSplit
+	}()
 
-	b := &testBot{}
-	upd1 := &models.Update{Message: &models.Message{Text: "first", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
-	HandleUpdate(context.Background(), b, upd1)
-	upd2 := &models.Update{Message: &models.Message{Text: "second", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
-	HandleUpdate(context.Background(), b, upd2)
-	hist, err := storage.LoadProjectHistory("demo")
-	if err != nil {
-		t.Fatalf("load history: %v", err)
+	// the size Telegram reports is checked before the file is requested
+	gotFile := false
+	b := &testBot{getFile: func(ctx context.Context, params *tg.GetFileParams) (*models.File, error) {
+		gotFile = true
+		return &models.File{FilePath: "file"}, nil
+	}}
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{
+		Voice: &models.Voice{FileID: "v1", FileSize: maxDownloadBytes + 1},
+		Chat:  models.Chat{ID: 1},
+		From:  &models.User{ID: 1},
+	}})
+	if len(b.sent) != 1 || b.sent[0] != "This audio is too large to transcribe (limit 20 MB)." {
+		t.Fatalf("sent = %q", b.sent)
 	}
-	if len(hist) != 3 {
-		t.Fatalf("expected 3 messages after trim, got %d", len(hist))
+	if gotFile || fake.audio != "" || calls != 0 {
+		t.Fatalf("oversized voice note was processed: file requested %v, transcribed %q, %d requests", gotFile, fake.audio, calls)
 	}
-	if hist[0].Content == "first" {
-		t.Fatalf("oldest message was not trimmed: %v", hist)
+
+	// a download over the transcription limit is rejected when it cannot be split
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{
+		Voice: &models.Voice{FileID: "v2"},
+		Chat:  models.Chat{ID: 1},
+		From:  &models.User{ID: 1},
+	}})
+	if len(b.sent) != 1 || b.sent[0] != "This audio is too large to transcribe (limit 25 MB)." {
+		t.Fatalf("sent = %q", b.sent)
+	}
+	if fake.audio != "" || calls != 0 {
+		t.Fatalf("oversized download was processed: transcribed %q, %d requests", fake.audio, calls)
+	}
+
+	// a caption is still answered without the transcript
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{
+		Caption: "what is this?",
+		Audio:   &models.Audio{FileID: "a1"},
+		Chat:    models.Chat{ID: 1},
+		From:    &models.User{ID: 1},
+	}})
+	if calls != 1 {
+		t.Fatalf("captioned audio requests = %d, want 1", calls)
+	}
+
+	// a local Bot API server hands out larger files
+	origLimit := maxDownloadBytes
+	defer func() { maxDownloadBytes = origLimit }()
+	t.Setenv("TBOT_TELEGRAM_API_URL", "http://localhost:8081")
+	loadTelegramAPI()
+	if maxDownloadBytes != localBotAPIDownloadBytes {
+		t.Fatalf("download limit with a local server = %d", maxDownloadBytes)
 	}
 }
 
-func TestChatGPTRequest_ProgressTickerSuccess(t *testing.T) {
+func TestAudioDocumentAndAudioOnly(t *testing.T) {
 	logging.Init()
 	initStore2(t)
 	chatGPTKey = "x"
@@ -468,42 +559,4523 @@ func TestChatGPTRequest_ProgressTickerSuccess(t *testing.T) {
 		t.Fatalf("map topic: %v", err)
 	}
 
-	origNew := newOpenAIClient
-	origResp := openAIResponses
-	origTicker := newTicker
-	newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-	openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-		time.Sleep(5 * time.Millisecond)
-		return "final reply", nil
+	var captured []responses.ResponseNewParams
+	origNew, origResp, origHTTP, origTranscriber := newOpenAIClient, openAIResponses, httpGetFunc, transcriber
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = append(captured, params)
+		return responseResult{Text: "ok"}, nil
 	}
-	newTicker = func(d time.Duration) *time.Ticker { return time.NewTicker(1 * time.Millisecond) }
-	defer func() { newOpenAIClient = origNew; openAIResponses = origResp; newTicker = origTicker }()
-
-	upd := &models.Update{Message: &models.Message{ID: 10, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
-	b := &testBot{}
-	HandleUpdate(context.Background(), b, upd)
-
-	if len(b.sent) == 0 || b.sent[0] != "Sending to ChatGPT..." {
-		t.Fatalf("progress message not sent: %v", b.sent)
+	httpGetFunc = func(url string) (*http.Response, error) {
+		return &http.Response{ContentLength: 5, Body: io.NopCloser(strings.NewReader("audio"))}, nil
+	}
+	fake := &fakeTranscriber{}
+	transcriber = fake
+	defer func() {
+		newOpenAIClient, openAIResponses, httpGetFunc, transcriber = origNew, origResp, origHTTP, origTranscriber
+	}()
+	var fileIDs []string
+	newBot := func() *testBot {
+		return &testBot{getFile: func(ctx context.Context, params *tg.GetFileParams) (*models.File, error) {
+			fileIDs = append(fileIDs, params.FileID)
+			return &models.File{FilePath: "file"}, nil
+		}}
+	}
+	audioDoc := &models.Update{Message: &models.Message{
+		Document: &models.Document{FileID: "d1", MimeType: "audio/mpeg", FileName: "memo.mp3"},
+		Chat:     models.Chat{ID: 1},
+		From:     &models.User{ID: 1},
+	}}
+
+	// audio-only messages are not sent to the model without a transcript
+	b := newBot()
+	HandleUpdate(context.Background(), b, audioDoc)
+	if len(captured) != 0 || len(b.sent) != 1 || b.sent[0] != "Audio transcription is off for project 'demo'. Turn it on with /settranscribe." {
+		t.Fatalf("transcription off: %d requests, sent %q", len(captured), b.sent)
+	}
+
+	if err := storage.SaveProjectTranscribe("demo", "on"); err != nil {
+		t.Fatalf("save transcribe: %v", err)
+	}
+	HandleUpdate(context.Background(), newBot(), audioDoc)
+	if !reflect.DeepEqual(fileIDs, []string{"d1"}) || fake.audio != "audio" {
+		t.Fatalf("audio document: files %q, transcribed %q", fileIDs, fake.audio)
+	}
+	if len(captured) != 1 {
+		t.Fatalf("audio document sent %d requests, want 1", len(captured))
+	}
+	inputs := captured[0].Input.OfInputItemList
+	parts := inputs[len(inputs)-1].OfMessage.Content.OfInputItemContentList
+	if len(parts) != 1 || parts[0].OfInputText.Text != "(Audio transcription)\nfake transcript" {
+		t.Fatalf("audio document parts = %+v", parts)
+	}
+
+	// other documents are still ignored
+	b = newBot()
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{
+		Document: &models.Document{FileID: "d2", MimeType: "application/pdf"},
+		Chat:     models.Chat{ID: 1},
+		From:     &models.User{ID: 1},
+	}})
+	if len(captured) != 1 || len(b.sent) != 0 {
+		t.Fatalf("pdf document: %d requests, sent %q", len(captured), b.sent)
+	}
+
+	// a failed transcription of an audio-only message is reported
+	httpGetFunc = func(url string) (*http.Response, error) { return nil, errors.New("network down") }
+	b = newBot()
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{
+		Voice: &models.Voice{FileID: "v1"},
+		Chat:  models.Chat{ID: 1},
+		From:  &models.User{ID: 1},
+	}})
+	if len(captured) != 1 || len(b.sent) != 1 || b.sent[0] != "Could not transcribe the audio." {
+		t.Fatalf("failed transcription: %d requests, sent %q", len(captured), b.sent)
+	}
+}
+
+// chunkTranscriber returns the audio it was given as the transcript.
+type chunkTranscriber struct{}
+
+func (chunkTranscriber) Transcribe(ctx context.Context, proj string, audio io.Reader) (string, error) {
+	data, err := io.ReadAll(audio)
+	return string(data), err
+}
+
+func TestTranscribeAudioChunks(t *testing.T) {
+	origTranscriber := transcriber
+	origSplit := splitAudio
+	defer func() { transcriber = origTranscriber; splitAudio = origSplit }()
+	transcriber = chunkTranscriber{}
+
+	big := bytes.Repeat([]byte{0}, maxTranscribeBytes+1)
+	var splitLen int
+	splitAudio = func(ctx context.Context, audio []byte) ([][]byte, error) {
+		splitLen = len(audio)
+		return [][]byte{[]byte(" first part "), []byte(""), []byte("second part"), []byte("third.\n")}, nil
+	}
+
+	// size unknown until the download is read
+	got, err := transcribeAudio(context.Background(), "demo", bytes.NewReader(big), -1)
+	if err != nil {
+		t.Fatalf("transcribeAudio: %v", err)
+	}
+	if splitLen != len(big) {
+		t.Fatalf("split got %d bytes, want %d", splitLen, len(big))
+	}
+	if want := "first part second part third."; got != want {
+		t.Fatalf("transcript = %q, want %q", got, want)
+	}
+
+	// small audio is passed through unsplit
+	splitLen = 0
+	if got, err := transcribeAudio(context.Background(), "demo", strings.NewReader("short"), 5); err != nil || got != "short" || splitLen != 0 {
+		t.Fatalf("small audio = %q, %v (split %d bytes)", got, err, splitLen)
+	}
+
+	splitAudio = func(ctx context.Context, audio []byte) ([][]byte, error) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if _, err := transcribeAudio(context.Background(), "demo", bytes.NewReader(big), -1); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("split error = %v", err)
+	}
+
+	splitAudio = nil
+	if _, err := transcribeAudio(context.Background(), "demo", bytes.NewReader(big), -1); !errors.Is(err, errAudioTooLarge) {
+		t.Fatalf("unsplittable audio error = %v, want errAudioTooLarge", err)
+	}
+}
+
+func TestHandleUpdate_MirrorLanguage(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveProjectInstruction("demo", "Be brief."); err != nil {
+		t.Fatalf("save instruction: %v", err)
+	}
+
+	var paramsCapture responses.ResponseNewParams
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		paramsCapture = params
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	systemTexts := func() []string {
+		upd := &models.Update{Message: &models.Message{Text: "Hei, mitä kuuluu?", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+		HandleUpdate(context.Background(), &testBot{}, upd)
+		var texts []string
+		for _, in := range paramsCapture.Input.OfInputItemList {
+			if m := in.OfMessage; m != nil && m.Role == responses.EasyInputMessageRoleSystem {
+				texts = append(texts, m.Content.OfString.Value)
+			}
+		}
+		return texts
+	}
+
+	if got := systemTexts(); !reflect.DeepEqual(got, []string{"Be brief."}) {
+		t.Fatalf("system inputs while off = %q", got)
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setmirrorlanguage demo on"))
+	if got := b.sent[len(b.sent)-1]; got != "Reply language mirroring for project 'demo' set to on." {
+		t.Fatalf("set reply = %q", got)
+	}
+	// the stored instruction is kept and the mirror instruction follows it
+	want := []string{"Be brief.", mirrorLanguageInstruction}
+	if got := systemTexts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("system inputs while on = %q, want %q", got, want)
+	}
+}
+
+func TestHandleUpdate_AudioTranscription(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveProjectTranscribe("demo", "on"); err != nil {
+		t.Fatalf("save transcribe: %v", err)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		var transcribed bool
+		var paramsCapture responses.ResponseNewParams
+		origNew := newOpenAIClient
+		origResp := openAIResponses
+		origTrans := openAITranscribe
+		origHTTP := httpGetFunc
+		newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+		openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+			paramsCapture = params
+			return responseResult{Text: "ok"}, nil
+		}
+		openAITranscribe = func(client *openai.Client, r io.Reader) (string, error) {
+			transcribed = true
+			return "voice text", nil
+		}
+		httpGetFunc = func(url string) (*http.Response, error) {
+			return &http.Response{Body: io.NopCloser(strings.NewReader("audio"))}, nil
+		}
+		defer func() {
+			newOpenAIClient = origNew
+			openAIResponses = origResp
+			openAITranscribe = origTrans
+			httpGetFunc = origHTTP
+		}()
+
+		upd := &models.Update{Message: &models.Message{
+			Text:  "hello",
+			Voice: &models.Voice{FileID: "v1"},
+			Chat:  models.Chat{ID: 1},
+			From:  &models.User{ID: 1},
+		}}
+		HandleUpdate(context.Background(), &testBot{}, upd)
+		if !transcribed {
+			t.Fatal("transcription not called")
+		}
+		user := paramsCapture.Input.OfInputItemList[len(paramsCapture.Input.OfInputItemList)-1].OfMessage
+		cont := user.Content.OfInputItemContentList
+		if len(cont) < 2 {
+			t.Fatalf("expected transcription in content, got %v", cont)
+		}
+		if txt := cont[1].OfInputText.Text; !strings.Contains(txt, "voice text") {
+			t.Fatalf("transcription text missing: %q", txt)
+		}
+	})
+
+	t.Run("download error", func(t *testing.T) {
+		var transcribed bool
+		origNew := newOpenAIClient
+		origResp := openAIResponses
+		origTrans := openAITranscribe
+		origHTTP := httpGetFunc
+		newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+		openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+			return responseResult{Text: "ok"}, nil
+		}
+		openAITranscribe = func(client *openai.Client, r io.Reader) (string, error) {
+			transcribed = true
+			return "voice text", nil
+		}
+		httpGetFunc = func(url string) (*http.Response, error) {
+			return nil, io.EOF
+		}
+		defer func() {
+			newOpenAIClient = origNew
+			openAIResponses = origResp
+			openAITranscribe = origTrans
+			httpGetFunc = origHTTP
+		}()
+
+		upd := &models.Update{Message: &models.Message{
+			Text:  "hello",
+			Voice: &models.Voice{FileID: "v1"},
+			Chat:  models.Chat{ID: 1},
+			From:  &models.User{ID: 1},
+		}}
+		HandleUpdate(context.Background(), &testBot{}, upd)
+		if transcribed {
+			t.Fatal("transcription should not be called on download error")
+		}
+	})
+}
+
+func TestHandleUpdate_PhotoAttachment(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		var paramsCapture responses.ResponseNewParams
+		origNew := newOpenAIClient
+		origResp := openAIResponses
+		newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+		openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+			paramsCapture = params
+			return responseResult{Text: "ok"}, nil
+		}
+		defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+		b := &testBot{}
+		upd := &models.Update{Message: &models.Message{
+			Photo: []models.PhotoSize{{FileID: "p1"}},
+			Chat:  models.Chat{ID: 1},
+			From:  &models.User{ID: 1},
+		}}
+		HandleUpdate(context.Background(), b, upd)
+		user := paramsCapture.Input.OfInputItemList[len(paramsCapture.Input.OfInputItemList)-1].OfMessage
+		cont := user.Content.OfInputItemContentList
+		hasImg := false
+		for _, c := range cont {
+			if c.OfInputImage != nil {
+				hasImg = true
+			}
+		}
+		if !hasImg {
+			t.Fatal("expected image content")
+		}
+	})
+
+	t.Run("getfile error", func(t *testing.T) {
+		var paramsCapture responses.ResponseNewParams
+		origNew := newOpenAIClient
+		origResp := openAIResponses
+		newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+		openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+			paramsCapture = params
+			return responseResult{Text: "ok"}, nil
+		}
+		defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+		b := &testBot{
+			getFile: func(ctx context.Context, params *tg.GetFileParams) (*models.File, error) {
+				return nil, io.EOF
+			},
+		}
+		upd := &models.Update{Message: &models.Message{
+			Photo: []models.PhotoSize{{FileID: "p1"}},
+			Chat:  models.Chat{ID: 1},
+			From:  &models.User{ID: 1},
+		}}
+		HandleUpdate(context.Background(), b, upd)
+		user := paramsCapture.Input.OfInputItemList[len(paramsCapture.Input.OfInputItemList)-1].OfMessage
+		cont := user.Content.OfInputItemContentList
+		for _, c := range cont {
+			if c.OfInputImage != nil {
+				t.Fatal("image should not be included on error")
+			}
+		}
+	})
+}
+
+func TestHandleUpdate_ImageDetail(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	var img *responses.ResponseInputImageParam
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		img = nil
+		user := params.Input.OfInputItemList[len(params.Input.OfInputItemList)-1].OfMessage
+		for _, c := range user.Content.OfInputItemContentList {
+			if c.OfInputImage != nil {
+				img = c.OfInputImage
+			}
+		}
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	photo := &models.Update{Message: &models.Message{
+		Photo: []models.PhotoSize{{FileID: "p1"}},
+		Chat:  models.Chat{ID: 1},
+		From:  &models.User{ID: 1},
+	}}
+	HandleUpdate(context.Background(), &testBot{}, photo)
+	if img == nil || img.Detail != responses.ResponseInputImageDetailAuto {
+		t.Fatalf("default detail = %+v, want auto", img)
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setimagedetail demo"))
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{Text: "High", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	if got := b.sent[len(b.sent)-1]; got != "Image detail for project 'demo' set to high." {
+		t.Fatalf("set reply = %q", got)
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/imagedetail demo"))
+	if got := b.sent[len(b.sent)-1]; got != "Image detail for project 'demo' is high." {
+		t.Fatalf("show reply = %q", got)
+	}
+
+	HandleUpdate(context.Background(), &testBot{}, photo)
+	if img == nil || img.Detail != responses.ResponseInputImageDetailHigh {
+		t.Fatalf("configured detail = %+v, want high", img)
+	}
+}
+
+func TestHandleUpdate_HistoryRecording(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 10); err != nil {
+		t.Fatalf("save history limit: %v", err)
+	}
+	if err := storage.SaveProjectTranscribe("demo", "on"); err != nil {
+		t.Fatalf("save transcribe: %v", err)
+	}
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	origTrans := openAITranscribe
+	origHTTP := httpGetFunc
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: "reply"}, nil
+	}
+	openAITranscribe = func(client *openai.Client, r io.Reader) (string, error) {
+		return "voice text", nil
+	}
+	httpGetFunc = func(url string) (*http.Response, error) {
+		return &http.Response{Body: io.NopCloser(strings.NewReader("audio"))}, nil
+	}
+	defer func() {
+		newOpenAIClient = origNew
+		openAIResponses = origResp
+		openAITranscribe = origTrans
+		httpGetFunc = origHTTP
+	}()
+
+	upd := &models.Update{Message: &models.Message{
+		Text:  "hi",
+		Voice: &models.Voice{FileID: "v"},
+		Photo: []models.PhotoSize{{FileID: "p"}},
+		Chat:  models.Chat{ID: 1},
+		From:  &models.User{ID: 1},
+	}}
+	HandleUpdate(context.Background(), &testBot{}, upd)
+	hist, err := storage.LoadProjectHistory("demo")
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	if len(hist) != 4 {
+		t.Fatalf("expected 4 history messages, got %d", len(hist))
+	}
+}
+
+func TestAssistantName(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 10); err != nil {
+		t.Fatalf("save history limit: %v", err)
+	}
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: "reply"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	lastName := func() string {
+		upd := &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+		HandleUpdate(context.Background(), &testBot{}, upd)
+		hist, err := storage.LoadProjectHistory("demo")
+		if err != nil {
+			t.Fatalf("load history: %v", err)
+		}
+		last := hist[len(hist)-1]
+		if last.Role != storage.RoleAssistant {
+			t.Fatalf("last history entry role = %s", last.Role)
+		}
+		return last.WhoName
+	}
+
+	if got := lastName(); got != "ChatGPT "+defaultModel {
+		t.Fatalf("default name = %q", got)
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setname demo Research Buddy"))
+	if got := b.sent[len(b.sent)-1]; got != "Project 'demo' stores replies as 'Research Buddy'." {
+		t.Fatalf("set reply = %q", got)
+	}
+	if got := lastName(); got != "Research Buddy" {
+		t.Fatalf("stored name = %q, want the configured one", got)
+	}
+
+	HandleUpdate(context.Background(), b, cmdUpdate("/setname demo "+strings.Repeat("x", maxAssistantName+1)))
+	if got := b.sent[len(b.sent)-1]; !strings.HasPrefix(got, "Please enter a single-line name") {
+		t.Fatalf("long name reply = %q", got)
+	}
+
+	HandleUpdate(context.Background(), b, cmdUpdate("/setname demo off"))
+	if got := lastName(); got != "ChatGPT "+defaultModel {
+		t.Fatalf("name after off = %q", got)
+	}
+}
+
+func TestHandleUpdate_HistoryTrim(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 3); err != nil {
+		t.Fatalf("save history limit: %v", err)
+	}
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	count := 0
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		count++
+		return responseResult{Text: "r" + strconv.Itoa(count)}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	b := &testBot{}
+	upd1 := &models.Update{Message: &models.Message{Text: "first", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), b, upd1)
+	upd2 := &models.Update{Message: &models.Message{Text: "second", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), b, upd2)
+	hist, err := storage.LoadProjectHistory("demo")
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	if len(hist) != 3 {
+		t.Fatalf("expected 3 messages after trim, got %d", len(hist))
+	}
+	if hist[0].Content == "first" {
+		t.Fatalf("oldest message was not trimmed: %v", hist)
+	}
+}
+
+func TestChatGPTRequest_ProgressTickerSuccess(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	origTicker := newTicker
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		time.Sleep(5 * time.Millisecond)
+		return responseResult{Text: "final reply"}, nil
+	}
+	newTicker = func(d time.Duration) *time.Ticker { return time.NewTicker(1 * time.Millisecond) }
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp; newTicker = origTicker }()
+
+	upd := &models.Update{Message: &models.Message{ID: 10, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+
+	if len(b.sent) == 0 || b.sent[0] != "Sending to ChatGPT..." {
+		t.Fatalf("progress message not sent: %v", b.sent)
 	}
 	if len(b.edits) < 2 {
 		t.Fatalf("expected at least 2 edits, got %d", len(b.edits))
 	}
-	if !strings.HasPrefix(b.edits[0].Text, "Waiting") {
-		t.Fatalf("first edit = %q, want waiting message", b.edits[0].Text)
+	if !strings.HasPrefix(b.edits[0].Text, "Waiting") {
+		t.Fatalf("first edit = %q, want waiting message", b.edits[0].Text)
+	}
+	if got := b.edits[len(b.edits)-1].Text; got != "final reply" {
+		t.Fatalf("final edit = %q, want %q", got, "final reply")
+	}
+	wantID := upd.Message.ID + 1
+	for i, e := range b.edits {
+		if e.MessageID != wantID {
+			t.Fatalf("edit %d used id %d want %d", i, e.MessageID, wantID)
+		}
+	}
+}
+
+func TestChatGPTRequest_ErrorHandling(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 5); err != nil {
+		t.Fatalf("save history limit: %v", err)
+	}
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	origTicker := newTicker
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{}, fmt.Errorf("boom")
+	}
+	newTicker = func(d time.Duration) *time.Ticker { return time.NewTicker(time.Hour) }
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp; newTicker = origTicker }()
+
+	upd := &models.Update{Message: &models.Message{ID: 5, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+
+	if len(b.sent) != 1 || b.sent[0] != "Sending to ChatGPT..." {
+		t.Fatalf("sent messages: %v", b.sent)
+	}
+	if len(b.edits) != 1 || b.edits[0].Text != "OpenAI error: boom" {
+		t.Fatalf("edits: %v", b.edits)
+	}
+	hist, err := storage.LoadProjectHistory("demo")
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	if len(hist) != 2 || hist[1].Content != "OpenAI error: boom" || !hist[1].IsError {
+		t.Fatalf("history: %v", hist)
+	}
+}
+
+func TestChatGPTRequest_WebSearchTool(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	cases := []struct {
+		setting  string
+		wantTool bool
+		size     responses.WebSearchToolSearchContextSize
+	}{
+		{"off", false, responses.WebSearchToolSearchContextSizeHigh},
+		{"low", true, responses.WebSearchToolSearchContextSizeLow},
+		{"medium", true, responses.WebSearchToolSearchContextSizeMedium},
+		{"high", true, responses.WebSearchToolSearchContextSizeHigh},
+		{"other", true, responses.WebSearchToolSearchContextSizeHigh},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.setting, func(t *testing.T) {
+			if err := storage.SaveProjectWebSearch("demo", tc.setting); err != nil {
+				t.Fatalf("save web search: %v", err)
+			}
+			origNew := newOpenAIClient
+			origResp := openAIResponses
+			newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+			var paramsCap responses.ResponseNewParams
+			openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+				paramsCap = params
+				return responseResult{Text: "ok"}, nil
+			}
+			defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+			upd := &models.Update{Message: &models.Message{ID: 1, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+			HandleUpdate(context.Background(), &testBot{}, upd)
+			if tc.wantTool {
+				if len(paramsCap.Tools) != 1 {
+					t.Fatalf("expected one tool, got %v", paramsCap.Tools)
+				}
+				tool := paramsCap.Tools[0].OfWebSearchPreview
+				if tool == nil || tool.SearchContextSize != tc.size {
+					t.Fatalf("tool size = %v, want %v", tool, tc.size)
+				}
+			} else if len(paramsCap.Tools) != 0 {
+				t.Fatalf("expected no tools, got %v", paramsCap.Tools)
+			}
+		})
+	}
+}
+
+func TestChatGPTRequest_SearchDomains(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	storage.MapTopic(1, 0, "demo")
+	storage.SaveProjectWebSearch("demo", "low")
+
+	var paramsCap responses.ResponseNewParams
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		paramsCap = params
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	// toolJSON returns the web search tool as it is sent to the API
+	toolJSON := func() map[string]any {
+		t.Helper()
+		if len(paramsCap.Tools) != 1 {
+			t.Fatalf("expected one tool, got %v", paramsCap.Tools)
+		}
+		data, err := json.Marshal(paramsCap.Tools[0])
+		if err != nil {
+			t.Fatalf("marshal tool: %v", err)
+		}
+		var m map[string]any
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatalf("unmarshal tool: %v", err)
+		}
+		return m
+	}
+
+	upd := &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), &testBot{}, upd)
+	if tool := toolJSON(); tool["type"] != "web_search_preview" || tool["filters"] != nil {
+		t.Fatalf("unfiltered tool = %v", tool)
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setsearchdomains demo"))
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{Text: "bad_domain", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	if got := b.sent[len(b.sent)-1]; got != `Invalid domains: invalid domain "bad_domain"` {
+		t.Fatalf("invalid reply = %q", got)
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setsearchdomains demo"))
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{Text: "Docs.Python.org, go.dev", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	if got := b.sent[len(b.sent)-1]; got != "Web search for project 'demo' is limited to: docs.python.org, go.dev" {
+		t.Fatalf("set reply = %q", got)
+	}
+
+	HandleUpdate(context.Background(), &testBot{}, upd)
+	tool := toolJSON()
+	want := map[string]any{"allowed_domains": []any{"docs.python.org", "go.dev"}}
+	if tool["type"] != "web_search" || !reflect.DeepEqual(tool["filters"], want) || tool["search_context_size"] != "low" {
+		t.Fatalf("filtered tool = %v", tool)
+	}
+
+	HandleUpdate(context.Background(), b, cmdUpdate("/setsearchdomains demo"))
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{Text: "off", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	HandleUpdate(context.Background(), &testBot{}, upd)
+	if tool := toolJSON(); tool["filters"] != nil {
+		t.Fatalf("filters kept after clearing: %v", tool)
+	}
+}
+
+func TestChatGPTRequest_SearchLocation(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	storage.MapTopic(1, 0, "demo")
+	storage.SaveProjectWebSearch("demo", "medium")
+
+	var paramsCap responses.ResponseNewParams
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		paramsCap = params
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp; searchLocation = webSearchLocation{} }()
+
+	cases := []struct {
+		name                    string
+		city, country, timezone string
+		want                    map[string]any
+	}{
+		{"unset", "", "", "", nil},
+		{"full", "Lisbon", "pt", "Europe/Lisbon", map[string]any{"type": "approximate", "city": "Lisbon", "country": "PT", "timezone": "Europe/Lisbon"}},
+		{"country only", "", "DE", "", map[string]any{"type": "approximate", "country": "DE"}},
+		{"invalid ignored", "Oslo", "Norway", "Nowhere/City", map[string]any{"type": "approximate", "city": "Oslo"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("TBOT_SEARCH_CITY", tc.city)
+			t.Setenv("TBOT_SEARCH_COUNTRY", tc.country)
+			t.Setenv("TBOT_SEARCH_TIMEZONE", tc.timezone)
+			loadSearchLocation()
+			HandleUpdate(context.Background(), &testBot{}, &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+			data, err := json.Marshal(paramsCap.Tools[0])
+			if err != nil {
+				t.Fatalf("marshal tool: %v", err)
+			}
+			var tool map[string]any
+			json.Unmarshal(data, &tool)
+			if tc.want == nil {
+				if loc, ok := tool["user_location"]; ok {
+					t.Fatalf("location sent while unset: %v", loc)
+				}
+				return
+			}
+			if !reflect.DeepEqual(tool["user_location"], tc.want) {
+				t.Fatalf("location = %v, want %v", tool["user_location"], tc.want)
+			}
+		})
+	}
+}
+
+func TestChatGPTRequest_ReasoningEffort(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	cases := []struct {
+		effort string
+		want   openai.ReasoningEffort
+	}{
+		{"minimal", openai.ReasoningEffortMinimal},
+		{"low", openai.ReasoningEffortLow},
+		{"high", openai.ReasoningEffortHigh},
+		{"", openai.ReasoningEffortMedium},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.effort, func(t *testing.T) {
+			if err := storage.SaveProjectReasoning("demo", tc.effort); err != nil {
+				t.Fatalf("save reasoning: %v", err)
+			}
+			origNew := newOpenAIClient
+			origResp := openAIResponses
+			newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+			var paramsCap responses.ResponseNewParams
+			openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+				paramsCap = params
+				return responseResult{Text: "ok"}, nil
+			}
+			defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+			upd := &models.Update{Message: &models.Message{ID: 2, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+			HandleUpdate(context.Background(), &testBot{}, upd)
+			if paramsCap.Reasoning.Effort != tc.want {
+				t.Fatalf("effort = %v, want %v", paramsCap.Reasoning.Effort, tc.want)
+			}
+		})
+	}
+}
+
+func TestResponseHandling_LongMessageSplit(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 5); err != nil {
+		t.Fatalf("save history: %v", err)
+	}
+
+	longReply := strings.Repeat("a", 9001)
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	origTicker := newTicker
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: longReply}, nil
+	}
+	newTicker = func(d time.Duration) *time.Ticker { return time.NewTicker(time.Hour) }
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp; newTicker = origTicker }()
+
+	upd := &models.Update{Message: &models.Message{ID: 3, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+
+	if len(b.sent) != 3 {
+		t.Fatalf("sent = %v", b.sent)
+	}
+	if b.sent[0] != "Sending to ChatGPT..." {
+		t.Fatalf("first sent = %q", b.sent[0])
+	}
+	if len(b.edits) != 1 || b.edits[0].Text != longReply[:4000] {
+		t.Fatalf("edits = %v", b.edits)
+	}
+	if b.sent[1] != longReply[4000:8000] || b.sent[2] != longReply[8000:] {
+		t.Fatalf("chunk send mismatch")
+	}
+	if b.sentParams[1].ReplyParameters == nil || b.sentParams[1].ReplyParameters.MessageID != b.edits[0].MessageID {
+		t.Fatalf("second chunk reply id = %v", b.sentParams[1].ReplyParameters)
+	}
+	if b.sentParams[2].ReplyParameters == nil || b.sentParams[2].ReplyParameters.MessageID != b.edits[0].MessageID+1 {
+		t.Fatalf("third chunk reply id = %v", b.sentParams[2].ReplyParameters)
+	}
+	hist, err := storage.LoadProjectHistory("demo")
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	if len(hist) != 2 || hist[1].Content != longReply {
+		t.Fatalf("history: %v", hist)
+	}
+}
+
+func TestHandleUpdate_TokenBudgetSummarize(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 10); err != nil {
+		t.Fatalf("save history limit: %v", err)
+	}
+	if err := storage.SaveTokenBudget("demo", 5); err != nil {
+		t.Fatalf("save token budget: %v", err)
+	}
+	if err := storage.SaveProjectAutoSummarize("demo", "on"); err != nil {
+		t.Fatalf("save autosummarize: %v", err)
+	}
+	for i, c := range []string{"old one aaaaaaaaaaaa", "old two aaaaaaaaaaaa", "recent aaaaaaaaaaaaa"} {
+		storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "user", When: int64(i + 1), Content: c})
+	}
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	var summarized string
+	answered := make(chan struct{})
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		if params.Instructions.Value == summaryInstruction {
+			if params.Model != defaultSummaryModel {
+				t.Errorf("summary model = %s, want %s", params.Model, defaultSummaryModel)
+			}
+			// the summary is written after the request has been answered
+			select {
+			case <-answered:
+			case <-time.After(5 * time.Second):
+				t.Error("the request waited for the summary")
+			}
+			summarized = params.Input.OfString.Value
+			return responseResult{Text: "sum"}, nil
+		}
+		return responseResult{Text: "reply"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	upd := &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), &testBot{}, upd)
+	close(answered)
+	summaries.Wait()
+
+	if !strings.Contains(summarized, "old one") || !strings.Contains(summarized, "old two") || strings.Contains(summarized, "recent") {
+		t.Fatalf("summarized input = %q", summarized)
+	}
+	hist, err := storage.LoadProjectHistory("demo")
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	if len(hist) != 4 {
+		t.Fatalf("expected 4 history messages, got %v", hist)
+	}
+	if !hist[0].IsSummary || hist[0].Content != "sum" || hist[0].When != 2 {
+		t.Fatalf("summary not stored first: %+v", hist[0])
+	}
+	if hist[1].Content != "recent aaaaaaaaaaaaa" {
+		t.Fatalf("recent message lost: %+v", hist[1])
+	}
+}
+
+func TestSummaryDiscardedWhenHistoryChanges(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 10); err != nil {
+		t.Fatalf("save history limit: %v", err)
+	}
+	if err := storage.SaveTokenBudget("demo", 5); err != nil {
+		t.Fatalf("save token budget: %v", err)
+	}
+	if err := storage.SaveProjectAutoSummarize("demo", "on"); err != nil {
+		t.Fatalf("save autosummarize: %v", err)
+	}
+	for i, c := range []string{"old one aaaaaaaaaaaa", "old two aaaaaaaaaaaa", "recent aaaaaaaaaaaaa"} {
+		storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "user", When: int64(i + 1), Content: c})
+	}
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	answered := make(chan struct{})
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		if params.Instructions.Value == summaryInstruction {
+			<-answered
+			// another request trims the history while the summary is written
+			if err := storage.TrimProjectHistory("demo", 3); err != nil {
+				t.Errorf("trim history: %v", err)
+			}
+			return responseResult{Text: "sum"}, nil
+		}
+		return responseResult{Text: "reply"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	upd := &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), &testBot{}, upd)
+	close(answered)
+	summaries.Wait()
+
+	hist, err := storage.LoadProjectHistory("demo")
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	for _, h := range hist {
+		if h.IsSummary {
+			t.Fatalf("summary stored over changed history: %+v", hist)
+		}
+	}
+	if len(hist) == 0 || hist[0].Content != "recent aaaaaaaaaaaaa" {
+		t.Fatalf("history = %+v", hist)
+	}
+}
+
+func TestHandleUpdate_SummaryModel(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	storage.SaveHistoryLimit("demo", 10)
+	storage.SaveTokenBudget("demo", 1)
+	storage.SaveProjectAutoSummarize("demo", "on")
+	if err := storage.SaveProjectSummaryModel("demo", "cheap-model"); err != nil {
+		t.Fatalf("save summary model: %v", err)
+	}
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "user", When: 1, Content: "some long enough message"})
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "assistant", When: 2, Content: "another long message"})
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	var summaryModelUsed, mainModelUsed string
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		if params.Instructions.Value == summaryInstruction {
+			summaryModelUsed = string(params.Model)
+			return responseResult{Text: "sum"}, nil
+		}
+		mainModelUsed = string(params.Model)
+		return responseResult{Text: "reply"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	upd := &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), &testBot{}, upd)
+	summaries.Wait()
+	if summaryModelUsed != "cheap-model" {
+		t.Fatalf("summary model = %q, want cheap-model", summaryModelUsed)
+	}
+	if mainModelUsed != defaultModel {
+		t.Fatalf("main model = %q, want %s", mainModelUsed, defaultModel)
+	}
+}
+
+func TestHandleUpdate_Preprocess(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	rules, err := parsePreprocessRules("quotes\nsignature\nreplace ticket-(\\d+) => #$1")
+	if err != nil {
+		t.Fatalf("parse rules: %v", err)
+	}
+	if err := storage.SaveProjectPreprocess("demo", rules); err != nil {
+		t.Fatalf("save preprocess: %v", err)
+	}
+
+	var paramsCapture responses.ResponseNewParams
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		paramsCapture = params
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	text := "> earlier reply\nPlease check ticket-42\n-- \nJohn Doe\nACME Corp"
+	upd := &models.Update{Message: &models.Message{Text: text, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), &testBot{}, upd)
+
+	user := paramsCapture.Input.OfInputItemList[len(paramsCapture.Input.OfInputItemList)-1].OfMessage
+	cont := user.Content.OfInputItemContentList
+	if len(cont) == 0 || cont[0].OfInputText.Text != "Please check #42" {
+		t.Fatalf("preprocessed text = %v", cont)
+	}
+}
+
+func TestHandleUpdate_Retry(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 10); err != nil {
+		t.Fatalf("save history limit: %v", err)
+	}
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	var sentText string
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		user := params.Input.OfInputItemList[len(params.Input.OfInputItemList)-1].OfMessage
+		sentText = user.Content.OfInputItemContentList[0].OfInputText.Text
+		return responseResult{Text: "fresh"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	t.Run("nothing to retry", func(t *testing.T) {
+		b := &testBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/retry"))
+		if len(b.sent) != 1 || b.sent[0] != "Nothing to retry." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("replaces error", func(t *testing.T) {
+		storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "user", WhoID: 1, WhoName: "bob", When: 1, Content: "question"})
+		storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "assistant", WhoName: "ChatGPT", When: 2, Content: "OpenAI error: boom", IsError: true})
+
+		HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/retry"))
+		if !strings.HasSuffix(sentText, "question") {
+			t.Fatalf("retried text = %q", sentText)
+		}
+		hist, err := storage.LoadProjectHistory("demo")
+		if err != nil {
+			t.Fatalf("load history: %v", err)
+		}
+		if len(hist) != 2 || hist[0].Content != "question" || hist[0].WhoName != "bob" || hist[1].Content != "fresh" || hist[1].IsError {
+			t.Fatalf("history: %+v", hist)
+		}
+	})
+
+	t.Run("photo and voice", func(t *testing.T) {
+		if err := storage.SaveProjectTranscribe("demo", "on"); err != nil {
+			t.Fatalf("save transcribe: %v", err)
+		}
+		origHTTP, origTranscriber := httpGetFunc, transcriber
+		httpGetFunc = func(url string) (*http.Response, error) {
+			return &http.Response{ContentLength: 5, Body: io.NopCloser(strings.NewReader("audio"))}, nil
+		}
+		transcriber = &fakeTranscriber{}
+		defer func() { httpGetFunc, transcriber = origHTTP, origTranscriber }()
+		if _, err := storage.ClearProjectHistory("demo"); err != nil {
+			t.Fatalf("clear history: %v", err)
+		}
+		for i, m := range []storage.HistoryMessage{
+			{Role: "user", WhoID: 1, WhoName: "bob", Content: "look"},
+			{Role: "user", WhoID: 1, WhoName: "bob", Content: transcriptPrefix + "spoken", FileID: "v1"},
+			{Role: "user", WhoID: 1, WhoName: "bob", Content: imageNote, FileID: "p1"},
+			{Role: "assistant", WhoName: "ChatGPT", Content: "OpenAI error: boom", IsError: true},
+		} {
+			m.When = int64(i + 1)
+			storage.AddHistoryMessage("demo", m)
+		}
+
+		var files []string
+		b := &testBot{getFile: func(ctx context.Context, params *tg.GetFileParams) (*models.File, error) {
+			files = append(files, params.FileID)
+			return &models.File{FilePath: params.FileID}, nil
+		}}
+		HandleUpdate(context.Background(), b, cmdUpdate("/retry"))
+		if !reflect.DeepEqual(files, []string{"v1", "p1"}) {
+			t.Fatalf("files fetched = %q", files)
+		}
+		hist, err := storage.LoadProjectHistory("demo")
+		if err != nil {
+			t.Fatalf("load history: %v", err)
+		}
+		var got []string
+		for _, h := range hist {
+			got = append(got, h.Content)
+		}
+		want := []string{"look", transcriptPrefix + "fake transcript", imageNote, "fresh"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("history = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestHandleUpdate_HistoryUnknownRoleSkipped(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 10); err != nil {
+		t.Fatalf("save history limit: %v", err)
+	}
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "user", When: 1, Content: "question"})
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "bogus", When: 2, Content: "should not be sent"})
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "tool", When: 3, Content: "search results"})
+
+	var paramsCapture responses.ResponseNewParams
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		paramsCapture = params
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	upd := &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), &testBot{}, upd)
+
+	inputs := paramsCapture.Input.OfInputItemList
+	if len(inputs) != 3 {
+		t.Fatalf("expected 3 inputs, got %d", len(inputs))
+	}
+	for _, in := range inputs[:2] {
+		if strings.Contains(in.OfMessage.Content.OfString.Value, "should not be sent") {
+			t.Fatal("message with unknown role was replayed")
+		}
+	}
+	tool := inputs[1].OfMessage
+	if tool.Role != responses.EasyInputMessageRoleDeveloper || !strings.Contains(tool.Content.OfString.Value, "search results") {
+		t.Fatalf("tool output not replayed as developer message: %+v", tool)
+	}
+}
+
+func TestHandleUpdate_MetricsCommand(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{}, fmt.Errorf("boom")
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+	upd := &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), &testBot{}, upd)
+
+	t.Run("not admin", func(t *testing.T) {
+		b := &testBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/metrics"))
+		if len(b.sent) != 1 || b.sent[0] != "Admins only." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		adminUsers = map[int64]bool{1: true}
+		defer func() { adminUsers = nil }()
+		b := &testBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/metrics"))
+		if len(b.sent) != 1 {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+		var counters map[string]int64
+		if err := json.Unmarshal([]byte(b.sent[0]), &counters); err != nil {
+			t.Fatalf("reply is not JSON: %v", err)
+		}
+		for _, name := range []string{"telegram_requests", "chatgpt_requests", "chatgpt_errors", "openai_input_tokens"} {
+			if _, ok := counters[name]; !ok {
+				t.Fatalf("counter %s missing in %v", name, counters)
+			}
+		}
+		if counters["chatgpt_requests"] < 1 || counters["chatgpt_errors"] < 1 {
+			t.Fatalf("activity not counted: %v", counters)
+		}
+	})
+}
+
+func TestHandleUpdate_BusyTopic(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		user := params.Input.OfInputItemList[len(params.Input.OfInputItemList)-1].OfMessage
+		started <- user.Content.OfInputItemContentList[0].OfInputText.Text
+		<-release
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	send := func(text string, b *testBot) {
+		HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{Text: text, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		if err := storage.SaveProjectBusyMode("demo", "reject"); err != nil {
+			t.Fatalf("save busy mode: %v", err)
+		}
+		done := make(chan struct{})
+		go func() { send("first", &testBot{}); close(done) }()
+		<-started
+		b := &testBot{}
+		send("second", b)
+		if len(b.sent) != 1 || b.sent[0] != busyReply {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+		release <- struct{}{}
+		<-done
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		if err := storage.SaveProjectBusyMode("demo", "queue"); err != nil {
+			t.Fatalf("save busy mode: %v", err)
+		}
+		done := make(chan struct{}, 2)
+		go func() { send("first", &testBot{}); done <- struct{}{} }()
+		if got := <-started; got != "first" {
+			t.Fatalf("first request = %q", got)
+		}
+		go func() { send("second", &testBot{}); done <- struct{}{} }()
+		select {
+		case got := <-started:
+			t.Fatalf("%q started while first request in flight", got)
+		case <-time.After(20 * time.Millisecond):
+		}
+		release <- struct{}{}
+		if got := <-started; got != "second" {
+			t.Fatalf("queued request = %q", got)
+		}
+		release <- struct{}{}
+		<-done
+		<-done
+	})
+}
+
+func TestHandleUpdate_ImageAnswerCache(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveImageCacheTTL("demo", 60); err != nil {
+		t.Fatalf("save image cache ttl: %v", err)
+	}
+
+	calls := 0
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	origHTTP := httpGetFunc
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		calls++
+		return responseResult{Text: "a cat"}, nil
+	}
+	httpGetFunc = func(url string) (*http.Response, error) {
+		return &http.Response{Body: io.NopCloser(strings.NewReader("image bytes"))}, nil
+	}
+	defer func() {
+		newOpenAIClient = origNew
+		openAIResponses = origResp
+		httpGetFunc = origHTTP
+	}()
+
+	send := func() *testBot {
+		b := &testBot{}
+		upd := &models.Update{Message: &models.Message{
+			Caption: "what is it?",
+			Photo:   []models.PhotoSize{{FileID: "p1"}},
+			Chat:    models.Chat{ID: 1},
+			From:    &models.User{ID: 1},
+		}}
+		HandleUpdate(context.Background(), b, upd)
+		return b
+	}
+	send()
+	b := send()
+	if calls != 1 {
+		t.Fatalf("expected one ChatGPT request, got %d", calls)
+	}
+	if len(b.edits) == 0 || b.edits[len(b.edits)-1].Text != "a cat" {
+		t.Fatalf("expected cached reply, got %+v", b.edits)
+	}
+}
+
+func TestHandleUpdate_ImageResize(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	cb := &testBot{}
+	HandleUpdate(context.Background(), cb, cmdUpdate("/setimageresize demo 64"))
+	if got := cb.sent[len(cb.sent)-1]; got != "Project 'demo' downscales images to at most 64 pixels." {
+		t.Fatalf("set reply = %q", got)
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			src.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, src); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+
+	var imageURL string
+	var served []byte
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	origHTTP := httpGetFunc
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		user := params.Input.OfInputItemList[len(params.Input.OfInputItemList)-1].OfMessage
+		for _, c := range user.Content.OfInputItemContentList {
+			if c.OfInputImage != nil {
+				imageURL = c.OfInputImage.ImageURL.Value
+			}
+		}
+		return responseResult{Text: "ok"}, nil
+	}
+	httpGetFunc = func(url string) (*http.Response, error) {
+		return &http.Response{Body: io.NopCloser(bytes.NewReader(served))}, nil
+	}
+	defer func() {
+		newOpenAIClient = origNew
+		openAIResponses = origResp
+		httpGetFunc = origHTTP
+	}()
+	send := func() {
+		imageURL = ""
+		HandleUpdate(context.Background(), &testBot{}, &models.Update{Message: &models.Message{
+			Photo: []models.PhotoSize{{FileID: "p1"}},
+			Chat:  models.Chat{ID: 1},
+			From:  &models.User{ID: 1},
+		}})
+	}
+
+	served = pngData.Bytes()
+	send()
+	const prefix = "data:image/jpeg;base64,"
+	if !strings.HasPrefix(imageURL, prefix) {
+		t.Fatalf("image URL = %.40q, want data URL", imageURL)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(imageURL, prefix))
+	if err != nil {
+		t.Fatalf("decode base64: %v", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("decode jpeg: %v", err)
+	}
+	if got := img.Bounds().Size(); got != (image.Point{X: 64, Y: 32}) {
+		t.Fatalf("downscaled size = %v, want 64x32", got)
+	}
+
+	served = []byte("not an image")
+	send()
+	if imageURL != "http://example.com/file" {
+		t.Fatalf("image URL = %q, want original file URL", imageURL)
+	}
+}
+
+func TestHandleUpdate_EditedMessageRerun(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 10); err != nil {
+		t.Fatalf("save history limit: %v", err)
+	}
+
+	var prompts []string
+	long := false
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		items := params.Input.OfInputItemList
+		cont := items[len(items)-1].OfMessage.Content.OfInputItemContentList
+		prompts = append(prompts, cont[0].OfInputText.Text)
+		if long {
+			return responseResult{Text: strings.Repeat("long answer ", 500)}, nil
+		}
+		return responseResult{Text: fmt.Sprintf("answer %d", len(prompts))}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	b := &testBot{}
+	msg := func(text string) *models.Message {
+		return &models.Message{ID: 10, Text: text, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1, Username: "u"}}
+	}
+
+	// editing is ignored until the project enables it
+	HandleUpdate(context.Background(), b, &models.Update{Message: msg("hi")})
+	HandleUpdate(context.Background(), b, &models.Update{EditedMessage: msg("hello")})
+	if len(prompts) != 1 {
+		t.Fatalf("expected edit to be ignored, got %d requests", len(prompts))
+	}
+
+	if err := storage.SaveProjectEditRerun("demo", "on"); err != nil {
+		t.Fatalf("save edit rerun: %v", err)
+	}
+	b.edits = nil
+	HandleUpdate(context.Background(), b, &models.Update{EditedMessage: msg("hello")})
+	if len(prompts) != 2 || !strings.HasSuffix(prompts[1], "hello") {
+		t.Fatalf("expected edited prompt to be re-run, got %q", prompts)
+	}
+	if len(b.sent) != 1 {
+		t.Fatalf("expected no new messages, got %q", b.sent)
+	}
+	last := b.edits[len(b.edits)-1]
+	if last.MessageID != 11 || last.Text != "answer 2" {
+		t.Fatalf("expected reply 11 to be replaced, got %+v", last)
+	}
+
+	hist, err := storage.LoadProjectHistory("demo")
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	if len(hist) != 2 || hist[0].Content != "hello" || hist[1].Content != "answer 2" {
+		t.Fatalf("unexpected history: %+v", hist)
+	}
+
+	// every chunk of a split reply is replaced
+	long = true
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{ID: 20, Text: "tell me more", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1, Username: "u"}}})
+	if len(b.sent) != 2 {
+		t.Fatalf("expected a split reply, got %d messages", len(b.sent))
+	}
+	long = false
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, &models.Update{EditedMessage: &models.Message{ID: 20, Text: "tell me less", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1, Username: "u"}}})
+	if len(b.deleted) != 1 || b.deleted[0].MessageID != 22 {
+		t.Fatalf("expected the second chunk 22 to be deleted, got %+v", b.deleted)
+	}
+	if last := b.edits[len(b.edits)-1]; last.MessageID != 21 || last.Text != "answer 4" {
+		t.Fatalf("expected reply 21 to be replaced, got %+v", last)
+	}
+}
+
+func TestChatGPTRequest_TypingAction(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	origTicker := newTicker
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		time.Sleep(5 * time.Millisecond)
+		return responseResult{Text: "final reply"}, nil
+	}
+	newTicker = func(d time.Duration) *time.Ticker { return time.NewTicker(1 * time.Millisecond) }
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp; newTicker = origTicker }()
+
+	upd := &models.Update{Message: &models.Message{ID: 10, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	if len(b.actions) == 0 {
+		t.Fatal("expected typing action to be sent")
+	}
+	if b.actions[0].Action != models.ChatActionTyping || b.actions[0].ChatID != int64(1) {
+		t.Fatalf("unexpected action: %+v", b.actions[0])
+	}
+
+	if err := storage.SaveProjectTyping("demo", "off"); err != nil {
+		t.Fatalf("save typing: %v", err)
+	}
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	if len(b.actions) != 0 {
+		t.Fatalf("expected no typing action, got %d", len(b.actions))
+	}
+}
+
+func TestChatGPTRequest_VoiceReply(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	var spoken []string
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	origTTS := openAITTS
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: strings.Repeat("a", 4000) + "b"}, nil
+	}
+	openAITTS = func(client *openai.Client, text string) ([]byte, error) {
+		spoken = append(spoken, text)
+		return []byte("ogg"), nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp; openAITTS = origTTS }()
+
+	upd := &models.Update{Message: &models.Message{ID: 10, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	if len(b.voices) != 0 || len(spoken) != 0 {
+		t.Fatal("voice reply sent while disabled")
+	}
+
+	if err := storage.SaveProjectVoiceReply("demo", "on"); err != nil {
+		t.Fatalf("save voice reply: %v", err)
+	}
+	if err := storage.SaveProjectFooter("demo", "— {project}"); err != nil {
+		t.Fatalf("save footer: %v", err)
+	}
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	if len(spoken) != 1 || spoken[0] != strings.Repeat("a", 4000) {
+		t.Fatalf("expected the reply cut to the speech limit to be spoken, got %d texts", len(spoken))
+	}
+	if len(b.voices) != 1 {
+		t.Fatalf("expected one voice message, got %d", len(b.voices))
+	}
+	data, err := io.ReadAll(b.voices[0].Voice.(*models.InputFileUpload).Data)
+	if err != nil || string(data) != "ogg" {
+		t.Fatalf("unexpected voice data %q: %v", data, err)
+	}
+	if b.voices[0].ReplyParameters == nil || b.voices[0].ReplyParameters.MessageID != 11 {
+		t.Fatalf("voice should reply to the answer: %+v", b.voices[0].ReplyParameters)
+	}
+
+	// a short reply is spoken without the footer shown under it
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: "short answer"}, nil
+	}
+	spoken = nil
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	if len(spoken) != 1 || spoken[0] != "short answer" {
+		t.Fatalf("spoken = %q, want the plain reply", spoken)
+	}
+	if last := b.edits[len(b.edits)-1].Text; !strings.Contains(last, "— demo") {
+		t.Fatalf("footer missing from the shown reply %q", last)
+	}
+}
+
+func TestSetTopic_PostsWelcome(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setwelcome demo"))
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{Text: "This topic is for release planning.", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	if v, _ := storage.LoadProjectWelcome("demo"); v != "This topic is for release planning." {
+		t.Fatalf("welcome not saved: %q", v)
+	}
+
+	t.Run("pinned", func(t *testing.T) {
+		b := &testBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/settopic demo"))
+		want := []string{"Topic mapped to project 'demo'.", "This topic is for release planning."}
+		if !reflect.DeepEqual(b.sent, want) {
+			t.Fatalf("unexpected messages: %q", b.sent)
+		}
+		if len(b.pins) != 1 || b.pins[0].MessageID != 1 || b.pins[0].ChatID != int64(1) {
+			t.Fatalf("unexpected pins: %+v", b.pins)
+		}
+	})
+
+	t.Run("no pin permission", func(t *testing.T) {
+		b := &testBot{pinErr: fmt.Errorf("not enough rights")}
+		HandleUpdate(context.Background(), b, cmdUpdate("/settopic demo"))
+		if len(b.sent) != 2 || b.sent[1] != "This topic is for release planning." {
+			t.Fatalf("welcome should still be posted: %q", b.sent)
+		}
+	})
+}
+
+func TestChatGPTRequest_InputTooLarge(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveProjectModel("demo", "tiny-model"); err != nil {
+		t.Fatalf("save model: %v", err)
+	}
+	modelInputLimits["tiny-model"] = 100
+	defer delete(modelInputLimits, "tiny-model")
+
+	called := false
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		called = true
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	b := &testBot{}
+	upd := &models.Update{Message: &models.Message{Text: strings.Repeat("word ", 100), Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), b, upd)
+	if called {
+		t.Fatal("OpenAI should not be called for oversized input")
+	}
+	want := "Your message plus history is too large (~125 tokens). Try /forget or reduce the history limit."
+	if len(b.sent) != 1 || b.sent[0] != want {
+		t.Fatalf("unexpected messages: %q", b.sent)
+	}
+
+	b = &testBot{}
+	upd.Message.Text = "short"
+	HandleUpdate(context.Background(), b, upd)
+	if !called {
+		t.Fatal("OpenAI should be called for input within the limit")
+	}
+}
+
+func TestParseModelInputLimits(t *testing.T) {
+	limits, err := parseModelInputLimits("gpt-5=1000, default=500")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if limits["gpt-5"] != 1000 || limits["default"] != 500 {
+		t.Fatalf("limits = %v", limits)
+	}
+	if _, err := parseModelInputLimits("gpt-5=lots"); err == nil {
+		t.Fatal("expected error for invalid limit")
+	}
+}
+
+func TestRawCommand(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	storage.SaveProjectModel("demo", "gpt-4o")
+	storage.SaveProjectInstruction("demo", "be a pirate")
+	storage.SaveProjectWebSearch("demo", "high")
+	storage.SaveHistoryLimit("demo", 10)
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: storage.RoleUser, When: 1, Content: "earlier"})
+
+	var captured responses.ResponseNewParams
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = params
+		return responseResult{Text: "42"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	auditEnabled = true
+	defer func() { auditEnabled = false }()
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/raw what is the answer?"))
+	if audit, _ := storage.LoadAudit("demo"); len(audit) != 1 || audit[0].Prompt != "what is the answer?" || audit[0].Reply != "42" || audit[0].Model != "gpt-4o" {
+		t.Fatalf("audit = %+v", audit)
+	}
+
+	items := captured.Input.OfInputItemList
+	if len(items) != 1 || items[0].OfMessage == nil || items[0].OfMessage.Role != responses.EasyInputMessageRoleUser {
+		t.Fatalf("expected a single user message, got %+v", items)
+	}
+	if got := items[0].OfMessage.Content.OfString.Value; got != "what is the answer?" {
+		t.Fatalf("question = %q", got)
+	}
+	if len(captured.Tools) != 0 {
+		t.Fatalf("expected no tools, got %d", len(captured.Tools))
+	}
+	if string(captured.Model) != "gpt-4o" {
+		t.Fatalf("model = %q", captured.Model)
+	}
+	if len(b.sent) != 1 || b.sent[0] != "42" {
+		t.Fatalf("unexpected messages: %q", b.sent)
+	}
+	if hist, _ := storage.LoadProjectHistory("demo"); len(hist) != 1 {
+		t.Fatalf("history should be untouched, got %d messages", len(hist))
+	}
+}
+
+func TestPenaltiesNotSupported(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setpenalties demo"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/penalties demo"))
+	want := "Frequency and presence penalties are not supported by the Responses API."
+	if !reflect.DeepEqual(b.sent, []string{want, want}) {
+		t.Fatalf("replies = %q", b.sent)
+	}
+}
+
+func TestSeedNotSupported(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setseed demo"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/seed demo"))
+	want := "Sampling seeds are not supported by the Responses API."
+	if !reflect.DeepEqual(b.sent, []string{want, want}) {
+		t.Fatalf("replies = %q", b.sent)
+	}
+}
+
+func TestDuplicateMessagesNotStored(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 20); err != nil {
+		t.Fatalf("save history limit: %v", err)
+	}
+
+	requests := 0
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		requests++
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
+	text := func(s string) *models.Update {
+		return &models.Update{Message: &models.Message{Text: s, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	}
+	userMessages := func() []string {
+		hist, err := storage.LoadProjectHistory("demo")
+		if err != nil {
+			t.Fatalf("load history: %v", err)
+		}
+		var out []string
+		for _, h := range hist {
+			if h.Role == storage.RoleUser {
+				out = append(out, h.Content)
+			}
+		}
+		return out
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/dedup demo"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/setdedup demo 0"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/setdedup demo 30"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/dedup demo"))
+	want := []string{
+		"Project 'demo' stores every message in history.",
+		"Please enter a number of seconds between 1 and 600, or off.",
+		"Project 'demo' skips a message repeated within 30 seconds.",
+		"Project 'demo' skips a message repeated within 30 seconds.",
+	}
+	if !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("replies = %q, want %q", b.sent, want)
+	}
+
+	HandleUpdate(context.Background(), &testBot{}, text("hello"))
+	HandleUpdate(context.Background(), &testBot{}, text("hello"))
+	if requests != 2 {
+		t.Fatalf("requests = %d, want both messages answered", requests)
+	}
+	if got := userMessages(); len(got) != 1 {
+		t.Fatalf("user history = %q, want one entry", got)
+	}
+	hist, err := storage.LoadProjectHistory("demo")
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	var turns []string
+	for _, h := range hist {
+		turns = append(turns, h.Role+":"+h.Content)
+	}
+	if want := []string{"user:hello", "assistant:ok"}; !reflect.DeepEqual(turns, want) {
+		t.Fatalf("history = %q, want %q without the reply to the duplicate", turns, want)
+	}
+	HandleUpdate(context.Background(), &testBot{}, text("bye"))
+	if got := userMessages(); len(got) != 2 {
+		t.Fatalf("user history = %q, want a different message stored", got)
+	}
+
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/setdedup demo off"))
+	HandleUpdate(context.Background(), &testBot{}, text("bye"))
+	if got := userMessages(); len(got) != 3 {
+		t.Fatalf("user history = %q, want duplicates stored when off", got)
+	}
+}
+
+func TestStopSequences(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	var captured responses.ResponseNewParams
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = params
+		return responseResult{Text: "answer### notes END tail"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
+	text := func(s string) *models.Update {
+		return &models.Update{Message: &models.Message{Text: s, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, text("hi"))
+	if len(b.edits) != 1 || b.edits[0].Text != "answer### notes END tail" {
+		t.Fatalf("reply cut while unset: %+v", b.edits)
+	}
+
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setstop demo"))
+	HandleUpdate(context.Background(), b, text("a, b, c, d, e"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/setstop demo"))
+	HandleUpdate(context.Background(), b, text("END,,###"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/setstop demo"))
+	HandleUpdate(context.Background(), b, text("END, ###"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/stop demo"))
+	prompt := "Enter up to 4 stop sequences separated by commas. The bot cuts each reply before the first of them after it arrives; the model still writes the whole answer."
+	invalid := "Please enter 1 to 4 non-empty stop sequences separated by commas."
+	want := []string{
+		prompt, invalid,
+		prompt, invalid,
+		prompt, `Stop sequences for project 'demo' set to "END", "###".`,
+		`Stop sequences for project 'demo': "END", "###".`,
+	}
+	if !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("replies = %q, want %q", b.sent, want)
+	}
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, text("hi"))
+	if len(b.edits) != 1 || b.edits[0].Text != "answer" {
+		t.Fatalf("reply not cut at the earliest stop: %+v", b.edits)
+	}
+	if _, ok := captured.ExtraFields()["stop"]; ok {
+		t.Fatal("stop sent as a request field")
+	}
+
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/clearstop demo"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/stop demo"))
+	if want := []string{"Stop sequences for project 'demo' cleared.", "No stop sequences set for project 'demo'."}; !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("clear replies = %q", b.sent)
+	}
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, text("hi"))
+	if len(b.edits) != 1 || b.edits[0].Text != "answer### notes END tail" {
+		t.Fatalf("reply cut after clearing: %+v", b.edits)
+	}
+}
+
+func TestJSONMode(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	storage.SaveProjectFooter("demo", "-- demo bot")
+
+	var captured []responses.ResponseNewParams
+	var replies []string
+	origNew, origResp, origTicker := newOpenAIClient, openAIResponses, newTicker
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = append(captured, params)
+		reply := replies[0]
+		replies = replies[1:]
+		return responseResult{Text: reply}, nil
+	}
+	newTicker = func(d time.Duration) *time.Ticker { return time.NewTicker(time.Hour) }
+	defer func() { newOpenAIClient, openAIResponses, newTicker = origNew, origResp, origTicker }()
+	text := func(s string) *models.Update {
+		return &models.Update{Message: &models.Message{Text: s, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setjsonmode demo on"))
+	if b.sent[0] != "JSON mode for project 'demo' set to on." {
+		t.Fatalf("setjsonmode reply = %q", b.sent)
+	}
+
+	// the first reply is not JSON, so the request is sent again
+	replies = []string{"Sure! Here it is: {", `{"ok": true}`}
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, text("status?"))
+	if len(captured) != 2 {
+		t.Fatalf("sent %d requests, want a retry", len(captured))
+	}
+	if captured[0].Text.Format.OfJSONObject == nil {
+		t.Fatalf("response format = %+v, want JSON object", captured[0].Text.Format)
+	}
+	if got := captured[0].Input.OfInputItemList[0].OfMessage.Content.OfString.Value; got != jsonModeInstruction {
+		t.Fatalf("first input = %q, want the JSON instruction", got)
+	}
+	// the footer is left out so the reply still parses
+	if len(b.edits) != 1 || b.edits[0].Text != `{"ok": true}` {
+		t.Fatalf("edits = %+v", b.edits)
+	}
+
+	// a second invalid reply is reported instead of sent
+	replies = []string{"no", "still no"}
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, text("again"))
+	if len(captured) != 4 || len(b.edits) != 1 || b.edits[0].Text != invalidJSONText {
+		t.Fatalf("requests = %d, edits = %+v", len(captured), b.edits)
+	}
+
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setjsonschema demo"))
+	HandleUpdate(context.Background(), b, text("[1, 2]"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/setjsonschema demo"))
+	HandleUpdate(context.Background(), b, text(`{"type": "object", "properties": {"ok": {"type": "boolean"}}}`))
+	if len(b.sent) != 4 || !strings.HasPrefix(b.sent[1], "Invalid schema: ") || b.sent[3] != "JSON schema for project 'demo' saved." {
+		t.Fatalf("schema replies = %q", b.sent)
+	}
+	replies = []string{`{"ok": false}`}
+	HandleUpdate(context.Background(), &testBot{}, text("once more"))
+	format := captured[len(captured)-1].Text.Format.OfJSONSchema
+	if format == nil || format.Schema["type"] != "object" {
+		t.Fatalf("response format = %+v, want the schema", captured[len(captured)-1].Text.Format)
+	}
+
+	// stop sequences would break the JSON, so they are not applied
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/setstop demo"))
+	HandleUpdate(context.Background(), &testBot{}, text("ok"))
+	replies = []string{`{"ok": true}`}
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, text("stopped?"))
+	if len(b.edits) != 1 || b.edits[0].Text != `{"ok": true}` {
+		t.Fatalf("JSON reply cut at a stop sequence: %+v", b.edits)
+	}
+
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/setjsonmode demo off"))
+	replies = []string{"plain"}
+	HandleUpdate(context.Background(), &testBot{}, text("bye"))
+	if last := captured[len(captured)-1]; last.Text.Format.OfJSONObject != nil || last.Text.Format.OfJSONSchema != nil {
+		t.Fatalf("response format set with JSON mode off: %+v", last.Text.Format)
+	}
+}
+
+func TestShowReasoning(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	var captured responses.ResponseNewParams
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = params
+		return responseResult{Text: "answer", ReasoningSummary: "thought about it"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	upd := &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	if captured.Reasoning.Summary != "" {
+		t.Fatalf("summary requested while off: %q", captured.Reasoning.Summary)
+	}
+	for _, s := range b.sent {
+		if strings.HasPrefix(s, reasoningHeader) {
+			t.Fatalf("reasoning shown while off: %q", s)
+		}
+	}
+
+	cb := &testBot{}
+	HandleUpdate(context.Background(), cb, cmdUpdate("/setshowreasoning demo on"))
+	if got := cb.sent[len(cb.sent)-1]; got != "Reasoning summary for project 'demo' set to on." {
+		t.Fatalf("set reply = %q", got)
+	}
+
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	if captured.Reasoning.Summary != openai.ReasoningSummaryAuto {
+		t.Fatalf("summary not requested: %q", captured.Reasoning.Summary)
+	}
+	var params *tg.SendMessageParams
+	summaryAt := -1
+	for i := range b.sentParams {
+		if strings.HasPrefix(b.sentParams[i].Text, reasoningHeader) {
+			params, summaryAt = &b.sentParams[i], i
+		}
+	}
+	if params == nil {
+		t.Fatalf("reasoning not shown: %v", b.sent)
+	}
+	if params.Text != reasoningHeader+"thought about it" {
+		t.Fatalf("reasoning text = %q", params.Text)
+	}
+	if len(params.Entities) != 1 || params.Entities[0].Type != models.MessageEntityTypeSpoiler || params.Entities[0].Offset != len(reasoningHeader) || params.Entities[0].Length != len("thought about it") {
+		t.Fatalf("entities = %+v", params.Entities)
+	}
+	// the answer follows the summary as a new message instead of filling
+	// the progress message posted above it
+	if last := len(b.sent) - 1; summaryAt != last-1 || b.sent[last] != "answer" {
+		t.Fatalf("messages = %q, want the summary and then the answer", b.sent)
+	}
+	if len(b.deleted) != 1 || len(b.edits) != 0 {
+		t.Fatalf("progress message not replaced: deleted %+v, edits %+v", b.deleted, b.edits)
+	}
+
+	HandleUpdate(context.Background(), cb, cmdUpdate("/setshowreasoning demo off"))
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	for _, s := range b.sent {
+		if strings.HasPrefix(s, reasoningHeader) {
+			t.Fatalf("reasoning shown after turning off: %q", s)
+		}
+	}
+}
+
+func TestMentionOnly(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	SetBotIdentity(99, "GptBot")
+	defer SetBotIdentity(0, "")
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(-100, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	var prompts []string
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		prompts = append(prompts, renderInputs(params.Input.OfInputItemList))
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	cb := &testBot{}
+	HandleUpdate(context.Background(), cb, cmdUpdate("/setmentiononly demo on"))
+	if got := cb.sent[len(cb.sent)-1]; got != "Mention-only mode for project 'demo' set to on." {
+		t.Fatalf("set reply = %q", got)
+	}
+
+	group := models.Chat{ID: -100, Type: models.ChatTypeSupergroup}
+	user := &models.User{ID: 1}
+	cases := []struct {
+		name   string
+		msg    *models.Message
+		answer bool
+	}{
+		{"unmentioned", &models.Message{Text: "just chatting", Chat: group, From: user}, false},
+		{"other mention", &models.Message{Text: "@someone hi", Chat: group, From: user,
+			Entities: []models.MessageEntity{{Type: models.MessageEntityTypeMention, Offset: 0, Length: 8}}}, false},
+		{"mentioned", &models.Message{Text: "привет @gptbot what time is it", Chat: group, From: user,
+			Entities: []models.MessageEntity{{Type: models.MessageEntityTypeMention, Offset: 7, Length: 7}}}, true},
+		{"reply to bot", &models.Message{Text: "and tomorrow?", Chat: group, From: user,
+			ReplyToMessage: &models.Message{ID: 5, From: &models.User{ID: 99}}}, true},
+		{"private", &models.Message{Text: "hello", Chat: models.Chat{ID: 1, Type: models.ChatTypePrivate}, From: user}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			prompts = nil
+			HandleUpdate(context.Background(), &testBot{}, &models.Update{Message: c.msg})
+			if got := len(prompts) == 1; got != c.answer {
+				t.Fatalf("answered = %v, want %v", got, c.answer)
+			}
+			if c.answer && strings.Contains(prompts[0], "@gptbot") {
+				t.Fatalf("mention not stripped: %q", prompts[0])
+			}
+		})
+	}
+
+	HandleUpdate(context.Background(), cb, cmdUpdate("/setmentiononly demo off"))
+	prompts = nil
+	HandleUpdate(context.Background(), &testBot{}, &models.Update{Message: &models.Message{Text: "just chatting", Chat: group, From: user}})
+	if len(prompts) != 1 {
+		t.Fatal("group message ignored with mention-only off")
+	}
+}
+
+func TestProgressSendFailure(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	reply := "answer"
+	var respErr error
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: reply}, respErr
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	for _, tc := range []struct {
+		name string
+		fail func() (*models.Message, error)
+	}{
+		{"error", func() (*models.Message, error) { return nil, fmt.Errorf("telegram down") }},
+		{"nil message", func() (*models.Message, error) { return nil, nil }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			respErr = nil
+			b := &testBot{}
+			b.send = func(ctx context.Context, params *tg.SendMessageParams) (*models.Message, error) {
+				if params.Text == "Sending to ChatGPT..." {
+					return tc.fail()
+				}
+				return &models.Message{ID: 7}, nil
+			}
+			HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{ID: 3, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+			if len(b.edits) != 0 {
+				t.Fatalf("edited a missing progress message: %v", b.edits)
+			}
+			last := b.sentParams[len(b.sentParams)-1]
+			if last.Text != "answer" || last.ReplyMarkup == nil {
+				t.Fatalf("reply not sent fresh: %+v", last)
+			}
+			if last.ReplyParameters == nil || last.ReplyParameters.MessageID != 3 {
+				t.Fatalf("reply params = %+v", last.ReplyParameters)
+			}
+		})
+	}
+
+	t.Run("request error", func(t *testing.T) {
+		respErr = fmt.Errorf("boom")
+		b := &testBot{}
+		b.send = func(ctx context.Context, params *tg.SendMessageParams) (*models.Message, error) {
+			if params.Text == "Sending to ChatGPT..." {
+				return nil, fmt.Errorf("telegram down")
+			}
+			return &models.Message{ID: 7}, nil
+		}
+		HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{ID: 3, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+		if len(b.edits) != 0 {
+			t.Fatalf("edited a missing progress message: %v", b.edits)
+		}
+		if got := b.sent[len(b.sent)-1]; got != classifyOpenAIError(respErr) {
+			t.Fatalf("error reply = %q", got)
+		}
+	})
+}
+
+// apiError builds an OpenAI API error that can be logged like a real one.
+func apiError(status int, code string) *openai.Error {
+	req, _ := http.NewRequest(http.MethodPost, "https://api.openai.com/v1/responses", nil)
+	return &openai.Error{StatusCode: status, Code: code, Request: req, Response: &http.Response{StatusCode: status}}
+}
+
+func TestFallbackModel(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.SaveProjectModel("demo", "gpt-old"); err != nil {
+		t.Fatalf("save model: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 10); err != nil {
+		t.Fatalf("save limit: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	var requested []string
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		requested = append(requested, string(params.Model))
+		if params.Model == "gpt-old" {
+			return responseResult{}, apiError(404, "model_not_found")
+		}
+		return responseResult{Text: "fresh answer"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	upd := &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	if len(requested) != 1 {
+		t.Fatalf("retried without fallback: %v", requested)
+	}
+
+	cb := &testBot{}
+	HandleUpdate(context.Background(), cb, cmdUpdate("/setfallback demo gpt-new"))
+	if got := cb.sent[len(cb.sent)-1]; got != "Project 'demo' falls back to model 'gpt-new'." {
+		t.Fatalf("set reply = %q", got)
+	}
+
+	requested = nil
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	if !reflect.DeepEqual(requested, []string{"gpt-old", "gpt-new"}) {
+		t.Fatalf("models = %v", requested)
+	}
+	want := "fresh answer\n\n(answered by gpt-new because gpt-old was unavailable)"
+	if got := b.edits[len(b.edits)-1].Text; got != want {
+		t.Fatalf("reply = %q, want %q", got, want)
+	}
+	hist, _ := storage.LoadProjectHistory("demo")
+	last := hist[len(hist)-1]
+	if last.Content != "fresh answer" || last.WhoName != "ChatGPT gpt-new" {
+		t.Fatalf("history = %+v", last)
+	}
+
+	// other errors are not retried
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		requested = append(requested, string(params.Model))
+		return responseResult{}, apiError(429, "rate_limit_exceeded")
+	}
+	requested = nil
+	HandleUpdate(context.Background(), &testBot{}, upd)
+	if len(requested) != 1 {
+		t.Fatalf("retried a non-model error: %v", requested)
+	}
+
+	HandleUpdate(context.Background(), cb, cmdUpdate("/setfallback demo off"))
+	HandleUpdate(context.Background(), cb, cmdUpdate("/fallback demo"))
+	if got := cb.sent[len(cb.sent)-1]; got != "Project 'demo' has no fallback model." {
+		t.Fatalf("fallback reply = %q", got)
+	}
+	fallbackModel = "gpt-global"
+	defer func() { fallbackModel = "" }()
+	HandleUpdate(context.Background(), cb, cmdUpdate("/fallback demo"))
+	if got := cb.sent[len(cb.sent)-1]; got != "Project 'demo' falls back to model 'gpt-global'." {
+		t.Fatalf("global fallback reply = %q", got)
+	}
+}
+
+func TestHistoryMaxLen(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	storage.MapTopic(1, 0, "demo")
+	storage.SaveHistoryLimit("demo", 10)
+
+	var sentText string
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		items := params.Input.OfInputItemList
+		sentText = items[len(items)-1].OfMessage.Content.OfInputItemContentList[0].OfInputText.Text
+		return responseResult{Text: "short reply"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	cb := &testBot{}
+	HandleUpdate(context.Background(), cb, cmdUpdate("/sethistorymaxlen demo 100"))
+	if got := cb.sent[len(cb.sent)-1]; got != "Project 'demo' stores at most 100 characters per history message." {
+		t.Fatalf("set reply = %q", got)
+	}
+
+	long := strings.Repeat("ж", 50000)
+	HandleUpdate(context.Background(), &testBot{}, &models.Update{Message: &models.Message{Text: long, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	if !strings.HasSuffix(sentText, long) {
+		t.Fatalf("current request got %d characters, want the full %d", len([]rune(sentText)), len([]rune(long)))
+	}
+	hist, _ := storage.LoadProjectHistory("demo")
+	if len(hist) != 2 {
+		t.Fatalf("history = %+v", hist)
+	}
+	stored := hist[0].Content
+	if n := len([]rune(stored)); n != 100 || !strings.HasSuffix(stored, truncatedMarker) {
+		t.Fatalf("stored %d characters: %q", n, stored)
+	}
+	if hist[1].Content != "short reply" {
+		t.Fatalf("short reply changed: %q", hist[1].Content)
+	}
+
+	HandleUpdate(context.Background(), cb, cmdUpdate("/sethistorymaxlen demo off"))
+	HandleUpdate(context.Background(), &testBot{}, &models.Update{Message: &models.Message{Text: long, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	hist, _ = storage.LoadProjectHistory("demo")
+	if hist[2].Content != long {
+		t.Fatalf("message truncated with the limit off: %d characters", len([]rune(hist[2].Content)))
+	}
+
+	HandleUpdate(context.Background(), cb, cmdUpdate("/sethistorymaxlen demo 5"))
+	if got := cb.sent[len(cb.sent)-1]; !strings.HasPrefix(got, "Please enter a number greater than") {
+		t.Fatalf("invalid value reply = %q", got)
+	}
+}
+
+func TestChunkNumbers(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	storage.MapTopic(1, 0, "demo")
+
+	long := strings.Repeat("a", 3990) + strings.Repeat("b", 3990) + "c"
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: long}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	cb := &testBot{}
+	HandleUpdate(context.Background(), cb, cmdUpdate("/setchunknumbers demo on"))
+	if got := cb.sent[len(cb.sent)-1]; got != "Continuation numbering for project 'demo' set to on." {
+		t.Fatalf("set reply = %q", got)
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{ID: 5, Text: "long please", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	first := b.edits[len(b.edits)-1].Text
+	rest := b.sent[1:]
+	if len(rest) != 2 {
+		t.Fatalf("continuations = %d, want 2: %q", len(rest), rest)
+	}
+	if strings.HasPrefix(first, "(continued") {
+		t.Fatalf("first chunk numbered: %q", first[:20])
+	}
+	for i, c := range rest {
+		prefix := fmt.Sprintf("(continued %d/3)\n", i+2)
+		if !strings.HasPrefix(c, prefix) {
+			t.Fatalf("chunk %d starts with %q, want %q", i+2, c[:20], prefix)
+		}
+		if n := len([]rune(c)); n > 4000 {
+			t.Fatalf("chunk %d has %d characters", i+2, n)
+		}
+		rest[i] = strings.TrimPrefix(c, prefix)
+	}
+	if got := first + strings.Join(rest, ""); got != long {
+		t.Fatal("reply text changed by numbering")
+	}
+	// each continuation replies to the previous chunk, so they stay ordered
+	if b.sentParams[2].ReplyParameters.MessageID != b.sentParams[1].ReplyParameters.MessageID+1 {
+		t.Fatalf("chunks not chained: %+v %+v", b.sentParams[1].ReplyParameters, b.sentParams[2].ReplyParameters)
+	}
+}
+
+func TestReplyFooter(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveHistoryLimit("demo", 10); err != nil {
+		t.Fatalf("save history limit: %v", err)
+	}
+
+	reply := "short answer"
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: reply}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	cb := &testBot{}
+	HandleUpdate(context.Background(), cb, cmdUpdate("/setfooter demo"))
+	HandleUpdate(context.Background(), cb, &models.Update{Message: &models.Message{Text: "— Answered by {project} ({model})", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	if got := cb.sent[len(cb.sent)-1]; got != "Footer saved." {
+		t.Fatalf("set reply = %q", got)
+	}
+	footer := "— Answered by demo (" + defaultModel + ")"
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{ID: 5, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	if got := b.edits[len(b.edits)-1].Text; got != "short answer\n\n"+footer {
+		t.Fatalf("sent reply = %q", got)
+	}
+
+	// on a split reply only the last chunk carries the footer
+	reply = strings.Repeat("a", 4000) + strings.Repeat("b", 100)
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{ID: 6, Text: "long", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	if got := b.edits[len(b.edits)-1].Text; strings.Contains(got, footer) {
+		t.Fatal("footer on the first chunk")
+	}
+	if got := b.sent[len(b.sent)-1]; got != strings.Repeat("b", 100)+"\n\n"+footer {
+		t.Fatalf("last chunk = %q", got)
+	}
+
+	hist, err := storage.LoadProjectHistory("demo")
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	var stored int
+	for _, h := range hist {
+		if strings.Contains(h.Content, "Answered by") {
+			t.Fatalf("footer stored in history: %q", h.Content)
+		}
+		if h.Role == storage.RoleAssistant {
+			stored++
+		}
+	}
+	if stored != 2 {
+		t.Fatalf("stored assistant messages = %d, want 2", stored)
+	}
+}
+
+func TestReplyChunks(t *testing.T) {
+	cases := []struct {
+		name, text, footer string
+		numbered           bool
+		want               []string
+	}{
+		{"no footer", "abcdefgh", "", false, []string{"abcdef", "gh"}},
+		{"footer fits", "abc", "f", false, []string{"abc\n\nf"}},
+		{"footer on last chunk", "abcdefgh", "f", false, []string{"abcdef", "gh\n\nf"}},
+		{"footer of its own", "abcdef", "foot", false, []string{"abcdef", "foot"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := replyChunks(c.text, c.footer, 6, c.numbered); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("replyChunks = %q, want %q", got, c.want)
+			}
+		})
+	}
+
+	// the footer chunk counts towards the continuation numbering
+	text := strings.Repeat("x", 2*(4000-32))
+	got := replyChunks(text, "footer", 4000, true)
+	if len(got) != 3 || got[2] != "(continued 3/3)\nfooter" {
+		t.Fatalf("numbered chunks = %d, last %q", len(got), got[len(got)-1])
+	}
+}
+
+func TestNewResponseResult(t *testing.T) {
+	var resp responses.Response
+	data := `{"output":[
+		{"type":"reasoning","id":"rs_1","summary":[{"type":"summary_text","text":"first"},{"type":"summary_text","text":"second"}]},
+		{"type":"message","id":"msg_1","role":"assistant","status":"completed","content":[{"type":"output_text","text":"the answer","annotations":[
+			{"type":"url_citation","url":"https://example.com/a","title":"Page A","start_index":0,"end_index":3},
+			{"type":"url_citation","url":"https://example.com/a","title":"Page A","start_index":4,"end_index":7},
+			{"type":"file_citation","file_id":"f1","filename":"doc.pdf","index":1},
+			{"type":"url_citation","url":"https://example.org/b","start_index":8,"end_index":10}
+		]}]}
+	]}`
+	if err := json.Unmarshal([]byte(data), &resp); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	res := newResponseResult(&resp)
+	if res.Text != "the answer" {
+		t.Fatalf("text = %q", res.Text)
+	}
+	if res.ReasoningSummary != "first\n\nsecond" {
+		t.Fatalf("reasoning = %q", res.ReasoningSummary)
+	}
+	want := []citation{{URL: "https://example.com/a", Title: "Page A"}, {URL: "https://example.org/b"}}
+	if !reflect.DeepEqual(res.Citations, want) {
+		t.Fatalf("citations = %+v, want %+v", res.Citations, want)
+	}
+}
+
+func TestCitationsFooter(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	storage.MapTopic(1, 0, "demo")
+	storage.SaveHistoryLimit("demo", 10)
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: "the news", Citations: []citation{
+			{URL: "https://example.com/a", Title: "Page A"},
+			{URL: "https://example.org/b"},
+		}}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	upd := &models.Update{Message: &models.Message{Text: "news?", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	want := "the news\n\nSources:\n1. Page A - https://example.com/a\n2. https://example.org/b"
+	if got := b.edits[len(b.edits)-1].Text; got != want {
+		t.Fatalf("reply = %q, want %q", got, want)
+	}
+	hist, _ := storage.LoadProjectHistory("demo")
+	if last := hist[len(hist)-1]; last.Content != "the news" {
+		t.Fatalf("footer stored in history: %q", last.Content)
+	}
+
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/setcitations demo off"))
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, upd)
+	if got := b.edits[len(b.edits)-1].Text; got != "the news" {
+		t.Fatalf("reply with citations off = %q", got)
+	}
+}
+
+func TestPreviewCommand(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	storage.SaveProjectInstruction("demo", "be a pirate")
+	storage.SaveHistoryLimit("demo", 10)
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: storage.RoleUser, WhoName: "bob", When: 1, Content: "earlier question"})
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: storage.RoleAssistant, WhoName: "ChatGPT", When: 2, Content: "earlier answer"})
+
+	called := false
+	origResp := openAIResponses
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		called = true
+		return responseResult{}, nil
+	}
+	defer func() { openAIResponses = origResp }()
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/preview what now?"))
+
+	if called {
+		t.Fatal("preview must not call OpenAI")
+	}
+	if len(b.sent) != 1 {
+		t.Fatalf("expected one preview message, got %v", b.sent)
+	}
+	for _, want := range []string{"[system]\nbe a pirate", "earlier question", "[assistant]", "earlier answer", "[user]", "what now?"} {
+		if !strings.Contains(b.sent[0], want) {
+			t.Fatalf("preview %q missing %q", b.sent[0], want)
+		}
+	}
+	hist, _ := storage.LoadProjectHistory("demo")
+	if len(hist) != 2 {
+		t.Fatalf("history changed: %d messages", len(hist))
+	}
+
+	// the JSON mode instruction is part of the request as well
+	storage.SaveProjectJSONMode("demo", "on")
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/preview what now?"))
+	if len(b.sent) != 1 || !strings.Contains(b.sent[0], "[system]\n"+jsonModeInstruction) {
+		t.Fatalf("preview %q missing the JSON mode instruction", b.sent)
+	}
+}
+
+func TestUndoCommand(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: storage.RoleUser, When: 1, Content: "q"})
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: storage.RoleAssistant, When: 2, Content: "a"})
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/undo"))
+	if got := b.sent[len(b.sent)-1]; got != "Removed the last exchange (2 messages) from history." {
+		t.Fatalf("reply = %q", got)
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/undo"))
+	if got := b.sent[len(b.sent)-1]; got != "Nothing to undo." {
+		t.Fatalf("reply = %q", got)
+	}
+}
+
+func TestBackupCommand(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	origAdmins := adminUsers
+	adminUsers = map[int64]bool{1: true}
+	defer func() { adminUsers = origAdmins }()
+
+	b := &testBot{}
+	upd := cmdUpdate("/backup")
+	upd.Message.From.ID = 2
+	HandleUpdate(context.Background(), b, upd)
+	if len(b.documents) != 0 || b.sent[len(b.sent)-1] != "Admins only." {
+		t.Fatalf("non-admin got %d documents, replies %q", len(b.documents), b.sent)
+	}
+
+	HandleUpdate(context.Background(), b, cmdUpdate("/backup"))
+	if len(b.documents) != 1 {
+		t.Fatalf("documents = %d, want 1", len(b.documents))
+	}
+	doc := b.documents[0].Document.(*models.InputFileUpload)
+	if !strings.HasPrefix(doc.Filename, "bot-") || !strings.HasSuffix(doc.Filename, ".db") {
+		t.Fatalf("file name = %q", doc.Filename)
+	}
+	data, err := io.ReadAll(doc.Data)
+	if err != nil {
+		t.Fatalf("read document: %v", err)
+	}
+	storage.Close()
+	path := filepath.Join(t.TempDir(), doc.Filename)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("write backup: %v", err)
+	}
+	if err := storage.Init(path); err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	if ok, _ := storage.ProjectExists("demo"); !ok {
+		t.Fatal("project missing from backup")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	storage.SaveHistoryLimit("demo", 0)
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: "pong"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	upd := &models.Update{Message: &models.Message{Text: "ping", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), &testBot{}, upd)
+	if got, _ := storage.LoadAudit("demo"); len(got) != 0 {
+		t.Fatalf("audit written while disabled: %+v", got)
+	}
+
+	auditEnabled = true
+	defer func() { auditEnabled = false }()
+	HandleUpdate(context.Background(), &testBot{}, upd)
+	got, _ := storage.LoadAudit("demo")
+	if len(got) != 1 || got[0].Prompt != "ping" || got[0].Reply != "pong" || got[0].UserID != 1 || got[0].Model == "" {
+		t.Fatalf("audit = %+v", got)
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/audit demo"))
+	if len(b.sent) != 1 || b.sent[0] != "Admins only." {
+		t.Fatalf("unexpected reply: %v", b.sent)
+	}
+
+	adminUsers = map[int64]bool{1: true}
+	defer func() { adminUsers = nil }()
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/audit demo"))
+	if len(b.documents) != 1 {
+		t.Fatalf("expected audit document, got messages %v", b.sent)
+	}
+	doc := b.documents[0].Document.(*models.InputFileUpload)
+	data, _ := io.ReadAll(doc.Data)
+	var e storage.AuditEntry
+	if err := json.Unmarshal(bytes.TrimSpace(data), &e); err != nil || e.Prompt != "ping" || e.Reply != "pong" {
+		t.Fatalf("export = %q (%v)", data, err)
+	}
+	if doc.Filename != "audit-demo.jsonl" {
+		t.Fatalf("filename = %q", doc.Filename)
+	}
+}
+
+func TestFeedbackButtons(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: "answer"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{ID: 5, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	last := b.edits[len(b.edits)-1]
+	kb, ok := last.ReplyMarkup.(*models.InlineKeyboardMarkup)
+	if !ok || len(kb.InlineKeyboard) != 1 || len(kb.InlineKeyboard[0]) != 2 {
+		t.Fatalf("expected feedback keyboard on reply, got %+v", last.ReplyMarkup)
+	}
+
+	press := func(data string) {
+		HandleUpdate(context.Background(), b, &models.Update{CallbackQuery: &models.CallbackQuery{
+			ID:      "cb",
+			From:    models.User{ID: 1},
+			Data:    data,
+			Message: models.MaybeInaccessibleMessage{Message: &models.Message{ID: last.MessageID, Chat: models.Chat{ID: 1}}},
+		}})
+	}
+	press(kb.InlineKeyboard[0][1].CallbackData)
+	if got, err := storage.LoadFeedback("demo", last.MessageID); err != nil || got != "down" {
+		t.Fatalf("feedback = %q, %v", got, err)
+	}
+	press(kb.InlineKeyboard[0][0].CallbackData)
+	if got, _ := storage.LoadFeedback("demo", last.MessageID); got != "up" {
+		t.Fatalf("feedback after change = %q", got)
+	}
+	if len(b.answers) != 2 || b.answers[1].CallbackQueryID != "cb" || b.answers[1].Text != "Thanks for the feedback!" {
+		t.Fatalf("unexpected callback answers %+v", b.answers)
+	}
+
+	if kb.InlineKeyboard[0][0].CallbackData != "feedback:up:demo" {
+		t.Fatalf("project missing from callback data %q", kb.InlineKeyboard[0][0].CallbackData)
+	}
+
+	press("unknown")
+	if len(b.answers) != 3 {
+		t.Fatalf("unknown callback not answered: %+v", b.answers)
+	}
+
+	// buttons without the project resolve it from the topic mapping
+	press(feedbackDownData)
+	if got, _ := storage.LoadFeedback("demo", last.MessageID); got != "down" {
+		t.Fatalf("legacy feedback = %q", got)
+	}
+
+	// a reply redirected to an unmapped topic is still rated for its project
+	HandleUpdate(context.Background(), b, &models.Update{CallbackQuery: &models.CallbackQuery{
+		ID:      "cb",
+		From:    models.User{ID: 1},
+		Data:    "feedback:up:demo",
+		Message: models.MaybeInaccessibleMessage{Message: &models.Message{ID: 42, Chat: models.Chat{ID: 1}, MessageThreadID: 7}},
+	}})
+	if got, err := storage.LoadFeedback("demo", 42); err != nil || got != "up" {
+		t.Fatalf("redirected feedback = %q, %v", got, err)
+	}
+}
+
+func TestCallbackDispatch(t *testing.T) {
+	logging.Init()
+	var gotArg string
+	callbackHandlers["test"] = func(ctx context.Context, b Bot, cq *models.CallbackQuery, arg string) string {
+		gotArg = arg
+		return "done"
+	}
+	defer delete(callbackHandlers, "test")
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, &models.Update{CallbackQuery: &models.CallbackQuery{ID: "1", Data: "test:page:2"}})
+	if gotArg != "page:2" {
+		t.Fatalf("handler arg = %q", gotArg)
+	}
+	HandleUpdate(context.Background(), b, &models.Update{CallbackQuery: &models.CallbackQuery{ID: "2", Data: "nope"}})
+	if len(b.answers) != 2 || b.answers[0].CallbackQueryID != "1" || b.answers[0].Text != "done" || b.answers[1].CallbackQueryID != "2" || b.answers[1].Text != "" {
+		t.Fatalf("unexpected answers %+v", b.answers)
+	}
+	if len(b.sent) != 0 {
+		t.Fatalf("expected no messages, got %v", b.sent)
+	}
+
+	allowedUsers = map[int64]bool{5: true}
+	defer func() { allowedUsers = nil }()
+	gotArg = ""
+	HandleUpdate(context.Background(), b, &models.Update{CallbackQuery: &models.CallbackQuery{ID: "3", From: models.User{ID: 9}, Data: "test:x"}})
+	if gotArg != "" || b.answers[2].Text != "Not allowed." {
+		t.Fatalf("disallowed user reached handler: arg %q, answers %+v", gotArg, b.answers)
+	}
+}
+
+func TestAppendHistoryConcurrent(t *testing.T) {
+	initStore2(t)
+	const workers, rounds, limit = 8, 10, 40
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				tag := fmt.Sprintf("%d-%d", w, r)
+				_, err := appendHistory("demo", limit,
+					storage.HistoryMessage{Role: storage.RoleUser, When: 1, Content: "q" + tag},
+					storage.HistoryMessage{Role: storage.RoleAssistant, When: 1, Content: "a" + tag},
+				)
+				if err != nil {
+					t.Errorf("append: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	hist, err := storage.LoadProjectHistory("demo")
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	if len(hist) != limit {
+		t.Fatalf("history has %d messages, want %d", len(hist), limit)
+	}
+	for i := 0; i < len(hist); i += 2 {
+		q, a := hist[i].Content, hist[i+1].Content
+		if q[0] != 'q' || a[0] != 'a' || q[1:] != a[1:] {
+			t.Fatalf("exchange split at %d: %q, %q", i, q, a)
+		}
+	}
+}
+
+func TestRequestLimiterQueues(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	for _, topic := range []int{1, 2} {
+		if err := storage.MapTopic(1, topic, "demo"); err != nil {
+			t.Fatalf("map topic: %v", err)
+		}
+	}
+	requestSlots.setMax(1)
+	defer requestSlots.setMax(0)
+
+	started := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		started <- struct{}{}
+		<-unblock
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	var queuedEdit sync.WaitGroup
+	queuedEdit.Add(1)
+	b1 := &testBot{}
+	b2 := &testBot{edit: func(ctx context.Context, params *tg.EditMessageTextParams) (*models.Message, error) {
+		if strings.HasPrefix(params.Text, "Queued") {
+			queuedEdit.Done()
+		}
+		return &models.Message{ID: params.MessageID}, nil
+	}}
+	send := func(b *testBot, topic int) *sync.WaitGroup {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, MessageThreadID: topic, From: &models.User{ID: 1}}})
+		}()
+		return &wg
+	}
+
+	done1 := send(b1, 1)
+	<-started
+	done2 := send(b2, 2)
+	queuedEdit.Wait()
+	select {
+	case <-started:
+		t.Fatal("second request started while the only slot was busy")
+	default:
+	}
+	if got := b2.edits[0].Text; got != "Queued (position 1)..." {
+		t.Fatalf("queued status = %q", got)
+	}
+
+	close(unblock)
+	done1.Wait()
+	done2.Wait()
+	if len(started) != 1 {
+		t.Fatalf("second request did not run after the slot was released")
+	}
+}
+
+func TestRequestLimiterCancel(t *testing.T) {
+	l := &requestLimiter{max: 1}
+	release, err := l.acquire(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	// a queued request gives up when its context ends
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.acquire(ctx, func(int) { cancel() })
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("cancelled acquire = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire ignored the cancelled context")
+	}
+	if len(l.waiting) != 0 {
+		t.Fatalf("cancelled request left in the queue: %d waiting", len(l.waiting))
+	}
+
+	// the slot is still handed on once released
+	release()
+	release, err = l.acquire(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	release()
+	if l.active != 0 {
+		t.Fatalf("active = %d after all releases", l.active)
+	}
+}
+
+func TestReplyTopicRedirect(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 3, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: strings.Repeat("a", 4500)}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	ask := func() *testBot {
+		b := &testBot{}
+		HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{ID: 9, Text: "hi", Chat: models.Chat{ID: 1}, MessageThreadID: 3, From: &models.User{ID: 1}}})
+		return b
+	}
+
+	b := ask()
+	for _, p := range b.sentParams {
+		if p.MessageThreadID != 3 {
+			t.Fatalf("unset redirect: message sent to topic %d", p.MessageThreadID)
+		}
+	}
+
+	cmd := &testBot{}
+	inTopic := func(text string) *models.Update {
+		u := cmdUpdate(text)
+		u.Message.MessageThreadID = 3
+		return u
+	}
+	HandleUpdate(context.Background(), cmd, cmdUpdate("/setreplytopic 7"))
+	if cmd.sent[0] != "Topic is not mapped to a project." {
+		t.Fatalf("unexpected reply: %v", cmd.sent)
+	}
+	HandleUpdate(context.Background(), cmd, inTopic("/setreplytopic -1"))
+	if cmd.sent[1] != "Please enter a non-negative topic id." {
+		t.Fatalf("unexpected reply: %v", cmd.sent)
+	}
+	HandleUpdate(context.Background(), cmd, inTopic("/setreplytopic 7"))
+	if cmd.sent[2] != "Questions to project 'demo' in this topic are now answered in topic 7." {
+		t.Fatalf("unexpected reply: %v", cmd.sent)
+	}
+	HandleUpdate(context.Background(), cmd, inTopic("/replytopic"))
+	if cmd.sent[3] != "Questions to project 'demo' in this topic are answered in topic 7." {
+		t.Fatalf("unexpected reply: %v", cmd.sent)
+	}
+
+	// the same project mapped in another chat keeps answering in place
+	if err := storage.MapTopic(2, 3, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	other := &testBot{}
+	HandleUpdate(context.Background(), other, &models.Update{Message: &models.Message{ID: 9, Text: "hi", Chat: models.Chat{ID: 2}, MessageThreadID: 3, From: &models.User{ID: 1}}})
+	for _, p := range other.sentParams {
+		if p.MessageThreadID != 3 {
+			t.Fatalf("other chat: message sent to topic %d", p.MessageThreadID)
+		}
+	}
+
+	b = ask()
+	if len(b.sentParams) != 2 {
+		t.Fatalf("expected progress and second chunk, got %d messages", len(b.sentParams))
+	}
+	for _, p := range b.sentParams {
+		if p.MessageThreadID != 7 {
+			t.Fatalf("message sent to topic %d, want 7", p.MessageThreadID)
+		}
+	}
+	if b.sentParams[0].ReplyParameters != nil {
+		t.Fatal("progress message must not reply across topics")
+	}
+
+	HandleUpdate(context.Background(), cmd, inTopic("/setreplytopic off"))
+	b = ask()
+	if b.sentParams[0].MessageThreadID != 3 {
+		t.Fatalf("cleared redirect: message sent to topic %d", b.sentParams[0].MessageThreadID)
+	}
+}
+
+func TestAskCommand(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	for _, p := range []string{"mapped", "other"} {
+		if err := storage.SaveProject(p); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+	}
+	storage.MapTopic(1, 0, "mapped")
+	storage.SaveProjectModel("mapped", "gpt-4o")
+	storage.SaveProjectInstruction("mapped", "mapped rule")
+	storage.SaveProjectModel("other", "gpt-4.1")
+	storage.SaveProjectInstruction("other", "be brief")
+	storage.SaveProjectWebSearch("other", "low")
+	storage.SaveHistoryLimit("other", 10)
+	storage.AddHistoryMessage("other", storage.HistoryMessage{Role: storage.RoleUser, When: 1, Content: "earlier"})
+
+	var captured responses.ResponseNewParams
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = params
+		return responseResult{Text: "short answer"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	auditEnabled = true
+	defer func() { auditEnabled = false }()
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/ask other what is up?"))
+	if audit, _ := storage.LoadAudit("other"); len(audit) != 1 || audit[0].Prompt != "what is up?" || audit[0].Reply != "short answer" || audit[0].Model != "gpt-4.1" {
+		t.Fatalf("audit = %+v", audit)
+	}
+	if string(captured.Model) != "gpt-4.1" {
+		t.Fatalf("model = %q", captured.Model)
+	}
+	items := captured.Input.OfInputItemList
+	if len(items) != 2 || items[0].OfMessage.Content.OfString.Value != "be brief" {
+		t.Fatalf("expected instruction and question only, got %+v", items)
+	}
+	if got := items[1].OfMessage.Content.OfInputItemContentList[0].OfInputText.Text; got != "what is up?" {
+		t.Fatalf("question = %q", got)
+	}
+	if len(captured.Tools) != 1 || captured.Tools[0].OfWebSearchPreview == nil {
+		t.Fatalf("expected web search tool, got %+v", captured.Tools)
+	}
+	if len(b.sent) != 1 || b.sent[0] != "short answer" {
+		t.Fatalf("unexpected messages: %v", b.sent)
+	}
+	if hist, _ := storage.LoadProjectHistory("other"); len(hist) != 1 {
+		t.Fatalf("history written without --history: %+v", hist)
+	}
+
+	HandleUpdate(context.Background(), b, cmdUpdate("/ask other --history and now?"))
+	items = captured.Input.OfInputItemList
+	if len(items) != 3 || !strings.HasSuffix(items[1].OfMessage.Content.OfString.Value, "earlier") {
+		t.Fatalf("expected replayed history, got %+v", items)
+	}
+	hist, _ := storage.LoadProjectHistory("other")
+	if len(hist) != 3 || hist[1].Content != "and now?" || hist[2].Content != "short answer" {
+		t.Fatalf("history = %+v", hist)
+	}
+	if h, _ := storage.LoadProjectHistory("mapped"); len(h) != 0 {
+		t.Fatalf("mapped project history changed: %+v", h)
+	}
+
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/ask other"))
+	if len(b.sent) != 1 || b.sent[0] != askUsage {
+		t.Fatalf("unexpected messages: %v", b.sent)
+	}
+}
+
+func TestCompareCommand(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	storage.MapTopic(1, 0, "demo")
+	storage.SaveProjectInstruction("demo", "be brief")
+	storage.SaveHistoryLimit("demo", 10)
+
+	var mu sync.Mutex
+	instructions := map[string]string{}
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		mu.Lock()
+		instructions[string(params.Model)] = params.Input.OfInputItemList[0].OfMessage.Content.OfString.Value
+		mu.Unlock()
+		switch params.Model {
+		case "model-a":
+			return responseResult{Text: "answer a"}, nil
+		case "model-b":
+			return responseResult{Text: "answer b"}, nil
+		}
+		return responseResult{}, apiError(404, "model_not_found")
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	auditEnabled = true
+	defer func() { auditEnabled = false }()
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/compare model-a model-b which is better?"))
+	got := append([]string(nil), b.sent...)
+	sort.Strings(got)
+	if want := []string{"[model-a]\nanswer a", "[model-b]\nanswer b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("replies = %q, want %q", got, want)
+	}
+	audit, _ := storage.LoadAudit("demo")
+	var audited []string
+	for _, e := range audit {
+		audited = append(audited, e.Model+":"+e.Reply)
+	}
+	sort.Strings(audited)
+	if want := []string{"model-a:answer a", "model-b:answer b"}; !reflect.DeepEqual(audited, want) {
+		t.Fatalf("audit = %q, want %q", audited, want)
+	}
+	if instructions["model-a"] != "be brief" || instructions["model-b"] != "be brief" {
+		t.Fatalf("instruction not reused: %v", instructions)
+	}
+	if hist, _ := storage.LoadProjectHistory("demo"); len(hist) != 0 {
+		t.Fatalf("history written: %+v", hist)
+	}
+
+	// a failing model does not prevent the other answer
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/compare model-a gone which is better?"))
+	got = append([]string(nil), b.sent...)
+	sort.Strings(got)
+	want := []string{"[gone]\n" + classifyOpenAIError(apiError(404, "model_not_found")), "[model-a]\nanswer a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("replies = %q, want %q", got, want)
+	}
+
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/compare model-a model-b"))
+	if len(b.sent) != 1 || b.sent[0] != compareUsage {
+		t.Fatalf("unexpected messages: %v", b.sent)
+	}
+}
+
+func TestCompactCommand(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	origAdmins := adminUsers
+	adminUsers = map[int64]bool{1: true}
+	defer func() { adminUsers = origAdmins }()
+
+	b := &testBot{}
+	upd := cmdUpdate("/compact")
+	upd.Message.From.ID = 2
+	HandleUpdate(context.Background(), b, upd)
+	if b.sent[len(b.sent)-1] != "Admins only." {
+		t.Fatalf("non-admin reply = %q", b.sent)
+	}
+
+	HandleUpdate(context.Background(), b, cmdUpdate("/compact"))
+	if reply := b.sent[len(b.sent)-1]; !strings.HasPrefix(reply, "Database compacted: ") {
+		t.Fatalf("reply = %q", reply)
+	}
+	if ok, _ := storage.ProjectExists("demo"); !ok {
+		t.Fatal("project missing after compaction")
+	}
+}
+
+func TestProjectAPIKey(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "global"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	var keys []string
+	origEnc, origDec := encryptAPIKey, decryptAPIKey
+	origClient, origResp := openAIClientWithKey, openAIResponses
+	encryptAPIKey = func(s string) (string, error) { return "enc:" + s, nil }
+	decryptAPIKey = func(s string) (string, error) { return strings.TrimPrefix(s, "enc:"), nil }
+	openAIClientWithKey = func(key string) *openai.Client {
+		keys = append(keys, key)
+		return &openai.Client{}
+	}
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() {
+		encryptAPIKey, decryptAPIKey = origEnc, origDec
+		openAIClientWithKey, openAIResponses = origClient, origResp
+	}()
+
+	ask := func() string {
+		keys = nil
+		upd := &models.Update{Message: &models.Message{Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+		HandleUpdate(context.Background(), &testBot{}, upd)
+		if len(keys) == 0 {
+			t.Fatal("no client created")
+		}
+		return keys[0]
+	}
+	if got := ask(); got != "global" {
+		t.Fatalf("key without project key = %q, want global", got)
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setkey demo"))
+	upd := cmdUpdate("sk-team")
+	upd.Message.ID = 42
+	HandleUpdate(context.Background(), b, upd)
+	if len(b.deleted) != 1 || b.deleted[0].MessageID != 42 {
+		t.Fatalf("deleted = %+v, want the key message", b.deleted)
+	}
+	if got, _ := storage.LoadProjectAPIKey("demo"); got != "enc:sk-team" {
+		t.Fatalf("stored key = %q, want it encrypted", got)
+	}
+	if got := ask(); got != "sk-team" {
+		t.Fatalf("key with project key = %q, want sk-team", got)
+	}
+
+	HandleUpdate(context.Background(), b, cmdUpdate("/setkey demo"))
+	HandleUpdate(context.Background(), b, cmdUpdate("off"))
+	if b.sent[len(b.sent)-1] != "Project 'demo' now uses the global API key." {
+		t.Fatalf("reply = %q", b.sent[len(b.sent)-1])
+	}
+	if got := ask(); got != "global" {
+		t.Fatalf("key after off = %q, want global", got)
+	}
+}
+
+func TestMaskAPIKey(t *testing.T) {
+	cases := map[string]string{
+		"sk-proj-abcdef1234": "****1234",
+		"123456789":          "****6789",
+		"12345678":           "****",
+		"":                   "****",
+	}
+	for in, want := range cases {
+		if got := maskAPIKey(in); got != want {
+			t.Fatalf("maskAPIKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestKeyStatusAndDeleteKey(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "global"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	origAdmins := adminUsers
+	adminUsers = map[int64]bool{1: true}
+	origDec := decryptAPIKey
+	decryptAPIKey = func(s string) (string, error) { return strings.TrimPrefix(s, "enc:"), nil }
+	defer func() { adminUsers = origAdmins; decryptAPIKey = origDec }()
+
+	b := &testBot{}
+	last := func() string { return b.sent[len(b.sent)-1] }
+	upd := cmdUpdate("/keystatus demo")
+	upd.Message.From.ID = 2
+	HandleUpdate(context.Background(), b, upd)
+	if last() != "Admins only." {
+		t.Fatalf("non-admin reply = %q", last())
+	}
+
+	HandleUpdate(context.Background(), b, cmdUpdate("/keystatus demo"))
+	if last() != "Project 'demo' uses the global API key." {
+		t.Fatalf("status without key = %q", last())
+	}
+
+	if err := storage.SaveProjectAPIKey("demo", "enc:sk-team-secret-9876"); err != nil {
+		t.Fatalf("save key: %v", err)
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/keystatus demo"))
+	if last() != "Project 'demo' uses its own API key ****9876." || strings.Contains(last(), "secret") {
+		t.Fatalf("status with key = %q", last())
+	}
+	if got := projectAPIKey("demo"); got != "sk-team-secret-9876" {
+		t.Fatalf("key before delete = %q", got)
+	}
+
+	HandleUpdate(context.Background(), b, cmdUpdate("/deletekey demo"))
+	if last() != "Project 'demo' now uses the global API key." {
+		t.Fatalf("delete reply = %q", last())
+	}
+	if _, err := storage.LoadProjectAPIKey("demo"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("key after delete: %v", err)
+	}
+	if got := projectAPIKey("demo"); got != "global" {
+		t.Fatalf("key after delete = %q, want global", got)
+	}
+}
+
+func TestSendRetryOnRateLimit(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	var waits []time.Duration
+	origWait := retryWait
+	retryWait = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	defer func() { retryWait = origWait }()
+
+	failures := 1
+	b := &testBot{}
+	b.send = func(ctx context.Context, params *tg.SendMessageParams) (*models.Message, error) {
+		if failures > 0 {
+			failures--
+			return nil, &tg.TooManyRequestsError{Message: "too many requests", RetryAfter: 3}
+		}
+		return &models.Message{ID: 7}, nil
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/newproject demo"))
+	if len(b.sent) != 2 || b.sent[0] != b.sent[1] {
+		t.Fatalf("sent = %q, want the reply resent once", b.sent)
+	}
+	if len(waits) != 1 || waits[0] != 3*time.Second {
+		t.Fatalf("waits = %v, want [3s]", waits)
+	}
+
+	// the retry limit is respected and the error returned
+	failures = 10
+	waits = nil
+	rb := withSendRetry(b)
+	if _, err := rb.SendMessage(context.Background(), &tg.SendMessageParams{ChatID: 1, Text: "x"}); !tg.IsTooManyRequestsError(err) {
+		t.Fatalf("err = %v, want 429", err)
+	}
+	if len(waits) != sendRetries {
+		t.Fatalf("retries = %d, want %d", len(waits), sendRetries)
+	}
+
+	// other errors are not retried
+	waits = nil
+	b.send = func(ctx context.Context, params *tg.SendMessageParams) (*models.Message, error) {
+		return nil, errors.New("bad request")
+	}
+	if _, err := rb.SendMessage(context.Background(), &tg.SendMessageParams{ChatID: 1, Text: "x"}); err == nil || len(waits) != 0 {
+		t.Fatalf("err = %v, waits = %v", err, waits)
+	}
+}
+
+func TestTranslateCommand(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	storage.SaveProjectInstruction("demo", "be a pirate")
+	storage.SaveHistoryLimit("demo", 10)
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: storage.RoleUser, When: 1, Content: "earlier"})
+
+	var captured responses.ResponseNewParams
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = params
+		return responseResult{Text: "Guten Morgen"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	check := func(name, wantText string) {
+		t.Helper()
+		items := captured.Input.OfInputItemList
+		if len(items) != 2 || items[0].OfMessage == nil || items[1].OfMessage == nil {
+			t.Fatalf("%s: inputs = %+v", name, items)
+		}
+		if got := items[0].OfMessage.Content.OfString.Value; !strings.Contains(got, "into German") || strings.Contains(got, "pirate") {
+			t.Fatalf("%s: instruction = %q", name, got)
+		}
+		if got := items[1].OfMessage.Content.OfString.Value; got != wantText {
+			t.Fatalf("%s: text = %q, want %q", name, got, wantText)
+		}
+		if len(captured.Tools) != 0 {
+			t.Fatalf("%s: expected no tools", name)
+		}
+	}
+
+	auditEnabled = true
+	defer func() { auditEnabled = false }()
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/translate German good morning"))
+	check("inline", "good morning")
+	if audit, _ := storage.LoadAudit("demo"); len(audit) != 1 || audit[0].Prompt != "good morning" || audit[0].Reply != "Guten Morgen" {
+		t.Fatalf("audit = %+v", audit)
+	}
+	if len(b.sent) != 1 || b.sent[0] != "Guten Morgen" {
+		t.Fatalf("unexpected messages: %q", b.sent)
+	}
+
+	upd := cmdUpdate("/translate German")
+	upd.Message.ReplyToMessage = &models.Message{ID: 5, Text: "see you tomorrow"}
+	HandleUpdate(context.Background(), b, upd)
+	check("reply", "see you tomorrow")
+
+	HandleUpdate(context.Background(), b, cmdUpdate("/translate German"))
+	if !strings.HasPrefix(b.sent[len(b.sent)-1], "Usage: /translate") {
+		t.Fatalf("reply without text = %q", b.sent[len(b.sent)-1])
+	}
+	if hist, _ := storage.LoadProjectHistory("demo"); len(hist) != 1 {
+		t.Fatalf("history should be untouched, got %d messages", len(hist))
+	}
+}
+
+func TestHandleUpdate_EmptyReply(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	storage.SaveHistoryLimit("demo", 10)
+
+	origNew := newOpenAIClient
+	origResp := openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: " \n"}, nil
+	}
+	defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+
+	b := &testBot{}
+	upd := &models.Update{Message: &models.Message{ID: 5, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), b, upd)
+	if len(b.sent) != 1 {
+		t.Fatalf("sent = %q, want only the progress message", b.sent)
+	}
+	if len(b.edits) == 0 || b.edits[len(b.edits)-1].Text != emptyReplyText || b.edits[len(b.edits)-1].MessageID != 6 {
+		t.Fatalf("edits = %+v, want the progress message replaced", b.edits)
+	}
+	hist, _ := storage.LoadProjectHistory("demo")
+	for _, m := range hist {
+		if m.Role == storage.RoleAssistant {
+			t.Fatalf("empty reply stored in history: %+v", hist)
+		}
+	}
+}
+
+func TestProgressDelay(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	var wait chan struct{}
+	origNew, origResp, origDelay := newOpenAIClient, openAIResponses, progressDelay
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		if wait != nil {
+			<-wait
+		}
+		return responseResult{Text: "fast"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses, progressDelay = origNew, origResp, origDelay }()
+
+	// a reply arriving within the delay is posted directly
+	progressDelay = time.Hour
+	b := &testBot{}
+	upd := &models.Update{Message: &models.Message{ID: 5, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), b, upd)
+	if len(b.sent) != 1 || b.sent[0] != "fast" || len(b.edits) != 0 {
+		t.Fatalf("sent = %q, edits = %d, want only the reply", b.sent, len(b.edits))
+	}
+	if rp := b.sentParams[0].ReplyParameters; rp == nil || rp.MessageID != 5 {
+		t.Fatalf("reply parameters = %+v, want a reply to the prompt", rp)
+	}
+	if last, ok, _ := storage.LoadLastReply(1, 0); !ok || last.ReplyID != 6 {
+		t.Fatalf("last reply = %+v, %v, want the direct reply", last, ok)
+	}
+
+	// a slower reply gets the progress message, which is then edited
+	progressDelay = time.Millisecond
+	wait = make(chan struct{})
+	b = &testBot{}
+	b.send = func(ctx context.Context, params *tg.SendMessageParams) (*models.Message, error) {
+		if params.Text == "Sending to ChatGPT..." {
+			close(wait)
+		}
+		return &models.Message{ID: 9}, nil
+	}
+	upd.Message.ID = 8
+	HandleUpdate(context.Background(), b, upd)
+	if len(b.sent) != 1 || b.sent[0] != "Sending to ChatGPT..." {
+		t.Fatalf("sent = %q, want the progress message", b.sent)
+	}
+	if len(b.edits) == 0 || b.edits[len(b.edits)-1].Text != "fast" {
+		t.Fatalf("edits = %+v, want the reply in the progress message", b.edits)
+	}
+}
+
+func TestUseProject(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	for _, p := range []string{"alpha", "beta"} {
+		if err := storage.SaveProject(p); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+	}
+
+	var routed []string
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(proj string) *openai.Client {
+		routed = append(routed, proj)
+		return &openai.Client{}
+	}
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
+
+	private := func(text string) *models.Update {
+		upd := cmdUpdate(text)
+		upd.Message.Chat.Type = models.ChatTypePrivate
+		return upd
+	}
+	b := &testBot{}
+	last := func() string { return b.sent[len(b.sent)-1] }
+	ask := func() string {
+		routed = nil
+		HandleUpdate(context.Background(), b, private("hello"))
+		if len(routed) != 1 {
+			return ""
+		}
+		return routed[0]
+	}
+
+	HandleUpdate(context.Background(), b, private("/use"))
+	if last() != "No current project. Choose one with /use <projectName>." {
+		t.Fatalf("reply without project = %q", last())
+	}
+	if got := ask(); got != "" {
+		t.Fatalf("unrouted message went to %q", got)
+	}
+
+	HandleUpdate(context.Background(), b, private("/use alpha"))
+	if last() != "Now using project 'alpha'." {
+		t.Fatalf("use reply = %q", last())
+	}
+	if got := ask(); got != "alpha" {
+		t.Fatalf("routed to %q, want alpha", got)
+	}
+	HandleUpdate(context.Background(), b, private("/use beta"))
+	if got := ask(); got != "beta" {
+		t.Fatalf("routed to %q, want beta", got)
+	}
+	HandleUpdate(context.Background(), b, private("/use"))
+	if last() != "Current project: beta" {
+		t.Fatalf("current reply = %q", last())
+	}
+
+	HandleUpdate(context.Background(), b, private("/use missing"))
+	if last() != "Project not found." {
+		t.Fatalf("unknown project reply = %q", last())
+	}
+
+	// clearing falls back to the chat mapping
+	if err := storage.MapTopic(1, 0, "alpha"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	HandleUpdate(context.Background(), b, private("/use off"))
+	if got := ask(); got != "alpha" {
+		t.Fatalf("routed to %q after off, want alpha", got)
+	}
+
+	// groups keep using topic mappings
+	HandleUpdate(context.Background(), b, cmdUpdate("/use beta"))
+	if !strings.HasPrefix(last(), "/use works in private chats only") {
+		t.Fatalf("group reply = %q", last())
+	}
+}
+
+func TestUserCurrentProjectRouting(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("notes"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.SetUserCurrentProject(1, "notes"); err != nil {
+		t.Fatalf("set current project: %v", err)
+	}
+
+	var routed []string
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(proj string) *openai.Client {
+		routed = append(routed, proj)
+		return &openai.Client{}
+	}
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
+
+	// a private chat without any topic setup uses the persisted selection
+	upd := cmdUpdate("remember the milk")
+	upd.Message.Chat.Type = models.ChatTypePrivate
+	HandleUpdate(context.Background(), &testBot{}, upd)
+	// so does a scheduled prompt, which carries no chat type
+	HandleScheduled(context.Background(), &testBot{}, storage.Schedule{ChatID: 1, UserID: 1, Prompt: "daily summary"})
+	if !reflect.DeepEqual(routed, []string{"notes", "notes"}) {
+		t.Fatalf("routed = %v, want both to notes", routed)
+	}
+}
+
+func TestThinkAndQuick(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	if err := storage.SaveProjectReasoning("demo", "medium"); err != nil {
+		t.Fatalf("save reasoning: %v", err)
+	}
+
+	var captured responses.ResponseNewParams
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = params
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
+
+	cases := []struct {
+		text     string
+		effort   openai.ReasoningEffort
+		question string
+	}{
+		{"/think why is the sky blue?", openai.ReasoningEffortHigh, "why is the sky blue?"},
+		{"/quick 2+2?", openai.ReasoningEffortMinimal, "2+2?"},
+		{"plain question", openai.ReasoningEffortMedium, "plain question"},
+	}
+	for _, tc := range cases {
+		captured = responses.ResponseNewParams{}
+		HandleUpdate(context.Background(), &testBot{}, cmdUpdate(tc.text))
+		if captured.Reasoning.Effort != tc.effort {
+			t.Fatalf("%q: effort = %q, want %q", tc.text, captured.Reasoning.Effort, tc.effort)
+		}
+		items := captured.Input.OfInputItemList
+		last := items[len(items)-1].OfMessage
+		if last == nil || len(last.Content.OfInputItemContentList) == 0 || last.Content.OfInputItemContentList[0].OfInputText == nil {
+			t.Fatalf("%q: unexpected user input %+v", tc.text, last)
+		}
+		if got := last.Content.OfInputItemContentList[0].OfInputText.Text; !strings.Contains(got, tc.question) || strings.Contains(got, "/") {
+			t.Fatalf("%q: question sent as %q", tc.text, got)
+		}
+		if got, _ := storage.LoadProjectReasoning("demo"); got != "medium" {
+			t.Fatalf("%q: stored reasoning = %q, want medium", tc.text, got)
+		}
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/think"))
+	if len(b.sent) != 1 || b.sent[0] != "Usage: /think <question>" {
+		t.Fatalf("usage reply = %q", b.sent)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	storage.SaveHistoryLimit("demo", 10)
+
+	cancelled := make(chan error, 1)
+	origNew, origResp, origTimeout := newOpenAIClient, openAIResponses, requestTimeout
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		<-ctx.Done()
+		select {
+		case cancelled <- ctx.Err():
+		default:
+		}
+		return responseResult{}, ctx.Err()
+	}
+	requestTimeout = 50 * time.Millisecond
+	defer func() { newOpenAIClient, openAIResponses, requestTimeout = origNew, origResp, origTimeout }()
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{ID: 5, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	if len(b.edits) == 0 || b.edits[len(b.edits)-1].Text != "Request timed out after 0 seconds." {
+		t.Fatalf("edits = %+v, want the timeout message", b.edits)
+	}
+	if err := <-cancelled; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("request context error = %v, want deadline exceeded", err)
+	}
+	hist, _ := storage.LoadProjectHistory("demo")
+	if len(hist) != 1 || hist[0].Role != storage.RoleUser {
+		t.Fatalf("history = %+v, want only the prompt", hist)
+	}
+
+	// one-off questions are bound by the same timeout
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/ask demo hi"))
+	if len(b.sent) != 1 || b.sent[0] != "Request timed out after 0 seconds." {
+		t.Fatalf("/ask replies = %q, want the timeout message", b.sent)
+	}
+	if err := <-cancelled; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("/ask context error = %v, want deadline exceeded", err)
+	}
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/compare model-a model-b hi"))
+	if len(b.sent) != 2 || !strings.HasSuffix(b.sent[0], "\nRequest timed out after 0 seconds.") || !strings.HasSuffix(b.sent[1], "\nRequest timed out after 0 seconds.") {
+		t.Fatalf("/compare replies = %q, want the timeout message for both models", b.sent)
+	}
+	<-cancelled
+	for _, cmd := range []string{"/raw hi", "/translate German hi"} {
+		b = &testBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate(cmd))
+		if len(b.sent) != 1 || b.sent[0] != "Request timed out after 0 seconds." {
+			t.Fatalf("%s replies = %q, want the timeout message", cmd, b.sent)
+		}
+		<-cancelled
+	}
+
+	// a project timeout replaces the global one
+	HandleUpdate(context.Background(), b, cmdUpdate("/settimeout demo 2"))
+	if got := b.sent[len(b.sent)-1]; got != "Please enter a number of seconds between 5 and 3600, or off." {
+		t.Fatalf("reply = %q", got)
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/settimeout demo 30"))
+	if got := projectTimeout("demo"); got != 30*time.Second {
+		t.Fatalf("project timeout = %v, want 30s", got)
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/settimeout demo off"))
+	if got := projectTimeout("demo"); got != requestTimeout {
+		t.Fatalf("timeout after off = %v, want the global one", got)
+	}
+}
+
+func TestResponseChaining(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	storage.SaveHistoryLimit("demo", 10)
+	storage.SaveProjectInstruction("demo", "Be brief.")
+
+	var captured []responses.ResponseNewParams
+	var fail bool
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = append(captured, params)
+		if fail {
+			return responseResult{}, errors.New("previous response not found")
+		}
+		return responseResult{ID: fmt.Sprintf("resp_%d", len(captured)), Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setchaining demo on"))
+	if len(b.sent) != 1 || b.sent[0] != "Response chaining for project 'demo' set to on." {
+		t.Fatalf("setchaining reply = %q", b.sent)
+	}
+
+	ask := func(text string) responses.ResponseNewParams {
+		t.Helper()
+		HandleUpdate(context.Background(), &testBot{}, cmdUpdate(text))
+		return captured[len(captured)-1]
+	}
+	first := ask("first")
+	if first.PreviousResponseID.Valid() {
+		t.Fatalf("first request chained to %q", first.PreviousResponseID.Value)
+	}
+	if len(first.Input.OfInputItemList) != 2 {
+		t.Fatalf("first request has %d inputs, want instruction and question", len(first.Input.OfInputItemList))
+	}
+	second := ask("second")
+	if second.PreviousResponseID.Value != "resp_1" {
+		t.Fatalf("second request previous id = %q, want resp_1", second.PreviousResponseID.Value)
+	}
+	if len(second.Input.OfInputItemList) != 1 {
+		t.Fatalf("chained request has %d inputs, want only the new question", len(second.Input.OfInputItemList))
+	}
+	if third := ask("third"); third.PreviousResponseID.Value != "resp_2" {
+		t.Fatalf("third request previous id = %q, want resp_2", third.PreviousResponseID.Value)
+	}
+
+	// a failed chained request drops the chain and replays local history
+	fail = true
+	ask("fourth")
+	fail = false
+	fifth := ask("fifth")
+	if fifth.PreviousResponseID.Valid() {
+		t.Fatalf("request after a failure chained to %q", fifth.PreviousResponseID.Value)
+	}
+	if len(fifth.Input.OfInputItemList) < 3 {
+		t.Fatalf("request after a failure has %d inputs, want replayed history", len(fifth.Input.OfInputItemList))
+	}
+
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/setchaining demo off"))
+	ask("sixth")
+	if last := ask("seventh"); last.PreviousResponseID.Valid() {
+		t.Fatalf("chaining off but request chained to %q", last.PreviousResponseID.Value)
+	}
+	if _, err := storage.LoadLastResponseID("demo"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("response id kept with chaining off: %v", err)
+	}
+}
+
+func TestHistoryChangesRestartChain(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	for _, p := range []string{"demo", "other"} {
+		if err := storage.SaveProject(p); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	storage.SaveHistoryLimit("demo", 10)
+	storage.SaveProjectChaining("demo", "on")
+
+	var captured []responses.ResponseNewParams
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = append(captured, params)
+		return responseResult{ID: fmt.Sprintf("resp_%d", len(captured)), Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
+
+	ask := func(text string) responses.ResponseNewParams {
+		t.Helper()
+		HandleUpdate(context.Background(), &testBot{}, cmdUpdate(text))
+		return captured[len(captured)-1]
+	}
+	changes := []struct {
+		name   string
+		change func()
+	}{
+		{"clear", func() {
+			HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/clearhistory demo"))
+			HandleUpdate(context.Background(), &testBot{}, &models.Update{CallbackQuery: &models.CallbackQuery{
+				ID:      "cb",
+				From:    models.User{ID: 1},
+				Data:    "confirm:clearhistory:1:demo",
+				Message: models.MaybeInaccessibleMessage{Message: &models.Message{ID: 7, Chat: models.Chat{ID: 1}}},
+			}})
+		}},
+		{"undo", func() { HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/undo")) }},
+		{"forget", func() { HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/forget demo 1")) }},
+		{"move", func() { HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/movehistory other demo")) }},
+	}
+	for _, c := range changes {
+		ask("before " + c.name)
+		if p := ask("chained " + c.name); !p.PreviousResponseID.Valid() {
+			t.Fatalf("%s: request not chained before the change", c.name)
+		}
+		c.change()
+		if p := ask("after " + c.name); p.PreviousResponseID.Valid() {
+			t.Fatalf("%s: request after the change chained to %q", c.name, p.PreviousResponseID.Value)
+		}
+	}
+}
+
+func TestExportAllImportAll(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	origAdmins, origHTTP := adminUsers, httpGetFunc
+	adminUsers = map[int64]bool{1: true}
+	defer func() { adminUsers, httpGetFunc = origAdmins, origHTTP }()
+	for _, p := range []string{"alpha", "beta"} {
+		if err := storage.SaveProject(p); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+	}
+	storage.SaveProjectModel("beta", "gpt-5-mini")
+	storage.SaveProjectAPIKey("alpha", "enc-alpha")
+	storage.MapTopic(-100, 3, "alpha")
+	storage.MapTopic(-100, 4, "beta")
+
+	b := &testBot{}
+	upd := cmdUpdate("/exportall")
+	upd.Message.From.ID = 2
+	HandleUpdate(context.Background(), b, upd)
+	if len(b.sent) != 1 || b.sent[0] != "Admins only." || len(b.documents) != 0 {
+		t.Fatalf("non-admin export: sent %q, %d documents", b.sent, len(b.documents))
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/exportall"))
+	if len(b.documents) != 1 {
+		t.Fatalf("documents = %d, want 1", len(b.documents))
+	}
+	data, _ := io.ReadAll(b.documents[0].Document.(*models.InputFileUpload).Data)
+	if strings.Contains(string(data), "enc-alpha") {
+		t.Fatal("api key exported without --with-keys")
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/exportall --with-keys"))
+	withKeys, _ := io.ReadAll(b.documents[1].Document.(*models.InputFileUpload).Data)
+	if !strings.Contains(string(withKeys), "enc-alpha") {
+		t.Fatal("api key missing with --with-keys")
+	}
+
+	// import into a fresh database
+	storage.Close()
+	initStore2(t)
+	storage.SaveProject("old")
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/importall replace"))
+	if b.sent[0] != "Send the file produced by /exportall (mode: replace)." {
+		t.Fatalf("prompt = %q", b.sent[0])
+	}
+	httpGetFunc = func(url string) (*http.Response, error) {
+		return &http.Response{Body: io.NopCloser(bytes.NewReader(data))}, nil
+	}
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{
+		Chat:     models.Chat{ID: 1},
+		From:     &models.User{ID: 1},
+		Document: &models.Document{FileID: "cfg", FileSize: int64(len(data))},
+	}})
+	if reply := b.sent[len(b.sent)-1]; reply != "Imported 2 projects and 2 mappings (replace)." {
+		t.Fatalf("import reply = %q", reply)
+	}
+	if names, _ := storage.ListProjects(); !reflect.DeepEqual(names, []string{"alpha", "beta"}) {
+		t.Fatalf("projects = %v", names)
+	}
+	if model, _ := storage.LoadProjectModel("beta"); model != "gpt-5-mini" {
+		t.Fatalf("beta model = %q", model)
+	}
+	if proj, err := storage.GetMappedProject(-100, 4); err != nil || proj != "beta" {
+		t.Fatalf("mapping = %q, %v", proj, err)
+	}
+	if _, err := storage.LoadProjectAPIKey("alpha"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("api key imported from an export without keys: %v", err)
+	}
+
+	// a broken document is reported and the flow ends
+	HandleUpdate(context.Background(), b, cmdUpdate("/importall"))
+	HandleUpdate(context.Background(), b, &models.Update{Message: &models.Message{Text: "not json", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}})
+	if reply := b.sent[len(b.sent)-1]; !strings.HasPrefix(reply, "Import error: invalid document") {
+		t.Fatalf("bad import reply = %q", reply)
+	}
+	if _, ok := pendingImport[1]; ok {
+		t.Fatal("import still pending after a reply")
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	origAdmins := adminUsers
+	adminUsers = map[int64]bool{1: true}
+	calls := 0
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		calls++
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { adminUsers, newOpenAIClient, openAIResponses = origAdmins, origNew, origResp }()
+	chat := func(text string) *models.Update {
+		return &models.Update{Message: &models.Message{ID: 5, Text: text, Chat: models.Chat{ID: 1}, From: &models.User{ID: 2}}}
+	}
+
+	b := &testBot{}
+	upd := cmdUpdate("/maintenance on")
+	upd.Message.From.ID = 2
+	HandleUpdate(context.Background(), b, upd)
+	if b.sent[0] != "Admins only." {
+		t.Fatalf("non-admin reply = %q", b.sent)
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/maintenance on"))
+	if reply := b.sent[len(b.sent)-1]; reply != "Maintenance mode on. Chat messages are answered with: The assistant is temporarily unavailable." {
+		t.Fatalf("on reply = %q", reply)
+	}
+
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, chat("hello"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/ask demo hello"))
+	if calls != 0 {
+		t.Fatalf("OpenAI called %d times during maintenance", calls)
+	}
+	if len(b.sent) != 2 || b.sent[0] != defaultMaintenanceMessage || b.sent[1] != defaultMaintenanceMessage {
+		t.Fatalf("replies during maintenance = %q", b.sent)
+	}
+
+	// commands keep working, and the message can be changed
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/citations demo"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/maintenance on Back at noon."))
+	HandleUpdate(context.Background(), b, chat("hello"))
+	want := []string{"Sources footer for project 'demo' is on.", "Maintenance mode on. Chat messages are answered with: Back at noon.", "Back at noon."}
+	if !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("sent = %q, want %q", b.sent, want)
+	}
+
+	// the mode survives until switched off
+	HandleUpdate(context.Background(), b, cmdUpdate("/maintenance"))
+	if reply := b.sent[len(b.sent)-1]; reply != "Maintenance mode is on. Chat messages are answered with: Back at noon." {
+		t.Fatalf("status = %q", reply)
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/maintenance off"))
+	HandleUpdate(context.Background(), &testBot{}, chat("hello"))
+	if calls != 1 {
+		t.Fatalf("OpenAI calls after maintenance = %d, want 1", calls)
+	}
+}
+
+func TestMessageBatching(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+
+	requests := make(chan string, 10)
+	origNew, origResp, origUnit := newOpenAIClient, openAIResponses, batchUnit
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		items := params.Input.OfInputItemList
+		requests <- items[len(items)-1].OfMessage.Content.OfInputItemContentList[0].OfInputText.Text
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses, batchUnit = origNew, origResp, origUnit }()
+	chat := func(id int, text string) *models.Update {
+		return &models.Update{Message: &models.Message{ID: id, Text: text, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setbatch demo 2"))
+	if b.sent[0] != "Project 'demo' combines messages sent within 2 seconds of each other." {
+		t.Fatalf("setbatch reply = %q", b.sent[0])
+	}
+
+	batchUnit = 100 * time.Millisecond
+	for i, text := range []string{"first", "second", "third"} {
+		HandleUpdate(context.Background(), &testBot{}, chat(10+i, text))
+	}
+	select {
+	case got := <-requests:
+		if got != "first\nsecond\nthird" {
+			t.Fatalf("combined prompt = %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch was not sent")
+	}
+	select {
+	case got := <-requests:
+		t.Fatalf("extra request %q", got)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// a command in the middle of the window sends the batch first
+	batchUnit = time.Hour
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, chat(20, "one"))
+	HandleUpdate(context.Background(), b, chat(21, "two"))
+	if len(requests) != 0 {
+		t.Fatal("batch sent before the window ended")
+	}
+	HandleUpdate(context.Background(), b, cmdUpdate("/batch demo"))
+	if got := <-requests; got != "one\ntwo" {
+		t.Fatalf("flushed prompt = %q", got)
+	}
+	if last := b.sent[len(b.sent)-1]; last != "Project 'demo' combines messages sent within 2 seconds of each other." {
+		t.Fatalf("command reply = %q, want it after the flushed batch", last)
+	}
+	if b.sentParams[0].ReplyParameters == nil || b.sentParams[0].ReplyParameters.MessageID != 21 {
+		t.Fatalf("batch answered %+v, want the last message", b.sentParams[0].ReplyParameters)
+	}
+
+	// without a window every message is its own request
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/setbatch demo off"))
+	HandleUpdate(context.Background(), &testBot{}, chat(30, "alone"))
+	if got := <-requests; got != "alone" {
+		t.Fatalf("unbatched prompt = %q", got)
+	}
+}
+
+func TestPinAndUnpin(t *testing.T) {
+	logging.Init()
+	origID := botID
+	botID = 99
+	defer func() { botID = origID }()
+	reply := func(text string, to *models.Message) *models.Update {
+		upd := cmdUpdate(text)
+		upd.Message.Chat.ID = -100
+		upd.Message.ReplyToMessage = to
+		return upd
 	}
-	if got := b.edits[len(b.edits)-1].Text; got != "final reply" {
-		t.Fatalf("final edit = %q, want %q", got, "final reply")
+	botMsg := &models.Message{ID: 42, From: &models.User{ID: 99}}
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, reply("/pin", botMsg))
+	if len(b.pins) != 1 || b.pins[0].MessageID != 42 || b.pins[0].ChatID != int64(-100) {
+		t.Fatalf("pins = %+v", b.pins)
 	}
-	wantID := upd.Message.ID + 1
-	for i, e := range b.edits {
-		if e.MessageID != wantID {
-			t.Fatalf("edit %d used id %d want %d", i, e.MessageID, wantID)
+	HandleUpdate(context.Background(), b, reply("/unpin", botMsg))
+	if len(b.unpins) != 1 || b.unpins[0].MessageID != 42 || b.unpins[0].ChatID != int64(-100) {
+		t.Fatalf("unpins = %+v", b.unpins)
+	}
+	if len(b.sent) != 0 {
+		t.Fatalf("unexpected replies %q", b.sent)
+	}
+
+	// only replies to bot messages are pinned
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, reply("/pin", nil))
+	HandleUpdate(context.Background(), b, reply("/pin", &models.Message{ID: 7, From: &models.User{ID: 5}}))
+	HandleUpdate(context.Background(), b, reply("/unpin", &models.Message{ID: 1, From: &models.User{ID: 99}, ForumTopicCreated: &models.ForumTopicCreated{Name: "t"}}))
+	want := []string{"Send /pin as a reply to one of my messages.", "Send /pin as a reply to one of my messages.", "Send /unpin as a reply to one of my messages."}
+	if !reflect.DeepEqual(b.sent, want) || len(b.pins)+len(b.unpins) != 0 {
+		t.Fatalf("sent = %q, pins = %+v, unpins = %+v", b.sent, b.pins, b.unpins)
+	}
+
+	b = &testBot{pinErr: fmt.Errorf("bad request, Bad Request: not enough rights to manage pinned messages in the chat")}
+	HandleUpdate(context.Background(), b, reply("/pin", botMsg))
+	if len(b.sent) != 1 || b.sent[0] != "I need the permission to pin messages in this chat." {
+		t.Fatalf("permission error reply = %q", b.sent)
+	}
+}
+
+func TestInlineQuery(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	storage.SaveProjectModel("demo", "gpt-5-mini")
+	storage.SaveProjectInstruction("demo", "Answer in one sentence.")
+	storage.SetUserCurrentProject(1, "demo")
+
+	origAllowed := allowedUsers
+	allowedUsers = map[int64]bool{1: true}
+	var captured []responses.ResponseNewParams
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = append(captured, params)
+		return responseResult{Text: "Paris."}, nil
+	}
+	defer func() { allowedUsers, newOpenAIClient, openAIResponses = origAllowed, origNew, origResp }()
+	query := func(userID int64, text string) *models.Update {
+		return &models.Update{InlineQuery: &models.InlineQuery{ID: "q1", From: &models.User{ID: userID}, Query: text}}
+	}
+
+	auditEnabled = true
+	defer func() { auditEnabled = false }()
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, query(1, "capital of France?"))
+	if audit, _ := storage.LoadAudit("demo"); len(audit) != 1 || audit[0].Prompt != "capital of France?" || audit[0].Reply != "Paris." || audit[0].UserID != 1 {
+		t.Fatalf("audit = %+v", audit)
+	}
+	if len(b.inline) != 1 || b.inline[0].InlineQueryID != "q1" || len(b.inline[0].Results) != 1 {
+		t.Fatalf("inline answers = %+v", b.inline)
+	}
+	article, ok := b.inline[0].Results[0].(*models.InlineQueryResultArticle)
+	if !ok {
+		t.Fatalf("result = %T, want an article", b.inline[0].Results[0])
+	}
+	if content := article.InputMessageContent.(*models.InputTextMessageContent); content.MessageText != "Paris." || article.Title != "capital of France?" {
+		t.Fatalf("article = %+v, content = %+v", article, content)
+	}
+	if len(captured) != 1 || captured[0].Model != "gpt-5-mini" || captured[0].Reasoning.Effort != openai.ReasoningEffortMinimal {
+		t.Fatalf("request = %+v", captured)
+	}
+	if items := captured[0].Input.OfInputItemList; len(items) != 2 {
+		t.Fatalf("inputs = %d, want the instruction and the question", len(items))
+	}
+	if len(b.sent) != 0 {
+		t.Fatalf("inline query sent messages %q", b.sent)
+	}
+
+	// users who are not allowed get no results and cause no request
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, query(2, "capital of France?"))
+	if len(b.inline) != 1 || len(b.inline[0].Results) != 0 || len(captured) != 1 {
+		t.Fatalf("denied query: answers = %+v, requests = %d", b.inline, len(captured))
+	}
+
+	// the first keystrokes are not sent to the model
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, query(1, "ca"))
+	if len(b.inline) != 0 || len(captured) != 1 {
+		t.Fatalf("short query: answers = %+v, requests = %d", b.inline, len(captured))
+	}
+}
+
+func TestInlineQuerySuperseded(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	started := make(chan struct{})
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		if params.Input.OfInputItemList[0].OfMessage.Content.OfInputItemContentList[0].OfInputText.Text == "slow question" {
+			close(started)
+			<-ctx.Done()
+			return responseResult{}, ctx.Err()
 		}
+		return responseResult{Text: "fast"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
+
+	slow := &testBot{}
+	done := make(chan struct{})
+	go func() {
+		HandleUpdate(context.Background(), slow, &models.Update{InlineQuery: &models.InlineQuery{ID: "a", From: &models.User{ID: 1}, Query: "slow question"}})
+		close(done)
+	}()
+	<-started
+	fast := &testBot{}
+	HandleUpdate(context.Background(), fast, &models.Update{InlineQuery: &models.InlineQuery{ID: "b", From: &models.User{ID: 1}, Query: "fast question"}})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("superseded query was not cancelled")
+	}
+	if len(slow.inline) != 0 {
+		t.Fatalf("superseded query answered: %+v", slow.inline)
+	}
+	if len(fast.inline) != 1 || len(fast.inline[0].Results) != 1 {
+		t.Fatalf("newer query answers = %+v", fast.inline)
 	}
 }
 
-func TestChatGPTRequest_ErrorHandling(t *testing.T) {
+func TestLogChannelCopy(t *testing.T) {
 	logging.Init()
 	initStore2(t)
 	chatGPTKey = "x"
@@ -513,40 +5085,146 @@ func TestChatGPTRequest_ErrorHandling(t *testing.T) {
 	if err := storage.MapTopic(1, 0, "demo"); err != nil {
 		t.Fatalf("map topic: %v", err)
 	}
-	if err := storage.SaveHistoryLimit("demo", 5); err != nil {
-		t.Fatalf("save history limit: %v", err)
+	origNew, origResp, origChannel := newOpenAIClient, openAIResponses, logChannelID
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: strings.Repeat("a", maxLogContent+10)}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses, logChannelID = origNew, origResp, origChannel }()
+	upd := func() *models.Update {
+		return &models.Update{Message: &models.Message{ID: 5, Text: "hello", Chat: models.Chat{ID: 1}, From: &models.User{ID: 7, Username: "ann"}}}
 	}
 
-	origNew := newOpenAIClient
-	origResp := openAIResponses
-	origTicker := newTicker
-	newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-	openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-		return "", fmt.Errorf("boom")
+	// without the env var nothing is copied
+	logChannelID = 0
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, upd())
+	for _, p := range b.sentParams {
+		if p.ChatID != int64(1) {
+			t.Fatalf("message sent to %v without a log channel", p.ChatID)
+		}
 	}
-	newTicker = func(d time.Duration) *time.Ticker { return time.NewTicker(time.Hour) }
-	defer func() { newOpenAIClient = origNew; openAIResponses = origResp; newTicker = origTicker }()
 
-	upd := &models.Update{Message: &models.Message{ID: 5, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	t.Setenv("TBOT_LOG_CHANNEL_ID", "-100500")
+	loadLogChannel()
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, upd())
+	var user, channel []tg.SendMessageParams
+	for _, p := range b.sentParams {
+		if p.ChatID == int64(-100500) {
+			channel = append(channel, p)
+		} else {
+			user = append(user, p)
+		}
+	}
+	if len(user) == 0 {
+		t.Fatal("the user got no reply")
+	}
+	if len(channel) != 1 {
+		t.Fatalf("log channel copies = %d, want 1", len(channel))
+	}
+	text := channel[0].Text
+	for _, want := range []string{"Project: demo", "User: @ann (7)", "Model: gpt-5", "Prompt:\nhello", "Reply:\n" + strings.Repeat("a", maxLogContent) + "…"} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("copy %q does not contain %q", text, want)
+		}
+	}
+	if strings.Contains(text, strings.Repeat("a", maxLogContent+1)) {
+		t.Fatal("long reply not truncated")
+	}
+
+	// one-off requests and inline queries are copied as well, one copy per
+	// answer
+	storage.SetUserCurrentProject(7, "demo")
+	copies := func(b *testBot) []string {
+		var out []string
+		for _, p := range b.sentParams {
+			if p.ChatID == int64(-100500) {
+				out = append(out, p.Text)
+			}
+		}
+		return out
+	}
+	for cmd, want := range map[string]int{"/ask demo hi": 1, "/compare model-a model-b hi": 2, "/translate German hi": 1, "/raw hi": 1} {
+		u := cmdUpdate(cmd)
+		u.Message.From = &models.User{ID: 7, Username: "ann"}
+		b = &testBot{}
+		HandleUpdate(context.Background(), b, u)
+		if got := copies(b); len(got) != want || !strings.Contains(got[0], "Prompt:\nhi") {
+			t.Fatalf("%s: log channel copies = %q, want %d", cmd, got, want)
+		}
+	}
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, &models.Update{InlineQuery: &models.InlineQuery{ID: "q1", From: &models.User{ID: 7, Username: "ann"}, Query: "inline question"}})
+	if got := copies(b); len(got) != 1 || !strings.Contains(got[0], "Prompt:\ninline question") || !strings.Contains(got[0], "Project: demo") {
+		t.Fatalf("inline log channel copies = %q", got)
+	}
+}
+
+func TestMonthlyBudget(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	calls := 0
+	origNew, origResp, origNow := newOpenAIClient, openAIResponses, usageNow
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		calls++
+		return responseResult{Text: "ok", Tokens: 60}, nil
+	}
+	now := time.Date(2025, 3, 31, 23, 0, 0, 0, time.UTC)
+	usageNow = func() time.Time { return now }
+	defer func() { newOpenAIClient, openAIResponses, usageNow = origNew, origResp, origNow }()
+
 	b := &testBot{}
-	HandleUpdate(context.Background(), b, upd)
+	HandleUpdate(context.Background(), b, cmdUpdate("/setbudget demo lots"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/setbudget demo 100"))
+	want := []string{"Please enter a positive number of tokens, or off.", "Monthly budget for project 'demo' set to 100 tokens."}
+	if !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("setbudget replies = %q, want %q", b.sent, want)
+	}
 
-	if len(b.sent) != 1 || b.sent[0] != "Sending to ChatGPT..." {
-		t.Fatalf("sent messages: %v", b.sent)
+	// the second request crosses the budget; the third is refused
+	for i := 0; i < 3; i++ {
+		HandleUpdate(context.Background(), &testBot{}, cmdUpdate("hello"))
 	}
-	if len(b.edits) != 1 || b.edits[0].Text != "OpenAI error: boom" {
-		t.Fatalf("edits: %v", b.edits)
+	if calls != 2 {
+		t.Fatalf("OpenAI called %d times, want 2", calls)
 	}
-	hist, err := storage.LoadProjectHistory("demo")
-	if err != nil {
-		t.Fatalf("load history: %v", err)
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("hello"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/ask demo hello"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/limits demo"))
+	want = []string{monthlyBudgetText, monthlyBudgetText, "Project 'demo' used 120 tokens in 2025-03. Monthly budget: 100 tokens, 0 left."}
+	if calls != 2 || !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("over budget: calls = %d, sent = %q, want %q", calls, b.sent, want)
 	}
-	if len(hist) != 2 || hist[1].Content != "OpenAI error: boom" {
-		t.Fatalf("history: %v", hist)
+
+	// usage starts over with the new month
+	now = now.Add(2 * time.Hour)
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("hello"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/limits demo"))
+	if calls != 3 || b.sent[len(b.sent)-1] != "Project 'demo' used 60 tokens in 2025-04. Monthly budget: 100 tokens, 40 left." {
+		t.Fatalf("new month: calls = %d, sent = %q", calls, b.sent)
+	}
+
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setbudget demo off"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/limits demo"))
+	want = []string{"Project 'demo' has no monthly budget.", "Project 'demo' used 60 tokens in 2025-04. No monthly budget is set."}
+	if !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("budget off: sent = %q, want %q", b.sent, want)
 	}
 }
 
-func TestChatGPTRequest_WebSearchTool(t *testing.T) {
+func TestErrorRepliesNotReplayed(t *testing.T) {
 	logging.Init()
 	initStore2(t)
 	chatGPTKey = "x"
@@ -556,52 +5234,41 @@ func TestChatGPTRequest_WebSearchTool(t *testing.T) {
 	if err := storage.MapTopic(1, 0, "demo"); err != nil {
 		t.Fatalf("map topic: %v", err)
 	}
+	storage.SaveHistoryLimit("demo", 10)
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "user", WhoName: "bob", When: 1, Content: "question"})
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "assistant", WhoName: "ChatGPT", When: 2, Content: "OpenAI error: boom", IsError: true})
 
-	cases := []struct {
-		setting  string
-		wantTool bool
-		size     responses.WebSearchToolSearchContextSize
-	}{
-		{"off", false, responses.WebSearchToolSearchContextSizeHigh},
-		{"low", true, responses.WebSearchToolSearchContextSizeLow},
-		{"medium", true, responses.WebSearchToolSearchContextSizeMedium},
-		{"high", true, responses.WebSearchToolSearchContextSizeHigh},
-		{"other", true, responses.WebSearchToolSearchContextSizeHigh},
+	var captured responses.ResponseNewParams
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = params
+		return responseResult{Text: "ok"}, nil
 	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
 
-	for _, tc := range cases {
-		t.Run(tc.setting, func(t *testing.T) {
-			if err := storage.SaveProjectWebSearch("demo", tc.setting); err != nil {
-				t.Fatalf("save web search: %v", err)
-			}
-			origNew := newOpenAIClient
-			origResp := openAIResponses
-			newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-			var paramsCap responses.ResponseNewParams
-			openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-				paramsCap = params
-				return "ok", nil
-			}
-			defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("again"))
+	inputs := captured.Input.OfInputItemList
+	if len(inputs) != 2 {
+		t.Fatalf("request has %d inputs, want the question and the new message", len(inputs))
+	}
+	for _, in := range inputs {
+		if strings.Contains(in.OfMessage.Content.OfString.Value, "OpenAI error") {
+			t.Fatalf("error reply replayed: %q", in.OfMessage.Content.OfString.Value)
+		}
+	}
 
-			upd := &models.Update{Message: &models.Message{ID: 1, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
-			HandleUpdate(context.Background(), &testBot{}, upd)
-			if tc.wantTool {
-				if len(paramsCap.Tools) != 1 {
-					t.Fatalf("expected one tool, got %v", paramsCap.Tools)
-				}
-				tool := paramsCap.Tools[0].OfWebSearchPreview
-				if tool == nil || tool.SearchContextSize != tc.size {
-					t.Fatalf("tool size = %v, want %v", tool, tc.size)
-				}
-			} else if len(paramsCap.Tools) != 0 {
-				t.Fatalf("expected no tools, got %v", paramsCap.Tools)
-			}
-		})
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/historymessages demo"))
+	if len(b.sent) != 1 || !strings.Contains(b.sent[0], "OpenAI error: boom") {
+		t.Fatalf("historymessages = %q", b.sent)
+	}
+	if hist, _ := storage.LoadProjectHistory("demo"); len(hist) != 4 {
+		t.Fatalf("history has %d messages, want 4", len(hist))
 	}
 }
 
-func TestChatGPTRequest_ReasoningEffort(t *testing.T) {
+func TestMetaFormat(t *testing.T) {
 	logging.Init()
 	initStore2(t)
 	chatGPTKey = "x"
@@ -611,42 +5278,62 @@ func TestChatGPTRequest_ReasoningEffort(t *testing.T) {
 	if err := storage.MapTopic(1, 0, "demo"); err != nil {
 		t.Fatalf("map topic: %v", err)
 	}
+	storage.SaveHistoryLimit("demo", 10)
+	when := time.Date(2025, 5, 1, 12, 30, 0, 0, time.UTC).Unix()
+	storage.AddHistoryMessage("demo", storage.HistoryMessage{Role: "user", WhoName: "bob", When: when, Content: "question"})
 
-	cases := []struct {
-		effort string
-		want   openai.ReasoningEffort
-	}{
-		{"minimal", openai.ReasoningEffortMinimal},
-		{"low", openai.ReasoningEffortLow},
-		{"high", openai.ReasoningEffortHigh},
-		{"", openai.ReasoningEffortMedium},
+	var captured responses.ResponseNewParams
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = params
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
+	// ask returns the replayed history message and the new user message
+	ask := func() (string, string) {
+		t.Helper()
+		HandleUpdate(context.Background(), &testBot{}, &models.Update{Message: &models.Message{ID: 5, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1, Username: "ann"}}})
+		inputs := captured.Input.OfInputItemList
+		last := inputs[len(inputs)-1].OfMessage.Content.OfInputItemContentList
+		if len(last) != 1 {
+			t.Fatalf("user message has %d parts", len(last))
+		}
+		return inputs[0].OfMessage.Content.OfString.Value, last[0].OfInputText.Text
 	}
 
-	for _, tc := range cases {
-		t.Run(tc.effort, func(t *testing.T) {
-			if err := storage.SaveProjectReasoning("demo", tc.effort); err != nil {
-				t.Fatalf("save reasoning: %v", err)
-			}
-			origNew := newOpenAIClient
-			origResp := openAIResponses
-			newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-			var paramsCap responses.ResponseNewParams
-			openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-				paramsCap = params
-				return "ok", nil
-			}
-			defer func() { newOpenAIClient = origNew; openAIResponses = origResp }()
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/metaformat demo"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/setmetaformat demo [{user}]"))
+	want := []string{"History messages of project 'demo' start with the default line '{time} {user}:'.", "History messages of project 'demo' start with the line '[{user}]'."}
+	if !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("replies = %q, want %q", b.sent, want)
+	}
+	if hist, cur := ask(); hist != "[bob]\nquestion" || cur != "[ann]\nhi" {
+		t.Fatalf("custom format: history %q, message %q", hist, cur)
+	}
 
-			upd := &models.Update{Message: &models.Message{ID: 2, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
-			HandleUpdate(context.Background(), &testBot{}, upd)
-			if paramsCap.Reasoning.Effort != tc.want {
-				t.Fatalf("effort = %v, want %v", paramsCap.Reasoning.Effort, tc.want)
-			}
-		})
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setmetaformat demo none"))
+	if b.sent[0] != "History messages of project 'demo' are sent without metadata." {
+		t.Fatalf("none reply = %q", b.sent)
+	}
+	if hist, cur := ask(); hist != "question" || cur != "hi" {
+		t.Fatalf("disabled format: history %q, message %q", hist, cur)
+	}
+	// the metadata is still stored with the message
+	hist, _ := storage.LoadProjectHistory("demo")
+	if last := hist[len(hist)-2]; last.Content != "hi" || last.WhoName != "ann" || last.When == 0 {
+		t.Fatalf("stored message = %+v", last)
+	}
+
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/setmetaformat demo default"))
+	if hist, _ := ask(); hist != "2025-05-01 12:30:00 bob:\nquestion" {
+		t.Fatalf("default format: history %q", hist)
 	}
 }
 
-func TestResponseHandling_LongMessageSplit(t *testing.T) {
+func TestStickerAndGIFInputs(t *testing.T) {
 	logging.Init()
 	initStore2(t)
 	chatGPTKey = "x"
@@ -656,49 +5343,170 @@ func TestResponseHandling_LongMessageSplit(t *testing.T) {
 	if err := storage.MapTopic(1, 0, "demo"); err != nil {
 		t.Fatalf("map topic: %v", err)
 	}
-	if err := storage.SaveHistoryLimit("demo", 5); err != nil {
-		t.Fatalf("save history: %v", err)
+	var captured []responses.ResponseNewParams
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		captured = append(captured, params)
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
+	sticker := &models.Update{Message: &models.Message{ID: 5, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1},
+		Sticker: &models.Sticker{FileID: "s", Emoji: "😂", SetName: "funny_cats"}}}
+	gif := func(thumb *models.PhotoSize) *models.Update {
+		return &models.Update{Message: &models.Message{ID: 6, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1},
+			Animation: &models.Animation{FileID: "a", Thumbnail: thumb}}}
 	}
 
-	longReply := strings.Repeat("a", 9001)
+	// both are ignored by default
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, sticker)
+	HandleUpdate(context.Background(), b, gif(&models.PhotoSize{FileID: "thumb"}))
+	if len(captured) != 0 || len(b.sent) != 0 {
+		t.Fatalf("media answered while off: %d requests, sent %q", len(captured), b.sent)
+	}
 
-	origNew := newOpenAIClient
-	origResp := openAIResponses
-	origTicker := newTicker
-	newOpenAIClient = func() *openai.Client { return &openai.Client{} }
-	openAIResponses = func(client *openai.Client, params responses.ResponseNewParams) (string, error) {
-		return longReply, nil
+	HandleUpdate(context.Background(), b, cmdUpdate("/setstickers demo on"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/setgifs demo on"))
+	want := []string{"Sticker answers for project 'demo' set to on.", "GIF answers for project 'demo' set to on."}
+	if !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("toggle replies = %q, want %q", b.sent, want)
 	}
-	newTicker = func(d time.Duration) *time.Ticker { return time.NewTicker(time.Hour) }
-	defer func() { newOpenAIClient = origNew; openAIResponses = origResp; newTicker = origTicker }()
 
-	upd := &models.Update{Message: &models.Message{ID: 3, Text: "hi", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	HandleUpdate(context.Background(), &testBot{}, sticker)
+	if len(captured) != 1 {
+		t.Fatalf("sticker sent %d requests, want 1", len(captured))
+	}
+	inputs := captured[0].Input.OfInputItemList
+	parts := inputs[len(inputs)-1].OfMessage.Content.OfInputItemContentList
+	if len(parts) != 1 || parts[0].OfInputText.Text != `(User sent a sticker 😂 from the set "funny_cats")` {
+		t.Fatalf("sticker parts = %+v", parts)
+	}
+
+	var fileIDs []string
+	b = &testBot{getFile: func(ctx context.Context, params *tg.GetFileParams) (*models.File, error) {
+		fileIDs = append(fileIDs, params.FileID)
+		return &models.File{FilePath: "thumb.jpg"}, nil
+	}}
+	HandleUpdate(context.Background(), b, gif(&models.PhotoSize{FileID: "thumb"}))
+	if len(captured) != 2 || !reflect.DeepEqual(fileIDs, []string{"thumb"}) {
+		t.Fatalf("gif: %d requests, files %q", len(captured), fileIDs)
+	}
+	inputs = captured[1].Input.OfInputItemList
+	parts = inputs[len(inputs)-1].OfMessage.Content.OfInputItemContentList
+	if len(parts) != 1 || parts[0].OfInputImage == nil || parts[0].OfInputImage.ImageURL.Value != "http://example.com/file" {
+		t.Fatalf("gif parts = %+v", parts)
+	}
+
+	// a GIF without a thumbnail has nothing to send
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, gif(nil))
+	if len(captured) != 2 || len(b.sent) != 0 {
+		t.Fatalf("gif without thumbnail: %d requests, sent %q", len(captured), b.sent)
+	}
+}
+
+func TestModelRouting(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	var usedModels []string
+	origNew, origResp := newOpenAIClient, openAIResponses
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		usedModels = append(usedModels, string(params.Model))
+		return responseResult{Text: "ok"}, nil
+	}
+	defer func() { newOpenAIClient, openAIResponses = origNew, origResp }()
+
 	b := &testBot{}
-	HandleUpdate(context.Background(), b, upd)
+	HandleUpdate(context.Background(), b, cmdUpdate("/setautomodel demo on gpt-5-nano gpt-5"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/setautomodel demo on gpt-5-nano gpt-5 zero"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/setautomodel demo on gpt-5-nano gpt-5 20"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/automodel demo"))
+	routed := "Project 'demo' uses 'gpt-5-nano' for prompts of up to 20 characters and 'gpt-5' for longer ones."
+	want := []string{
+		"Usage: /setautomodel <projectName> on <shortModel> <longModel> <threshold> or /setautomodel <projectName> off",
+		"Please enter a positive number of characters.",
+		routed,
+		routed,
+	}
+	if !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("replies = %q, want %q", b.sent, want)
+	}
 
-	if len(b.sent) != 3 {
-		t.Fatalf("sent = %v", b.sent)
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("short question"))
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("a much longer question that needs a bigger model"))
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("/ask demo short question"))
+	if want := []string{"gpt-5-nano", "gpt-5", "gpt-5-nano"}; !reflect.DeepEqual(usedModels, want) {
+		t.Fatalf("models = %q, want %q", usedModels, want)
 	}
-	if b.sent[0] != "Sending to ChatGPT..." {
-		t.Fatalf("first sent = %q", b.sent[0])
+
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setautomodel demo off"))
+	HandleUpdate(context.Background(), &testBot{}, cmdUpdate("short question"))
+	if b.sent[0] != "Model routing for project 'demo' is off." || usedModels[len(usedModels)-1] != defaultModel {
+		t.Fatalf("off: sent %q, model %q", b.sent, usedModels[len(usedModels)-1])
 	}
-	if len(b.edits) != 1 || b.edits[0].Text != longReply[:4000] {
-		t.Fatalf("edits = %v", b.edits)
+}
+
+func TestReplyRedaction(t *testing.T) {
+	logging.Init()
+	initStore2(t)
+	chatGPTKey = "x"
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
 	}
-	if b.sent[1] != longReply[4000:8000] || b.sent[2] != longReply[8000:] {
-		t.Fatalf("chunk send mismatch")
+	if err := storage.MapTopic(1, 0, "demo"); err != nil {
+		t.Fatalf("map topic: %v", err)
 	}
-	if b.sentParams[1].ReplyParameters == nil || b.sentParams[1].ReplyParameters.MessageID != b.edits[0].MessageID {
-		t.Fatalf("second chunk reply id = %v", b.sentParams[1].ReplyParameters)
+	storage.SaveHistoryLimit("demo", 10)
+	origNew, origResp, origTicker := newOpenAIClient, openAIResponses, newTicker
+	newOpenAIClient = func(string) *openai.Client { return &openai.Client{} }
+	openAIResponses = func(ctx context.Context, client *openai.Client, params responses.ResponseNewParams) (responseResult, error) {
+		return responseResult{Text: "Mail bob@example.com or open db1.corp.internal."}, nil
 	}
-	if b.sentParams[2].ReplyParameters == nil || b.sentParams[2].ReplyParameters.MessageID != b.edits[0].MessageID+1 {
-		t.Fatalf("third chunk reply id = %v", b.sentParams[2].ReplyParameters)
+	newTicker = func(d time.Duration) *time.Ticker { return time.NewTicker(time.Hour) }
+	defer func() { newOpenAIClient, openAIResponses, newTicker = origNew, origResp, origTicker }()
+
+	b := &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/addredaction demo ([a-z"))
+	HandleUpdate(context.Background(), b, cmdUpdate(`/addredaction demo [\w.]+@[\w.]+\w`))
+	HandleUpdate(context.Background(), b, cmdUpdate(`/addredaction demo \w+\.corp\.internal`))
+	HandleUpdate(context.Background(), b, cmdUpdate("/redactions demo"))
+	if len(b.sent) != 4 || !strings.HasPrefix(b.sent[0], "Invalid regex: ") {
+		t.Fatalf("replies = %q", b.sent)
 	}
-	hist, err := storage.LoadProjectHistory("demo")
-	if err != nil {
-		t.Fatalf("load history: %v", err)
+	want := []string{
+		"Redaction rule 1 added to project 'demo'.",
+		"Redaction rule 2 added to project 'demo'.",
+		"Redaction rules for project 'demo':\n1. [\\w.]+@[\\w.]+\\w\n2. \\w+\\.corp\\.internal",
 	}
-	if len(hist) != 2 || hist[1].Content != longReply {
-		t.Fatalf("history: %v", hist)
+	if !reflect.DeepEqual(b.sent[1:], want) {
+		t.Fatalf("replies = %q, want %q", b.sent[1:], want)
+	}
+
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("where?"))
+	redacted := "Mail [redacted] or open [redacted]."
+	if len(b.edits) != 1 || b.edits[0].Text != redacted {
+		t.Fatalf("edits = %+v", b.edits)
+	}
+	hist, _ := storage.LoadProjectHistory("demo")
+	if len(hist) != 2 || hist[1].Content != redacted {
+		t.Fatalf("history = %+v", hist)
+	}
+
+	b = &testBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/clearredactions demo"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/redactions demo"))
+	if want := []string{"Project 'demo' has no redaction rules.", "Project 'demo' has no redaction rules."}; !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("clear replies = %q", b.sent)
 	}
 }
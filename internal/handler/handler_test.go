@@ -1,16 +1,20 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	tg "github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 	openai "github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/responses"
+	"github.com/rs/zerolog"
 
 	"telegram-chatgpt-bot/internal/logging"
 	"telegram-chatgpt-bot/internal/storage"
@@ -99,6 +103,28 @@ func TestReasoningEffortToConst(t *testing.T) {
 	}
 }
 
+func TestHistoryInputRole(t *testing.T) {
+	cases := []struct {
+		in   string
+		want responses.EasyInputMessageRole
+		ok   bool
+	}{
+		{"user", responses.EasyInputMessageRoleUser, true},
+		{"assistant", responses.EasyInputMessageRoleAssistant, true},
+		{"system", responses.EasyInputMessageRoleSystem, true},
+		{"developer", responses.EasyInputMessageRoleDeveloper, true},
+		{"tool", responses.EasyInputMessageRoleDeveloper, true},
+		{"function_call", "", false},
+		{"", "", false},
+	}
+	for _, tc := range cases {
+		got, ok := historyInputRole(tc.in)
+		if got != tc.want || ok != tc.ok {
+			t.Fatalf("historyInputRole(%q) = %v %v, want %v %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
 type fakeBot struct{ sent []string }
 
 func (f *fakeBot) SendMessage(ctx context.Context, params *tg.SendMessageParams) (*models.Message, error) {
@@ -112,6 +138,38 @@ func (f *fakeBot) GetFile(ctx context.Context, params *tg.GetFileParams) (*model
 
 func (f *fakeBot) FileDownloadLink(file *models.File) string { return "" }
 
+func (f *fakeBot) SendChatAction(ctx context.Context, params *tg.SendChatActionParams) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeBot) SendVoice(ctx context.Context, params *tg.SendVoiceParams) (*models.Message, error) {
+	return &models.Message{ID: 1}, nil
+}
+
+func (f *fakeBot) PinChatMessage(ctx context.Context, params *tg.PinChatMessageParams) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeBot) UnpinChatMessage(ctx context.Context, params *tg.UnpinChatMessageParams) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeBot) AnswerInlineQuery(ctx context.Context, params *tg.AnswerInlineQueryParams) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeBot) AnswerCallbackQuery(ctx context.Context, params *tg.AnswerCallbackQueryParams) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeBot) DeleteMessage(ctx context.Context, params *tg.DeleteMessageParams) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeBot) SendDocument(ctx context.Context, params *tg.SendDocumentParams) (*models.Message, error) {
+	return &models.Message{ID: 1}, nil
+}
+
 func (f *fakeBot) EditMessageText(ctx context.Context, params *tg.EditMessageTextParams) (*models.Message, error) {
 	return &models.Message{ID: params.MessageID}, nil
 }
@@ -139,7 +197,7 @@ func initStore(t *testing.T) {
 	t.Cleanup(func() { storage.Close() })
 }
 
-func TestHandleUpdate_IgnoresCallback(t *testing.T) {
+func TestHandleUpdate_CallbackNotTreatedAsMessage(t *testing.T) {
 	b := &fakeBot{}
 	upd := &models.Update{CallbackQuery: &models.CallbackQuery{}, Message: &models.Message{Text: "hi"}}
 	HandleUpdate(context.Background(), b, upd)
@@ -276,7 +334,7 @@ func TestHandleUpdateSetTopic(t *testing.T) {
 			From:     &models.User{ID: 1},
 		}}
 		HandleUpdate(context.Background(), b, upd)
-		if len(b.sent) != 1 || b.sent[0] != "Usage: /settopic <projectName>" {
+		if len(b.sent) != 1 || b.sent[0] != "Usage: /settopic <projectName> [--create]" {
 			t.Fatalf("unexpected messages: %v", b.sent)
 		}
 	})
@@ -321,9 +379,11 @@ func TestHandleUpdateSetTopic(t *testing.T) {
 		b := &fakeBot{}
 		origPE := projectExists
 		origMT := mapTopic
+		origLW := loadProjectWelcome
 		projectExists = func(name string) (bool, error) { return true, nil }
 		mapTopic = func(chatID int64, topicID int, project string) error { return nil }
-		defer func() { projectExists = origPE; mapTopic = origMT }()
+		loadProjectWelcome = func(name string) (string, error) { return "", storage.ErrNotFound }
+		defer func() { projectExists = origPE; mapTopic = origMT; loadProjectWelcome = origLW }()
 		upd := &models.Update{Message: &models.Message{
 			Text:            "/settopic demo",
 			Entities:        []models.MessageEntity{{Type: models.MessageEntityTypeBotCommand, Offset: 0, Length: len("/settopic")}},
@@ -336,6 +396,49 @@ func TestHandleUpdateSetTopic(t *testing.T) {
 			t.Fatalf("unexpected messages: %v", b.sent)
 		}
 	})
+
+	t.Run("create", func(t *testing.T) {
+		b := &fakeBot{}
+		origPE := projectExists
+		origSP := saveProject
+		origMT := mapTopic
+		origLW := loadProjectWelcome
+		var saved, mapped string
+		projectExists = func(name string) (bool, error) { return false, nil }
+		saveProject = func(name string) error { saved = name; return nil }
+		mapTopic = func(chatID int64, topicID int, project string) error { mapped = project; return nil }
+		loadProjectWelcome = func(name string) (string, error) { return "", storage.ErrNotFound }
+		defer func() { projectExists = origPE; saveProject = origSP; mapTopic = origMT; loadProjectWelcome = origLW }()
+		HandleUpdate(context.Background(), b, cmdUpdate("/settopic demo --create"))
+		if saved != "demo" || mapped != "demo" {
+			t.Fatalf("saved %q, mapped %q", saved, mapped)
+		}
+		want := []string{"Project 'demo' registered.", "Topic mapped to project 'demo'."}
+		if !reflect.DeepEqual(b.sent, want) {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("create existing", func(t *testing.T) {
+		b := &fakeBot{}
+		origPE := projectExists
+		origSP := saveProject
+		origMT := mapTopic
+		origLW := loadProjectWelcome
+		saveCalled := false
+		projectExists = func(name string) (bool, error) { return true, nil }
+		saveProject = func(name string) error { saveCalled = true; return nil }
+		mapTopic = func(chatID int64, topicID int, project string) error { return nil }
+		loadProjectWelcome = func(name string) (string, error) { return "", storage.ErrNotFound }
+		defer func() { projectExists = origPE; saveProject = origSP; mapTopic = origMT; loadProjectWelcome = origLW }()
+		HandleUpdate(context.Background(), b, cmdUpdate("/settopic --create demo"))
+		if saveCalled {
+			t.Fatal("existing project must not be saved again")
+		}
+		if len(b.sent) != 1 || b.sent[0] != "Topic mapped to project 'demo'." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
 }
 
 func TestHandleUpdateUnsetTopic(t *testing.T) {
@@ -397,7 +500,7 @@ func TestHandleUpdateSetModel(t *testing.T) {
 		b := &fakeBot{}
 		upd := cmdUpdate("/setmodel")
 		HandleUpdate(context.Background(), b, upd)
-		if len(b.sent) != 1 || b.sent[0] != "Usage: /setmodel <projectName>" {
+		if len(b.sent) != 1 || b.sent[0] != "Usage: /setmodel <projectName> [modelName]" {
 			t.Fatalf("unexpected messages: %v", b.sent)
 		}
 	})
@@ -427,6 +530,35 @@ func TestHandleUpdateSetModel(t *testing.T) {
 		if len(b.sent) != 1 || b.sent[0] != "Enter model name" {
 			t.Fatalf("unexpected messages: %v", b.sent)
 		}
+
+		upd = &models.Update{Message: &models.Message{Text: "gpt-4o", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+		HandleUpdate(context.Background(), b, upd)
+		if model, _ := storage.LoadProjectModel("demo"); model != "gpt-4o" {
+			t.Fatalf("model not saved: %q", model)
+		}
+		if len(b.sent) != 2 || b.sent[1] != "Project 'demo' uses model 'gpt-4o'." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("inline model", func(t *testing.T) {
+		initStore(t)
+		if err := storage.SaveProject("demo"); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+		pendingModel = map[int64]string{}
+		b := &fakeBot{}
+		upd := cmdUpdate("/setmodel demo gpt-4o-mini")
+		HandleUpdate(context.Background(), b, upd)
+		if _, ok := pendingModel[1]; ok {
+			t.Fatalf("pendingModel should not be set: %v", pendingModel)
+		}
+		if model, _ := storage.LoadProjectModel("demo"); model != "gpt-4o-mini" {
+			t.Fatalf("model not saved: %q", model)
+		}
+		if len(b.sent) != 1 || b.sent[0] != "Project 'demo' uses model 'gpt-4o-mini'." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
 	})
 }
 
@@ -467,6 +599,60 @@ func TestHandleUpdateSetRule(t *testing.T) {
 			t.Fatalf("unexpected messages: %v", b.sent)
 		}
 	})
+
+	t.Run("from replied message", func(t *testing.T) {
+		initStore(t)
+		if err := storage.SaveProject("demo"); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+		pendingRule = map[int64]string{}
+		b := &fakeBot{}
+		upd := cmdUpdate("/setrule demo")
+		upd.Message.ReplyToMessage = &models.Message{Text: "  Answer like a pirate.  "}
+		HandleUpdate(context.Background(), b, upd)
+		if _, ok := pendingRule[1]; ok {
+			t.Fatalf("pendingRule should not be set: %v", pendingRule)
+		}
+		if instr, _ := storage.LoadProjectInstruction("demo"); instr != "Answer like a pirate." {
+			t.Fatalf("instruction not saved: %q", instr)
+		}
+		if len(b.sent) != 1 || b.sent[0] != "Instruction saved." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("empty replied message", func(t *testing.T) {
+		initStore(t)
+		if err := storage.SaveProject("demo"); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+		pendingRule = map[int64]string{}
+		b := &fakeBot{}
+		upd := cmdUpdate("/setrule demo")
+		upd.Message.ReplyToMessage = &models.Message{Photo: []models.PhotoSize{{FileID: "p"}}}
+		HandleUpdate(context.Background(), b, upd)
+		if instr, _ := storage.LoadProjectInstruction("demo"); instr != "" {
+			t.Fatalf("instruction should not be saved: %q", instr)
+		}
+		if len(b.sent) != 1 || b.sent[0] != "The replied message has no text to use as instruction." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("topic root is not a reply", func(t *testing.T) {
+		initStore(t)
+		if err := storage.SaveProject("demo"); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+		pendingRule = map[int64]string{}
+		b := &fakeBot{}
+		upd := cmdUpdate("/setrule demo")
+		upd.Message.ReplyToMessage = &models.Message{ForumTopicCreated: &models.ForumTopicCreated{Name: "t"}}
+		HandleUpdate(context.Background(), b, upd)
+		if pendingRule[1] != "demo" {
+			t.Fatalf("pendingRule not set: %v", pendingRule)
+		}
+	})
 }
 
 func TestHandleUpdateShowRule(t *testing.T) {
@@ -787,7 +973,7 @@ func TestHandleUpdateHistoryMessages(t *testing.T) {
 		b := &fakeBot{}
 		upd := cmdUpdate("/historymessages")
 		HandleUpdate(context.Background(), b, upd)
-		if len(b.sent) != 1 || b.sent[0] != "Usage: /historymessages <projectName>" {
+		if len(b.sent) != 1 || b.sent[0] != "Usage: /historymessages <projectName> [page]" {
 			t.Fatalf("unexpected messages: %v", b.sent)
 		}
 	})
@@ -829,6 +1015,43 @@ func TestHandleUpdateHistoryMessages(t *testing.T) {
 			t.Fatalf("unexpected messages: %v", b.sent)
 		}
 	})
+
+	t.Run("pages", func(t *testing.T) {
+		initStore(t)
+		if err := storage.SaveProject("demo"); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+		total := 2*historyPageSize + 5
+		for i := 0; i < total; i++ {
+			storage.AddHistoryMessage("demo", storage.HistoryMessage{When: int64(i), WhoName: "u", Content: fmt.Sprintf("msg%03d", i)})
+		}
+		b := &fakeBot{}
+		for _, p := range []string{"", " 2", " 3", " 4"} {
+			HandleUpdate(context.Background(), b, cmdUpdate("/historymessages demo"+p))
+		}
+		if len(b.sent) != 4 {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+		checks := []struct {
+			first, last, footer string
+		}{
+			{"msg000", fmt.Sprintf("msg%03d", historyPageSize-1), "Page 1/3"},
+			{fmt.Sprintf("msg%03d", historyPageSize), fmt.Sprintf("msg%03d", 2*historyPageSize-1), "Page 2/3"},
+			{fmt.Sprintf("msg%03d", 2*historyPageSize), fmt.Sprintf("msg%03d", total-1), "Page 3/3"},
+		}
+		for i, c := range checks {
+			out := b.sent[i]
+			if got := strings.Count(out, ":\nmsg"); i < 2 && got != historyPageSize || i == 2 && got != 5 {
+				t.Fatalf("page %d has %d messages", i+1, got)
+			}
+			if !strings.Contains(out, c.first) || !strings.Contains(out, c.last) || !strings.HasSuffix(out, c.footer) {
+				t.Fatalf("page %d = %q", i+1, out)
+			}
+		}
+		if b.sent[3] != "Page must be between 1 and 3." {
+			t.Fatalf("unexpected out of range reply: %q", b.sent[3])
+		}
+	})
 }
 
 func TestHandleUpdateSetHistoryLimit(t *testing.T) {
@@ -899,16 +1122,184 @@ func TestHandleUpdateClearHistory(t *testing.T) {
 		}
 		storage.AddHistoryMessage("demo", storage.HistoryMessage{When: 1, Content: "hi"})
 		storage.AddHistoryMessage("demo", storage.HistoryMessage{When: 2, Content: "there"})
-		pendingClearHist = map[int64]string{}
-		b := &fakeBot{}
+		b := &testBot{}
 		upd := cmdUpdate("/clearhistory demo")
 		HandleUpdate(context.Background(), b, upd)
-		if pendingClearHist[1] != "demo" {
-			t.Fatalf("pendingClearHist not set: %v", pendingClearHist)
-		}
 		if len(b.sent) != 1 || !strings.Contains(b.sent[0], "The 2 messages will be removed") {
 			t.Fatalf("unexpected messages: %v", b.sent)
 		}
+		kb, ok := b.sentParams[0].ReplyMarkup.(*models.InlineKeyboardMarkup)
+		if !ok || len(kb.InlineKeyboard[0]) != 2 || kb.InlineKeyboard[0][0].CallbackData != "confirm:clearhistory:1:demo" || kb.InlineKeyboard[0][1].CallbackData != "confirm:cancel:1:demo" {
+			t.Fatalf("unexpected keyboard: %+v", b.sentParams[0].ReplyMarkup)
+		}
+	})
+}
+
+func TestHandleUpdateClearTopic(t *testing.T) {
+	logging.Init()
+	t.Run("unmapped", func(t *testing.T) {
+		initStore(t)
+		b := &testBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/cleartopic"))
+		if len(b.sent) != 1 || b.sent[0] != "Topic is not mapped to a project." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("mapped", func(t *testing.T) {
+		initStore(t)
+		if err := storage.SaveProject("demo"); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+		if err := storage.MapTopic(1, 0, "demo"); err != nil {
+			t.Fatalf("map topic: %v", err)
+		}
+		storage.AddHistoryMessage("demo", storage.HistoryMessage{When: 1, Content: "hi"})
+		b := &testBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/cleartopic"))
+		if len(b.sent) != 1 || b.sent[0] != "The 1 messages will be removed from the 'demo' project." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+		kb, ok := b.sentParams[0].ReplyMarkup.(*models.InlineKeyboardMarkup)
+		if !ok || len(kb.InlineKeyboard[0]) != 2 || kb.InlineKeyboard[0][0].CallbackData != "confirm:clearhistory:1:demo" {
+			t.Fatalf("unexpected keyboard: %+v", b.sentParams[0].ReplyMarkup)
+		}
+
+		HandleUpdate(context.Background(), b, &models.Update{CallbackQuery: &models.CallbackQuery{
+			ID:      "cb",
+			From:    models.User{ID: 1},
+			Data:    kb.InlineKeyboard[0][0].CallbackData,
+			Message: models.MaybeInaccessibleMessage{Message: &models.Message{ID: 7, Chat: models.Chat{ID: 1}}},
+		}})
+		if len(b.edits) != 1 || b.edits[0].Text != "Cleared 1 messages from project 'demo'." {
+			t.Fatalf("unexpected edits: %+v", b.edits)
+		}
+		if n, _ := storage.CountProjectHistory("demo"); n != 0 {
+			t.Fatalf("history left: %d", n)
+		}
+	})
+}
+
+func TestHandleUpdateMoveHistory(t *testing.T) {
+	logging.Init()
+	t.Run("usage", func(t *testing.T) {
+		b := &fakeBot{}
+		upd := cmdUpdate("/movehistory a")
+		HandleUpdate(context.Background(), b, upd)
+		if len(b.sent) != 1 || !strings.HasPrefix(b.sent[0], "Usage: /movehistory") {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("project not found", func(t *testing.T) {
+		initStore(t)
+		if err := storage.SaveProject("a"); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+		b := &fakeBot{}
+		upd := cmdUpdate("/movehistory a b")
+		HandleUpdate(context.Background(), b, upd)
+		if len(b.sent) != 1 || b.sent[0] != "Project 'b' not found." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var gotReplace, gotClear bool
+		origPE := projectExists
+		origMove := moveProjectHistory
+		projectExists = func(name string) (bool, error) { return true, nil }
+		moveProjectHistory = func(src, dst string, replace, clearSrc bool) (int, error) {
+			gotReplace, gotClear = replace, clearSrc
+			return 4, nil
+		}
+		defer func() { projectExists = origPE; moveProjectHistory = origMove }()
+		b := &fakeBot{}
+		upd := cmdUpdate("/movehistory a b --replace --clear")
+		HandleUpdate(context.Background(), b, upd)
+		if !gotReplace || !gotClear {
+			t.Fatalf("flags not passed: replace=%v clear=%v", gotReplace, gotClear)
+		}
+		if len(b.sent) != 1 || b.sent[0] != "Moved 4 messages from 'a' to 'b'." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+}
+
+func TestHandleUpdateSchedule(t *testing.T) {
+	logging.Init()
+	t.Run("invalid cron", func(t *testing.T) {
+		b := &fakeBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/schedule 61 8 * * * plan my day"))
+		if len(b.sent) != 1 || !strings.HasPrefix(b.sent[0], "Invalid schedule:") {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("topic not mapped", func(t *testing.T) {
+		initStore(t)
+		b := &fakeBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/schedule 0 8 * * * plan my day"))
+		if len(b.sent) != 1 || b.sent[0] != "Topic is not mapped to a project." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("add list remove", func(t *testing.T) {
+		initStore(t)
+		if err := storage.MapTopic(1, 0, "demo"); err != nil {
+			t.Fatalf("map topic: %v", err)
+		}
+		b := &fakeBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/schedule 0 8 * * 1-5 plan my day"))
+		if len(b.sent) != 1 || b.sent[0] != "Schedule #1 added: 0 8 * * 1-5" {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+		items, _ := storage.ListSchedules()
+		if len(items) != 1 || items[0].Prompt != "plan my day" {
+			t.Fatalf("schedule not stored: %+v", items)
+		}
+		HandleUpdate(context.Background(), b, cmdUpdate("/schedules"))
+		if len(b.sent) != 2 || !strings.Contains(b.sent[1], "#1 0 8 * * 1-5") {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+		HandleUpdate(context.Background(), b, cmdUpdate("/unschedule 1"))
+		if len(b.sent) != 3 || b.sent[2] != "Schedule #1 removed." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+}
+
+func TestHandleUpdateForget(t *testing.T) {
+	logging.Init()
+	t.Run("usage", func(t *testing.T) {
+		b := &fakeBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/forget demo"))
+		if len(b.sent) != 1 || b.sent[0] != "Usage: /forget <projectName> <n>" {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("invalid count", func(t *testing.T) {
+		b := &fakeBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/forget demo zero"))
+		if len(b.sent) != 1 || b.sent[0] != "Please enter a positive number of messages." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		initStore(t)
+		if err := storage.SaveProject("demo"); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+		storage.AddHistoryMessage("demo", storage.HistoryMessage{When: 1, Content: "keep"})
+		storage.AddHistoryMessage("demo", storage.HistoryMessage{When: 2, Content: "oops"})
+		b := &fakeBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/forget demo 5"))
+		if len(b.sent) != 1 || b.sent[0] != "Removed the last 2 messages from project 'demo'." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
 	})
 }
 
@@ -929,6 +1320,97 @@ func TestHandleUpdateListProjects(t *testing.T) {
 	}
 }
 
+func TestHandleUpdateListProjectsDetailed(t *testing.T) {
+	logging.Init()
+	initStore(t)
+	for _, p := range []string{"beta", "Alpha"} {
+		if err := storage.SaveProject(p); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+	}
+	if err := storage.SaveProjectModel("beta", "gpt-4o"); err != nil {
+		t.Fatalf("save model: %v", err)
+	}
+	if err := storage.MapTopic(1, 2, "beta"); err != nil {
+		t.Fatalf("map topic: %v", err)
+	}
+	for _, m := range []storage.HistoryMessage{
+		{Role: storage.RoleUser, When: 1, Content: "hi"},
+		{Role: storage.RoleAssistant, When: 2, Content: "hello"},
+	} {
+		if err := storage.AddHistoryMessage("beta", m); err != nil {
+			t.Fatalf("add history: %v", err)
+		}
+	}
+
+	b := &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/listprojects"))
+	if len(b.sent) != 1 || b.sent[0] != "Projects: Alpha, beta" {
+		t.Fatalf("compact list = %v", b.sent)
+	}
+
+	b = &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/listprojects --detailed"))
+	want := "Projects:\nAlpha: model " + defaultModel + ", 0 history messages, no topic\nbeta: model gpt-4o, 2 history messages, 1 topic(s)"
+	if len(b.sent) != 1 || b.sent[0] != want {
+		t.Fatalf("detailed list = %q, want %q", b.sent, want)
+	}
+
+	b = &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/listprojects --bogus"))
+	if len(b.sent) != 1 || b.sent[0] != listProjectsUsage {
+		t.Fatalf("usage = %v", b.sent)
+	}
+}
+
+func TestProjectDescription(t *testing.T) {
+	logging.Init()
+	initStore(t)
+	for _, p := range []string{"alpha", "beta"} {
+		if err := storage.SaveProject(p); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+	}
+
+	b := &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setdescription beta "+strings.Repeat("x", maxDescription+1)))
+	HandleUpdate(context.Background(), b, cmdUpdate("/setdescription beta Support bot for the shop"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/description beta"))
+	want := []string{
+		fmt.Sprintf("Please enter a single-line description of at most %d characters.", maxDescription),
+		"Description of project 'beta' saved.",
+		"Project 'beta': Support bot for the shop",
+	}
+	if !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("replies = %q, want %q", b.sent, want)
+	}
+
+	b = &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/listprojects --detailed"))
+	list := "Projects:\nalpha: model " + defaultModel + ", 0 history messages, no topic\nbeta: model " + defaultModel + ", 0 history messages, no topic\n  Support bot for the shop"
+	if len(b.sent) != 1 || b.sent[0] != list {
+		t.Fatalf("detailed list = %q, want %q", b.sent, list)
+	}
+
+	b = &fakeBot{}
+	upd := cmdUpdate("/use beta")
+	upd.Message.Chat.Type = models.ChatTypePrivate
+	HandleUpdate(context.Background(), b, upd)
+	upd = cmdUpdate("/use")
+	upd.Message.Chat.Type = models.ChatTypePrivate
+	HandleUpdate(context.Background(), b, upd)
+	if len(b.sent) != 2 || b.sent[1] != "Current project: beta\nSupport bot for the shop" {
+		t.Fatalf("use replies = %q", b.sent)
+	}
+
+	b = &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/setdescription beta off"))
+	HandleUpdate(context.Background(), b, cmdUpdate("/description beta"))
+	if want := []string{"Project 'beta' has no description.", "Project 'beta' has no description."}; !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("off replies = %q", b.sent)
+	}
+}
+
 func TestPendingModel(t *testing.T) {
 	logging.Init()
 
@@ -1228,54 +1710,501 @@ func TestPendingHistoryLimit(t *testing.T) {
 	})
 }
 
-func TestPendingClearHistory(t *testing.T) {
+func TestClearHistoryConfirmCallback(t *testing.T) {
 	logging.Init()
+	press := func(b Bot, from int64, data string) {
+		HandleUpdate(context.Background(), b, &models.Update{CallbackQuery: &models.CallbackQuery{
+			ID:      "cb",
+			From:    models.User{ID: from},
+			Data:    data,
+			Message: models.MaybeInaccessibleMessage{Message: &models.Message{ID: 7, Chat: models.Chat{ID: 1}}},
+		}})
+	}
 
 	t.Run("cancel", func(t *testing.T) {
-		pendingClearHist = map[int64]string{1: "demo"}
 		called := false
 		orig := clearProjectHistory
 		clearProjectHistory = func(name string) (int, error) { called = true; return 0, nil }
 		defer func() { clearProjectHistory = orig }()
-		b := &fakeBot{}
-		upd := &models.Update{Message: &models.Message{Text: "no", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
-		HandleUpdate(context.Background(), b, upd)
+		b := &testBot{}
+		press(b, 1, "confirm:cancel:1:demo")
 		if called {
 			t.Fatal("clearProjectHistory should not be called")
 		}
-		if len(b.sent) != 1 || b.sent[0] != "Cancelled." {
-			t.Fatalf("unexpected messages: %v", b.sent)
+		if len(b.edits) != 1 || b.edits[0].MessageID != 7 || b.edits[0].Text != "Cancelled." {
+			t.Fatalf("unexpected edits: %+v", b.edits)
+		}
+		if len(b.answers) != 1 {
+			t.Fatalf("callback not answered: %+v", b.answers)
 		}
 	})
 
 	t.Run("error", func(t *testing.T) {
-		pendingClearHist = map[int64]string{1: "demo"}
 		orig := clearProjectHistory
 		clearProjectHistory = func(name string) (int, error) { return 0, fmt.Errorf("boom") }
 		defer func() { clearProjectHistory = orig }()
-		b := &fakeBot{}
-		upd := &models.Update{Message: &models.Message{Text: "confirm", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
-		HandleUpdate(context.Background(), b, upd)
-		if len(b.sent) != 1 || !strings.Contains(b.sent[0], "Clear error: boom") {
-			t.Fatalf("unexpected messages: %v", b.sent)
+		b := &testBot{}
+		press(b, 1, "confirm:clearhistory:1:demo")
+		if len(b.edits) != 1 || b.edits[0].Text != "Clear error: boom" {
+			t.Fatalf("unexpected edits: %+v", b.edits)
 		}
 	})
 
-	t.Run("success", func(t *testing.T) {
-		pendingClearHist = map[int64]string{1: "demo"}
+	t.Run("confirm", func(t *testing.T) {
 		var gotName string
 		orig := clearProjectHistory
 		clearProjectHistory = func(name string) (int, error) { gotName = name; return 3, nil }
 		defer func() { clearProjectHistory = orig }()
-		b := &fakeBot{}
-		upd := &models.Update{Message: &models.Message{Text: "confirm", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
-		HandleUpdate(context.Background(), b, upd)
+		b := &testBot{}
+		press(b, 1, "confirm:clearhistory:1:demo")
 		if gotName != "demo" {
 			t.Fatalf("unexpected name: %s", gotName)
 		}
 		want := "Cleared 3 messages from project 'demo'."
-		if len(b.sent) != 1 || b.sent[0] != want {
+		if len(b.edits) != 1 || b.edits[0].Text != want {
+			t.Fatalf("unexpected edits: %+v", b.edits)
+		}
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		called := false
+		orig := clearProjectHistory
+		clearProjectHistory = func(name string) (int, error) { called = true; return 0, nil }
+		defer func() { clearProjectHistory = orig }()
+		b := &testBot{}
+		press(b, 2, "confirm:clearhistory:1:demo")
+		if called {
+			t.Fatal("clearProjectHistory should not be called for another user")
+		}
+		if len(b.edits) != 0 {
+			t.Fatalf("unexpected edits: %+v", b.edits)
+		}
+		if len(b.answers) != 1 || b.answers[0].Text != "Only the user who started this can confirm it." {
+			t.Fatalf("unexpected answers: %+v", b.answers)
+		}
+	})
+}
+
+func TestHandleUpdate_SetupWizard(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	if err := storage.Init(dbPath); err != nil {
+		t.Fatalf("storage init: %v", err)
+	}
+	t.Cleanup(func() { storage.Close() })
+
+	b := &fakeBot{}
+	send := func(upd *models.Update) {
+		upd.Message.MessageThreadID = 5
+		HandleUpdate(context.Background(), b, upd)
+	}
+	textUpdate := func(text string) *models.Update {
+		return &models.Update{Message: &models.Message{Text: text, Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+	}
+
+	send(cmdUpdate("/setup"))
+	send(textUpdate("demo"))
+
+	// progress survives a restart
+	storage.Close()
+	if err := storage.Init(dbPath); err != nil {
+		t.Fatalf("storage reopen: %v", err)
+	}
+	pendingSetup = map[setupKey]storage.SetupState{}
+	if err := RestoreSetup(); err != nil {
+		t.Fatalf("restore setup: %v", err)
+	}
+
+	// a message in another topic is not an answer to the wizard
+	other := textUpdate("elsewhere")
+	other.Message.MessageThreadID = 6
+	HandleUpdate(context.Background(), b, other)
+	if len(b.sent) != 2 {
+		t.Fatalf("message from another topic answered: %q", b.sent[2:])
+	}
+
+	send(textUpdate("maybe"))
+	send(textUpdate("yes"))
+	send(textUpdate("gpt-4o"))
+
+	if exists, _ := storage.ProjectExists("demo"); !exists {
+		t.Fatal("project not created")
+	}
+	if proj, _ := storage.GetMappedProject(1, 5); proj != "demo" {
+		t.Fatalf("topic mapped to %q", proj)
+	}
+	if model, _ := storage.LoadProjectModel("demo"); model != "gpt-4o" {
+		t.Fatalf("model %q", model)
+	}
+	if states, _ := storage.ListSetupStates(); len(states) != 0 {
+		t.Fatal("setup state not cleared")
+	}
+	want := []string{
+		"Setup step 1/3: enter a name for the project (an existing project is reused). Send /setup cancel to stop.",
+		"Setup step 2/3: map this topic to project 'demo'? (yes/no)",
+		"Please enter one of: yes, no.",
+		"Setup step 3/3: enter the model name, or \"default\" for gpt-5.",
+		"Setup complete. Project 'demo' uses model 'gpt-4o'.",
+	}
+	if !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("unexpected replies: %q", b.sent)
+	}
+}
+
+func TestHandleUpdateSetVoiceReply(t *testing.T) {
+	logging.Init()
+	initStore(t)
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+
+	t.Run("inline", func(t *testing.T) {
+		b := &fakeBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/setvoicereply demo on"))
+		if v, _ := storage.LoadProjectVoiceReply("demo"); v != "on" {
+			t.Fatalf("voice reply = %q", v)
+		}
+		if len(b.sent) != 1 || b.sent[0] != "Voice replies for project 'demo' set to on." {
 			t.Fatalf("unexpected messages: %v", b.sent)
 		}
 	})
+
+	t.Run("two step", func(t *testing.T) {
+		pendingVoiceReply = map[int64]string{}
+		b := &fakeBot{}
+		HandleUpdate(context.Background(), b, cmdUpdate("/setvoicereply demo"))
+		if pendingVoiceReply[1] != "demo" {
+			t.Fatalf("pendingVoiceReply not set: %v", pendingVoiceReply)
+		}
+		upd := &models.Update{Message: &models.Message{Text: "maybe", Chat: models.Chat{ID: 1}, From: &models.User{ID: 1}}}
+		HandleUpdate(context.Background(), b, upd)
+		if len(b.sent) != 2 || b.sent[1] != "Please enter one of: on, off." {
+			t.Fatalf("unexpected messages: %v", b.sent)
+		}
+		if v, _ := storage.LoadProjectVoiceReply("demo"); v != "on" {
+			t.Fatalf("voice reply changed to %q", v)
+		}
+	})
+}
+
+func TestHandleUpdateStats(t *testing.T) {
+	logging.Init()
+	initStore(t)
+	if err := storage.SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+
+	b := &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/stats"))
+	if len(b.sent) != 1 || b.sent[0] != "Admins only." {
+		t.Fatalf("unexpected messages: %v", b.sent)
+	}
+
+	adminUsers = map[int64]bool{1: true}
+	defer func() { adminUsers = nil }()
+	b = &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/stats"))
+	if len(b.sent) != 1 || !strings.HasPrefix(b.sent[0], "Projects: 1\nMapped topics: 0\nHistory messages: 0\nDatabase size: ") {
+		t.Fatalf("unexpected messages: %v", b.sent)
+	}
+}
+
+func TestNewProjectDefaults(t *testing.T) {
+	logging.Init()
+	initStore(t)
+	t.Setenv("TBOT_DEFAULT_MODEL", "gpt-4o")
+	t.Setenv("TBOT_DEFAULT_REASONING", "high")
+	t.Setenv("TBOT_DEFAULT_WEBSEARCH", "low")
+	origModel := defaultModel
+	defer func() {
+		defaultModel = origModel
+		storage.SetProjectDefaults(storage.ProjectDefaults{})
+	}()
+	loadProjectDefaults()
+
+	b := &fakeBot{}
+	for _, cmd := range []string{"/newproject demo", "/model demo", "/reasoning demo", "/websearch demo"} {
+		HandleUpdate(context.Background(), b, cmdUpdate(cmd))
+	}
+	want := []string{
+		"Project 'demo' registered.",
+		"Project 'demo' uses model 'gpt-4o'.",
+		"Reasoning effort for project 'demo' is high.",
+		"Web search for project 'demo' is low.",
+	}
+	if !reflect.DeepEqual(b.sent, want) {
+		t.Fatalf("unexpected messages: %q", b.sent)
+	}
+
+	// registering the name again keeps the existing project as it is
+	storage.SaveProjectModel("demo", "custom")
+	b = &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/newproject demo"))
+	if len(b.sent) != 1 || b.sent[0] != "Project 'demo' already exists." {
+		t.Fatalf("unexpected messages: %q", b.sent)
+	}
+	if model, _ := storage.LoadProjectModel("demo"); model != "custom" {
+		t.Fatalf("model = %q, want the existing custom model", model)
+	}
+}
+
+func TestBuildInputsWithHistory(t *testing.T) {
+	when := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cfg := projectConfig{
+		Instruction:  "sys",
+		HistoryLimit: 10,
+		History: []storage.HistoryMessage{
+			{Role: storage.RoleUser, WhoName: "bob", When: when.Add(-2 * time.Minute).Unix(), Content: "first"},
+			{Role: "bogus", WhoName: "x", When: when.Add(-90 * time.Second).Unix(), Content: "skipped"},
+			{Role: storage.RoleAssistant, WhoName: "ChatGPT", When: when.Add(-time.Minute).Unix(), Content: "second"},
+		},
+	}
+	msg := messageData{UserID: 7, UserName: "alice", MessageID: 42, When: when, Text: "hi", Transcribed: "spoken", HasImage: true, ImageURL: "http://img"}
+
+	var logs bytes.Buffer
+	ctx := zerolog.New(&logs).WithContext(context.Background())
+	inputs, records := buildInputs(ctx, cfg, msg)
+	if len(inputs) != 4 {
+		t.Fatalf("expected 4 inputs, got %d", len(inputs))
+	}
+	if !strings.Contains(logs.String(), `"role":"bogus"`) {
+		t.Fatalf("unknown role not logged: %s", logs.String())
+	}
+	if inputs[0].OfMessage.Role != responses.EasyInputMessageRoleSystem || inputs[0].OfMessage.Content.OfString.Value != "sys" {
+		t.Fatalf("unexpected system input %+v", inputs[0].OfMessage)
+	}
+	if got := inputs[1].OfMessage.Content.OfString.Value; !strings.HasSuffix(got, " bob:\nfirst") {
+		t.Fatalf("history[0] = %q", got)
+	}
+	if inputs[2].OfMessage.Role != responses.EasyInputMessageRoleAssistant || !strings.HasSuffix(inputs[2].OfMessage.Content.OfString.Value, "second") {
+		t.Fatalf("history[1] = %+v", inputs[2].OfMessage)
+	}
+	parts := inputs[3].OfMessage.Content.OfInputItemContentList
+	if len(parts) != 2 || parts[1].OfInputImage == nil {
+		t.Fatalf("expected text and image parts, got %+v", parts)
+	}
+	wantMeta := "2024-05-01 12:00:00 alice:\nhi\n(Audio transcription)\nspoken"
+	if got := parts[0].OfInputText.Text; got != wantMeta {
+		t.Fatalf("meta = %q, want %q", got, wantMeta)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 history records, got %d", len(records))
+	}
+	for _, r := range records {
+		if r.WhoID != 7 || r.WhoName != "alice" || r.MessageID != 42 || r.When != when.Unix() {
+			t.Fatalf("unexpected record %+v", r)
+		}
+	}
+	if records[1].Content != "(Transcribed audio) spoken" || records[2].Content != "(User has attached some image)" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+}
+
+func TestBuildInputsWithoutHistory(t *testing.T) {
+	cfg := projectConfig{
+		HistoryLimit: 0,
+		History:      []storage.HistoryMessage{{Role: storage.RoleUser, Content: "old"}},
+	}
+	msg := messageData{UserName: "alice", When: time.Now(), Text: "hi", Transcribed: "spoken"}
+
+	inputs, records := buildInputs(context.Background(), cfg, msg)
+	if len(inputs) != 1 {
+		t.Fatalf("expected only the user input, got %d", len(inputs))
+	}
+	parts := inputs[0].OfMessage.Content.OfInputItemContentList
+	if len(parts) != 2 || parts[0].OfInputText.Text != "hi" || parts[1].OfInputText.Text != "(Audio transcription)\nspoken" {
+		t.Fatalf("unexpected parts %+v", parts)
+	}
+	if records != nil {
+		t.Fatalf("expected no history records, got %+v", records)
+	}
+}
+
+func TestBuildInputsTimezone(t *testing.T) {
+	when := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		zone string
+		want string
+	}{
+		{"", "2024-01-15 12:00:00"},
+		{"Europe/Helsinki", "2024-01-15 14:00:00"},
+		{"America/New_York", "2024-01-15 07:00:00"},
+		{"Mars/Olympus", "2024-01-15 12:00:00"},
+		{"Local", "2024-01-15 12:00:00"},
+	}
+	for _, tc := range cases {
+		cfg := projectConfig{
+			HistoryLimit: 5,
+			History:      []storage.HistoryMessage{{Role: storage.RoleUser, WhoName: "bob", When: when.Unix(), Content: "old"}},
+			Location:     parseLocation(tc.zone),
+		}
+		inputs, _ := buildInputs(context.Background(), cfg, messageData{UserName: "alice", When: when, Text: "new"})
+		if got, want := inputs[0].OfMessage.Content.OfString.Value, tc.want+" bob:\nold"; got != want {
+			t.Fatalf("%q: history = %q, want %q", tc.zone, got, want)
+		}
+		if got, want := inputs[1].OfMessage.Content.OfInputItemContentList[0].OfInputText.Text, tc.want+" alice:\nnew"; got != want {
+			t.Fatalf("%q: meta = %q, want %q", tc.zone, got, want)
+		}
+	}
+}
+
+func TestLiveAndReplayedRenderingMatch(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Skip("timezone data unavailable")
+	}
+	when := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, format := range []string{"", "[{user} at {time}]", noMetaFormat} {
+		cfg := projectConfig{HistoryLimit: 10, Location: loc, MetaFormat: format}
+		inputs, records := buildInputs(context.Background(), cfg, messageData{UserName: "alice", When: when, Text: "hi"})
+		live := inputs[0].OfMessage.Content.OfInputItemContentList[0].OfInputText.Text
+
+		cfg.History = records
+		inputs, _ = buildInputs(context.Background(), cfg, messageData{UserName: "bob", When: when.Add(time.Minute), Text: "next"})
+		if replayed := inputs[0].OfMessage.Content.OfString.Value; replayed != live {
+			t.Fatalf("format %q: replayed %q, live %q", format, replayed, live)
+		}
+	}
+}
+
+func TestTruncateGraphemes(t *testing.T) {
+	cases := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 2, "he"},
+		{"hello", 0, ""},
+		{"e\u0301te\u0301", 2, "e\u0301t"},
+		{"👍🏽👍🏽", 1, "👍🏽"},
+		{"👨‍👩‍👧x", 1, "👨‍👩‍👧"},
+		{"🇫🇮🇩🇪", 1, "🇫🇮"},
+		{"❤️ok", 1, "❤️"},
+		{"1️⃣2", 1, "1️⃣"},
+	}
+	for _, tc := range cases {
+		if got := truncateGraphemes(tc.in, tc.n); got != tc.want {
+			t.Fatalf("truncateGraphemes(%q, %d) = %q, want %q", tc.in, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestHandleUpdateTopics(t *testing.T) {
+	logging.Init()
+	initStore(t)
+	storage.SaveProject("a")
+	storage.SaveProject("b")
+	storage.MapTopic(-100, 5, "a")
+	storage.MapTopic(-100, 6, "b")
+
+	b := &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/topics a"))
+	if len(b.sent) != 1 || b.sent[0] != "chat -100, topic 5" {
+		t.Fatalf("unexpected messages: %v", b.sent)
+	}
+
+	b = &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/topics"))
+	if len(b.sent) != 1 || b.sent[0] != "Usage: /topics <projectName>" {
+		t.Fatalf("non-admin listing: %v", b.sent)
+	}
+
+	adminUsers = map[int64]bool{1: true}
+	defer func() { adminUsers = nil }()
+	b = &fakeBot{}
+	HandleUpdate(context.Background(), b, cmdUpdate("/topics"))
+	want := "chat -100, topic 5: a\nchat -100, topic 6: b"
+	if len(b.sent) != 1 || b.sent[0] != want {
+		t.Fatalf("unexpected messages: %v", b.sent)
+	}
+}
+
+func TestClassifyOpenAIError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"context length", &openai.Error{StatusCode: 400, Code: "context_length_exceeded"}, "The model rejected the request: context too long. Try /forget or reduce the history limit."},
+		{"content filter", &openai.Error{StatusCode: 400, Code: "content_policy_violation"}, "The model rejected the request: blocked by the content filter."},
+		{"unknown model", &openai.Error{StatusCode: 404, Code: "model_not_found"}, "The model rejected the request: unknown model. Check the project model with /model."},
+		{"quota", &openai.Error{StatusCode: 429, Code: "insufficient_quota"}, "The OpenAI account has run out of quota."},
+		{"rate limit", &openai.Error{StatusCode: 429}, "OpenAI rate limit reached, please try again in a moment."},
+		{"auth", &openai.Error{StatusCode: 401, Code: "invalid_api_key"}, "OpenAI rejected the API key."},
+		{"wrapped", fmt.Errorf("request: %w", &openai.Error{StatusCode: 403}), "OpenAI rejected the API key."},
+		{"other api", &openai.Error{StatusCode: 500, Message: "server exploded"}, "OpenAI error: server exploded"},
+		{"other api no message", &openai.Error{StatusCode: 502}, "OpenAI error: status 502"},
+		{"network", fmt.Errorf("dial tcp: timeout"), "OpenAI error: dial tcp: timeout"},
+	}
+	for _, tc := range cases {
+		if got := classifyOpenAIError(tc.err); got != tc.want {
+			t.Fatalf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseSearchDomains(t *testing.T) {
+	got, err := parseSearchDomains("example.com, Sub.Example.COM. example.com\nxn--80ak6aa92e.com")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := []string{"example.com", "sub.example.com", "xn--80ak6aa92e.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("domains = %v, want %v", got, want)
+	}
+	for _, bad := range []string{"", "localhost", "https://example.com", "example.com/path", "-a.com", "a-.com", "a..com", "10.0.0.1", "ex_ample.com"} {
+		if d, err := parseSearchDomains(bad); err == nil {
+			t.Errorf("parseSearchDomains(%q) = %v, want error", bad, d)
+		}
+	}
+	var many []string
+	for i := 0; i <= maxSearchDomains; i++ {
+		many = append(many, fmt.Sprintf("site%d.com", i))
+	}
+	if _, err := parseSearchDomains(strings.Join(many, " ")); err == nil {
+		t.Errorf("%d domains accepted", len(many))
+	}
+}
+
+func TestRouteModel(t *testing.T) {
+	r := storage.ModelRoute{Short: "gpt-5-nano", Long: "gpt-5", Threshold: 5}
+	cases := map[string]string{
+		"":       "gpt-5-nano",
+		"hello":  "gpt-5-nano",
+		"привет": "gpt-5",
+		"hello!": "gpt-5",
+	}
+	for prompt, want := range cases {
+		if got := routeModel(r, prompt); got != want {
+			t.Errorf("routeModel(%q) = %q, want %q", prompt, got, want)
+		}
+	}
+}
+
+func TestRedactTextOrder(t *testing.T) {
+	// the second rule sees the output of the first
+	got := redactText("key=abc123", []string{`abc\d+`, `key=\[redacted\]`, `(`})
+	if got != redactedText {
+		t.Fatalf("redactText = %q, want %q", got, redactedText)
+	}
+}
+
+func TestAudioFileID(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  models.Message
+		want string
+	}{
+		{"voice", models.Message{Voice: &models.Voice{FileID: "v"}}, "v"},
+		{"audio", models.Message{Audio: &models.Audio{FileID: "a"}}, "a"},
+		{"audio document", models.Message{Document: &models.Document{FileID: "d", MimeType: "audio/mpeg"}}, "d"},
+		{"ogg document", models.Message{Document: &models.Document{FileID: "o", MimeType: "application/ogg"}}, "o"},
+		{"pdf document", models.Message{Document: &models.Document{FileID: "p", MimeType: "application/pdf"}}, ""},
+		{"text", models.Message{Text: "hi"}, ""},
+	}
+	for _, tt := range tests {
+		if got := audioFileID(&tt.msg); got != tt.want {
+			t.Errorf("%s: audioFileID = %q, want %q", tt.name, got, tt.want)
+		}
+	}
 }
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+var (
+	historyLocksMu sync.Mutex
+	historyLocks   = map[string]*sync.Mutex{}
+)
+
+// historyLock returns the lock serializing history writes of a project.
+func historyLock(proj string) *sync.Mutex {
+	historyLocksMu.Lock()
+	defer historyLocksMu.Unlock()
+	l, ok := historyLocks[proj]
+	if !ok {
+		l = &sync.Mutex{}
+		historyLocks[proj] = l
+	}
+	return l
+}
+
+// lockHistory takes the history locks of the given projects in name order, so
+// two writers never wait on each other, and returns the function releasing
+// them. Every change of a project history runs under its lock.
+func lockHistory(projects ...string) func() {
+	names := append([]string(nil), projects...)
+	sort.Strings(names)
+	var locks []*sync.Mutex
+	for i, p := range names {
+		if i > 0 && p == names[i-1] {
+			continue
+		}
+		l := historyLock(p)
+		l.Lock()
+		locks = append(locks, l)
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// errHistoryChanged reports that the summarized messages were changed by
+// another request while the summary was written.
+var errHistoryChanged = errors.New("history changed during summarization")
+
+// replaceSummarized stores summary in place of the summarized messages, which
+// must still be the oldest ones of proj. The summary call is slow and runs
+// without the lock, so the prefix is checked again under it.
+func replaceSummarized(proj string, summarized []storage.HistoryMessage, summary storage.HistoryMessage) error {
+	defer lockHistory(proj)()
+	current, err := storage.LoadProjectHistory(proj)
+	if err != nil {
+		return err
+	}
+	if len(current) < len(summarized) {
+		return errHistoryChanged
+	}
+	for i, m := range summarized {
+		if current[i] != m {
+			return errHistoryChanged
+		}
+	}
+	return replaceOldestHistory(proj, len(summarized), summary)
+}
+
+// maxAssistantName is the longest display name /setname accepts.
+const maxAssistantName = 64
+
+// assistantName returns the name assistant history entries of proj are stored
+// under: the custom display name, or "ChatGPT <model>" when none is set.
+func assistantName(proj, model string) string {
+	if name, _ := storage.LoadAssistantName(proj); name != "" {
+		return name
+	}
+	return "ChatGPT " + model
+}
+
+// truncatedMarker ends history messages cut to the project size limit.
+const truncatedMarker = "… [truncated]"
+
+// truncateForHistory shortens content to at most max characters, including
+// the truncation marker. A non-positive max keeps content as is.
+func truncateForHistory(content string, max int) string {
+	if max <= 0 || utf8.RuneCountInString(content) <= max {
+		return content
+	}
+	keep := max - utf8.RuneCountInString(truncatedMarker)
+	if keep < 0 {
+		keep = 0
+	}
+	return truncateGraphemes(content, keep) + truncatedMarker
+}
+
+// isDuplicateMessage reports whether m repeats the last stored user message of
+// proj: the same user sent the same text no more than window seconds earlier.
+func isDuplicateMessage(proj string, m storage.HistoryMessage, window int) bool {
+	if window <= 0 || m.Role != storage.RoleUser {
+		return false
+	}
+	last, err := storage.LastUserHistoryMessage(proj)
+	if err != nil {
+		return false
+	}
+	return last.WhoID == m.WhoID && last.Content == m.Content && m.When-last.When <= int64(window)
+}
+
+// appendHistory stores msgs for a project and then trims its history to
+// limit, or skips trimming when limit is not positive. Message contents are
+// cut to the project history message size limit first; the current request
+// has already been built from the full text. A user message repeating the
+// previous one within the project duplicate window is not stored again, and
+// neither are the replies following it in msgs; duplicate reports such a
+// skip, so a reply stored later can be dropped as well. The writes run under
+// the project history lock, so concurrent requests do not interleave their
+// messages or trims.
+func appendHistory(proj string, limit int, msgs ...storage.HistoryMessage) (duplicate bool, err error) {
+	maxLen, _ := storage.LoadHistoryMaxLen(proj)
+	dedupWindow, _ := storage.LoadProjectDedupWindow(proj)
+	defer lockHistory(proj)()
+	for _, m := range msgs {
+		m.Content = truncateForHistory(m.Content, maxLen)
+		if isDuplicateMessage(proj, m, dedupWindow) {
+			duplicate = true
+			continue
+		}
+		if duplicate && m.Role != storage.RoleUser {
+			continue
+		}
+		if err := storage.AddHistoryMessage(proj, m); err != nil {
+			return duplicate, err
+		}
+	}
+	if limit > 0 {
+		return duplicate, storage.TrimProjectHistory(proj, limit)
+	}
+	return duplicate, nil
+}
+
+// trailingExchange splits off the last exchange of hist the way
+// storage.UndoLastExchange removes it: replies are the trailing assistant and
+// tool messages, prompt the user messages before them. A summary ends the
+// exchange.
+func trailingExchange(hist []storage.HistoryMessage) (prompt, replies []storage.HistoryMessage) {
+	i := len(hist)
+	for i > 0 && !hist[i-1].IsSummary && hist[i-1].Role != storage.RoleUser {
+		i--
+	}
+	end := i
+	for i > 0 && !hist[i-1].IsSummary && hist[i-1].Role == storage.RoleUser {
+		i--
+	}
+	return hist[i:end], hist[end:]
+}
+
+// retryMessage rebuilds the message of a failed prompt from its history
+// entries so /retry sends the text, image and audio again. cmd is the /retry
+// command, which gives the chat and topic. A transcript stored without its
+// audio file is sent as text.
+func retryMessage(cmd *models.Message, prompt []storage.HistoryMessage) *models.Message {
+	first := prompt[0]
+	msg := &models.Message{
+		ID:              cmd.ID,
+		Chat:            cmd.Chat,
+		MessageThreadID: cmd.MessageThreadID,
+		From:            &models.User{ID: first.WhoID, Username: first.WhoName},
+	}
+	var texts []string
+	for _, m := range prompt {
+		switch {
+		case m.Content == imageNote && m.FileID != "":
+			msg.Photo = []models.PhotoSize{{FileID: m.FileID}}
+		case m.Content == imageNote:
+			// the image is lost, so only the note is kept
+			texts = append(texts, m.Content)
+		case strings.HasPrefix(m.Content, transcriptPrefix) && m.FileID != "":
+			msg.Voice = &models.Voice{FileID: m.FileID}
+		default:
+			texts = append(texts, m.Content)
+		}
+	}
+	msg.Text = strings.Join(texts, "\n")
+	return msg
+}
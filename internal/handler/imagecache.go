@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// imageCacheKey derives the answer cache key from the image content and the
+// accompanying prompt.
+func imageCacheKey(image []byte, prompt string) string {
+	h := sha256.New()
+	h.Write(image)
+	h.Write([]byte{0})
+	h.Write([]byte(prompt))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// downloadFile fetches the file behind url.
+func downloadFile(url string) ([]byte, error) {
+	resp, err := httpGetFunc(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 0 && resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
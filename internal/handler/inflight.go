@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"fmt"
+	"sync"
+)
+
+const busyReply = "Still working on your previous message, please wait."
+
+var (
+	topicLocksMu sync.Mutex
+	topicLocks   = map[string]*sync.Mutex{}
+)
+
+// topicLock returns the lock guarding requests of a chat topic.
+func topicLock(chatID int64, topicID int) *sync.Mutex {
+	key := fmt.Sprintf("%d:%d", chatID, topicID)
+	topicLocksMu.Lock()
+	defer topicLocksMu.Unlock()
+	l, ok := topicLocks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		topicLocks[key] = l
+	}
+	return l
+}
+
+// acquireTopic waits for or rejects a request while another one is in flight
+// in the same topic, depending on the project busy mode. It returns the unlock
+// function and false when the request was rejected.
+func acquireTopic(chatID int64, topicID int, mode string) (func(), bool) {
+	l := topicLock(chatID, topicID)
+	if mode == "reject" {
+		if !l.TryLock() {
+			return nil, false
+		}
+		return l.Unlock, true
+	}
+	l.Lock()
+	return l.Unlock, true
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	openai "github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/responses"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/metrics"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+const (
+	// minInlineQuery skips the first keystrokes of an inline query.
+	minInlineQuery = 3
+	// maxInlineAnswer keeps the chosen answer within one Telegram message.
+	maxInlineAnswer = 4000
+	// inlineCacheTime lets Telegram reuse an answer for repeated queries, in
+	// seconds.
+	inlineCacheTime = 60
+)
+
+// inlineTimeout bounds the model call of an inline query; Telegram stops
+// waiting for results shortly after.
+var inlineTimeout = 8 * time.Second
+
+// inlineRequest is the running model call of a user's inline query.
+type inlineRequest struct {
+	cancel context.CancelFunc
+}
+
+// inlineRequests lets a newer inline query of a user cancel the running one,
+// as Telegram sends a query whenever the user pauses typing.
+var (
+	inlineMu       sync.Mutex
+	inlineRequests = map[int64]*inlineRequest{}
+)
+
+// handleInlineQuery answers "@bot <question>" typed in any chat. The request is
+// stateless: it uses the model and instruction of the user's /use project, or
+// the default model, with minimal reasoning and no history or web search.
+func handleInlineQuery(ctx context.Context, b Bot, q *models.InlineQuery) {
+	log := logging.Ctx(ctx)
+	if q.From == nil || (len(allowedUsers) > 0 && !allowedUsers[q.From.ID]) {
+		log.Info().Str("event", "inline_denied").Msg("inline query from a user who is not allowed")
+		answerInline(ctx, b, q, nil)
+		return
+	}
+	ctx = logging.WithUser(ctx, q.From.ID)
+	log = logging.Ctx(ctx)
+	question := strings.TrimSpace(q.Query)
+	if utf8.RuneCountInString(question) < minInlineQuery {
+		return
+	}
+	if setting, _ := storage.LoadMaintenance(); setting == "on" {
+		answerInline(ctx, b, q, inlineArticle(question, maintenanceMessage()))
+		return
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, inlineTimeout)
+	req := &inlineRequest{cancel: cancel}
+	inlineMu.Lock()
+	if prev := inlineRequests[q.From.ID]; prev != nil {
+		prev.cancel()
+	}
+	inlineRequests[q.From.ID] = req
+	inlineMu.Unlock()
+	defer func() {
+		cancel()
+		inlineMu.Lock()
+		if inlineRequests[q.From.ID] == req {
+			delete(inlineRequests, q.From.ID)
+		}
+		inlineMu.Unlock()
+	}()
+
+	proj, err := storage.GetUserCurrentProject(q.From.ID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Error().Err(err).Msg("failed to load current project")
+	}
+	model := defaultModel
+	cfg := projectConfig{}
+	if proj != "" {
+		if m, _ := storage.LoadProjectModel(proj); m != "" {
+			model = m
+		}
+		cfg = loadProjectConfig(proj)
+	}
+	if proj != "" && monthlyBudgetReached(proj) {
+		answerInline(ctx, b, q, inlineArticle(question, monthlyBudgetText))
+		return
+	}
+	inputs, _ := buildInputs(ctx, cfg, messageData{UserID: q.From.ID, UserName: q.From.Username, When: time.Now(), Text: question})
+
+	metrics.Inc(metrics.ChatGPTRequests)
+	log.Info().Str("event", "chatgpt_inline_request").Str("project", proj).Str("model", model).Str("snippet", logging.Snippet(question, 30)).Msg("sending inline query to ChatGPT")
+	resp, err := openAIResponses(reqCtx, newOpenAIClient(proj), responses.ResponseNewParams{
+		Model:     openai.ResponsesModel(model),
+		Input:     responses.ResponseNewParamsInputUnion{OfInputItemList: inputs},
+		Reasoning: openai.ReasoningParam{Effort: openai.ReasoningEffortMinimal},
+	})
+	recordUsage(ctx, proj, resp)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			// superseded by a newer query, which is answered instead
+			return
+		}
+		metrics.Inc(metrics.ChatGPTErrors)
+		log.Error().Err(err).Str("model", model).Msg("chatgpt inline request failed")
+		reply := classifyOpenAIError(err)
+		entry := storage.AuditEntry{UserID: q.From.ID, Model: model, Prompt: question, Reply: reply, IsError: true}
+		// the audit log is kept per project, so queries without one are
+		// not recorded
+		if proj != "" {
+			recordAudit(ctx, proj, entry)
+		}
+		answerInline(ctx, b, q, inlineArticle(question, reply))
+		sendLogCopy(ctx, b, proj, q.From, entry)
+		return
+	}
+	reply := resp.Text
+	if proj != "" {
+		reply = redactReply(ctx, proj, reply)
+	}
+	if strings.TrimSpace(reply) == "" {
+		reply = emptyReplyText
+	}
+	entry := storage.AuditEntry{UserID: q.From.ID, Model: model, Prompt: question, Reply: reply}
+	if proj != "" {
+		recordAudit(ctx, proj, entry)
+	}
+	answerInline(ctx, b, q, inlineArticle(question, reply))
+	sendLogCopy(ctx, b, proj, q.From, entry)
+}
+
+// inlineArticle builds the single result offered for an inline query.
+func inlineArticle(question, answer string) models.InlineQueryResult {
+	answer = truncateGraphemes(answer, maxInlineAnswer)
+	return &models.InlineQueryResultArticle{
+		ID:                  "answer",
+		Title:               truncateGraphemes(question, 64),
+		Description:         truncateGraphemes(answer, 128),
+		InputMessageContent: &models.InputTextMessageContent{MessageText: answer},
+	}
+}
+
+// answerInline sends the results of q; nil sends an empty list.
+func answerInline(ctx context.Context, b Bot, q *models.InlineQuery, result models.InlineQueryResult) {
+	results := []models.InlineQueryResult{}
+	if result != nil {
+		results = append(results, result)
+	}
+	if _, err := b.AnswerInlineQuery(ctx, &tg.AnswerInlineQueryParams{
+		InlineQueryID: q.ID,
+		Results:       results,
+		CacheTime:     inlineCacheTime,
+		IsPersonal:    true,
+	}); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("failed to answer inline query")
+	}
+}
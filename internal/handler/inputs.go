@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	openai "github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/responses"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// projectConfig holds the project settings that shape the request input.
+// Timestamps are shown in Location, or UTC when it is nil. Images are sent
+// with ImageDetail, or auto when it is empty. The instruction is sent with the
+// developer role when InstructionRole is "developer" and as system otherwise.
+// InjectTime adds a system message with the current date and time and
+// MirrorLanguage one asking for replies in the user's language; JSONMode adds
+// one asking for JSON replies. MetaFormat is
+// the template of the line sent before each history message, defaultMetaFormat
+// when it is empty; "none" sends the content alone. Project names the project
+// in log messages.
+type projectConfig struct {
+	Project         string
+	Instruction     string
+	InstructionRole string
+	InjectTime      bool
+	MirrorLanguage  bool
+	JSONMode        bool
+	HistoryLimit    int
+	History         []storage.HistoryMessage
+	Location        *time.Location
+	ImageDetail     string
+	MetaFormat      string
+}
+
+const (
+	// defaultMetaFormat names the time and author of each history message.
+	defaultMetaFormat = "{time} {user}:"
+	// noMetaFormat disables the metadata line.
+	noMetaFormat = "none"
+	// maxMetaFormat is the longest template /setmetaformat accepts.
+	maxMetaFormat = 100
+)
+
+const (
+	// transcriptPrefix starts the history entry of a transcribed audio.
+	transcriptPrefix = "(Transcribed audio) "
+	// imageNote is the history entry standing for an attached image.
+	imageNote = "(User has attached some image)"
+)
+
+// renderMessage returns a message as it is sent to the model with history
+// enabled: the metadata line of cfg, with the time shown in loc, followed by
+// the content. The live prompt and replayed history are both rendered here,
+// so a message looks the same in every request.
+func (cfg projectConfig) renderMessage(h storage.HistoryMessage, loc *time.Location) string {
+	var lines []string
+	format := cfg.MetaFormat
+	if format == "" {
+		format = defaultMetaFormat
+	}
+	if format != noMetaFormat {
+		when := formatUnix(h.When, loc, historyTimeLayout)
+		lines = append(lines, strings.NewReplacer("{time}", when, "{user}", h.WhoName).Replace(format))
+	}
+	if h.Role == storage.RoleTool {
+		lines = append(lines, "(Tool output)")
+	}
+	if h.Content != "" {
+		lines = append(lines, h.Content)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// metaFormatText describes the metadata format of proj for /metaformat.
+func metaFormatText(proj, format string) string {
+	switch format {
+	case "":
+		return fmt.Sprintf("History messages of project '%s' start with the default line '%s'.", proj, defaultMetaFormat)
+	case noMetaFormat:
+		return fmt.Sprintf("History messages of project '%s' are sent without metadata.", proj)
+	}
+	return fmt.Sprintf("History messages of project '%s' start with the line '%s'.", proj, format)
+}
+
+// mirrorLanguageInstruction is sent when a project mirrors the user's language.
+const mirrorLanguageInstruction = "Respond in the same language as the user's latest message."
+
+// loadProjectConfig loads the project settings shared by every request. The
+// history fields are left for the caller.
+func loadProjectConfig(proj string) projectConfig {
+	instr, _ := storage.LoadProjectInstruction(proj)
+	role, _ := storage.LoadProjectInstructionRole(proj)
+	injectTime, _ := storage.LoadProjectInjectTime(proj)
+	mirror, _ := storage.LoadProjectMirrorLanguage(proj)
+	detail, _ := storage.LoadProjectImageDetail(proj)
+	metaFormat, _ := storage.LoadProjectMetaFormat(proj)
+	jsonMode, _ := storage.LoadProjectJSONMode(proj)
+	return projectConfig{
+		Project:         proj,
+		Instruction:     instr,
+		InstructionRole: role,
+		InjectTime:      injectTime == "on",
+		MirrorLanguage:  mirror == "on",
+		JSONMode:        jsonMode == "on",
+		Location:        projectLocation(proj),
+		ImageDetail:     detail,
+		MetaFormat:      metaFormat,
+	}
+}
+
+// messageData describes the incoming user message. ImageURL is empty when an
+// attached image could not be resolved.
+type messageData struct {
+	UserID      int64
+	UserName    string
+	ChatID      int64
+	MessageID   int
+	When        time.Time
+	Text        string
+	Transcribed string
+	HasImage    bool
+	ImageURL    string
+	// ImageFileID and AudioFileID are the Telegram files of the image and
+	// the transcribed audio, kept in history so /retry can send them again.
+	ImageFileID string
+	AudioFileID string
+}
+
+// buildInputs assembles the request input from the project configuration and
+// the incoming message: the system instruction, the replayed history and the
+// user message. It also returns the history entries to store for the message,
+// which is empty when history is disabled. History messages with an unknown
+// role are skipped with a warning, error replies silently.
+func buildInputs(ctx context.Context, cfg projectConfig, msg messageData) (responses.ResponseInputParam, []storage.HistoryMessage) {
+	loc := cfg.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	inputs := responses.ResponseInputParam{}
+	if cfg.Instruction != "" {
+		role := responses.EasyInputMessageRoleSystem
+		if cfg.InstructionRole == "developer" {
+			role = responses.EasyInputMessageRoleDeveloper
+		}
+		inputs = append(inputs, responses.ResponseInputItemParamOfMessage(cfg.Instruction, role))
+	}
+	if cfg.InjectTime {
+		now := "Current date/time: " + msg.When.In(loc).Format(currentTimeLayout)
+		inputs = append(inputs, responses.ResponseInputItemParamOfMessage(now, responses.EasyInputMessageRoleSystem))
+	}
+	if cfg.MirrorLanguage {
+		inputs = append(inputs, responses.ResponseInputItemParamOfMessage(mirrorLanguageInstruction, responses.EasyInputMessageRoleSystem))
+	}
+	if cfg.JSONMode {
+		inputs = append(inputs, responses.ResponseInputItemParamOfMessage(jsonModeInstruction, responses.EasyInputMessageRoleSystem))
+	}
+	if cfg.HistoryLimit > 0 {
+		for _, h := range cfg.History {
+			if h.Content == "" || h.IsError {
+				continue
+			}
+			role, ok := historyInputRole(h.Role)
+			if !ok {
+				logging.Ctx(ctx).Warn().Str("project", cfg.Project).Str("role", h.Role).Msg("skipping history message with unknown role")
+				continue
+			}
+			inputs = append(inputs, responses.ResponseInputItemParamOfMessage(cfg.renderMessage(h, loc), role))
+		}
+	}
+
+	var parts responses.ResponseInputMessageContentListParam
+	if cfg.HistoryLimit > 0 {
+		var content []string
+		if msg.Text != "" {
+			content = append(content, msg.Text)
+		}
+		if msg.Transcribed != "" {
+			content = append(content, "(Audio transcription)\n"+msg.Transcribed)
+		}
+		live := storage.HistoryMessage{
+			Role:    string(responses.EasyInputMessageRoleUser),
+			WhoName: msg.UserName,
+			When:    msg.When.Unix(),
+			Content: strings.Join(content, "\n"),
+		}
+		if text := cfg.renderMessage(live, loc); text != "" {
+			parts = append(parts, responses.ResponseInputContentParamOfInputText(text))
+		}
+	} else {
+		if msg.Text != "" {
+			parts = append(parts, responses.ResponseInputContentParamOfInputText(msg.Text))
+		}
+		if msg.Transcribed != "" {
+			parts = append(parts, responses.ResponseInputContentParamOfInputText("(Audio transcription)\n"+msg.Transcribed))
+		}
+	}
+	if msg.ImageURL != "" {
+		img := responses.ResponseInputImageParam{
+			Detail:   imageDetailToConst(cfg.ImageDetail),
+			ImageURL: openai.String(msg.ImageURL),
+		}
+		parts = append(parts, responses.ResponseInputContentUnionParam{OfInputImage: &img})
+	}
+	inputs = append(inputs, responses.ResponseInputItemParamOfMessage(parts, responses.EasyInputMessageRoleUser))
+
+	if cfg.HistoryLimit <= 0 {
+		return inputs, nil
+	}
+	var records []storage.HistoryMessage
+	add := func(content, fileID string) {
+		records = append(records, storage.HistoryMessage{
+			Role:      string(responses.EasyInputMessageRoleUser),
+			WhoID:     msg.UserID,
+			WhoName:   msg.UserName,
+			When:      msg.When.Unix(),
+			Content:   content,
+			ChatID:    msg.ChatID,
+			MessageID: msg.MessageID,
+			FileID:    fileID,
+		})
+	}
+	if msg.Text != "" {
+		add(msg.Text, "")
+	}
+	if msg.Transcribed != "" {
+		add(transcriptPrefix+msg.Transcribed, msg.AudioFileID)
+	}
+	if msg.HasImage {
+		add(imageNote, msg.ImageFileID)
+	}
+	return inputs, records
+}
+
+// estimateInputTokens estimates the token count of all text in inputs.
+func estimateInputTokens(inputs responses.ResponseInputParam) int {
+	n := 0
+	for _, item := range inputs {
+		m := item.OfMessage
+		if m == nil {
+			continue
+		}
+		if m.Content.OfString.Valid() {
+			n += estimateTokens(m.Content.OfString.Value)
+			continue
+		}
+		for _, p := range m.Content.OfInputItemContentList {
+			if p.OfInputText != nil {
+				n += estimateTokens(p.OfInputText.Text)
+			}
+		}
+	}
+	return n
+}
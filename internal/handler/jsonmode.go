@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/openai/openai-go/v2/responses"
+	"github.com/openai/openai-go/v2/shared"
+)
+
+// jsonModeInstruction asks for JSON replies. The JSON object format of the
+// API also requires the word JSON somewhere in the input.
+const jsonModeInstruction = "Respond with a single valid JSON value and nothing else."
+
+// invalidJSONText answers a request whose reply was not JSON twice in a row.
+const invalidJSONText = "The model did not return valid JSON."
+
+var errInvalidJSON = errors.New("reply is not valid JSON")
+
+// jsonTextConfig returns the response format of a project in JSON mode:
+// replies follow schema, or are any JSON object when schema is empty.
+func jsonTextConfig(schema string) responses.ResponseTextConfigParam {
+	var parsed map[string]any
+	if schema == "" || json.Unmarshal([]byte(schema), &parsed) != nil {
+		return responses.ResponseTextConfigParam{
+			Format: responses.ResponseFormatTextConfigUnionParam{OfJSONObject: &shared.ResponseFormatJSONObjectParam{}},
+		}
+	}
+	return responses.ResponseTextConfigParam{
+		Format: responses.ResponseFormatTextConfigUnionParam{
+			OfJSONSchema: &responses.ResponseFormatTextJSONSchemaConfigParam{Name: "reply", Schema: parsed},
+		},
+	}
+}
+
+// validJSON reports whether a reply is a JSON value.
+func validJSON(reply string) bool {
+	reply = strings.TrimSpace(reply)
+	return reply != "" && json.Valid([]byte(reply))
+}
+
+// parseJSONSchema checks that s is a JSON object and returns it compacted.
+func parseJSONSchema(s string) (string, error) {
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(s), &schema); err != nil {
+		return "", fmt.Errorf("the schema must be a JSON object: %v", err)
+	}
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"telegram-chatgpt-bot/internal/logging"
+)
+
+// requestLimiter bounds the number of simultaneous OpenAI requests. Requests
+// over the limit wait in FIFO order.
+type requestLimiter struct {
+	mu      sync.Mutex
+	max     int // 0 means unlimited
+	active  int
+	waiting []chan struct{}
+}
+
+// requestSlots limits the OpenAI requests of the whole bot, configured by
+// TBOT_MAX_CONCURRENT.
+var requestSlots = &requestLimiter{}
+
+// loadMaxConcurrent reads TBOT_MAX_CONCURRENT. Unset, zero or invalid values
+// leave requests unlimited.
+func loadMaxConcurrent() {
+	v := strings.TrimSpace(os.Getenv("TBOT_MAX_CONCURRENT"))
+	if v == "" {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		logging.Log.Warn().Str("value", v).Msg("invalid TBOT_MAX_CONCURRENT")
+		return
+	}
+	requestSlots.setMax(n)
+}
+
+func (l *requestLimiter) setMax(n int) {
+	l.mu.Lock()
+	l.max = n
+	l.mu.Unlock()
+}
+
+// acquire takes a request slot, waiting while all slots are busy or until ctx
+// is done. queued, if not nil, is called with the queue position before
+// waiting. The returned function releases the slot.
+func (l *requestLimiter) acquire(ctx context.Context, queued func(pos int)) (func(), error) {
+	l.mu.Lock()
+	if l.max <= 0 || l.active < l.max {
+		l.active++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+	ch := make(chan struct{})
+	l.waiting = append(l.waiting, ch)
+	pos := len(l.waiting)
+	l.mu.Unlock()
+	if queued != nil {
+		queued(pos)
+	}
+	select {
+	case <-ch:
+		return l.release, nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	for i, w := range l.waiting {
+		if w == ch {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			l.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	l.mu.Unlock()
+	// the slot was handed over while ctx ended, so it goes to the next one
+	l.release()
+	return nil, ctx.Err()
+}
+
+// release frees a slot or hands it directly to the longest waiting request.
+func (l *requestLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiting) > 0 {
+		ch := l.waiting[0]
+		l.waiting = l.waiting[1:]
+		close(ch)
+		return
+	}
+	l.active--
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"telegram-chatgpt-bot/internal/logging"
+)
+
+// defaultInputLimit is the input token limit for models without an entry in
+// modelInputLimits.
+const defaultInputLimit = 128000
+
+// modelInputLimits maps model names to the number of input tokens accepted in
+// a single request. TBOT_MODEL_INPUT_LIMITS extends or overrides it.
+var modelInputLimits = map[string]int{
+	"gpt-5":       272000,
+	"gpt-5-mini":  272000,
+	"gpt-5-nano":  272000,
+	"gpt-4.1":     1000000,
+	"gpt-4o":      128000,
+	"gpt-4o-mini": 128000,
+}
+
+// loadModelInputLimits reads "model=tokens" pairs separated by commas from
+// TBOT_MODEL_INPUT_LIMITS. The "default" key changes the fallback limit.
+func loadModelInputLimits() {
+	env := os.Getenv("TBOT_MODEL_INPUT_LIMITS")
+	if env == "" {
+		return
+	}
+	limits, err := parseModelInputLimits(env)
+	if err != nil {
+		logging.Log.Warn().Err(err).Msg("invalid TBOT_MODEL_INPUT_LIMITS")
+		return
+	}
+	for model, n := range limits {
+		modelInputLimits[model] = n
+	}
+}
+
+// parseModelInputLimits parses a comma separated list of model=tokens pairs.
+func parseModelInputLimits(s string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		model, val, ok := strings.Cut(p, "=")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			return nil, fmt.Errorf("invalid entry %q", p)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit in %q", p)
+		}
+		limits[model] = n
+	}
+	return limits, nil
+}
+
+// inputLimit returns the input token limit of model.
+func inputLimit(model string) int {
+	if n, ok := modelInputLimits[model]; ok {
+		return n
+	}
+	if n, ok := modelInputLimits["default"]; ok {
+		return n
+	}
+	return defaultInputLimit
+}
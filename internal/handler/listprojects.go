@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	tg "github.com/go-telegram/bot"
+
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+const listProjectsUsage = "Usage: /listprojects [--detailed]"
+
+// maxDescription is the longest project description /setdescription accepts.
+const maxDescription = 200
+
+// handleListProjects replies with the saved projects in alphabetical order.
+// The compact form joins the names on one line, --detailed prints one project
+// per line with its model, history size and topic mappings, followed by its
+// description when one is set.
+func handleListProjects(ctx context.Context, b Bot, chatID int64, topicID int, args string) {
+	reply := func(text string) {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: text})
+	}
+	detailed := false
+	switch args {
+	case "":
+	case "--detailed":
+		detailed = true
+	default:
+		reply(listProjectsUsage)
+		return
+	}
+	projs, err := storage.ListProjects()
+	if err != nil {
+		reply("Load error: " + err.Error())
+		return
+	}
+	// BoltDB returns keys in byte order, which puts upper case names first
+	sort.SliceStable(projs, func(i, j int) bool {
+		return strings.ToLower(projs[i]) < strings.ToLower(projs[j])
+	})
+	if !detailed {
+		reply("Projects: " + strings.Join(projs, ", "))
+		return
+	}
+	if len(projs) == 0 {
+		reply("No projects.")
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("Projects:")
+	for _, p := range projs {
+		model, _ := storage.LoadProjectModel(p)
+		if model == "" {
+			model = defaultModel
+		}
+		count, _ := storage.CountProjectHistory(p)
+		mappings, _ := storage.ListProjectMappings(p)
+		topics := "no topic"
+		if len(mappings) > 0 {
+			topics = fmt.Sprintf("%d topic(s)", len(mappings))
+		}
+		fmt.Fprintf(&sb, "\n%s: model %s, %d history messages, %s", p, model, count, topics)
+		if desc, _ := storage.LoadProjectDescription(p); desc != "" {
+			sb.WriteString("\n  " + desc)
+		}
+	}
+	reply(sb.String())
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// maxLogContent limits the prompt and the reply in a log channel copy, in
+// characters each, so the copy fits one Telegram message.
+const maxLogContent = 1800
+
+// logChannelID receives a copy of every prompt and reply. It is set with
+// TBOT_LOG_CHANNEL_ID; zero disables the feed.
+var logChannelID int64
+
+// loadLogChannel reads TBOT_LOG_CHANNEL_ID.
+func loadLogChannel() {
+	v := strings.TrimSpace(os.Getenv("TBOT_LOG_CHANNEL_ID"))
+	if v == "" {
+		return
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id == 0 {
+		logging.Log.Warn().Str("value", v).Msg("invalid TBOT_LOG_CHANNEL_ID")
+		return
+	}
+	logChannelID = id
+}
+
+// truncateLogContent shortens s to maxLogContent characters.
+func truncateLogContent(s string) string {
+	if t := truncateGraphemes(s, maxLogContent); t != s {
+		return t + "…"
+	}
+	return s
+}
+
+// sendLogCopy posts a request of proj and its reply to the log channel. The
+// bot passed in retries when Telegram rate limits the channel. proj is empty
+// for inline queries of users without a current project.
+func sendLogCopy(ctx context.Context, b Bot, proj string, from *models.User, e storage.AuditEntry) {
+	if logChannelID == 0 {
+		return
+	}
+	user := fmt.Sprintf("user %d", e.UserID)
+	if from != nil && from.Username != "" {
+		user = fmt.Sprintf("@%s (%d)", from.Username, e.UserID)
+	}
+	if proj == "" {
+		proj = "(none)"
+	}
+	header := fmt.Sprintf("Project: %s\nUser: %s\nModel: %s", proj, user, e.Model)
+	if e.IsError {
+		header += "\n(error)"
+	}
+	text := header + "\n\nPrompt:\n" + truncateLogContent(e.Prompt) + "\n\nReply:\n" + truncateLogContent(e.Reply)
+	if _, err := b.SendMessage(ctx, &tg.SendMessageParams{ChatID: logChannelID, Text: text}); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Int64("channel_id", logChannelID).Msg("failed to send log channel copy")
+	}
+}
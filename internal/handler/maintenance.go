@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// defaultMaintenanceMessage answers requests during maintenance when no
+// message of its own was set.
+const defaultMaintenanceMessage = "The assistant is temporarily unavailable."
+
+const maintenanceUsage = "Usage: /maintenance [on [message]|off]"
+
+// maintenanceMessage returns the reply sent while maintenance mode is on.
+func maintenanceMessage() string {
+	if text, err := storage.LoadMaintenanceMessage(); err == nil && text != "" {
+		return text
+	}
+	return defaultMaintenanceMessage
+}
+
+// underMaintenance reports whether requests to OpenAI are paused. If so, msg
+// is answered with the maintenance message.
+func underMaintenance(ctx context.Context, b Bot, msg *models.Message) bool {
+	if setting, _ := storage.LoadMaintenance(); setting != "on" {
+		return false
+	}
+	b.SendMessage(ctx, &tg.SendMessageParams{ChatID: msg.Chat.ID, MessageThreadID: msg.MessageThreadID, Text: maintenanceMessage()})
+	logging.Ctx(ctx).Info().Str("event", "maintenance_refused").Int64("chat_id", msg.Chat.ID).Msg("request refused during maintenance")
+	return true
+}
+
+// handleMaintenance shows or switches maintenance mode. "on" may be followed
+// by the message to reply with, which is kept for later maintenance periods.
+func handleMaintenance(ctx context.Context, b Bot, msg *models.Message, args string) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	log := logging.Ctx(ctx)
+	val, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	switch strings.ToLower(val) {
+	case "":
+		if setting, _ := storage.LoadMaintenance(); setting == "on" {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Maintenance mode is on. Chat messages are answered with: " + maintenanceMessage()})
+		} else {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Maintenance mode is off."})
+		}
+	case "on":
+		var err error
+		if text != "" {
+			err = storage.SaveMaintenanceMessage(text)
+		}
+		if err == nil {
+			err = storage.SaveMaintenance("on")
+		}
+		if err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Maintenance mode on. Chat messages are answered with: %s", maintenanceMessage())})
+		log.Info().Str("event", "maintenance_on").Msg("maintenance mode enabled")
+	case "off":
+		if text != "" {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: maintenanceUsage})
+			return
+		}
+		if err := storage.SaveMaintenance("off"); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Maintenance mode off."})
+		log.Info().Str("event", "maintenance_off").Msg("maintenance mode disabled")
+	default:
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: maintenanceUsage})
+	}
+}
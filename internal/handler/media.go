@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// stickerContext describes a sticker to the model by its emoji and sticker
+// set, as the image of most stickers adds little.
+func stickerContext(s *models.Sticker) string {
+	desc := "(User sent a sticker"
+	if s.Emoji != "" {
+		desc += " " + s.Emoji
+	}
+	if s.SetName != "" {
+		desc += fmt.Sprintf(" from the set %q", s.SetName)
+	}
+	return desc + ")"
+}
+
+// mediaInput returns what proj sends to the model for a sticker or GIF in
+// msg: the sticker description, and the file id of the GIF thumbnail used as
+// the image. Both are empty when the project does not answer the media, or
+// when a GIF comes without a thumbnail.
+func mediaInput(msg *models.Message, proj string) (sticker, thumbFileID string) {
+	if msg.Sticker != nil {
+		if setting, _ := storage.LoadProjectStickers(proj); setting == "on" {
+			sticker = stickerContext(msg.Sticker)
+		}
+	}
+	if msg.Animation != nil && msg.Animation.Thumbnail != nil {
+		if setting, _ := storage.LoadProjectAnimations(proj); setting == "on" {
+			thumbFileID = msg.Animation.Thumbnail.FileID
+		}
+	}
+	return sticker, thumbFileID
+}
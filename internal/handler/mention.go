@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// identity of the bot account, used to recognize messages addressed to it
+var (
+	botID       int64
+	botUsername string
+)
+
+// SetBotIdentity records the bot account returned by GetMe. It must be called
+// before updates are handled for mention-only projects to work.
+func SetBotIdentity(id int64, username string) {
+	botID = id
+	botUsername = username
+}
+
+// addressedToBot reports whether msg mentions the bot or replies to one of its
+// messages.
+func addressedToBot(msg *models.Message) bool {
+	if botID != 0 && msg.ReplyToMessage != nil && msg.ReplyToMessage.From != nil && msg.ReplyToMessage.From.ID == botID {
+		return true
+	}
+	text, entities := msg.Text, msg.Entities
+	if text == "" {
+		text, entities = msg.Caption, msg.CaptionEntities
+	}
+	// entity offsets are measured in UTF-16 code units
+	units := utf16.Encode([]rune(text))
+	for _, e := range entities {
+		switch e.Type {
+		case models.MessageEntityTypeMention:
+			if botUsername == "" || e.Offset < 0 || e.Length < 0 || e.Offset+e.Length > len(units) {
+				continue
+			}
+			name := string(utf16.Decode(units[e.Offset : e.Offset+e.Length]))
+			if strings.EqualFold(strings.TrimPrefix(name, "@"), botUsername) {
+				return true
+			}
+		case models.MessageEntityTypeTextMention:
+			if e.User != nil && botID != 0 && e.User.ID == botID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripBotMention removes mentions of the bot from text so they are not sent
+// to the model.
+func stripBotMention(text string) string {
+	if botUsername == "" {
+		return text
+	}
+	// usernames are ASCII, so a byte-wise case-insensitive match is enough
+	mention := "@" + botUsername
+	for i := 0; i+len(mention) <= len(text); i++ {
+		end := i + len(mention)
+		if strings.EqualFold(text[i:end], mention) && (end == len(text) || !isUsernameByte(text[end])) {
+			text = text[:i] + text[end:]
+			i--
+		}
+	}
+	return strings.TrimSpace(text)
+}
+
+// isUsernameByte reports whether c may appear in a Telegram username.
+func isUsernameByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// ignoredInGroup reports whether msg should be left unanswered because it was
+// posted in a group topic whose project only answers when the bot is
+// addressed. Private chats are always answered.
+func ignoredInGroup(ctx context.Context, msg *models.Message) bool {
+	if msg.Chat.Type == models.ChatTypePrivate || addressedToBot(msg) {
+		return false
+	}
+	proj, err := storage.GetMappedProject(msg.Chat.ID, msg.MessageThreadID)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			logging.Ctx(ctx).Error().Err(err).Msg("failed to load topic mapping")
+		}
+		return false
+	}
+	setting, _ := storage.LoadProjectMentionOnly(proj)
+	return setting == "on"
+}
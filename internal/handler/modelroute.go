@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// routeModel picks the model of a prompt by its length in characters: the
+// short model up to the threshold and the long model beyond it.
+func routeModel(r storage.ModelRoute, prompt string) string {
+	if utf8.RuneCountInString(prompt) <= r.Threshold {
+		return r.Short
+	}
+	return r.Long
+}
+
+// projectRouteModel returns the model the routing rule of proj picks for
+// prompt, or model when the project has no rule.
+func projectRouteModel(ctx context.Context, proj, model, prompt string) string {
+	r, err := storage.LoadProjectModelRoute(proj)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			logging.Ctx(ctx).Error().Err(err).Str("project", proj).Msg("failed to load model routing rule")
+		}
+		return model
+	}
+	routed := routeModel(r, prompt)
+	logging.Ctx(ctx).Info().Str("event", "model_routed").Str("project", proj).Str("model", routed).Int("chars", utf8.RuneCountInString(prompt)).Msg("model picked by prompt length")
+	return routed
+}
+
+// modelRouteText describes the routing rule of proj for /automodel.
+func modelRouteText(proj string, r storage.ModelRoute) string {
+	return fmt.Sprintf("Project '%s' uses '%s' for prompts of up to %d characters and '%s' for longer ones.", proj, r.Short, r.Threshold, r.Long)
+}
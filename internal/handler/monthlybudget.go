@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// monthlyBudgetText answers requests of a project over its monthly budget.
+const monthlyBudgetText = "Monthly budget reached."
+
+// usageNow decides the current month of the token usage; tests replace it.
+var usageNow = time.Now
+
+// currentMonth returns the month usage is counted in, as YYYY-MM in UTC.
+func currentMonth() string {
+	return usageNow().UTC().Format("2006-01")
+}
+
+// recordUsage adds the tokens of a response to the month-to-date usage of
+// proj. Failures are logged and otherwise ignored.
+func recordUsage(ctx context.Context, proj string, res responseResult) {
+	if proj == "" || res.Tokens == 0 {
+		return
+	}
+	if _, err := storage.AddMonthlyUsage(proj, currentMonth(), res.Tokens); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Str("project", proj).Msg("failed to record token usage")
+	}
+}
+
+// monthlyBudgetReached reports whether proj has used up its monthly token
+// budget. Usage starts over when the month rolls over.
+func monthlyBudgetReached(proj string) bool {
+	budget, err := storage.LoadProjectMonthlyBudget(proj)
+	if err != nil || budget <= 0 {
+		return false
+	}
+	used, _ := storage.LoadMonthlyUsage(proj, currentMonth())
+	return used >= budget
+}
+
+// overMonthlyBudget reports whether proj has used up its monthly token budget.
+// If so, msg is answered with monthlyBudgetText.
+func overMonthlyBudget(ctx context.Context, b Bot, msg *models.Message, proj string) bool {
+	if !monthlyBudgetReached(proj) {
+		return false
+	}
+	b.SendMessage(ctx, &tg.SendMessageParams{ChatID: msg.Chat.ID, MessageThreadID: msg.MessageThreadID, Text: monthlyBudgetText})
+	logging.Ctx(ctx).Info().Str("event", "monthly_budget_reached").Str("project", proj).Msg("request refused over the monthly budget")
+	return true
+}
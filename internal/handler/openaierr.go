@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	openai "github.com/openai/openai-go/v2"
+)
+
+// emptyReplyText is shown instead of a reply without any text, e.g. when the
+// model only called tools or refused.
+const emptyReplyText = "The model returned an empty response."
+
+// isModelUnavailable reports whether err says the requested model does not
+// exist or is not available to the account.
+func isModelUnavailable(err error) bool {
+	var apiErr *openai.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == "model_not_found" || apiErr.Code == "invalid_model" || apiErr.StatusCode == http.StatusNotFound
+}
+
+// classifyOpenAIError turns an OpenAI error into a short message for the
+// chat. Unrecognized API errors show only the API message; other errors, such
+// as network failures, are shown as they are.
+func classifyOpenAIError(err error) string {
+	var apiErr *openai.Error
+	if !errors.As(err, &apiErr) {
+		return "OpenAI error: " + err.Error()
+	}
+	switch apiErr.Code {
+	case "context_length_exceeded", "string_above_max_length":
+		return "The model rejected the request: context too long. Try /forget or reduce the history limit."
+	case "content_filter", "content_policy_violation":
+		return "The model rejected the request: blocked by the content filter."
+	case "model_not_found", "invalid_model":
+		return "The model rejected the request: unknown model. Check the project model with /model."
+	case "insufficient_quota":
+		return "The OpenAI account has run out of quota."
+	case "rate_limit_exceeded":
+		return "OpenAI rate limit reached, please try again in a moment."
+	case "invalid_api_key":
+		return "OpenAI rejected the API key."
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests:
+		return "OpenAI rate limit reached, please try again in a moment."
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "OpenAI rejected the API key."
+	case http.StatusNotFound:
+		return "The model rejected the request: unknown model. Check the project model with /model."
+	}
+	if apiErr.Message != "" {
+		return "OpenAI error: " + apiErr.Message
+	}
+	return fmt.Sprintf("OpenAI error: status %d", apiErr.StatusCode)
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"strings"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+)
+
+// pinnedReply returns the bot message msg replies to. Messages in forum topics
+// implicitly reply to the topic creation message, which does not count.
+func pinnedReply(msg *models.Message) (*models.Message, bool) {
+	reply := msg.ReplyToMessage
+	if reply == nil || reply.ForumTopicCreated != nil {
+		return nil, false
+	}
+	if botID != 0 && (reply.From == nil || reply.From.ID != botID) {
+		return nil, false
+	}
+	return reply, true
+}
+
+// pinErrorText explains a failed pin or unpin. Telegram refuses both when the
+// bot is not allowed to manage pinned messages.
+func pinErrorText(err error) string {
+	if strings.Contains(err.Error(), "not enough rights") {
+		return "I need the permission to pin messages in this chat."
+	}
+	return "Pin error: " + err.Error()
+}
+
+// handlePin pins or, with unpin set, unpins the bot message replied to.
+func handlePin(ctx context.Context, b Bot, msg *models.Message, unpin bool) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	log := logging.Ctx(ctx)
+	cmd := "/pin"
+	if unpin {
+		cmd = "/unpin"
+	}
+	reply, ok := pinnedReply(msg)
+	if !ok {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Send " + cmd + " as a reply to one of my messages."})
+		return
+	}
+	var err error
+	if unpin {
+		_, err = b.UnpinChatMessage(ctx, &tg.UnpinChatMessageParams{ChatID: chatID, MessageID: reply.ID})
+	} else {
+		_, err = b.PinChatMessage(ctx, &tg.PinChatMessageParams{ChatID: chatID, MessageID: reply.ID, DisableNotification: true})
+	}
+	if err != nil {
+		log.Warn().Err(err).Int("message_id", reply.ID).Bool("unpin", unpin).Msg("failed to change pinned message")
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: pinErrorText(err)})
+		return
+	}
+	log.Info().Str("event", strings.TrimPrefix(cmd, "/")).Int("message_id", reply.ID).Msg("pinned message changed")
+}
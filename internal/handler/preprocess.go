@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+const preprocessHelp = "Enter preprocessing rules, one per line:\n" +
+	"signature - drop everything after a \"-- \" signature line\n" +
+	"quotes - drop quoted lines starting with \">\"\n" +
+	"replace <regex> => <replacement> - apply a regular expression replace\n" +
+	"Send \"off\" to remove all rules."
+
+// parsePreprocessRules converts the user supplied rule lines into a ruleset.
+func parsePreprocessRules(text string) (storage.Preprocess, error) {
+	var p storage.Preprocess
+	if strings.EqualFold(strings.TrimSpace(text), "off") {
+		return p, nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		switch {
+		case strings.EqualFold(line, "signature"):
+			p.TrimSignature = true
+		case strings.EqualFold(line, "quotes"):
+			p.StripQuotes = true
+		case strings.HasPrefix(strings.ToLower(line), "replace "):
+			rule := strings.TrimSpace(line[len("replace "):])
+			pattern, repl, ok := strings.Cut(rule, " => ")
+			if !ok {
+				pattern, repl, ok = strings.Cut(rule, "=>")
+			}
+			if !ok || strings.TrimSpace(pattern) == "" {
+				return p, fmt.Errorf("invalid replace rule %q", line)
+			}
+			pattern = strings.TrimSpace(pattern)
+			if _, err := regexp.Compile(pattern); err != nil {
+				return p, fmt.Errorf("invalid regex %q: %v", pattern, err)
+			}
+			p.Replacements = append(p.Replacements, storage.Replacement{Pattern: pattern, Replace: strings.TrimSpace(repl)})
+		default:
+			return p, fmt.Errorf("unknown rule %q", line)
+		}
+	}
+	return p, nil
+}
+
+// formatPreprocessRules renders a ruleset in the same format it is entered.
+func formatPreprocessRules(p storage.Preprocess) string {
+	var lines []string
+	if p.TrimSignature {
+		lines = append(lines, "signature")
+	}
+	if p.StripQuotes {
+		lines = append(lines, "quotes")
+	}
+	for _, r := range p.Replacements {
+		lines = append(lines, fmt.Sprintf("replace %s => %s", r.Pattern, r.Replace))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// preprocessText applies the project ruleset to incoming text.
+func preprocessText(text string, p storage.Preprocess) string {
+	if text == "" {
+		return text
+	}
+	if p.StripQuotes || p.TrimSignature {
+		var kept []string
+		for _, line := range strings.Split(text, "\n") {
+			if p.TrimSignature && (line == "-- " || line == "--") {
+				break
+			}
+			if p.StripQuotes && strings.HasPrefix(strings.TrimSpace(line), ">") {
+				continue
+			}
+			kept = append(kept, line)
+		}
+		text = strings.Join(kept, "\n")
+	}
+	for _, r := range p.Replacements {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			continue
+		}
+		text = re.ReplaceAllString(text, r.Replace)
+	}
+	return strings.TrimSpace(text)
+}
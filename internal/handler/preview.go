@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/openai/openai-go/v2/responses"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// renderInputs formats request inputs as readable text, one block per message.
+func renderInputs(inputs responses.ResponseInputParam) string {
+	var sb strings.Builder
+	for _, item := range inputs {
+		m := item.OfMessage
+		if m == nil {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\n\n")
+		}
+		sb.WriteString("[" + string(m.Role) + "]\n")
+		if m.Content.OfString.Valid() {
+			sb.WriteString(m.Content.OfString.Value)
+			continue
+		}
+		for i, p := range m.Content.OfInputItemContentList {
+			if i > 0 {
+				sb.WriteString("\n")
+			}
+			switch {
+			case p.OfInputText != nil:
+				sb.WriteString(p.OfInputText.Text)
+			case p.OfInputImage != nil:
+				sb.WriteString("(image)")
+			}
+		}
+	}
+	return sb.String()
+}
+
+// handlePreview replies with the input a request for text would send in the
+// current topic. Neither OpenAI nor the history is touched.
+func handlePreview(ctx context.Context, b Bot, msg *models.Message, text string) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	proj, err := messageProject(msg)
+	if err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Topic is not mapped to a project."})
+		return
+	}
+	if rules, _ := storage.LoadProjectPreprocess(proj); text != "" {
+		text = preprocessText(text, rules)
+	}
+	limit, _ := storage.LoadHistoryLimit(proj)
+	hist, _ := storage.LoadProjectHistory(proj)
+	// summarizing would call OpenAI, so the preview only drops what does not fit
+	if budget, _ := storage.LoadTokenBudget(proj); limit > 0 && budget > 0 {
+		hist = hist[historyOverflow(hist, budget):]
+	}
+	userName := msg.From.Username
+	if userName == "" {
+		userName = msg.From.FirstName
+	}
+	cfg := loadProjectConfig(proj)
+	cfg.HistoryLimit, cfg.History = limit, hist
+	inputs, _ := buildInputs(ctx, cfg, messageData{UserName: userName, When: time.Now(), Text: text})
+	for _, chunk := range splitMessage(renderInputs(inputs), 4000) {
+		if _, err := b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: chunk}); err != nil {
+			logging.Ctx(ctx).Error().Err(err).Msg("failed to send preview chunk")
+			return
+		}
+	}
+	logging.Ctx(ctx).Info().Str("event", "preview").Str("project", proj).Msg("request preview sent")
+}
@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"telegram-chatgpt-bot/internal/logging"
+)
+
+// progressDelay holds back the "Sending to ChatGPT..." message, so answers
+// arriving within it are posted directly. Zero posts it immediately.
+var progressDelay time.Duration
+
+// loadProgressDelay reads TBOT_PROGRESS_DELAY.
+func loadProgressDelay() {
+	v := strings.TrimSpace(os.Getenv("TBOT_PROGRESS_DELAY"))
+	if v == "" {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		logging.Log.Warn().Str("value", v).Msg("invalid TBOT_PROGRESS_DELAY")
+		return
+	}
+	progressDelay = d
+}
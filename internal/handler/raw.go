@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	openai "github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/responses"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/metrics"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// handleRaw sends question to the model of the topic project without the
+// project instruction, history or tools. Nothing is written to history.
+func handleRaw(ctx context.Context, b Bot, msg *models.Message, question string) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	if question == "" {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /raw <question>"})
+		return
+	}
+	proj, err := messageProject(msg)
+	if err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Topic is not mapped to a project."})
+		return
+	}
+	logging.Ctx(ctx).Info().Str("event", "chatgpt_raw_request").Str("project", proj).Str("snippet", logging.Snippet(question, 30)).Msg("sending raw question to ChatGPT")
+	sendOneOff(ctx, b, msg, proj, question, responses.ResponseInputParam{
+		responses.ResponseInputItemParamOfMessage(question, responses.EasyInputMessageRoleUser),
+	})
+}
+
+// sendOneOff sends inputs to the model of proj without tools and replies to
+// msg with the answer. Nothing is written to history; the audit log records
+// the exchange with prompt as the user input.
+func sendOneOff(ctx context.Context, b Bot, msg *models.Message, proj, prompt string, inputs responses.ResponseInputParam) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	log := logging.Ctx(ctx)
+	if underMaintenance(ctx, b, msg) || overMonthlyBudget(ctx, b, msg, proj) {
+		return
+	}
+	model, err := storage.LoadProjectModel(proj)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Error().Err(err).Str("project", proj).Msg("failed to load model")
+	}
+	if model == "" {
+		model = defaultModel
+	}
+
+	metrics.Inc(metrics.ChatGPTRequests)
+	params := responses.ResponseNewParams{
+		Model: openai.ResponsesModel(model),
+		Input: responses.ResponseNewParamsInputUnion{OfInputItemList: inputs},
+	}
+	timeout := projectTimeout(proj)
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	var resp responseResult
+	release, err := requestSlots.acquire(reqCtx, nil)
+	if err == nil {
+		resp, err = openAIResponses(reqCtx, newOpenAIClient(proj), params)
+		release()
+	}
+	cancel()
+	reply := redactReply(ctx, proj, resp.Text)
+	recordUsage(ctx, proj, resp)
+	if err != nil {
+		metrics.Inc(metrics.ChatGPTErrors)
+		log.Error().Err(err).Str("model", model).Msg("chatgpt one-off request failed")
+		reply = classifyOpenAIError(err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			reply = timeoutText(timeout)
+		}
+	} else if strings.TrimSpace(reply) == "" {
+		reply = emptyReplyText
+	}
+	entry := storage.AuditEntry{UserID: msg.From.ID, Model: model, Prompt: prompt, Reply: reply, IsError: err != nil}
+	recordAudit(ctx, proj, entry)
+	// the copy is posted once the user has the answer
+	defer sendLogCopy(ctx, b, proj, msg.From, entry)
+	var replyTo *models.ReplyParameters
+	if msg.ID != 0 {
+		replyTo = &models.ReplyParameters{MessageID: msg.ID}
+	}
+	for _, chunk := range splitMessage(reply, 4000) {
+		sent, err := b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: chunk, ReplyParameters: replyTo})
+		if err != nil {
+			log.Error().Err(err).Msg("failed to send chunk")
+			return
+		}
+		replyTo = &models.ReplyParameters{MessageID: sent.ID}
+	}
+}
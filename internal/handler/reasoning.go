@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"context"
+	"unicode/utf16"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+)
+
+// reasoningHeader starts the message carrying the reasoning summary.
+const reasoningHeader = "Reasoning summary:\n"
+
+// sendReasoningSummary posts summary as a spoiler so it does not distract
+// from the answer that follows it.
+func sendReasoningSummary(ctx context.Context, b Bot, chatID int64, topicID, replyTo int, summary string) {
+	const maxSummaryLen = 3500
+	if chunks := splitMessage(summary, maxSummaryLen); len(chunks) > 1 {
+		summary = chunks[0] + "…"
+	}
+	params := &tg.SendMessageParams{
+		ChatID:          chatID,
+		MessageThreadID: topicID,
+		Text:            reasoningHeader + summary,
+		// entity offsets are measured in UTF-16 code units
+		Entities: []models.MessageEntity{{
+			Type:   models.MessageEntityTypeSpoiler,
+			Offset: len(utf16.Encode([]rune(reasoningHeader))),
+			Length: len(utf16.Encode([]rune(summary))),
+		}},
+	}
+	if replyTo != 0 {
+		params.ReplyParameters = &models.ReplyParameters{MessageID: replyTo}
+	}
+	if _, err := b.SendMessage(ctx, params); err != nil {
+		logging.Ctx(ctx).Error().Err(err).Msg("failed to send reasoning summary")
+	}
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"regexp"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// redactedText replaces the matches of redaction rules.
+const redactedText = "[redacted]"
+
+// redactText replaces every match of patterns in text with redactedText,
+// applying the patterns in order. Patterns that do not compile are skipped.
+func redactText(text string, patterns []string) string {
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			continue
+		}
+		text = re.ReplaceAllLiteralString(text, redactedText)
+	}
+	return text
+}
+
+// redactReply applies the redaction rules of proj to a model reply before it
+// is sent or stored.
+func redactReply(ctx context.Context, proj, reply string) string {
+	patterns, err := storage.LoadProjectRedactions(proj)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			logging.Ctx(ctx).Error().Err(err).Str("project", proj).Msg("failed to load redaction rules")
+		}
+		return reply
+	}
+	return redactText(reply, patterns)
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/openai/openai-go/v2/responses"
+)
+
+// responseResult holds the parts of a model response the bot uses.
+type responseResult struct {
+	ID               string
+	Text             string
+	ReasoningSummary string
+	Citations        []citation
+	// Tokens is the total token usage reported for the request.
+	Tokens int
+}
+
+// citation is a web page the model cited in its answer.
+type citation struct {
+	URL   string
+	Title string
+}
+
+// newResponseResult extracts the answer text, the reasoning summary and the
+// cited URLs from resp.
+func newResponseResult(resp *responses.Response) responseResult {
+	var parts []string
+	var cites []citation
+	seen := map[string]bool{}
+	for _, item := range resp.Output {
+		switch item.Type {
+		case "reasoning":
+			for _, s := range item.Summary {
+				if t := strings.TrimSpace(s.Text); t != "" {
+					parts = append(parts, t)
+				}
+			}
+		case "message":
+			for _, c := range item.Content {
+				for _, a := range c.Annotations {
+					if a.Type != "url_citation" || a.URL == "" || seen[a.URL] {
+						continue
+					}
+					seen[a.URL] = true
+					cites = append(cites, citation{URL: a.URL, Title: a.Title})
+				}
+			}
+		}
+	}
+	return responseResult{
+		ID:               resp.ID,
+		Text:             resp.OutputText(),
+		ReasoningSummary: strings.Join(parts, "\n\n"),
+		Citations:        cites,
+		Tokens:           int(resp.Usage.TotalTokens),
+	}
+}
+
+// sourcesFooter lists cites under a reply, or returns "" without citations.
+func sourcesFooter(cites []citation) string {
+	if len(cites) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("\n\nSources:")
+	for i, c := range cites {
+		if c.Title != "" {
+			fmt.Fprintf(&sb, "\n%d. %s - %s", i+1, c.Title, c.URL)
+		} else {
+			fmt.Fprintf(&sb, "\n%d. %s", i+1, c.URL)
+		}
+	}
+	return sb.String()
+}
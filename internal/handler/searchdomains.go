@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxSearchDomains is the number of allowed domains the web search tool
+// accepts.
+const maxSearchDomains = 20
+
+// parseSearchDomains parses domains separated by spaces or commas. URLs with a
+// scheme or path are rejected so the stored list matches what the web search
+// filter expects. Duplicates are dropped.
+func parseSearchDomains(s string) ([]string, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no domains given")
+	}
+	var domains []string
+	seen := map[string]bool{}
+	for _, f := range fields {
+		d := strings.ToLower(strings.TrimSuffix(f, "."))
+		if !validDomain(d) {
+			return nil, fmt.Errorf("invalid domain %q", f)
+		}
+		if seen[d] {
+			continue
+		}
+		seen[d] = true
+		domains = append(domains, d)
+	}
+	if len(domains) > maxSearchDomains {
+		return nil, fmt.Errorf("at most %d domains are allowed", maxSearchDomains)
+	}
+	return domains, nil
+}
+
+// validDomain reports whether d is a host name with at least two labels of
+// letters, digits and inner hyphens.
+func validDomain(d string) bool {
+	if len(d) > 253 {
+		return false
+	}
+	labels := strings.Split(d, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if l == "" || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for _, c := range l {
+			if c != '-' && (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+				return false
+			}
+		}
+	}
+	// the top level domain is never numeric, which also rejects IP addresses
+	tld := labels[len(labels)-1]
+	return strings.Trim(tld, "0123456789") != ""
+}
@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// Steps of the /setup wizard.
+const (
+	setupStepProject = "project"
+	setupStepTopic   = "topic"
+	setupStepModel   = "model"
+)
+
+// setupKey identifies the wizard a user runs in a chat topic, so a user can
+// talk elsewhere while a wizard is waiting for an answer.
+type setupKey struct {
+	chatID  int64
+	topicID int
+	userID  int64
+}
+
+// messageSetupKey returns the key of the wizard msg would answer.
+func messageSetupKey(msg *models.Message) setupKey {
+	return setupKey{chatID: msg.Chat.ID, topicID: msg.MessageThreadID, userID: msg.From.ID}
+}
+
+// RestoreSetup reloads setup wizard progress saved before a restart. It must be
+// called after the storage is initialized.
+func RestoreSetup() error {
+	states, err := storage.ListSetupStates()
+	if err != nil {
+		return err
+	}
+	pendingSetup = map[setupKey]storage.SetupState{}
+	for _, st := range states {
+		pendingSetup[setupKey{chatID: st.ChatID, topicID: st.TopicID, userID: st.UserID}] = st
+	}
+	return nil
+}
+
+// storeSetup records the wizard progress of a user in memory and storage.
+func storeSetup(st storage.SetupState) error {
+	if err := saveSetupState(st); err != nil {
+		return err
+	}
+	pendingSetup[setupKey{chatID: st.ChatID, topicID: st.TopicID, userID: st.UserID}] = st
+	return nil
+}
+
+// clearSetup drops the wizard progress of a user in a chat topic.
+func clearSetup(key setupKey) error {
+	delete(pendingSetup, key)
+	return deleteSetupState(key.chatID, key.topicID, key.userID)
+}
+
+// startSetup begins the setup wizard for the user in the current topic.
+func startSetup(ctx context.Context, b Bot, msg *models.Message) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	st := storage.SetupState{Step: setupStepProject, ChatID: chatID, TopicID: topicID, UserID: msg.From.ID}
+	if err := storeSetup(st); err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+		return
+	}
+	b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Setup step 1/3: enter a name for the project (an existing project is reused). Send /setup cancel to stop."})
+	logging.Ctx(ctx).Info().Str("event", "setup_start").Int64("chat_id", chatID).Int("topic_id", topicID).Msg("setup started")
+}
+
+// cancelSetup drops the setup wizard progress of the user.
+func cancelSetup(ctx context.Context, b Bot, msg *models.Message) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	if err := clearSetup(messageSetupKey(msg)); err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+		return
+	}
+	b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Setup cancelled."})
+}
+
+// handleSetupStep applies msg to the wizard the user runs in its chat topic.
+// It reports whether the message was consumed by the wizard.
+func handleSetupStep(ctx context.Context, b Bot, msg *models.Message) bool {
+	key := messageSetupKey(msg)
+	st, ok := pendingSetup[key]
+	if !ok {
+		return false
+	}
+	log := logging.Ctx(ctx)
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	reply := func(text string) {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: text})
+	}
+	val := strings.TrimSpace(msg.Text)
+
+	switch st.Step {
+	case setupStepProject:
+		if val == "" || strings.ContainsAny(val, " \n") {
+			reply("Please enter a project name without spaces.")
+			return true
+		}
+		exists, err := projectExists(val)
+		if err != nil {
+			reply("Save error: " + err.Error())
+			return true
+		}
+		if !exists {
+			if err := saveProject(val); err != nil {
+				reply("Save failed: " + err.Error())
+				return true
+			}
+			log.Info().Str("event", "new_project").Str("project", val).Msg("project registered")
+		}
+		st.Project = val
+		st.Step = setupStepTopic
+		if err := storeSetup(st); err != nil {
+			reply("Save error: " + err.Error())
+			return true
+		}
+		reply(fmt.Sprintf("Setup step 2/3: map this topic to project '%s'? (yes/no)", val))
+
+	case setupStepTopic:
+		switch strings.ToLower(val) {
+		case "yes", "y":
+			if err := mapTopic(st.ChatID, st.TopicID, st.Project); err != nil {
+				reply("Failed to map topic: " + err.Error())
+				return true
+			}
+			log.Info().Str("event", "map_topic").Int64("chat_id", st.ChatID).Int("topic_id", st.TopicID).Str("project", st.Project).Msg("topic mapped")
+			postWelcome(ctx, b, st.ChatID, st.TopicID, st.Project)
+		case "no", "n":
+		default:
+			reply("Please enter one of: yes, no.")
+			return true
+		}
+		st.Step = setupStepModel
+		if err := storeSetup(st); err != nil {
+			reply("Save error: " + err.Error())
+			return true
+		}
+		reply(fmt.Sprintf("Setup step 3/3: enter the model name, or \"default\" for %s.", defaultModel))
+
+	case setupStepModel:
+		if val == "" {
+			reply("Please enter a model name.")
+			return true
+		}
+		model := val
+		if strings.EqualFold(model, "default") {
+			model = defaultModel
+		}
+		if err := saveProjectModel(st.Project, model); err != nil {
+			reply("Save error: " + err.Error())
+			return true
+		}
+		if err := clearSetup(key); err != nil {
+			log.Error().Err(err).Msg("failed to clear setup state")
+		}
+		reply(fmt.Sprintf("Setup complete. Project '%s' uses model '%s'.", st.Project, model))
+		log.Info().Str("event", "setup_done").Str("project", st.Project).Str("model", model).Msg("setup completed")
+
+	default:
+		clearSetup(key)
+		return false
+	}
+	return true
+}
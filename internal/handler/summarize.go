@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	openai "github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/responses"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+const summaryInstruction = "Summarize the following conversation excerpt in a few short paragraphs. " +
+	"Keep names, decisions, facts and open questions that may matter later. Reply with the summary only."
+
+// estimateTokens gives a rough token count for s, assuming about four
+// characters per token.
+func estimateTokens(s string) int {
+	return (utf8.RuneCountInString(s) + 3) / 4
+}
+
+// historyOverflow returns how many of the oldest messages must be dropped so
+// the remaining history fits into budget tokens.
+func historyOverflow(hist []storage.HistoryMessage, budget int) int {
+	total := 0
+	for _, h := range hist {
+		total += estimateTokens(h.Content)
+	}
+	cut := 0
+	for cut < len(hist) && total > budget {
+		total -= estimateTokens(hist[cut].Content)
+		cut++
+	}
+	return cut
+}
+
+var (
+	summarizingMu sync.Mutex
+	summarizing   = map[string]bool{}
+	// summaries tracks the background summarizations, so tests can wait for
+	// them.
+	summaries sync.WaitGroup
+)
+
+// fitHistoryBudget trims hist to the project's token budget. When
+// auto-summarize is enabled the overflowing messages are also replaced in
+// storage by a single summary message. The summary call is slow, so it runs in
+// the background and the current request goes on with the trimmed history;
+// later requests see the summary. A lone summary is never summarized again, so
+// an oversized summary falls back to plain trimming.
+func fitHistoryBudget(ctx context.Context, client *openai.Client, proj string, hist []storage.HistoryMessage, budget int) []storage.HistoryMessage {
+	cut := historyOverflow(hist, budget)
+	if cut == 0 {
+		return hist
+	}
+	auto, _ := storage.LoadProjectAutoSummarize(proj)
+	if auto == "on" && !(cut == 1 && hist[0].IsSummary) {
+		summarizingMu.Lock()
+		busy := summarizing[proj]
+		summarizing[proj] = true
+		summarizingMu.Unlock()
+		if !busy {
+			summarized := append([]storage.HistoryMessage(nil), hist[:cut]...)
+			summaries.Add(1)
+			go func() {
+				defer summaries.Done()
+				defer func() {
+					summarizingMu.Lock()
+					delete(summarizing, proj)
+					summarizingMu.Unlock()
+				}()
+				// the request may finish first, so the summary gets its own deadline
+				sumCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), projectTimeout(proj))
+				defer cancel()
+				summarizeOverflow(sumCtx, client, proj, summarized)
+			}()
+		}
+	}
+	return hist[cut:]
+}
+
+// summarizeOverflow replaces the oldest messages of proj, given by msgs, with
+// a summary of them. The summary is discarded when the history changed in the
+// meantime.
+func summarizeOverflow(ctx context.Context, client *openai.Client, proj string, msgs []storage.HistoryMessage) {
+	log := logging.Ctx(ctx)
+	summary, err := summarizeHistory(ctx, client, proj, summarizerModel(proj), projectLocation(proj), msgs)
+	if err != nil {
+		log.Error().Err(err).Str("project", proj).Msg("history summarization failed")
+		return
+	}
+	msg := storage.HistoryMessage{
+		Role:      string(responses.EasyInputMessageRoleSystem),
+		WhoName:   "Summary",
+		When:      msgs[len(msgs)-1].When,
+		Content:   summary,
+		IsSummary: true,
+	}
+	if err := replaceSummarized(proj, msgs, msg); errors.Is(err, errHistoryChanged) {
+		log.Warn().Str("event", "summary_discarded").Str("project", proj).Msg("history changed while it was summarized")
+	} else if err != nil {
+		log.Error().Err(err).Str("project", proj).Msg("failed to store history summary")
+	} else {
+		log.Info().Str("event", "history_summarized").Str("project", proj).Int("replaced", len(msgs)).Msg("history summarized")
+	}
+}
+
+// summarizerModel returns the model used for summaries of the project: the
+// project setting if present, otherwise the global TBOT_SUMMARY_MODEL value.
+func summarizerModel(proj string) string {
+	if m, _ := storage.LoadProjectSummaryModel(proj); m != "" {
+		return m
+	}
+	return summaryModel
+}
+
+// summarizeHistory asks the model for a condensed version of msgs, with
+// timestamps shown in loc. The tokens count towards the usage of proj.
+func summarizeHistory(ctx context.Context, client *openai.Client, proj, model string, loc *time.Location, msgs []storage.HistoryMessage) (string, error) {
+	var sb strings.Builder
+	for _, h := range msgs {
+		when := formatUnix(h.When, loc, historyTimeLayout)
+		fmt.Fprintf(&sb, "%s %s:\n%s\n\n", when, h.WhoName, h.Content)
+	}
+	params := responses.ResponseNewParams{
+		Model:        openai.ResponsesModel(model),
+		Instructions: openai.String(summaryInstruction),
+		Input:        responses.ResponseNewParamsInputUnion{OfString: openai.String(strings.TrimSpace(sb.String()))},
+	}
+	resp, err := openAIResponses(ctx, client, params)
+	if err != nil {
+		return "", err
+	}
+	recordUsage(ctx, proj, resp)
+	summary := strings.TrimSpace(resp.Text)
+	if summary == "" {
+		return "", fmt.Errorf("empty summary")
+	}
+	return summary, nil
+}
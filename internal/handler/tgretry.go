@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+)
+
+const (
+	// defaultSendRetries is how often a rate limited message is resent.
+	defaultSendRetries = 3
+	// maxRetryAfter caps the wait Telegram may ask for, so a handler does not
+	// block for minutes on a single message.
+	maxRetryAfter = 60 * time.Second
+)
+
+// sendRetries is the number of retries after Telegram answers 429 Too Many
+// Requests, set with TBOT_SEND_RETRIES.
+var sendRetries = defaultSendRetries
+
+// retryWait sleeps for d or until ctx is done.
+var retryWait = func(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func loadSendRetries() {
+	v := strings.TrimSpace(os.Getenv("TBOT_SEND_RETRIES"))
+	if v == "" {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		logging.Log.Warn().Str("value", v).Msg("invalid TBOT_SEND_RETRIES")
+		return
+	}
+	sendRetries = n
+}
+
+// retryBot resends messages and edits Telegram rejected with 429, waiting
+// the retry_after delay it reports. Uploads are passed through unchanged:
+// their data is read once and cannot be sent again.
+type retryBot struct {
+	Bot
+}
+
+// withSendRetry wraps b so rate limited sends and edits are retried.
+func withSendRetry(b Bot) Bot {
+	if _, ok := b.(retryBot); ok {
+		return b
+	}
+	return retryBot{b}
+}
+
+func (r retryBot) SendMessage(ctx context.Context, params *tg.SendMessageParams) (*models.Message, error) {
+	return retryOnRateLimit(ctx, "sendMessage", func() (*models.Message, error) {
+		return r.Bot.SendMessage(ctx, params)
+	})
+}
+
+func (r retryBot) EditMessageText(ctx context.Context, params *tg.EditMessageTextParams) (*models.Message, error) {
+	return retryOnRateLimit(ctx, "editMessageText", func() (*models.Message, error) {
+		return r.Bot.EditMessageText(ctx, params)
+	})
+}
+
+// retryOnRateLimit runs call and repeats it up to sendRetries times while it
+// fails with a Telegram 429 error.
+func retryOnRateLimit[T any](ctx context.Context, method string, call func() (T, error)) (T, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := call()
+		var tooMany *tg.TooManyRequestsError
+		if err == nil || !errors.As(err, &tooMany) || attempt >= sendRetries {
+			return res, err
+		}
+		wait := min(time.Duration(tooMany.RetryAfter)*time.Second, maxRetryAfter)
+		logging.Ctx(ctx).Warn().Str("event", "telegram_rate_limited").Str("method", method).Dur("retry_after", wait).Int("attempt", attempt+1).Msg("rate limited by telegram, retrying")
+		if err := retryWait(ctx, wait); err != nil {
+			return res, err
+		}
+	}
+}
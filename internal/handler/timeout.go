@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+const (
+	// defaultRequestTimeout leaves room for long high effort reasoning.
+	defaultRequestTimeout = 10 * time.Minute
+	// minProjectTimeout and maxProjectTimeout bound /settimeout, in seconds.
+	minProjectTimeout = 5
+	maxProjectTimeout = 3600
+)
+
+// requestTimeout applies to projects without their own timeout. It is set
+// with TBOT_REQUEST_TIMEOUT.
+var requestTimeout = defaultRequestTimeout
+
+func loadRequestTimeout() {
+	v := strings.TrimSpace(os.Getenv("TBOT_REQUEST_TIMEOUT"))
+	if v == "" {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		logging.Log.Warn().Str("value", v).Msg("invalid TBOT_REQUEST_TIMEOUT")
+		return
+	}
+	requestTimeout = d
+}
+
+// projectTimeout returns how long an OpenAI request of proj may take.
+func projectTimeout(proj string) time.Duration {
+	seconds, err := storage.LoadProjectTimeout(proj)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			logging.Log.Error().Err(err).Str("project", proj).Msg("failed to load request timeout")
+		}
+		return requestTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// timeoutText is the reply to a request that ran past its timeout.
+func timeoutText(timeout time.Duration) string {
+	return fmt.Sprintf("Request timed out after %d seconds.", int(timeout.Seconds()))
+}
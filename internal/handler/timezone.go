@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"time"
+
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// historyTimeLayout is the layout of timestamps injected into prompts.
+const historyTimeLayout = "2006-01-02 15:04:05"
+
+// currentTimeLayout is the layout of the injected current date and time. The
+// weekday and zone help the model with relative dates.
+const currentTimeLayout = "Monday, 2006-01-02 15:04 MST"
+
+// parseLocation resolves an IANA timezone name. Empty, unknown and the
+// server-dependent "Local" names fall back to UTC.
+func parseLocation(name string) *time.Location {
+	if name == "" || name == "Local" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// projectLocation returns the timezone timestamps of a project are shown in.
+func projectLocation(proj string) *time.Location {
+	name, _ := storage.LoadProjectTimezone(proj)
+	return parseLocation(name)
+}
+
+// formatUnix formats a unix timestamp in loc using layout.
+func formatUnix(sec int64, loc *time.Location, layout string) string {
+	return time.Unix(sec, 0).In(loc).Format(layout)
+}
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+)
+
+// Transcriber turns recorded speech into text.
+type Transcriber interface {
+	// Transcribe converts audio sent to the given project.
+	Transcribe(ctx context.Context, proj string, audio io.Reader) (string, error)
+}
+
+// openAITranscriber transcribes audio with OpenAI Whisper.
+type openAITranscriber struct{}
+
+func (openAITranscriber) Transcribe(ctx context.Context, proj string, audio io.Reader) (string, error) {
+	return openAITranscribe(newOpenAIClient(proj), audio)
+}
+
+// maxTranscribeBytes is the largest file the transcription API accepts.
+const maxTranscribeBytes = 25 << 20
+
+// maxDownloadBytes is the largest file the bot may fetch from Telegram: 20 MB
+// from the public Bot API, 2000 MB from a local Bot API server set with
+// TBOT_TELEGRAM_API_URL. Larger audio is rejected before it is requested.
+var maxDownloadBytes int64 = 20 << 20
+
+// localBotAPIDownloadBytes is the download limit of a local Bot API server.
+const localBotAPIDownloadBytes = 2000 << 20
+
+// errAudioTooLarge is returned for audio over maxTranscribeBytes when it
+// cannot be split.
+var errAudioTooLarge = errors.New("audio is too large to transcribe")
+
+// splitAudio cuts audio into pieces below maxTranscribeBytes, in playback
+// order. It is nil unless the bot is built with the ffmpeg tag.
+var splitAudio func(ctx context.Context, audio []byte) ([][]byte, error)
+
+// loadTelegramAPI raises maxDownloadBytes when TBOT_TELEGRAM_API_URL points
+// the bot at a local Bot API server.
+func loadTelegramAPI() {
+	if strings.TrimSpace(os.Getenv("TBOT_TELEGRAM_API_URL")) != "" {
+		maxDownloadBytes = localBotAPIDownloadBytes
+	}
+}
+
+// audioFileID returns the file id of the audio attached to msg: a voice note,
+// an audio file, or a document with an audio MIME type, as forwarded audio
+// files often arrive. It is empty when msg has no audio.
+func audioFileID(msg *models.Message) string {
+	switch {
+	case msg.Voice != nil:
+		return msg.Voice.FileID
+	case msg.Audio != nil:
+		return msg.Audio.FileID
+	case msg.Document != nil && (strings.HasPrefix(msg.Document.MimeType, "audio/") || msg.Document.MimeType == "application/ogg"):
+		return msg.Document.FileID
+	}
+	return ""
+}
+
+// audioFileSize returns the size in bytes Telegram reports for the audio
+// attached to msg, or 0 when it is unknown.
+func audioFileSize(msg *models.Message) int64 {
+	switch {
+	case msg.Voice != nil:
+		return msg.Voice.FileSize
+	case msg.Audio != nil:
+		return msg.Audio.FileSize
+	case msg.Document != nil:
+		return msg.Document.FileSize
+	}
+	return 0
+}
+
+// transcribeAudio transcribes audio sent to proj whose size in bytes is given by size, or
+// -1 when unknown. Oversized audio is transcribed in chunks when splitAudio is
+// available and rejected with errAudioTooLarge otherwise.
+func transcribeAudio(ctx context.Context, proj string, audio io.Reader, size int64) (string, error) {
+	if size > maxTranscribeBytes && splitAudio == nil {
+		return "", errAudioTooLarge
+	}
+	if size >= 0 && size <= maxTranscribeBytes {
+		return transcriber.Transcribe(ctx, proj, audio)
+	}
+	data, err := io.ReadAll(audio)
+	if err != nil {
+		return "", err
+	}
+	if len(data) <= maxTranscribeBytes {
+		return transcriber.Transcribe(ctx, proj, bytes.NewReader(data))
+	}
+	if splitAudio == nil {
+		return "", errAudioTooLarge
+	}
+	chunks, err := splitAudio(ctx, data)
+	if err != nil {
+		return "", fmt.Errorf("split audio: %w", err)
+	}
+	parts := make([]string, 0, len(chunks))
+	for i, chunk := range chunks {
+		text, err := transcriber.Transcribe(ctx, proj, bytes.NewReader(chunk))
+		if err != nil {
+			return "", fmt.Errorf("transcribe chunk %d/%d: %w", i+1, len(chunks), err)
+		}
+		parts = append(parts, text)
+	}
+	return joinTranscripts(parts), nil
+}
+
+// joinTranscripts concatenates the transcripts of consecutive audio chunks,
+// skipping empty ones.
+func joinTranscripts(parts []string) string {
+	var nonEmpty []string
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return strings.Join(nonEmpty, " ")
+}
+
+// transcribers maps TBOT_TRANSCRIBE_PROVIDER values to their constructors.
+// New providers only need an entry here.
+var transcribers = map[string]func() Transcriber{
+	"openai": func() Transcriber { return openAITranscriber{} },
+}
+
+// transcriber is the provider used for voice and audio messages.
+var transcriber Transcriber = openAITranscriber{}
+
+// loadTranscriber selects the provider named by TBOT_TRANSCRIBE_PROVIDER.
+// Unset or unknown names keep OpenAI.
+func loadTranscriber() {
+	name := strings.ToLower(strings.TrimSpace(os.Getenv("TBOT_TRANSCRIBE_PROVIDER")))
+	if name == "" {
+		return
+	}
+	newTranscriber, ok := transcribers[name]
+	if !ok {
+		logging.Log.Warn().Str("value", name).Msg("invalid TBOT_TRANSCRIBE_PROVIDER")
+		return
+	}
+	transcriber = newTranscriber()
+}
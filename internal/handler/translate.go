@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/openai/openai-go/v2/responses"
+
+	"telegram-chatgpt-bot/internal/logging"
+)
+
+// translateInstruction asks the model for the bare translation, so the reply
+// can be copied as is.
+const translateInstruction = "Translate the user's message into %s. Reply with the translation only, without explanations, notes or quotation marks. Keep the formatting, names and code unchanged."
+
+// handleTranslate translates the text after the language, or the message
+// replied to when no text is given, with the model of the topic project. The
+// project instruction and history are not used and nothing is stored.
+func handleTranslate(ctx context.Context, b Bot, msg *models.Message, args string) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	lang, text := strings.TrimSpace(args), ""
+	if i := strings.IndexFunc(lang, unicode.IsSpace); i >= 0 {
+		lang, text = lang[:i], strings.TrimSpace(lang[i:])
+	}
+	if text == "" && msg.ReplyToMessage != nil {
+		text = msg.ReplyToMessage.Text
+		if text == "" {
+			text = msg.ReplyToMessage.Caption
+		}
+	}
+	if lang == "" || text == "" {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Usage: /translate <language> <text>, or reply to a message with /translate <language>"})
+		return
+	}
+	proj, err := messageProject(msg)
+	if err != nil {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Topic is not mapped to a project."})
+		return
+	}
+	logging.Ctx(ctx).Info().Str("event", "chatgpt_translate_request").Str("project", proj).Str("language", lang).Str("snippet", logging.Snippet(text, 30)).Msg("sending translation to ChatGPT")
+	sendOneOff(ctx, b, msg, proj, text, responses.ResponseInputParam{
+		responses.ResponseInputItemParamOfMessage(fmt.Sprintf(translateInstruction, lang), responses.EasyInputMessageRoleSystem),
+		responses.ResponseInputItemParamOfMessage(text, responses.EasyInputMessageRoleUser),
+	})
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"telegram-chatgpt-bot/internal/logging"
+	"telegram-chatgpt-bot/internal/storage"
+)
+
+// routedProject returns the project a message from userID in chat and
+// topicID goes to. In private chats the project chosen with /use takes
+// precedence over the topic mapping; GetMappedProject only falls back to it.
+func routedProject(chat models.Chat, topicID int, userID int64) (string, error) {
+	if chat.Type == models.ChatTypePrivate {
+		proj, err := storage.GetUserCurrentProject(userID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return "", err
+		}
+		if err == nil {
+			if exists, _ := storage.ProjectExists(proj); exists {
+				return proj, nil
+			}
+		}
+	}
+	return storage.GetMappedProject(chat.ID, topicID)
+}
+
+// messageProject returns the project msg is routed to.
+func messageProject(msg *models.Message) (string, error) {
+	var userID int64
+	if msg.From != nil {
+		userID = msg.From.ID
+	}
+	return routedProject(msg.Chat, msg.MessageThreadID, userID)
+}
+
+// handleUse shows or switches the project private chat messages of the user
+// are sent to.
+func handleUse(ctx context.Context, b Bot, msg *models.Message, args string) {
+	chatID, topicID := msg.Chat.ID, msg.MessageThreadID
+	if msg.Chat.Type != models.ChatTypePrivate {
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "/use works in private chats only. Use /settopic to map a group topic."})
+		return
+	}
+	userID := msg.From.ID
+	proj := strings.TrimSpace(args)
+	switch {
+	case proj == "":
+		current, err := messageProject(msg)
+		if err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "No current project. Choose one with /use <projectName>."})
+			return
+		}
+		text := "Current project: " + current
+		if desc, _ := storage.LoadProjectDescription(current); desc != "" {
+			text += "\n" + desc
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: text})
+	case strings.EqualFold(proj, "off"):
+		if err := setUserCurrentProject(userID, ""); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Current project cleared."})
+		logging.Ctx(ctx).Info().Str("event", "use_project_cleared").Msg("current project cleared")
+	default:
+		if exists, err := storage.ProjectExists(proj); err != nil || !exists {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Project not found."})
+			return
+		}
+		if err := setUserCurrentProject(userID, proj); err != nil {
+			b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: "Save error: " + err.Error()})
+			return
+		}
+		b.SendMessage(ctx, &tg.SendMessageParams{ChatID: chatID, MessageThreadID: topicID, Text: fmt.Sprintf("Now using project '%s'.", proj)})
+		logging.Ctx(ctx).Info().Str("event", "use_project").Str("project", proj).Msg("current project switched")
+	}
+}
@@ -2,6 +2,7 @@ package logging
 
 import (
 	"context"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -13,8 +14,12 @@ import (
 // Log is the base logger used throughout the application.
 var Log zerolog.Logger
 
+// output is where log lines are written, replaced in tests.
+var output io.Writer = os.Stdout
+
 // Init configures the global logger. Log level can be overridden by the
-// LOG_LEVEL environment variable (e.g. debug, info, warn, error).
+// LOG_LEVEL environment variable (e.g. debug, info, warn, error). LOG_FORMAT
+// selects json (default) or console output for human readable local logs.
 func Init() {
 	level := zerolog.InfoLevel
 	if lvl := os.Getenv("LOG_LEVEL"); lvl != "" {
@@ -23,7 +28,11 @@ func Init() {
 		}
 	}
 	zerolog.TimeFieldFormat = time.RFC3339
-	Log = zerolog.New(os.Stdout).Level(level).With().Timestamp().Logger()
+	w := output
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "console") {
+		w = zerolog.ConsoleWriter{Out: output, TimeFormat: time.DateTime}
+	}
+	Log = zerolog.New(w).Level(level).With().Timestamp().Logger()
 }
 
 // Context returns a new context with a request scoped logger containing a
@@ -47,10 +56,15 @@ func Ctx(ctx context.Context) *zerolog.Logger {
 	return &Log
 }
 
-// Snippet returns the first n characters of s.
+// Snippet returns the first n characters of s. It cuts on rune boundaries so
+// multi-byte characters are never split.
 func Snippet(s string, n int) string {
-	if len(s) <= n {
-		return s
+	i := 0
+	for j := range s {
+		if i == n {
+			return s[:j]
+		}
+		i++
 	}
-	return s[:n]
+	return s
 }
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSnippet(t *testing.T) {
+	cases := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"привет", 3, "при"},
+		{"👍👍👍", 2, "👍👍"},
+		{"", 5, ""},
+	}
+	for _, tc := range cases {
+		got := Snippet(tc.in, tc.n)
+		if got != tc.want {
+			t.Fatalf("Snippet(%q, %d) = %q, want %q", tc.in, tc.n, got, tc.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Fatalf("Snippet(%q, %d) produced invalid UTF-8", tc.in, tc.n)
+		}
+	}
+}
+
+func TestSnippetMultibyteLength(t *testing.T) {
+	in := "你好世界，欢迎使用机器人"
+	got := Snippet(in, 4)
+	if !utf8.ValidString(got) {
+		t.Fatalf("Snippet produced invalid UTF-8: %q", got)
+	}
+	if n := utf8.RuneCountInString(got); n != 4 || got != "你好世界" {
+		t.Fatalf("Snippet = %q (%d runes), want 4 runes", got, n)
+	}
+}
+
+func TestInitFormat(t *testing.T) {
+	orig := output
+	defer func() { output = orig; Init() }()
+
+	var buf bytes.Buffer
+	output = &buf
+
+	t.Setenv("LOG_FORMAT", "")
+	Init()
+	Log.Info().Str("k", "v").Msg("hello")
+	var m map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil || m["message"] != "hello" {
+		t.Fatalf("expected JSON line, got %q (%v)", buf.String(), err)
+	}
+
+	buf.Reset()
+	t.Setenv("LOG_FORMAT", "console")
+	Init()
+	Log.Info().Str("k", "v").Msg("hello")
+	line := buf.String()
+	if strings.HasPrefix(line, "{") || !strings.Contains(line, "INF") || !strings.Contains(line, "hello") {
+		t.Fatalf("expected console line, got %q", line)
+	}
+}
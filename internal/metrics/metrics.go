@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Counter names used across the application.
+const (
+	TelegramRequests   = "telegram_requests"
+	ChatGPTRequests    = "chatgpt_requests"
+	ChatGPTErrors      = "chatgpt_errors"
+	OpenAIInputTokens  = "openai_input_tokens"
+	OpenAIOutputTokens = "openai_output_tokens"
+)
+
+var (
+	mu       sync.Mutex
+	counters = map[string]int64{
+		TelegramRequests:   0,
+		ChatGPTRequests:    0,
+		ChatGPTErrors:      0,
+		OpenAIInputTokens:  0,
+		OpenAIOutputTokens: 0,
+	}
+)
+
+// Inc increments the named counter by one.
+func Inc(name string) {
+	Add(name, 1)
+}
+
+// Add increments the named counter by n.
+func Add(name string, n int64) {
+	mu.Lock()
+	counters[name] += n
+	mu.Unlock()
+}
+
+// Snapshot returns a copy of all counters.
+func Snapshot() map[string]int64 {
+	mu.Lock()
+	defer mu.Unlock()
+	out := make(map[string]int64, len(counters))
+	for k, v := range counters {
+		out[k] = v
+	}
+	return out
+}
+
+// JSON returns the current counters as an indented JSON object.
+func JSON() ([]byte, error) {
+	return json.MarshalIndent(Snapshot(), "", "  ")
+}
+
+// Handler serves the current counters as JSON.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := JSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
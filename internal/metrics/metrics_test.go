@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	before := Snapshot()[ChatGPTErrors]
+	Inc(ChatGPTErrors)
+	Add(OpenAIInputTokens, 5)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	var got map[string]int64
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got[ChatGPTErrors] != before+1 {
+		t.Fatalf("errors = %d, want %d", got[ChatGPTErrors], before+1)
+	}
+	if _, ok := got[TelegramRequests]; !ok {
+		t.Fatalf("missing %s in %v", TelegramRequests, got)
+	}
+}
@@ -5,33 +5,154 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	bolt "github.com/boltdb/bolt"
 )
 
-var db *bolt.DB
+// handle guards the database, which Compact closes and replaces while the bot
+// is running. Storage calls hold the read lock; Compact holds the write lock.
+type handle struct {
+	mu   sync.RWMutex
+	bolt *bolt.DB
+}
+
+var db = &handle{}
+
+// View runs fn in a read-only transaction.
+func (h *handle) View(fn func(*bolt.Tx) error) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.bolt == nil {
+		return bolt.ErrDatabaseNotOpen
+	}
+	return h.bolt.View(fn)
+}
+
+// Update runs fn in a read-write transaction.
+func (h *handle) Update(fn func(*bolt.Tx) error) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.bolt == nil {
+		return bolt.ErrDatabaseNotOpen
+	}
+	return h.bolt.Update(fn)
+}
+
+// Path returns the location of the database file.
+func (h *handle) Path() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.bolt == nil {
+		return ""
+	}
+	return h.bolt.Path()
+}
+
+// ErrNotFound is returned by the loaders when the requested key is not stored.
+// Loaders with a default value return it together with ErrNotFound.
+var ErrNotFound = errors.New("not found")
+
+// ErrProjectExists is returned by SaveProject for a name that is already
+// registered, so the settings of the existing project are left alone.
+var ErrProjectExists = errors.New("project already exists")
 
 const (
 	bucketProjects      = "projects"
-	bucketMapping       = "mapping"        // key: chatID:topicID, value: projectName
-	bucketModels        = "models"         // key: projectName, value: model
-	bucketRules         = "rules"          // key: projectName, value: custom instruction
-	bucketHistoryLimits = "history_limits" // key: projectName, value: limit
-	bucketHistory       = "history"        // parent bucket for per-project history
-	bucketWebSearch     = "websearch"      // key: projectName, value: search context size or off
-	bucketReasoning     = "reasoning"      // key: projectName, value: reasoning effort
-	bucketTranscribe    = "transcribe"     // key: projectName, value: on/off
+	bucketMapping       = "mapping"         // key: chatID:topicID, value: projectName
+	bucketModels        = "models"          // key: projectName, value: model
+	bucketRules         = "rules"           // key: projectName, value: custom instruction
+	bucketHistoryLimits = "history_limits"  // key: projectName, value: limit
+	bucketHistory       = "history"         // parent bucket for per-project history
+	bucketWebSearch     = "websearch"       // key: projectName, value: search context size or off
+	bucketReasoning     = "reasoning"       // key: projectName, value: reasoning effort
+	bucketTranscribe    = "transcribe"      // key: projectName, value: on/off
+	bucketTokenBudgets  = "token_budgets"   // key: projectName, value: history token budget
+	bucketAutoSummarize = "autosummarize"   // key: projectName, value: on/off
+	bucketSchedules     = "schedules"       // key: schedule id, value: JSON schedule
+	bucketPreprocess    = "preprocess"      // key: projectName, value: JSON input preprocessing rules
+	bucketSummaryModels = "summary_models"  // key: projectName, value: model used for summaries
+	bucketBusyMode      = "busy_mode"       // key: projectName, value: queue/reject
+	bucketImageCacheTTL = "image_cache_ttl" // key: projectName, value: cache ttl in minutes
+	bucketImageCache    = "image_cache"     // parent bucket for per-project cached image answers
+	bucketSetup         = "setup"           // key: chatID:topicID:userID, value: JSON setup wizard progress
+	bucketEditRerun     = "edit_rerun"      // key: projectName, value: on/off
+	bucketLastReplies   = "last_replies"    // key: chatID:topicID, value: JSON last prompt and reply ids
+	bucketTyping        = "typing"          // key: projectName, value: on/off
+	bucketVoiceReply    = "voice_reply"     // key: projectName, value: on/off
+	bucketWelcome       = "welcome"         // key: projectName, value: welcome message posted when a topic is mapped
+	bucketTimezones     = "timezones"       // key: projectName, value: IANA timezone name
+	bucketAudit         = "audit"           // parent bucket for per-project audit logs
+	bucketReplyTopics   = "reply_topics"    // key: chatID:topicID, value: topic id replies to the mapped topic are posted to
+	bucketFeedback      = "feedback"        // parent bucket for per-project reply feedback, key: reply message id, value: up or down
+	bucketShowReasoning = "show_reasoning"  // key: projectName, value: on/off
+	bucketMentionOnly   = "mention_only"    // key: projectName, value: on/off
+	bucketFallbacks     = "fallback_models" // key: projectName, value: model used when the project model is unavailable
+	bucketHistoryMaxLen = "history_max_len" // key: projectName, value: max characters stored per history message
+	bucketCitations     = "citations"       // key: projectName, value: on/off
+	bucketSearchDomains = "search_domains"  // key: projectName, value: JSON list of domains web search is limited to
+	bucketChunkNumbers  = "chunk_numbers"   // key: projectName, value: on/off
+	bucketImageDetail   = "image_detail"    // key: projectName, value: auto/low/high
+	bucketImageResize   = "image_resize"    // key: projectName, value: max image dimension in pixels
+	bucketInstrRoles    = "instr_roles"     // key: projectName, value: system/developer
+	bucketInjectTime    = "inject_time"     // key: projectName, value: on/off
+	bucketMirrorLang    = "mirror_language" // key: projectName, value: on/off
+	bucketAssistNames   = "assistant_names" // key: projectName, value: assistant display name
+	bucketFooters       = "footers"         // key: projectName, value: footer appended to replies
+	bucketAPIKeys       = "api_keys"        // key: projectName, value: encrypted OpenAI API key
+	bucketUserCurrent   = "user_current"    // key: userID, value: projectName chosen with /use
+	bucketTimeouts      = "timeouts"        // key: projectName, value: request timeout in seconds
+	bucketChaining      = "chaining"        // key: projectName, value: on/off
+	bucketResponseIDs   = "response_ids"    // key: projectName, value: id of the last OpenAI response
+	bucketBatchWindows  = "batch_windows"   // key: projectName, value: message batching window in seconds
+	bucketMonthBudgets  = "month_budgets"   // key: projectName, value: monthly token budget
+	bucketMonthUsage    = "month_usage"     // key: projectName:YYYY-MM, value: tokens used in the month
+	bucketMetaFormats   = "meta_formats"    // key: projectName, value: history metadata prefix template or "none"
+	bucketStickers      = "stickers"        // key: projectName, value: on/off
+	bucketAnimations    = "animations"      // key: projectName, value: on/off
+	bucketModelRoutes   = "model_routes"    // key: projectName, value: JSON model routing rule
+	bucketRedactions    = "redactions"      // key: projectName, value: JSON list of regex patterns redacted from replies
+	bucketDescriptions  = "descriptions"    // key: projectName, value: short description shown in listings
+	bucketStops         = "stop_sequences"  // key: projectName, value: JSON list of stop sequences
+	bucketJSONModes     = "json_modes"      // key: projectName, value: on/off
+	bucketJSONSchemas   = "json_schemas"    // key: projectName, value: JSON schema replies must follow
+	bucketDedupWindows  = "dedup_windows"   // key: projectName, value: duplicate message window in seconds
+	bucketMeta          = "meta"            // key: setting name, value: database-wide setting
+
+	metaSchemaVersion      = "schema_version"
+	metaMaintenance        = "maintenance"         // on/off
+	metaMaintenanceMessage = "maintenance_message" // reply sent while maintenance is on
 )
 
+// migration upgrades the database layout by one schema version.
+type migration func(tx *bolt.Tx) error
+
+// migrations are applied in order on startup, after all buckets exist. The
+// schema version of a database is the number of migrations it has been
+// through, so new migrations are appended and existing ones never reordered.
+var migrations = []migration{
+	migrateLegacyProjects, // 1
+	migrateErrorHistory,   // 2
+	migrateReplyTopics,    // 3
+	migrateDropSampling,   // 4
+	migrateSetupKeys,      // 5
+}
+
 // Init opens the database file and creates buckets if needed.
 func Init(path string) error {
-	var err error
-	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	opened, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		return err
 	}
+	db.mu.Lock()
+	db.bolt = opened
+	db.mu.Unlock()
 	return db.Update(func(tx *bolt.Tx) error {
 		if _, err := tx.CreateBucketIfNotExists([]byte(bucketProjects)); err != nil {
 			return err
@@ -60,25 +181,447 @@ func Init(path string) error {
 		if _, err := tx.CreateBucketIfNotExists([]byte(bucketTranscribe)); err != nil {
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketTokenBudgets)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketAutoSummarize)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketSchedules)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketPreprocess)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketSummaryModels)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketBusyMode)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketImageCacheTTL)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketImageCache)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketSetup)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketEditRerun)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketLastReplies)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketTyping)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketVoiceReply)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketShowReasoning)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketMentionOnly)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketFallbacks)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketHistoryMaxLen)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketCitations)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketSearchDomains)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketChunkNumbers)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketImageDetail)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketImageResize)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketInstrRoles)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketInjectTime)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketMirrorLang)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketAssistNames)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketFooters)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketAPIKeys)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketUserCurrent)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketTimeouts)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketChaining)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketResponseIDs)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketBatchWindows)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketMonthBudgets)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketMonthUsage)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketMetaFormats)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketStickers)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketAnimations)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketModelRoutes)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketRedactions)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketDescriptions)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketStops)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketJSONModes)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketJSONSchemas)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketDedupWindows)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketWelcome)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketTimezones)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketAudit)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketFeedback)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketReplyTopics)); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketMeta)); err != nil {
+			return err
+		}
+		return runMigrations(tx, migrations)
+	})
+}
+
+// runMigrations applies the migrations the database has not been through yet
+// and records the resulting schema version. A database written by a newer
+// version is rejected rather than guessed at.
+func runMigrations(tx *bolt.Tx, list []migration) error {
+	mb := tx.Bucket([]byte(bucketMeta))
+	version := 0
+	if v := mb.Get([]byte(metaSchemaVersion)); v != nil {
+		n, err := strconv.Atoi(string(v))
+		if err != nil {
+			return fmt.Errorf("invalid schema version %q: %w", v, err)
+		}
+		version = n
+	}
+	if version > len(list) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(list))
+	}
+	for i := version; i < len(list); i++ {
+		if err := list[i](tx); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+	return mb.Put([]byte(metaSchemaVersion), []byte(strconv.Itoa(len(list))))
+}
+
+// SchemaVersion returns the schema version recorded in the database.
+func SchemaVersion() (int, error) {
+	return loadIntSetting(bucketMeta, metaSchemaVersion)
+}
+
+// SaveMaintenance turns maintenance mode, which pauses all requests to
+// OpenAI, on or off.
+func SaveMaintenance(setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMeta))
+		return b.Put([]byte(metaMaintenance), []byte(setting))
+	})
+}
+
+// LoadMaintenance returns whether maintenance mode is on. Default is "off".
+func LoadMaintenance() (string, error) {
+	return loadSetting(bucketMeta, metaMaintenance, "off")
+}
+
+// SaveMaintenanceMessage stores the reply sent while maintenance mode is on.
+func SaveMaintenanceMessage(text string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMeta))
+		return b.Put([]byte(metaMaintenanceMessage), []byte(text))
+	})
+}
+
+// LoadMaintenanceMessage returns the reply sent while maintenance mode is on.
+// It returns ErrNotFound when none is set.
+func LoadMaintenanceMessage() (string, error) {
+	return loadSetting(bucketMeta, metaMaintenanceMessage, "")
+}
+
+// migrateLegacyProjects converts databases written by the old version, which
+// stored each project's encrypted API key as its value in the projects
+// bucket. The keys are moved to bucketAPIKeys and the project entries are
+// reset to the empty value used now. Databases in the current layout are left
+// untouched.
+func migrateLegacyProjects(tx *bolt.Tx) error {
+	pb := tx.Bucket([]byte(bucketProjects))
+	// collect first: the bucket must not be modified while iterating it
+	legacy := map[string][]byte{}
+	if err := pb.ForEach(func(k, v []byte) error {
+		if len(v) > 0 {
+			legacy[string(k)] = append([]byte(nil), v...)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+	kb := tx.Bucket([]byte(bucketAPIKeys))
+	for name, key := range legacy {
+		if err := kb.Put([]byte(name), key); err != nil {
+			return err
+		}
+		if err := pb.Put([]byte(name), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errorReplyPrefixes start the error replies stored in history before they
+// were flagged with IsError.
+var errorReplyPrefixes = []string{
+	"OpenAI error: ",
+	"The model rejected the request: ",
+	"The OpenAI account has run out of quota.",
+	"OpenAI rate limit reached",
+	"OpenAI rejected the API key.",
+}
+
+// isErrorReply reports whether an unflagged assistant message looks like an
+// error reply.
+func isErrorReply(m HistoryMessage) bool {
+	if m.IsError || m.Role != RoleAssistant {
+		return false
+	}
+	for _, p := range errorReplyPrefixes {
+		if strings.HasPrefix(m.Content, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateErrorHistory flags the error replies stored in history by older
+// versions, recognized by their text, so they are no longer replayed to the
+// model.
+func migrateErrorHistory(tx *bolt.Tx) error {
+	hb := tx.Bucket([]byte(bucketHistory))
+	return hb.ForEach(func(name, v []byte) error {
+		pb := hb.Bucket(name)
+		if v != nil || pb == nil {
+			return nil
+		}
+		flagged := map[string][]byte{}
+		if err := pb.ForEach(func(k, v []byte) error {
+			var m HistoryMessage
+			if json.Unmarshal(v, &m) != nil || !isErrorReply(m) {
+				return nil
+			}
+			m.IsError = true
+			data, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			flagged[string(k)] = data
+			return nil
+		}); err != nil {
+			return err
+		}
+		for k, data := range flagged {
+			if err := pb.Put([]byte(k), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migrateReplyTopics re-keys reply redirects from project names to the chat
+// topics mapped to each project, as topic ids only mean something within one
+// chat.
+func migrateReplyTopics(tx *bolt.Tx) error {
+	rb := tx.Bucket([]byte(bucketReplyTopics))
+	byProject := map[string][]byte{}
+	if err := rb.ForEach(func(k, v []byte) error {
+		byProject[string(k)] = append([]byte(nil), v...)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for name := range byProject {
+		if err := rb.Delete([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(bucketMapping)).ForEach(func(k, v []byte) error {
+		if target, ok := byProject[string(v)]; ok {
+			return rb.Put(k, target)
+		}
 		return nil
 	})
 }
 
+// migrateSetupKeys moves setup wizard progress from user keys to
+// chat:topic:user keys, recording the user in the value.
+func migrateSetupKeys(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(bucketSetup))
+	old := map[string]SetupState{}
+	if err := b.ForEach(func(k, v []byte) error {
+		var st SetupState
+		if err := json.Unmarshal(v, &st); err != nil {
+			return err
+		}
+		old[string(k)] = st
+		return nil
+	}); err != nil {
+		return err
+	}
+	for k, st := range old {
+		userID, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return fmt.Errorf("setup key %q: %w", k, err)
+		}
+		st.UserID = userID
+		data, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		if err := b.Delete([]byte(k)); err != nil {
+			return err
+		}
+		if err := b.Put(setupKey(st.ChatID, st.TopicID, userID), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// droppedSettings are the project settings of earlier versions that are no
+// longer kept, by the schema version that removed them. Imports of older
+// exports skip them.
+var droppedSettings = map[string]int{
+	"penalties": 4,
+	"seeds":     4,
+}
+
+// migrateDropSampling removes the frequency and presence penalties and the
+// sampling seeds, which the Responses API does not accept.
+func migrateDropSampling(tx *bolt.Tx) error {
+	for _, name := range []string{"penalties", "seeds"} {
+		if err := tx.DeleteBucket([]byte(name)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
 // Close releases the underlying database. Primarily used in tests.
 func Close() error {
-	if db == nil {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.bolt == nil {
 		return nil
 	}
-	err := db.Close()
-	db = nil
+	err := db.bolt.Close()
+	db.bolt = nil
 	return err
 }
 
-// SaveProject registers a project name without any associated API key.
+// ProjectDefaults are the settings stored for a project when it is created.
+// Empty fields are left unset.
+type ProjectDefaults struct {
+	Model     string
+	Reasoning string
+	WebSearch string
+}
+
+var projectDefaults ProjectDefaults
+
+// SetProjectDefaults configures the settings applied to new projects.
+func SetProjectDefaults(d ProjectDefaults) {
+	projectDefaults = d
+}
+
+// SaveProject registers a project name without any associated API key. A new
+// project gets the configured default settings; an existing name is rejected
+// with ErrProjectExists.
 func SaveProject(name string) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucketProjects))
-		return b.Put([]byte(name), []byte{})
+		if b.Get([]byte(name)) != nil {
+			return ErrProjectExists
+		}
+		if err := b.Put([]byte(name), []byte{}); err != nil {
+			return err
+		}
+		defaults := []struct{ bucket, value string }{
+			{bucketModels, projectDefaults.Model},
+			{bucketReasoning, projectDefaults.Reasoning},
+			{bucketWebSearch, projectDefaults.WebSearch},
+		}
+		for _, d := range defaults {
+			if d.value == "" {
+				continue
+			}
+			sb := tx.Bucket([]byte(d.bucket))
+			if sb.Get([]byte(name)) != nil {
+				continue
+			}
+			if err := sb.Put([]byte(name), []byte(d.value)); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
 
@@ -96,55 +639,91 @@ func ProjectExists(name string) (bool, error) {
 	return exists, err
 }
 
-// SaveProjectModel stores the selected model for the given project.
-func SaveProjectModel(name, model string) error {
-	return db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketModels))
-		return b.Put([]byte(name), []byte(model))
-	})
-}
-
-// LoadProjectModel returns the stored model for the project.
-func LoadProjectModel(name string) (string, error) {
+// loadSetting reads a string setting of a project. A missing key yields def
+// and ErrNotFound, an empty stored value yields def.
+func loadSetting(bucket, name, def string) (string, error) {
 	var val []byte
 	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketModels))
+		b := tx.Bucket([]byte(bucket))
 		v := b.Get([]byte(name))
 		if v == nil {
-			return errors.New("model not found")
+			return ErrNotFound
 		}
 		val = append([]byte(nil), v...)
 		return nil
 	})
-	return string(val), err
-}
-
-// SaveProjectWebSearch stores web search setting for a project.
-func SaveProjectWebSearch(name, setting string) error {
-	return db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketWebSearch))
-		return b.Put([]byte(name), []byte(setting))
-	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return def, err
+		}
+		return "", err
+	}
+	if len(val) == 0 {
+		return def, nil
+	}
+	return string(val), nil
 }
 
-// LoadProjectWebSearch returns web search setting for a project. Default is "off".
-func LoadProjectWebSearch(name string) (string, error) {
-	var val []byte
+// loadIntSetting reads a numeric setting of a project. A missing key yields 0
+// and ErrNotFound.
+func loadIntSetting(bucket, name string) (int, error) {
+	var n int
 	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketWebSearch))
+		b := tx.Bucket([]byte(bucket))
 		v := b.Get([]byte(name))
-		if v != nil {
-			val = append([]byte(nil), v...)
+		if v == nil {
+			return ErrNotFound
+		}
+		i, err := strconv.Atoi(string(v))
+		if err != nil {
+			return err
 		}
+		n = i
 		return nil
 	})
-	if err != nil {
-		return "", err
-	}
-	if len(val) == 0 {
-		return "off", nil
-	}
-	return string(val), nil
+	return n, err
+}
+
+// SaveProjectModel stores the selected model for the given project.
+func SaveProjectModel(name, model string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketModels))
+		return b.Put([]byte(name), []byte(model))
+	})
+}
+
+// LoadProjectModel returns the stored model for the project. It returns
+// ErrNotFound when no model is set.
+func LoadProjectModel(name string) (string, error) {
+	return loadSetting(bucketModels, name, "")
+}
+
+// SaveProjectSummaryModel stores the model used to summarize history for the project.
+func SaveProjectSummaryModel(name, model string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketSummaryModels))
+		return b.Put([]byte(name), []byte(model))
+	})
+}
+
+// LoadProjectSummaryModel returns the summary model for the project. An empty
+// string means the global summary model is used; ErrNotFound is returned when
+// the setting was never stored.
+func LoadProjectSummaryModel(name string) (string, error) {
+	return loadSetting(bucketSummaryModels, name, "")
+}
+
+// SaveProjectWebSearch stores web search setting for a project.
+func SaveProjectWebSearch(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketWebSearch))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectWebSearch returns web search setting for a project. Default is "off".
+func LoadProjectWebSearch(name string) (string, error) {
+	return loadSetting(bucketWebSearch, name, "off")
 }
 
 // SaveProjectReasoning stores reasoning effort for a project.
@@ -157,22 +736,7 @@ func SaveProjectReasoning(name, effort string) error {
 
 // LoadProjectReasoning returns reasoning effort for a project. Default is "medium".
 func LoadProjectReasoning(name string) (string, error) {
-	var val []byte
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketReasoning))
-		v := b.Get([]byte(name))
-		if v != nil {
-			val = append([]byte(nil), v...)
-		}
-		return nil
-	})
-	if err != nil {
-		return "", err
-	}
-	if len(val) == 0 {
-		return "medium", nil
-	}
-	return string(val), nil
+	return loadSetting(bucketReasoning, name, "medium")
 }
 
 // SaveProjectTranscribe stores audio transcription setting for a project.
@@ -185,227 +749,2101 @@ func SaveProjectTranscribe(name, setting string) error {
 
 // LoadProjectTranscribe returns audio transcription setting. Default is "off".
 func LoadProjectTranscribe(name string) (string, error) {
-	var val []byte
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketTranscribe))
-		v := b.Get([]byte(name))
-		if v != nil {
-			val = append([]byte(nil), v...)
-		}
-		return nil
+	return loadSetting(bucketTranscribe, name, "off")
+}
+
+// SaveProjectAutoSummarize stores the history auto-summarize setting for a project.
+func SaveProjectAutoSummarize(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketAutoSummarize))
+		return b.Put([]byte(name), []byte(setting))
 	})
-	if err != nil {
-		return "", err
-	}
-	if len(val) == 0 {
-		return "off", nil
-	}
-	return string(val), nil
 }
 
-// SaveProjectInstruction stores the custom instruction for the project.
-func SaveProjectInstruction(name, instr string) error {
+// LoadProjectAutoSummarize returns the history auto-summarize setting. Default is "off".
+func LoadProjectAutoSummarize(name string) (string, error) {
+	return loadSetting(bucketAutoSummarize, name, "off")
+}
+
+// Replacement is a regular expression replace applied to incoming text.
+type Replacement struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+}
+
+// Preprocess describes transformations applied to user input before it is
+// sent to the model.
+type Preprocess struct {
+	TrimSignature bool          `json:"trim_signature,omitempty"`
+	StripQuotes   bool          `json:"strip_quotes,omitempty"`
+	Replacements  []Replacement `json:"replacements,omitempty"`
+}
+
+// SaveProjectPreprocess stores the input preprocessing rules for a project.
+func SaveProjectPreprocess(name string, p Preprocess) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
 	return db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketRules))
-		return b.Put([]byte(name), []byte(instr))
+		b := tx.Bucket([]byte(bucketPreprocess))
+		return b.Put([]byte(name), data)
 	})
 }
 
-// LoadProjectInstruction returns the stored instruction for the project.
-func LoadProjectInstruction(name string) (string, error) {
-	var val []byte
+// LoadProjectPreprocess returns the input preprocessing rules for a project.
+// Default is an empty ruleset.
+func LoadProjectPreprocess(name string) (Preprocess, error) {
+	var p Preprocess
 	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketRules))
+		b := tx.Bucket([]byte(bucketPreprocess))
 		v := b.Get([]byte(name))
 		if v == nil {
-			return errors.New("rule not found")
+			return ErrNotFound
 		}
-		val = append([]byte(nil), v...)
-		return nil
+		return json.Unmarshal(v, &p)
 	})
-	return string(val), err
+	return p, err
 }
 
-// MapTopic links a chat topic to a project.
-func MapTopic(chatID int64, topicID int, project string) error {
-	key := fmt.Sprintf("%d:%d", chatID, topicID)
+// ModelRoute picks the model of a request by its length: Short for prompts of
+// up to Threshold characters and Long for longer ones.
+type ModelRoute struct {
+	Short     string `json:"short"`
+	Long      string `json:"long"`
+	Threshold int    `json:"threshold"`
+}
+
+// SaveProjectModelRoute stores the model routing rule of a project.
+func SaveProjectModelRoute(name string, r ModelRoute) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
 	return db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketMapping))
-		return b.Put([]byte(key), []byte(project))
+		b := tx.Bucket([]byte(bucketModelRoutes))
+		return b.Put([]byte(name), data)
 	})
 }
 
-// UnmapTopic removes the association between a chat topic and a project.
-func UnmapTopic(chatID int64, topicID int) error {
-	key := fmt.Sprintf("%d:%d", chatID, topicID)
+// DeleteProjectModelRoute removes the model routing rule of a project.
+func DeleteProjectModelRoute(name string) error {
 	return db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketMapping))
-		return b.Delete([]byte(key))
+		b := tx.Bucket([]byte(bucketModelRoutes))
+		return b.Delete([]byte(name))
 	})
 }
 
-// GetMappedProject returns the project associated with the chat topic.
-func GetMappedProject(chatID int64, topicID int) (string, error) {
-	var proj []byte
-	key := fmt.Sprintf("%d:%d", chatID, topicID)
+// LoadProjectModelRoute returns the model routing rule of a project. It
+// returns ErrNotFound when none is set.
+func LoadProjectModelRoute(name string) (ModelRoute, error) {
+	var r ModelRoute
 	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketMapping))
-		v := b.Get([]byte(key))
+		b := tx.Bucket([]byte(bucketModelRoutes))
+		v := b.Get([]byte(name))
 		if v == nil {
-			return errors.New("no project mapped")
+			return ErrNotFound
 		}
-		proj = append([]byte(nil), v...)
-		return nil
+		return json.Unmarshal(v, &r)
 	})
-	return string(proj), err
+	return r, err
 }
 
-// ListProjects returns all stored project names.
-func ListProjects() ([]string, error) {
-	var names []string
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketProjects))
-		return b.ForEach(func(k, _ []byte) error {
-			names = append(names, string(k))
-			return nil
-		})
+// SaveProjectSearchDomains limits the web search of a project to domains.
+func SaveProjectSearchDomains(name string, domains []string) error {
+	data, err := json.Marshal(domains)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketSearchDomains))
+		return b.Put([]byte(name), data)
 	})
-	return names, err
-}
-
-// HistoryMessage represents a stored message in project history.
-type HistoryMessage struct {
-	Role    string `json:"role"`
-	WhoID   int64  `json:"who_id"`
-	WhoName string `json:"who_name"`
-	When    int64  `json:"when"`
-	Content string `json:"content"`
 }
 
-// SaveHistoryLimit sets the history limit for a project.
-func SaveHistoryLimit(project string, limit int) error {
+// DeleteProjectSearchDomains removes the web search domain limit of a project.
+func DeleteProjectSearchDomains(name string) error {
 	return db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketHistoryLimits))
-		return b.Put([]byte(project), []byte(strconv.Itoa(limit)))
+		b := tx.Bucket([]byte(bucketSearchDomains))
+		return b.Delete([]byte(name))
 	})
 }
 
-// LoadHistoryLimit retrieves the history limit for a project. Default is 0.
-func LoadHistoryLimit(project string) (int, error) {
-	var limit int
+// LoadProjectSearchDomains returns the domains web search of a project is
+// limited to. It returns ErrNotFound when search is not limited.
+func LoadProjectSearchDomains(name string) ([]string, error) {
+	var domains []string
 	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketHistoryLimits))
-		v := b.Get([]byte(project))
+		b := tx.Bucket([]byte(bucketSearchDomains))
+		v := b.Get([]byte(name))
 		if v == nil {
-			limit = 0
-			return nil
-		}
-		i, err := strconv.Atoi(string(v))
-		if err != nil {
-			return err
+			return ErrNotFound
 		}
-		limit = i
-		return nil
+		return json.Unmarshal(v, &domains)
 	})
-	return limit, err
+	return domains, err
 }
 
-// AddHistoryMessage stores a message for the given project.
-func AddHistoryMessage(project string, msg HistoryMessage) error {
-	return db.Update(func(tx *bolt.Tx) error {
-		hb := tx.Bucket([]byte(bucketHistory))
-		pb, err := hb.CreateBucketIfNotExists([]byte(project))
-		if err != nil {
-			return err
+// AddProjectRedaction appends a regex pattern to the redaction rules of a
+// project and returns the number of rules.
+func AddProjectRedaction(name, pattern string) (int, error) {
+	var n int
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketRedactions))
+		var patterns []string
+		if v := b.Get([]byte(name)); v != nil {
+			if err := json.Unmarshal(v, &patterns); err != nil {
+				return err
+			}
 		}
-		id, _ := pb.NextSequence()
-		key := make([]byte, 8)
-		binary.BigEndian.PutUint64(key, id)
-		data, err := json.Marshal(msg)
+		patterns = append(patterns, pattern)
+		n = len(patterns)
+		data, err := json.Marshal(patterns)
 		if err != nil {
 			return err
 		}
-		return pb.Put(key, data)
+		return b.Put([]byte(name), data)
 	})
+	return n, err
 }
 
-// LoadProjectHistory returns all stored history messages for a project.
-func LoadProjectHistory(project string) ([]HistoryMessage, error) {
-	var items []HistoryMessage
-	err := db.View(func(tx *bolt.Tx) error {
-		hb := tx.Bucket([]byte(bucketHistory))
-		pb := hb.Bucket([]byte(project))
-		if pb == nil {
-			return nil
-		}
-		return pb.ForEach(func(_, v []byte) error {
-			var m HistoryMessage
-			if err := json.Unmarshal(v, &m); err != nil {
-				return err
-			}
-			items = append(items, m)
-			return nil
-		})
+// DeleteProjectRedactions removes all redaction rules of a project.
+func DeleteProjectRedactions(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketRedactions))
+		return b.Delete([]byte(name))
 	})
-	return items, err
 }
 
-// CountProjectHistory returns the number of stored messages for a project.
-func CountProjectHistory(project string) (int, error) {
-	var count int
+// LoadProjectRedactions returns the redaction patterns of a project in the
+// order they were added. It returns ErrNotFound when none are set.
+func LoadProjectRedactions(name string) ([]string, error) {
+	var patterns []string
 	err := db.View(func(tx *bolt.Tx) error {
-		hb := tx.Bucket([]byte(bucketHistory))
-		pb := hb.Bucket([]byte(project))
-		if pb == nil {
-			count = 0
-			return nil
+		b := tx.Bucket([]byte(bucketRedactions))
+		v := b.Get([]byte(name))
+		if v == nil {
+			return ErrNotFound
 		}
-		stats := pb.Stats()
-		count = stats.KeyN
-		return nil
+		return json.Unmarshal(v, &patterns)
 	})
-	return count, err
+	return patterns, err
 }
 
-// TrimProjectHistory ensures the stored messages do not exceed the limit.
-func TrimProjectHistory(project string, limit int) error {
-	if limit <= 0 {
-		return nil
+// SaveProjectStops stores the stop sequences of a project.
+func SaveProjectStops(name string, stops []string) error {
+	data, err := json.Marshal(stops)
+	if err != nil {
+		return err
 	}
 	return db.Update(func(tx *bolt.Tx) error {
-		hb := tx.Bucket([]byte(bucketHistory))
-		pb := hb.Bucket([]byte(project))
-		if pb == nil {
-			return nil
-		}
-		stats := pb.Stats()
-		excess := stats.KeyN - limit
-		if excess <= 0 {
-			return nil
-		}
-		c := pb.Cursor()
-		for i := 0; i < excess; i++ {
-			k, _ := c.First()
-			if k == nil {
-				break
-			}
-			if err := c.Delete(); err != nil {
-				return err
-			}
+		b := tx.Bucket([]byte(bucketStops))
+		return b.Put([]byte(name), data)
+	})
+}
+
+// DeleteProjectStops removes the stop sequences of a project.
+func DeleteProjectStops(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketStops))
+		return b.Delete([]byte(name))
+	})
+}
+
+// LoadProjectStops returns the stop sequences of a project. It returns
+// ErrNotFound when none are set.
+func LoadProjectStops(name string) ([]string, error) {
+	var stops []string
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketStops))
+		v := b.Get([]byte(name))
+		if v == nil {
+			return ErrNotFound
 		}
-		return nil
+		return json.Unmarshal(v, &stops)
 	})
+	return stops, err
 }
 
-// ClearProjectHistory deletes all stored messages for a project and returns the number removed.
-func ClearProjectHistory(project string) (int, error) {
-	count, err := CountProjectHistory(project)
-	if err != nil {
-		return 0, err
-	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		hb := tx.Bucket([]byte(bucketHistory))
-		return hb.DeleteBucket([]byte(project))
+// SaveProjectTimezone stores the IANA timezone used for timestamps of a project.
+func SaveProjectTimezone(name, tz string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketTimezones))
+		return b.Put([]byte(name), []byte(tz))
+	})
+}
+
+// LoadProjectTimezone returns the timezone name of a project. Default is "UTC".
+func LoadProjectTimezone(name string) (string, error) {
+	return loadSetting(bucketTimezones, name, "UTC")
+}
+
+// SaveReplyTopic posts the replies to questions asked in a chat topic to
+// target, another topic of the same chat.
+func SaveReplyTopic(chatID int64, topicID, target int) error {
+	key := fmt.Sprintf("%d:%d", chatID, topicID)
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketReplyTopics))
+		return b.Put([]byte(key), []byte(strconv.Itoa(target)))
+	})
+}
+
+// DeleteReplyTopic answers questions in the chat topic they are asked in again.
+func DeleteReplyTopic(chatID int64, topicID int) error {
+	key := fmt.Sprintf("%d:%d", chatID, topicID)
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketReplyTopics))
+		return b.Delete([]byte(key))
+	})
+}
+
+// LoadReplyTopic returns the topic replies to questions asked in a chat topic
+// are posted to. It returns ErrNotFound when they go to the same topic.
+func LoadReplyTopic(chatID int64, topicID int) (int, error) {
+	return loadIntSetting(bucketReplyTopics, fmt.Sprintf("%d:%d", chatID, topicID))
+}
+
+// SaveProjectBusyMode stores how a project handles messages sent while a
+// request is still running in the same topic.
+func SaveProjectBusyMode(name, mode string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketBusyMode))
+		return b.Put([]byte(name), []byte(mode))
+	})
+}
+
+// LoadProjectBusyMode returns the busy mode of a project. Default is "queue".
+func LoadProjectBusyMode(name string) (string, error) {
+	return loadSetting(bucketBusyMode, name, "queue")
+}
+
+// SaveProjectEditRerun enables or disables re-running edited prompts for a project.
+func SaveProjectEditRerun(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketEditRerun))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectEditRerun returns whether edited prompts are re-run. Default is "off".
+func LoadProjectEditRerun(name string) (string, error) {
+	return loadSetting(bucketEditRerun, name, "off")
+}
+
+// SaveProjectTyping enables or disables the typing indicator for a project.
+func SaveProjectTyping(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketTyping))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectTyping returns whether the typing indicator is shown while
+// waiting for the model. Default is "on".
+func LoadProjectTyping(name string) (string, error) {
+	return loadSetting(bucketTyping, name, "on")
+}
+
+// SaveProjectVoiceReply enables or disables spoken replies for a project.
+func SaveProjectVoiceReply(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketVoiceReply))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectVoiceReply returns whether replies are also sent as voice. Default is "off".
+func LoadProjectVoiceReply(name string) (string, error) {
+	return loadSetting(bucketVoiceReply, name, "off")
+}
+
+// SaveProjectShowReasoning enables or disables the reasoning summary shown
+// before the answers of a project.
+func SaveProjectShowReasoning(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketShowReasoning))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectShowReasoning returns whether a reasoning summary is shown before
+// the answer. Default is "off".
+func LoadProjectShowReasoning(name string) (string, error) {
+	return loadSetting(bucketShowReasoning, name, "off")
+}
+
+// SaveProjectMentionOnly sets whether the project answers group messages only
+// when the bot is addressed.
+func SaveProjectMentionOnly(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMentionOnly))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectMentionOnly returns whether group messages are answered only when
+// the bot is mentioned or replied to. Default is "off".
+func LoadProjectMentionOnly(name string) (string, error) {
+	return loadSetting(bucketMentionOnly, name, "off")
+}
+
+// SaveProjectCitations enables or disables the sources footer listing the web
+// pages cited in the answers of a project.
+func SaveProjectCitations(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketCitations))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectCitations returns whether cited web pages are listed under the
+// answer. Default is "on".
+func LoadProjectCitations(name string) (string, error) {
+	return loadSetting(bucketCitations, name, "on")
+}
+
+// SaveProjectChaining enables or disables server-side conversation state,
+// where requests continue the previous response instead of replaying history.
+func SaveProjectChaining(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketChaining))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectChaining returns whether requests of a project are chained to
+// the previous response. Default is "off".
+func LoadProjectChaining(name string) (string, error) {
+	return loadSetting(bucketChaining, name, "off")
+}
+
+// SaveLastResponseID stores the id of the latest OpenAI response of a project.
+func SaveLastResponseID(name, id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketResponseIDs))
+		return b.Put([]byte(name), []byte(id))
+	})
+}
+
+// DeleteLastResponseID forgets the latest response of a project, so the next
+// chained request starts a new conversation.
+func DeleteLastResponseID(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketResponseIDs))
+		return b.Delete([]byte(name))
+	})
+}
+
+// LoadLastResponseID returns the id of the latest OpenAI response of a
+// project. It returns ErrNotFound when none is stored.
+func LoadLastResponseID(name string) (string, error) {
+	return loadSetting(bucketResponseIDs, name, "")
+}
+
+// SaveProjectChunkNumbers enables or disables the "(continued N/M)" prefix on
+// the continuation messages of long replies.
+func SaveProjectChunkNumbers(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketChunkNumbers))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectChunkNumbers returns whether continuation messages are numbered.
+// Default is "off".
+func LoadProjectChunkNumbers(name string) (string, error) {
+	return loadSetting(bucketChunkNumbers, name, "off")
+}
+
+// SaveProjectInstructionRole stores the role the project instruction is sent
+// under.
+func SaveProjectInstructionRole(name, role string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketInstrRoles))
+		return b.Put([]byte(name), []byte(role))
+	})
+}
+
+// LoadProjectInstructionRole returns the role of the project instruction.
+// Default is "system".
+func LoadProjectInstructionRole(name string) (string, error) {
+	return loadSetting(bucketInstrRoles, name, "system")
+}
+
+// SaveProjectInjectTime enables or disables sending the current date and time
+// with every request.
+func SaveProjectInjectTime(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketInjectTime))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectInjectTime returns whether the current date and time is sent with
+// every request. Default is "off".
+func LoadProjectInjectTime(name string) (string, error) {
+	return loadSetting(bucketInjectTime, name, "off")
+}
+
+// SaveProjectMirrorLanguage enables or disables asking the model to reply in
+// the language of the user's message.
+func SaveProjectMirrorLanguage(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMirrorLang))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectMirrorLanguage returns whether replies mirror the user's
+// language. Default is "off".
+func LoadProjectMirrorLanguage(name string) (string, error) {
+	return loadSetting(bucketMirrorLang, name, "off")
+}
+
+// SaveProjectImageDetail stores the detail level attached images are sent
+// with.
+func SaveProjectImageDetail(name, detail string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketImageDetail))
+		return b.Put([]byte(name), []byte(detail))
+	})
+}
+
+// LoadProjectImageDetail returns the image detail level for a project.
+// Default is "auto".
+func LoadProjectImageDetail(name string) (string, error) {
+	return loadSetting(bucketImageDetail, name, "auto")
+}
+
+// SaveProjectFallback sets the model retried when the project model is
+// unavailable.
+func SaveProjectFallback(name, model string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketFallbacks))
+		return b.Put([]byte(name), []byte(model))
+	})
+}
+
+// DeleteProjectFallback removes the fallback model of a project.
+func DeleteProjectFallback(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketFallbacks))
+		return b.Delete([]byte(name))
+	})
+}
+
+// SaveAssistantName sets the name assistant messages of a project are stored
+// under.
+func SaveAssistantName(name, display string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketAssistNames))
+		return b.Put([]byte(name), []byte(display))
+	})
+}
+
+// DeleteAssistantName removes the custom assistant name of a project.
+func DeleteAssistantName(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketAssistNames))
+		return b.Delete([]byte(name))
+	})
+}
+
+// LoadAssistantName returns the custom assistant name of a project, or an
+// empty string when none is set.
+func LoadAssistantName(name string) (string, error) {
+	return loadSetting(bucketAssistNames, name, "")
+}
+
+// SaveProjectStickers enables or disables answering stickers, which are sent
+// to the model as their emoji and sticker set name.
+func SaveProjectStickers(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketStickers))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectStickers returns whether stickers are answered. Defaults to "off".
+func LoadProjectStickers(name string) (string, error) {
+	return loadSetting(bucketStickers, name, "off")
+}
+
+// SaveProjectAnimations enables or disables answering GIFs, which are sent to
+// the model as their thumbnail image.
+func SaveProjectAnimations(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketAnimations))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectAnimations returns whether GIFs are answered. Defaults to "off".
+func LoadProjectAnimations(name string) (string, error) {
+	return loadSetting(bucketAnimations, name, "off")
+}
+
+// SaveProjectDescription stores the short description of a project.
+func SaveProjectDescription(name, description string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketDescriptions))
+		return b.Put([]byte(name), []byte(description))
+	})
+}
+
+// DeleteProjectDescription removes the description of a project.
+func DeleteProjectDescription(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketDescriptions))
+		return b.Delete([]byte(name))
+	})
+}
+
+// LoadProjectDescription returns the description of a project, or an empty
+// string when none is set.
+func LoadProjectDescription(name string) (string, error) {
+	return loadSetting(bucketDescriptions, name, "")
+}
+
+// SaveProjectJSONMode enables or disables JSON replies for a project.
+func SaveProjectJSONMode(name, setting string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketJSONModes))
+		return b.Put([]byte(name), []byte(setting))
+	})
+}
+
+// LoadProjectJSONMode returns whether replies of a project must be JSON.
+// Defaults to "off".
+func LoadProjectJSONMode(name string) (string, error) {
+	return loadSetting(bucketJSONModes, name, "off")
+}
+
+// SaveProjectJSONSchema stores the JSON schema replies of a project follow in
+// JSON mode.
+func SaveProjectJSONSchema(name, schema string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketJSONSchemas))
+		return b.Put([]byte(name), []byte(schema))
+	})
+}
+
+// DeleteProjectJSONSchema removes the JSON schema of a project.
+func DeleteProjectJSONSchema(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketJSONSchemas))
+		return b.Delete([]byte(name))
+	})
+}
+
+// LoadProjectJSONSchema returns the JSON schema of a project, or an empty
+// string when any JSON object is accepted.
+func LoadProjectJSONSchema(name string) (string, error) {
+	return loadSetting(bucketJSONSchemas, name, "")
+}
+
+// SaveProjectMetaFormat sets the template of the metadata prefix sent before
+// each history message of a project; "none" sends no prefix.
+func SaveProjectMetaFormat(name, format string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMetaFormats))
+		return b.Put([]byte(name), []byte(format))
+	})
+}
+
+// DeleteProjectMetaFormat restores the default metadata prefix of a project.
+func DeleteProjectMetaFormat(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMetaFormats))
+		return b.Delete([]byte(name))
+	})
+}
+
+// LoadProjectMetaFormat returns the metadata prefix template of a project, or
+// an empty string when the default is used.
+func LoadProjectMetaFormat(name string) (string, error) {
+	return loadSetting(bucketMetaFormats, name, "")
+}
+
+// LoadProjectFallback returns the fallback model of a project.
+// ErrNotFound is returned when none is set.
+func LoadProjectFallback(name string) (string, error) {
+	return loadSetting(bucketFallbacks, name, "")
+}
+
+// SaveProjectInstruction stores the custom instruction for the project.
+func SaveProjectInstruction(name, instr string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketRules))
+		return b.Put([]byte(name), []byte(instr))
+	})
+}
+
+// LoadProjectInstruction returns the stored instruction for the project. It
+// returns ErrNotFound when no instruction is set.
+func LoadProjectInstruction(name string) (string, error) {
+	return loadSetting(bucketRules, name, "")
+}
+
+// SaveProjectWelcome stores the welcome message of a project.
+func SaveProjectWelcome(name, text string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketWelcome))
+		return b.Put([]byte(name), []byte(text))
+	})
+}
+
+// SaveProjectFooter stores the footer appended to replies of a project. An
+// empty footer removes it.
+func SaveProjectFooter(name, footer string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketFooters))
+		if footer == "" {
+			return b.Delete([]byte(name))
+		}
+		return b.Put([]byte(name), []byte(footer))
+	})
+}
+
+// LoadProjectFooter returns the reply footer of a project, or an empty string
+// when none is set.
+func LoadProjectFooter(name string) (string, error) {
+	return loadSetting(bucketFooters, name, "")
+}
+
+// SaveProjectAPIKey stores the encrypted OpenAI API key of a project.
+func SaveProjectAPIKey(name, encrypted string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketAPIKeys))
+		return b.Put([]byte(name), []byte(encrypted))
+	})
+}
+
+// DeleteProjectAPIKey removes the API key of a project so the global key is
+// used again.
+func DeleteProjectAPIKey(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketAPIKeys))
+		return b.Delete([]byte(name))
+	})
+}
+
+// LoadProjectAPIKey returns the encrypted OpenAI API key of a project. It
+// returns ErrNotFound when none is set.
+func LoadProjectAPIKey(name string) (string, error) {
+	return loadSetting(bucketAPIKeys, name, "")
+}
+
+// LoadProjectWelcome returns the welcome message of a project. It returns
+// ErrNotFound when none is set.
+func LoadProjectWelcome(name string) (string, error) {
+	return loadSetting(bucketWelcome, name, "")
+}
+
+// MapTopic links a chat topic to a project.
+func MapTopic(chatID int64, topicID int, project string) error {
+	key := fmt.Sprintf("%d:%d", chatID, topicID)
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMapping))
+		return b.Put([]byte(key), []byte(project))
+	})
+}
+
+// UnmapTopic removes the association between a chat topic and a project,
+// and the reply redirect of the topic.
+func UnmapTopic(chatID int64, topicID int) error {
+	key := fmt.Sprintf("%d:%d", chatID, topicID)
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(bucketReplyTopics)).Delete([]byte(key)); err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte(bucketMapping))
+		return b.Delete([]byte(key))
+	})
+}
+
+// GetMappedProject returns the project associated with the chat topic. An
+// unmapped private chat yields the current project of its user, if any.
+func GetMappedProject(chatID int64, topicID int) (string, error) {
+	var proj []byte
+	key := fmt.Sprintf("%d:%d", chatID, topicID)
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMapping))
+		v := b.Get([]byte(key))
+		// private chats have the id of their user, so an unmapped one
+		// falls back to the user's current project
+		if v == nil && chatID > 0 {
+			v = tx.Bucket([]byte(bucketUserCurrent)).Get([]byte(strconv.FormatInt(chatID, 10)))
+			if v != nil && tx.Bucket([]byte(bucketProjects)).Get(v) == nil {
+				v = nil
+			}
+		}
+		if v == nil {
+			return ErrNotFound
+		}
+		proj = append([]byte(nil), v...)
+		return nil
+	})
+	return string(proj), err
+}
+
+// SetUserCurrentProject stores the project a user works with outside mapped
+// topics. An empty project clears the selection.
+func SetUserCurrentProject(userID int64, project string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketUserCurrent))
+		key := []byte(strconv.FormatInt(userID, 10))
+		if project == "" {
+			return b.Delete(key)
+		}
+		return b.Put(key, []byte(project))
+	})
+}
+
+// GetUserCurrentProject returns the current project of a user. It returns
+// ErrNotFound when none is chosen.
+func GetUserCurrentProject(userID int64) (string, error) {
+	return loadSetting(bucketUserCurrent, strconv.FormatInt(userID, 10), "")
+}
+
+// Mapping links a chat topic to a project.
+type Mapping struct {
+	ChatID     int64  `json:"chat_id"`
+	TopicID    int    `json:"topic_id"`
+	Project    string `json:"project"`
+	ReplyTopic *int   `json:"reply_topic,omitempty"` // topic replies are posted to, if redirected
+}
+
+// ListMappings returns all topic mappings. Keys that cannot be parsed as
+// "chatID:topicID" are skipped.
+func ListMappings() ([]Mapping, error) {
+	var items []Mapping
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMapping))
+		return b.ForEach(func(k, v []byte) error {
+			chat, topic, ok := strings.Cut(string(k), ":")
+			if !ok {
+				return nil
+			}
+			chatID, err := strconv.ParseInt(chat, 10, 64)
+			if err != nil {
+				return nil
+			}
+			topicID, err := strconv.Atoi(topic)
+			if err != nil {
+				return nil
+			}
+			items = append(items, Mapping{ChatID: chatID, TopicID: topicID, Project: string(v)})
+			return nil
+		})
+	})
+	return items, err
+}
+
+// ListProjectMappings returns the topic mappings of a project.
+func ListProjectMappings(project string) ([]Mapping, error) {
+	all, err := ListMappings()
+	if err != nil {
+		return nil, err
+	}
+	var items []Mapping
+	for _, m := range all {
+		if m.Project == project {
+			items = append(items, m)
+		}
+	}
+	return items, nil
+}
+
+// ListProjects returns all stored project names.
+func ListProjects() ([]string, error) {
+	var names []string
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketProjects))
+		return b.ForEach(func(k, _ []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// Roles recognized for stored history messages.
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleSystem    = "system"
+	RoleDeveloper = "developer"
+	RoleTool      = "tool"
+)
+
+// HistoryMessage represents a stored message in project history.
+type HistoryMessage struct {
+	Role      string `json:"role"`
+	WhoID     int64  `json:"who_id"`
+	WhoName   string `json:"who_name"`
+	When      int64  `json:"when"`
+	Content   string `json:"content"`
+	IsSummary bool   `json:"is_summary,omitempty"`
+	IsError   bool   `json:"is_error,omitempty"`
+	ChatID    int64  `json:"chat_id,omitempty"`    // Telegram chat of the prompt the message belongs to
+	MessageID int    `json:"message_id,omitempty"` // Telegram id of the prompt the message belongs to
+	FileID    string `json:"file_id,omitempty"`    // Telegram file of the image or audio the message stands for
+}
+
+// AuditEntry records one request to the model and its reply.
+type AuditEntry struct {
+	When    int64  `json:"when"`
+	UserID  int64  `json:"user_id"`
+	Model   string `json:"model"`
+	Prompt  string `json:"prompt"`
+	Reply   string `json:"reply"`
+	IsError bool   `json:"is_error,omitempty"`
+}
+
+// AppendAudit adds an entry to the audit log of a project. The audit log is
+// append-only and independent of the history limit.
+func AppendAudit(project string, e AuditEntry) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		ab := tx.Bucket([]byte(bucketAudit))
+		pb, err := ab.CreateBucketIfNotExists([]byte(project))
+		if err != nil {
+			return err
+		}
+		id, _ := pb.NextSequence()
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return pb.Put(historyKey(e.When, id), data)
+	})
+}
+
+// LoadAudit returns the audit log of a project, oldest entry first.
+func LoadAudit(project string) ([]AuditEntry, error) {
+	var items []AuditEntry
+	err := db.View(func(tx *bolt.Tx) error {
+		ab := tx.Bucket([]byte(bucketAudit))
+		pb := ab.Bucket([]byte(project))
+		if pb == nil {
+			return nil
+		}
+		return pb.ForEach(func(_, v []byte) error {
+			var e AuditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			items = append(items, e)
+			return nil
+		})
+	})
+	return items, err
+}
+
+// SaveFeedback records the rating ("up" or "down") a user gave to the reply
+// with the given Telegram message id. A later rating replaces the earlier one.
+func SaveFeedback(project string, messageID int, rating string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		fb := tx.Bucket([]byte(bucketFeedback))
+		pb, err := fb.CreateBucketIfNotExists([]byte(project))
+		if err != nil {
+			return err
+		}
+		return pb.Put([]byte(strconv.Itoa(messageID)), []byte(rating))
+	})
+}
+
+// LoadFeedback returns the rating of a reply. It returns ErrNotFound when the
+// reply was not rated.
+func LoadFeedback(project string, messageID int) (string, error) {
+	var rating string
+	err := db.View(func(tx *bolt.Tx) error {
+		fb := tx.Bucket([]byte(bucketFeedback))
+		pb := fb.Bucket([]byte(project))
+		if pb == nil {
+			return ErrNotFound
+		}
+		v := pb.Get([]byte(strconv.Itoa(messageID)))
+		if v == nil {
+			return ErrNotFound
+		}
+		rating = string(v)
+		return nil
+	})
+	return rating, err
+}
+
+// SaveHistoryLimit sets the history limit for a project.
+func SaveHistoryLimit(project string, limit int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketHistoryLimits))
+		return b.Put([]byte(project), []byte(strconv.Itoa(limit)))
+	})
+}
+
+// LoadHistoryLimit retrieves the history limit for a project. Default is 0.
+func LoadHistoryLimit(project string) (int, error) {
+	return loadIntSetting(bucketHistoryLimits, project)
+}
+
+// SaveHistoryMaxLen sets the maximum number of characters stored for each
+// history message of a project.
+func SaveHistoryMaxLen(project string, n int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketHistoryMaxLen))
+		return b.Put([]byte(project), []byte(strconv.Itoa(n)))
+	})
+}
+
+// DeleteHistoryMaxLen removes the history message size limit of a project.
+func DeleteHistoryMaxLen(project string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketHistoryMaxLen))
+		return b.Delete([]byte(project))
+	})
+}
+
+// LoadHistoryMaxLen returns the maximum number of characters stored for each
+// history message. ErrNotFound is returned when messages are stored in full.
+func LoadHistoryMaxLen(project string) (int, error) {
+	return loadIntSetting(bucketHistoryMaxLen, project)
+}
+
+// SaveImageResize sets the max dimension images of a project are downscaled
+// to before they are sent.
+func SaveImageResize(project string, maxDim int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketImageResize))
+		return b.Put([]byte(project), []byte(strconv.Itoa(maxDim)))
+	})
+}
+
+// DeleteImageResize turns image downscaling off for a project.
+func DeleteImageResize(project string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketImageResize))
+		return b.Delete([]byte(project))
+	})
+}
+
+// LoadImageResize returns the max image dimension of a project. ErrNotFound is
+// returned when images are sent at their original size.
+func LoadImageResize(project string) (int, error) {
+	return loadIntSetting(bucketImageResize, project)
+}
+
+// SaveProjectTimeout sets how many seconds a request of a project may take.
+func SaveProjectTimeout(project string, seconds int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketTimeouts))
+		return b.Put([]byte(project), []byte(strconv.Itoa(seconds)))
+	})
+}
+
+// DeleteProjectTimeout makes a project use the global request timeout again.
+func DeleteProjectTimeout(project string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketTimeouts))
+		return b.Delete([]byte(project))
+	})
+}
+
+// LoadProjectTimeout returns the request timeout of a project in seconds. It
+// returns ErrNotFound when the global timeout applies.
+func LoadProjectTimeout(project string) (int, error) {
+	return loadIntSetting(bucketTimeouts, project)
+}
+
+// SaveProjectBatchWindow sets for how many seconds consecutive messages of a
+// user are collected into one request.
+func SaveProjectBatchWindow(project string, seconds int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketBatchWindows))
+		return b.Put([]byte(project), []byte(strconv.Itoa(seconds)))
+	})
+}
+
+// DeleteProjectBatchWindow makes a project answer every message on its own.
+func DeleteProjectBatchWindow(project string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketBatchWindows))
+		return b.Delete([]byte(project))
+	})
+}
+
+// LoadProjectBatchWindow returns the batching window of a project in seconds.
+// It returns ErrNotFound when messages are not batched.
+func LoadProjectBatchWindow(project string) (int, error) {
+	return loadIntSetting(bucketBatchWindows, project)
+}
+
+// SaveProjectDedupWindow sets for how many seconds a user message identical to
+// the previous one of the same user is not stored in history again.
+func SaveProjectDedupWindow(project string, seconds int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketDedupWindows))
+		return b.Put([]byte(project), []byte(strconv.Itoa(seconds)))
+	})
+}
+
+// DeleteProjectDedupWindow makes a project store every user message.
+func DeleteProjectDedupWindow(project string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketDedupWindows))
+		return b.Delete([]byte(project))
+	})
+}
+
+// LoadProjectDedupWindow returns the duplicate message window of a project in
+// seconds. It returns ErrNotFound when duplicates are stored.
+func LoadProjectDedupWindow(project string) (int, error) {
+	return loadIntSetting(bucketDedupWindows, project)
+}
+
+// SaveProjectMonthlyBudget sets how many tokens a project may use per month.
+func SaveProjectMonthlyBudget(project string, tokens int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMonthBudgets))
+		return b.Put([]byte(project), []byte(strconv.Itoa(tokens)))
+	})
+}
+
+// DeleteProjectMonthlyBudget removes the monthly token budget of a project.
+func DeleteProjectMonthlyBudget(project string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMonthBudgets))
+		return b.Delete([]byte(project))
+	})
+}
+
+// LoadProjectMonthlyBudget returns the monthly token budget of a project. It
+// returns ErrNotFound when the project has no budget.
+func LoadProjectMonthlyBudget(project string) (int, error) {
+	return loadIntSetting(bucketMonthBudgets, project)
+}
+
+func monthUsageKey(project, month string) string {
+	return project + ":" + month
+}
+
+// AddMonthlyUsage adds tokens to the usage of a project in month, formatted
+// as YYYY-MM, and returns the new total.
+func AddMonthlyUsage(project, month string, tokens int) (int, error) {
+	var total int
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMonthUsage))
+		key := []byte(monthUsageKey(project, month))
+		if v := b.Get(key); v != nil {
+			n, err := strconv.Atoi(string(v))
+			if err != nil {
+				return err
+			}
+			total = n
+		}
+		total += tokens
+		return b.Put(key, []byte(strconv.Itoa(total)))
+	})
+	return total, err
+}
+
+// LoadMonthlyUsage returns the tokens a project used in month, formatted as
+// YYYY-MM. It returns ErrNotFound when nothing was recorded.
+func LoadMonthlyUsage(project, month string) (int, error) {
+	return loadIntSetting(bucketMonthUsage, monthUsageKey(project, month))
+}
+
+// SaveTokenBudget sets the history token budget for a project.
+func SaveTokenBudget(project string, budget int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketTokenBudgets))
+		return b.Put([]byte(project), []byte(strconv.Itoa(budget)))
+	})
+}
+
+// LoadTokenBudget retrieves the history token budget for a project. Default is 0 (unlimited).
+func LoadTokenBudget(project string) (int, error) {
+	return loadIntSetting(bucketTokenBudgets, project)
+}
+
+// historyKey builds the key of a history message from its timestamp and the
+// bucket sequence, so the byte ordered cursor always walks messages
+// chronologically and the sequence only breaks ties within the same second.
+// Keys written before this layout are 8-byte sequences and sort first.
+func historyKey(when int64, seq uint64) []byte {
+	if when < 0 {
+		when = 0
+	}
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(when))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// AddHistoryMessage stores a message for the given project.
+func AddHistoryMessage(project string, msg HistoryMessage) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(bucketHistory))
+		pb, err := hb.CreateBucketIfNotExists([]byte(project))
+		if err != nil {
+			return err
+		}
+		id, _ := pb.NextSequence()
+		key := historyKey(msg.When, id)
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return pb.Put(key, data)
+	})
+}
+
+// LoadProjectHistory returns all stored history messages for a project.
+func LoadProjectHistory(project string) ([]HistoryMessage, error) {
+	var items []HistoryMessage
+	err := db.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(bucketHistory))
+		pb := hb.Bucket([]byte(project))
+		if pb == nil {
+			return nil
+		}
+		return pb.ForEach(func(_, v []byte) error {
+			var m HistoryMessage
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			items = append(items, m)
+			return nil
+		})
+	})
+	return items, err
+}
+
+// CountProjectHistory returns the number of stored messages for a project.
+func CountProjectHistory(project string) (int, error) {
+	var count int
+	err := db.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(bucketHistory))
+		pb := hb.Bucket([]byte(project))
+		if pb == nil {
+			count = 0
+			return nil
+		}
+		stats := pb.Stats()
+		count = stats.KeyN
+		return nil
+	})
+	return count, err
+}
+
+// TrimProjectHistory ensures the stored messages do not exceed the limit.
+func TrimProjectHistory(project string, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(bucketHistory))
+		pb := hb.Bucket([]byte(project))
+		if pb == nil {
+			return nil
+		}
+		stats := pb.Stats()
+		excess := stats.KeyN - limit
+		if excess <= 0 {
+			return nil
+		}
+		c := pb.Cursor()
+		for i := 0; i < excess; i++ {
+			k, _ := c.First()
+			if k == nil {
+				break
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveLastHistoryMessages deletes the n most recent messages of a project
+// in one transaction, walking the keys with a reverse cursor. n is clamped to
+// the number of stored messages and the count actually removed is returned.
+// Removing messages also restarts a chained conversation.
+func RemoveLastHistoryMessages(project string, n int) (int, error) {
+	var removed int
+	err := db.Update(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(bucketHistory))
+		pb := hb.Bucket([]byte(project))
+		if pb == nil {
+			return nil
+		}
+		c := pb.Cursor()
+		for removed < n {
+			k, _ := c.Last()
+			if k == nil {
+				break
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+		if removed > 0 {
+			return restartChain(tx, project)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// LastUserHistoryMessage returns the most recent user message of a project,
+// or ErrNotFound when there is none.
+func LastUserHistoryMessage(project string) (HistoryMessage, error) {
+	var last HistoryMessage
+	found := false
+	err := db.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(bucketHistory))
+		pb := hb.Bucket([]byte(project))
+		if pb == nil {
+			return nil
+		}
+		c := pb.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var m HistoryMessage
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			if m.Role == RoleUser {
+				last, found = m, true
+				return nil
+			}
+		}
+		return nil
+	})
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return last, err
+}
+
+// UndoLastExchange deletes the most recent exchange of a project: the trailing
+// assistant and tool messages followed by the user messages that prompted
+// them. A dangling user message without an answer is removed on its own. A
+// history summary is never removed. It returns how many messages were deleted
+// and restarts a chained conversation when any were.
+func UndoLastExchange(project string) (int, error) {
+	var removed int
+	err := db.Update(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(bucketHistory))
+		pb := hb.Bucket([]byte(project))
+		if pb == nil {
+			return nil
+		}
+		c := pb.Cursor()
+		userTurn := false
+		for {
+			k, v := c.Last()
+			if k == nil {
+				break
+			}
+			var m HistoryMessage
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			if m.IsSummary || (userTurn && m.Role != RoleUser) {
+				break
+			}
+			if m.Role == RoleUser {
+				userTurn = true
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+		if removed > 0 {
+			return restartChain(tx, project)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// RemoveHistoryByMessageID deletes all messages of a project that belong to the
+// Telegram prompt with the given id in chatID and returns how many were
+// removed. Message ids are only unique within a chat, and a project can be
+// mapped to several chats. Removing messages also restarts a chained
+// conversation.
+func RemoveHistoryByMessageID(project string, chatID int64, messageID int) (int, error) {
+	var removed int
+	err := db.Update(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(bucketHistory))
+		pb := hb.Bucket([]byte(project))
+		if pb == nil {
+			return nil
+		}
+		var keys [][]byte
+		if err := pb.ForEach(func(k, v []byte) error {
+			var m HistoryMessage
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			if m.ChatID == chatID && m.MessageID == messageID {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := pb.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		if removed > 0 {
+			return restartChain(tx, project)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// ReplaceOldestHistory removes the n oldest messages of a project and stores
+// msg in their place, so it keeps the position of the removed messages.
+func ReplaceOldestHistory(project string, n int, msg HistoryMessage) error {
+	if n <= 0 {
+		return nil
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(bucketHistory))
+		pb := hb.Bucket([]byte(project))
+		if pb == nil {
+			return errors.New("no history stored")
+		}
+		c := pb.Cursor()
+		first, _ := c.First()
+		if first == nil {
+			return errors.New("no history stored")
+		}
+		first = append([]byte(nil), first...)
+		for i := 0; i < n; i++ {
+			k, _ := c.First()
+			if k == nil {
+				break
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return pb.Put(first, data)
+	})
+}
+
+// restartChain forgets the last response id of project, so a chained
+// conversation does not keep turns removed from its history on the server.
+func restartChain(tx *bolt.Tx, project string) error {
+	return tx.Bucket([]byte(bucketResponseIDs)).Delete([]byte(project))
+}
+
+// ClearProjectHistory deletes all stored messages for a project, and the id of
+// its last response, and returns the number of messages removed.
+func ClearProjectHistory(project string) (int, error) {
+	count, err := CountProjectHistory(project)
+	if err != nil {
+		return 0, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := restartChain(tx, project); err != nil {
+			return err
+		}
+		hb := tx.Bucket([]byte(bucketHistory))
+		return hb.DeleteBucket([]byte(project))
+	})
+	return count, err
+}
+
+// MoveProjectHistory copies all history messages of src into dst in a single
+// transaction. Messages keep their timestamps and therefore merge into dst in
+// chronological order. When replace is set the existing dst history is dropped
+// first, and when clearSrc is set the src history is removed afterwards. The
+// number of moved messages is returned. The chained conversations of dst, and
+// of src when it is cleared, are restarted.
+func MoveProjectHistory(src, dst string, replace, clearSrc bool) (int, error) {
+	if src == dst {
+		return 0, errors.New("source and destination are the same")
+	}
+	var moved int
+	err := db.Update(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(bucketHistory))
+		sb := hb.Bucket([]byte(src))
+		var items [][]byte
+		if sb != nil {
+			if err := sb.ForEach(func(_, v []byte) error {
+				items = append(items, append([]byte(nil), v...))
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		if replace && hb.Bucket([]byte(dst)) != nil {
+			if err := hb.DeleteBucket([]byte(dst)); err != nil {
+				return err
+			}
+		}
+		pb, err := hb.CreateBucketIfNotExists([]byte(dst))
+		if err != nil {
+			return err
+		}
+		for _, v := range items {
+			var m HistoryMessage
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			id, _ := pb.NextSequence()
+			if err := pb.Put(historyKey(m.When, id), v); err != nil {
+				return err
+			}
+		}
+		if clearSrc && sb != nil {
+			if err := hb.DeleteBucket([]byte(src)); err != nil {
+				return err
+			}
+		}
+		moved = len(items)
+		if err := restartChain(tx, dst); err != nil {
+			return err
+		}
+		if clearSrc {
+			return restartChain(tx, src)
+		}
+		return nil
+	})
+	return moved, err
+}
+
+// Schedule is a recurring prompt sent to the project mapped to a chat topic.
+type Schedule struct {
+	ID       uint64 `json:"id"`
+	ChatID   int64  `json:"chat_id"`
+	TopicID  int    `json:"topic_id"`
+	Cron     string `json:"cron"`
+	Prompt   string `json:"prompt"`
+	UserID   int64  `json:"user_id"`
+	UserName string `json:"user_name"`
+}
+
+// AddSchedule stores a new schedule and returns its assigned id.
+func AddSchedule(s Schedule) (uint64, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketSchedules))
+		id, _ := b.NextSequence()
+		s.ID = id
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, id)
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+	return s.ID, err
+}
+
+// ListSchedules returns all stored schedules ordered by id.
+func ListSchedules() ([]Schedule, error) {
+	var items []Schedule
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketSchedules))
+		return b.ForEach(func(_, v []byte) error {
+			var s Schedule
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			items = append(items, s)
+			return nil
+		})
+	})
+	return items, err
+}
+
+// DeleteSchedule removes the schedule with the given id.
+func DeleteSchedule(id uint64) error {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketSchedules))
+		if b.Get(key) == nil {
+			return errors.New("schedule not found")
+		}
+		return b.Delete(key)
+	})
+}
+
+// SaveImageCacheTTL sets for how many minutes image answers are cached for a
+// project. Turning the cache off drops the answers cached so far.
+func SaveImageCacheTTL(project string, minutes int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketImageCacheTTL))
+		if err := b.Put([]byte(project), []byte(strconv.Itoa(minutes))); err != nil {
+			return err
+		}
+		if minutes > 0 {
+			return nil
+		}
+		err := tx.Bucket([]byte(bucketImageCache)).DeleteBucket([]byte(project))
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// LoadImageCacheTTL returns the image answer cache ttl in minutes. Default is 0 (off).
+func LoadImageCacheTTL(project string) (int, error) {
+	return loadIntSetting(bucketImageCacheTTL, project)
+}
+
+type cachedAnswer struct {
+	Reply   string `json:"reply"`
+	Created int64  `json:"created"`
+}
+
+// maxCachedAnswers is the number of image answers kept per project.
+const maxCachedAnswers = 200
+
+// SaveCachedAnswer stores a reply for the given cache key of a project. Answers
+// older than the project's cache TTL are dropped on the way, and so are the
+// oldest ones once the project has more than maxCachedAnswers.
+func SaveCachedAnswer(project, key, reply string) error {
+	now := time.Now()
+	data, err := json.Marshal(cachedAnswer{Reply: reply, Created: now.Unix()})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		cb := tx.Bucket([]byte(bucketImageCache))
+		pb, err := cb.CreateBucketIfNotExists([]byte(project))
+		if err != nil {
+			return err
+		}
+		if err := pb.Put([]byte(key), data); err != nil {
+			return err
+		}
+		minutes, _ := strconv.Atoi(string(tx.Bucket([]byte(bucketImageCacheTTL)).Get([]byte(project))))
+		return pruneCachedAnswers(pb, now.Add(-time.Duration(minutes)*time.Minute).Unix())
+	})
+}
+
+// pruneCachedAnswers deletes the answers of b created before cutoff and then
+// the oldest ones over maxCachedAnswers.
+func pruneCachedAnswers(b *bolt.Bucket, cutoff int64) error {
+	type entry struct {
+		key     []byte
+		created int64
+	}
+	var kept, expired []entry
+	if err := b.ForEach(func(k, v []byte) error {
+		var ans cachedAnswer
+		if err := json.Unmarshal(v, &ans); err != nil {
+			return err
+		}
+		e := entry{key: append([]byte(nil), k...), created: ans.Created}
+		if ans.Created < cutoff {
+			expired = append(expired, e)
+		} else {
+			kept = append(kept, e)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(kept) > maxCachedAnswers {
+		sort.Slice(kept, func(i, j int) bool { return kept[i].created < kept[j].created })
+		expired = append(expired, kept[:len(kept)-maxCachedAnswers]...)
+	}
+	for _, e := range expired {
+		if err := b.Delete(e.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadCachedAnswer returns the reply cached under key if it is younger than ttl.
+func LoadCachedAnswer(project, key string, ttl time.Duration) (string, bool, error) {
+	var ans cachedAnswer
+	var found bool
+	err := db.View(func(tx *bolt.Tx) error {
+		cb := tx.Bucket([]byte(bucketImageCache))
+		pb := cb.Bucket([]byte(project))
+		if pb == nil {
+			return nil
+		}
+		v := pb.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &ans)
+	})
+	if err != nil || !found {
+		return "", false, err
+	}
+	if time.Since(time.Unix(ans.Created, 0)) > ttl {
+		return "", false, nil
+	}
+	return ans.Reply, true, nil
+}
+
+// SetupState is the progress of a user's /setup wizard in a chat topic.
+type SetupState struct {
+	Step    string `json:"step"`
+	Project string `json:"project,omitempty"`
+	ChatID  int64  `json:"chat_id"`
+	TopicID int    `json:"topic_id"`
+	UserID  int64  `json:"user_id"`
+}
+
+// setupKey returns the key of the wizard a user runs in a chat topic.
+func setupKey(chatID int64, topicID int, userID int64) []byte {
+	return []byte(fmt.Sprintf("%d:%d:%d", chatID, topicID, userID))
+}
+
+// SaveSetupState stores the setup wizard progress of st.UserID in the chat
+// topic of st.
+func SaveSetupState(st SetupState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketSetup))
+		return b.Put(setupKey(st.ChatID, st.TopicID, st.UserID), data)
+	})
+}
+
+// ListSetupStates returns the setup wizard progress of all users.
+func ListSetupStates() ([]SetupState, error) {
+	var items []SetupState
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketSetup))
+		return b.ForEach(func(k, v []byte) error {
+			var st SetupState
+			if err := json.Unmarshal(v, &st); err != nil {
+				return err
+			}
+			items = append(items, st)
+			return nil
+		})
+	})
+	return items, err
+}
+
+// DeleteSetupState removes the setup wizard progress of a user in a chat topic.
+func DeleteSetupState(chatID int64, topicID int, userID int64) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketSetup))
+		return b.Delete(setupKey(chatID, topicID, userID))
+	})
+}
+
+// LastReply links the latest prompt in a chat topic to the bot reply it got.
+// ChunkIDs lists the further messages of a reply split into chunks.
+type LastReply struct {
+	MessageID int   `json:"message_id"`
+	ReplyID   int   `json:"reply_id"`
+	ChunkIDs  []int `json:"chunk_ids,omitempty"`
+}
+
+// SaveLastReply stores the latest prompt and reply ids of a chat topic.
+func SaveLastReply(chatID int64, topicID int, r LastReply) error {
+	key := fmt.Sprintf("%d:%d", chatID, topicID)
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketLastReplies))
+		return b.Put([]byte(key), data)
+	})
+}
+
+// LoadLastReply returns the latest prompt and reply ids of a chat topic and
+// whether any were stored.
+func LoadLastReply(chatID int64, topicID int) (LastReply, bool, error) {
+	var r LastReply
+	var found bool
+	key := fmt.Sprintf("%d:%d", chatID, topicID)
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketLastReplies))
+		v := b.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &r)
+	})
+	return r, found, err
+}
+
+// Stats summarizes the stored data of all projects.
+type Stats struct {
+	Projects        int
+	MappedTopics    int
+	HistoryMessages int
+	DBSize          int64
+}
+
+// Snapshot writes a consistent copy of the whole database to w. Writes by
+// other goroutines may continue while it runs.
+func Snapshot(w io.Writer) error {
+	return db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// Path returns the location of the database file.
+func Path() string {
+	return db.Path()
+}
+
+// FileSize returns the size of the database file in bytes.
+func FileSize() (int64, error) {
+	info, err := os.Stat(db.Path())
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Compact rewrites the database into dstPath without the free pages left by
+// deletes and swaps it in place of the current file. The database is closed
+// while it is copied, so calls made meanwhile wait until it is reopened. On
+// failure the original file is reopened.
+func Compact(dstPath string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.bolt == nil {
+		return bolt.ErrDatabaseNotOpen
+	}
+	path := db.bolt.Path()
+	if err := db.bolt.Close(); err != nil {
+		return err
+	}
+	copyErr := compactFile(path, dstPath)
+	if copyErr == nil {
+		copyErr = os.Rename(dstPath, path)
+	}
+	if copyErr != nil {
+		os.Remove(dstPath)
+	}
+	reopened, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		db.bolt = nil
+		return errors.Join(copyErr, fmt.Errorf("reopen database: %w", err))
+	}
+	db.bolt = reopened
+	return copyErr
+}
+
+// compactFile copies every bucket of the database at src into a new database
+// at dst.
+func compactFile(src, dst string) error {
+	from, err := bolt.Open(src, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	os.Remove(dst)
+	to, err := bolt.Open(dst, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = from.View(func(stx *bolt.Tx) error {
+		return to.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, sb *bolt.Bucket) error {
+				b, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(sb, b)
+			})
+		})
+	})
+	if cerr := to.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// copyBucket copies the keys, nested buckets and sequence of src into dst.
+func copyBucket(src, dst *bolt.Bucket) error {
+	// keys arrive in order, so pages can be filled completely
+	dst.FillPercent = 1.0
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		child, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(src.Bucket(k), child)
+	})
+}
+
+// GlobalStats counts projects, mapped topics and stored history messages and
+// reports the size of the database file.
+func GlobalStats() (Stats, error) {
+	var st Stats
+	err := db.View(func(tx *bolt.Tx) error {
+		st.Projects = tx.Bucket([]byte(bucketProjects)).Stats().KeyN
+		st.MappedTopics = tx.Bucket([]byte(bucketMapping)).Stats().KeyN
+		hb := tx.Bucket([]byte(bucketHistory))
+		return hb.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			if pb := hb.Bucket(k); pb != nil {
+				st.HistoryMessages += pb.Stats().KeyN
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return st, err
+	}
+	st.DBSize, err = FileSize()
+	return st, err
+}
+
+// projectSettingBuckets hold one configuration value per project, keyed by
+// the project name. They make up a project export; history, caches and other
+// runtime state are left out, and API keys are exported separately.
+var projectSettingBuckets = []string{
+	bucketModels, bucketRules, bucketHistoryLimits, bucketWebSearch,
+	bucketReasoning, bucketTranscribe, bucketTokenBudgets, bucketAutoSummarize,
+	bucketPreprocess, bucketSummaryModels, bucketBusyMode, bucketImageCacheTTL,
+	bucketEditRerun, bucketTyping, bucketVoiceReply, bucketWelcome,
+	bucketTimezones,
+	bucketShowReasoning, bucketMentionOnly, bucketFallbacks, bucketHistoryMaxLen,
+	bucketCitations, bucketSearchDomains, bucketChunkNumbers, bucketImageDetail,
+	bucketImageResize, bucketInstrRoles, bucketInjectTime, bucketMirrorLang,
+	bucketAssistNames, bucketFooters, bucketTimeouts, bucketChaining,
+	bucketBatchWindows, bucketMonthBudgets, bucketMetaFormats, bucketStickers,
+	bucketAnimations, bucketModelRoutes, bucketRedactions, bucketDescriptions,
+	bucketStops, bucketJSONModes, bucketJSONSchemas, bucketDedupWindows,
+}
+
+// ProjectExport is the portable configuration of a project. Settings are keyed
+// by the name of the bucket they are stored in. APIKey is the encrypted key and
+// is only filled when requested.
+type ProjectExport struct {
+	Name     string            `json:"name"`
+	Settings map[string]string `json:"settings,omitempty"`
+	APIKey   string            `json:"api_key,omitempty"`
+}
+
+// ConfigExport is a snapshot of the whole bot configuration: all projects with
+// their settings and the topic mappings.
+type ConfigExport struct {
+	SchemaVersion int             `json:"schema_version"`
+	Projects      []ProjectExport `json:"projects"`
+	Mappings      []Mapping       `json:"mappings"`
+}
+
+// ExportProject returns the configuration of a project. It returns ErrNotFound
+// for an unknown project.
+func ExportProject(name string, withKey bool) (ProjectExport, error) {
+	var p ProjectExport
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		p, err = exportProject(tx, name, withKey)
+		return err
+	})
+	return p, err
+}
+
+func exportProject(tx *bolt.Tx, name string, withKey bool) (ProjectExport, error) {
+	if tx.Bucket([]byte(bucketProjects)).Get([]byte(name)) == nil {
+		return ProjectExport{}, ErrNotFound
+	}
+	p := ProjectExport{Name: name, Settings: map[string]string{}}
+	for _, bucket := range projectSettingBuckets {
+		if v := tx.Bucket([]byte(bucket)).Get([]byte(name)); v != nil {
+			p.Settings[bucket] = string(v)
+		}
+	}
+	if withKey {
+		p.APIKey = string(tx.Bucket([]byte(bucketAPIKeys)).Get([]byte(name)))
+	}
+	return p, nil
+}
+
+// ExportConfig returns a consistent snapshot of all projects and mappings.
+// Encrypted API keys are only included when withKeys is set; they can only be
+// read by a bot sharing the same master key.
+func ExportConfig(withKeys bool) (ConfigExport, error) {
+	cfg := ConfigExport{SchemaVersion: len(migrations), Projects: []ProjectExport{}, Mappings: []Mapping{}}
+	err := db.View(func(tx *bolt.Tx) error {
+		var names []string
+		if err := tx.Bucket([]byte(bucketProjects)).ForEach(func(k, _ []byte) error {
+			names = append(names, string(k))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, name := range names {
+			p, err := exportProject(tx, name, withKeys)
+			if err != nil {
+				return err
+			}
+			cfg.Projects = append(cfg.Projects, p)
+		}
+		return tx.Bucket([]byte(bucketMapping)).ForEach(func(k, v []byte) error {
+			chat, topic, ok := strings.Cut(string(k), ":")
+			if !ok {
+				return nil
+			}
+			chatID, err := strconv.ParseInt(chat, 10, 64)
+			if err != nil {
+				return nil
+			}
+			topicID, err := strconv.Atoi(topic)
+			if err != nil {
+				return nil
+			}
+			m := Mapping{ChatID: chatID, TopicID: topicID, Project: string(v)}
+			if target, err := strconv.Atoi(string(tx.Bucket([]byte(bucketReplyTopics)).Get(k))); err == nil {
+				m.ReplyTopic = &target
+			}
+			cfg.Mappings = append(cfg.Mappings, m)
+			return nil
+		})
+	})
+	return cfg, err
+}
+
+// ImportConfig applies an exported configuration in a single transaction. In
+// merge mode the imported projects and mappings are added to the existing
+// ones, overwriting settings they both have. In replace mode all projects,
+// their settings, API keys and mappings are dropped first; history is kept.
+// Nothing is changed when the document is invalid.
+func ImportConfig(cfg ConfigExport, replace bool) error {
+	if cfg.SchemaVersion > len(migrations) {
+		return fmt.Errorf("export schema version %d is newer than supported version %d", cfg.SchemaVersion, len(migrations))
+	}
+	known := map[string]bool{}
+	for _, bucket := range projectSettingBuckets {
+		known[bucket] = true
+	}
+	// exports before schema version 3 kept reply topics per project
+	legacyReplyTopics := map[string]string{}
+	names := map[string]bool{}
+	for _, p := range cfg.Projects {
+		if p.Name == "" {
+			return errors.New("project without a name")
+		}
+		names[p.Name] = true
+		for bucket, v := range p.Settings {
+			if bucket == bucketReplyTopics && cfg.SchemaVersion < 3 {
+				legacyReplyTopics[p.Name] = v
+				continue
+			}
+			if version, ok := droppedSettings[bucket]; ok && cfg.SchemaVersion < version {
+				continue
+			}
+			if !known[bucket] {
+				return fmt.Errorf("project %q: unknown setting %q", p.Name, bucket)
+			}
+		}
+	}
+	for _, m := range cfg.Mappings {
+		if m.Project == "" {
+			return fmt.Errorf("mapping %d:%d without a project", m.ChatID, m.TopicID)
+		}
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		pb := tx.Bucket([]byte(bucketProjects))
+		mb := tx.Bucket([]byte(bucketMapping))
+		rb := tx.Bucket([]byte(bucketReplyTopics))
+		if replace {
+			var old [][]byte
+			if err := pb.ForEach(func(k, _ []byte) error {
+				old = append(old, append([]byte(nil), k...))
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, name := range old {
+				for _, bucket := range append([]string{bucketProjects, bucketAPIKeys}, projectSettingBuckets...) {
+					if err := tx.Bucket([]byte(bucket)).Delete(name); err != nil {
+						return err
+					}
+				}
+			}
+			if err := tx.DeleteBucket([]byte(bucketMapping)); err != nil {
+				return err
+			}
+			if err := tx.DeleteBucket([]byte(bucketReplyTopics)); err != nil {
+				return err
+			}
+			var err error
+			if mb, err = tx.CreateBucket([]byte(bucketMapping)); err != nil {
+				return err
+			}
+			if rb, err = tx.CreateBucket([]byte(bucketReplyTopics)); err != nil {
+				return err
+			}
+		}
+		for _, p := range cfg.Projects {
+			if err := pb.Put([]byte(p.Name), []byte{}); err != nil {
+				return err
+			}
+			for bucket, v := range p.Settings {
+				if !known[bucket] {
+					continue
+				}
+				if err := tx.Bucket([]byte(bucket)).Put([]byte(p.Name), []byte(v)); err != nil {
+					return err
+				}
+			}
+			if p.APIKey != "" {
+				if err := tx.Bucket([]byte(bucketAPIKeys)).Put([]byte(p.Name), []byte(p.APIKey)); err != nil {
+					return err
+				}
+			}
+		}
+		for _, m := range cfg.Mappings {
+			// a mapping may only point at a project that exists afterwards
+			if !names[m.Project] && pb.Get([]byte(m.Project)) == nil {
+				return fmt.Errorf("mapping %d:%d refers to unknown project %q", m.ChatID, m.TopicID, m.Project)
+			}
+			key := fmt.Sprintf("%d:%d", m.ChatID, m.TopicID)
+			if err := mb.Put([]byte(key), []byte(m.Project)); err != nil {
+				return err
+			}
+			target, legacy := legacyReplyTopics[m.Project]
+			if m.ReplyTopic != nil {
+				target, legacy = strconv.Itoa(*m.ReplyTopic), true
+			}
+			if legacy {
+				if err := rb.Put([]byte(key), []byte(target)); err != nil {
+					return err
+				}
+			} else if err := rb.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
-	return count, err
 }
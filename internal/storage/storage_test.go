@@ -0,0 +1,1199 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func initTestDB(t *testing.T) {
+	dir := t.TempDir()
+	if err := Init(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatalf("storage init: %v", err)
+	}
+	t.Cleanup(func() { Close() })
+}
+
+func TestMoveProjectHistory(t *testing.T) {
+	t.Run("append", func(t *testing.T) {
+		initTestDB(t)
+		AddHistoryMessage("dst", HistoryMessage{When: 1, Content: "d1"})
+		AddHistoryMessage("src", HistoryMessage{When: 2, Content: "s1"})
+		AddHistoryMessage("src", HistoryMessage{When: 3, Content: "s2"})
+
+		moved, err := MoveProjectHistory("src", "dst", false, false)
+		if err != nil || moved != 2 {
+			t.Fatalf("moved = %d, err = %v", moved, err)
+		}
+		hist, _ := LoadProjectHistory("dst")
+		want := []string{"d1", "s1", "s2"}
+		if len(hist) != len(want) {
+			t.Fatalf("history = %v", hist)
+		}
+		for i, h := range hist {
+			if h.Content != want[i] || h.When != int64(i+1) {
+				t.Fatalf("history[%d] = %+v", i, h)
+			}
+		}
+		if n, _ := CountProjectHistory("src"); n != 2 {
+			t.Fatalf("src count = %d, want 2", n)
+		}
+	})
+
+	t.Run("replace and clear", func(t *testing.T) {
+		initTestDB(t)
+		AddHistoryMessage("dst", HistoryMessage{When: 1, Content: "d1"})
+		AddHistoryMessage("src", HistoryMessage{When: 2, Content: "s1"})
+
+		if _, err := MoveProjectHistory("src", "dst", true, true); err != nil {
+			t.Fatalf("move: %v", err)
+		}
+		hist, _ := LoadProjectHistory("dst")
+		if len(hist) != 1 || hist[0].Content != "s1" {
+			t.Fatalf("history = %v", hist)
+		}
+		if n, _ := CountProjectHistory("src"); n != 0 {
+			t.Fatalf("src count = %d, want 0", n)
+		}
+	})
+
+	t.Run("same project", func(t *testing.T) {
+		initTestDB(t)
+		if _, err := MoveProjectHistory("a", "a", false, false); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestSchedules(t *testing.T) {
+	initTestDB(t)
+	id1, err := AddSchedule(Schedule{ChatID: 1, TopicID: 2, Cron: "0 8 * * *", Prompt: "plan"})
+	if err != nil {
+		t.Fatalf("add schedule: %v", err)
+	}
+	id2, _ := AddSchedule(Schedule{ChatID: 1, Cron: "* * * * *", Prompt: "ping"})
+	items, err := ListSchedules()
+	if err != nil || len(items) != 2 {
+		t.Fatalf("list schedules = %v, %v", items, err)
+	}
+	if items[0].ID != id1 || items[0].Prompt != "plan" || items[0].TopicID != 2 || items[1].ID != id2 {
+		t.Fatalf("unexpected schedules: %+v", items)
+	}
+	if err := DeleteSchedule(id1); err != nil {
+		t.Fatalf("delete schedule: %v", err)
+	}
+	if err := DeleteSchedule(id1); err == nil {
+		t.Fatal("expected error deleting missing schedule")
+	}
+	items, _ = ListSchedules()
+	if len(items) != 1 || items[0].ID != id2 {
+		t.Fatalf("unexpected schedules after delete: %+v", items)
+	}
+}
+
+func TestHistoryChronologicalOrder(t *testing.T) {
+	initTestDB(t)
+	assertOrder := func(step string, want ...string) {
+		t.Helper()
+		hist, err := LoadProjectHistory("p")
+		if err != nil {
+			t.Fatalf("%s: load history: %v", step, err)
+		}
+		if len(hist) != len(want) {
+			t.Fatalf("%s: history = %+v, want %v", step, hist, want)
+		}
+		for i, h := range hist {
+			if h.Content != want[i] {
+				t.Fatalf("%s: history[%d] = %q, want %q", step, i, h.Content, want[i])
+			}
+			if i > 0 && h.When < hist[i-1].When {
+				t.Fatalf("%s: history not chronological: %+v", step, hist)
+			}
+		}
+	}
+
+	AddHistoryMessage("p", HistoryMessage{When: 100, Content: "a"})
+	AddHistoryMessage("p", HistoryMessage{When: 100, Content: "b"})
+	AddHistoryMessage("p", HistoryMessage{When: 300, Content: "c"})
+	assertOrder("initial", "a", "b", "c")
+
+	AddHistoryMessage("p", HistoryMessage{When: 200, Content: "late"})
+	assertOrder("late add", "a", "b", "late", "c")
+
+	if err := TrimProjectHistory("p", 2); err != nil {
+		t.Fatalf("trim: %v", err)
+	}
+	assertOrder("trim", "late", "c")
+
+	if _, err := ClearProjectHistory("p"); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	AddHistoryMessage("p", HistoryMessage{When: 500, Content: "d"})
+	AddHistoryMessage("p", HistoryMessage{When: 400, Content: "e"})
+	AddHistoryMessage("p", HistoryMessage{When: 500, Content: "f"})
+	assertOrder("re-add", "e", "d", "f")
+
+	AddHistoryMessage("src", HistoryMessage{When: 450, Content: "moved"})
+	if _, err := MoveProjectHistory("src", "p", false, true); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	assertOrder("merge", "e", "moved", "d", "f")
+
+	if _, err := RemoveLastHistoryMessages("p", 1); err != nil {
+		t.Fatalf("delete last: %v", err)
+	}
+	assertOrder("delete last", "e", "moved", "d")
+}
+
+func TestRemoveHistoryByMessageID(t *testing.T) {
+	initTestDB(t)
+	// the same message id in another chat mapped to the project is kept
+	for i, m := range []HistoryMessage{
+		{Role: RoleUser, Content: "a", ChatID: 1, MessageID: 10},
+		{Role: RoleAssistant, Content: "a reply", ChatID: 1, MessageID: 10},
+		{Role: RoleUser, Content: "b", ChatID: 2, MessageID: 10},
+		{Role: RoleAssistant, Content: "b reply", ChatID: 2, MessageID: 10},
+	} {
+		m.When = int64(i + 1)
+		AddHistoryMessage("p", m)
+	}
+	if err := SaveLastResponseID("p", "resp_1"); err != nil {
+		t.Fatalf("save response id: %v", err)
+	}
+	removed, err := RemoveHistoryByMessageID("p", 1, 10)
+	if err != nil || removed != 2 {
+		t.Fatalf("removed = %d, err = %v, want 2", removed, err)
+	}
+	if _, err := LoadLastResponseID("p"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("response id kept after removing an edited prompt: %v", err)
+	}
+	hist, _ := LoadProjectHistory("p")
+	if len(hist) != 2 || hist[0].Content != "b" || hist[1].Content != "b reply" {
+		t.Fatalf("history = %+v", hist)
+	}
+}
+
+func TestLastUserHistoryMessage(t *testing.T) {
+	initTestDB(t)
+	if _, err := LastUserHistoryMessage("p"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("empty history err = %v, want ErrNotFound", err)
+	}
+	for i, m := range []HistoryMessage{
+		{Role: RoleUser, Content: "q1"},
+		{Role: RoleUser, Content: "q2"},
+		{Role: RoleAssistant, Content: "a2"},
+	} {
+		m.When = int64(i + 1)
+		AddHistoryMessage("p", m)
+	}
+	m, err := LastUserHistoryMessage("p")
+	if err != nil || m.Content != "q2" {
+		t.Fatalf("last user message = %+v, err = %v, want q2", m, err)
+	}
+}
+
+func TestUndoLastExchange(t *testing.T) {
+	cases := []struct {
+		name    string
+		hist    []HistoryMessage
+		removed int
+		left    []string
+	}{
+		{
+			name: "exchange",
+			hist: []HistoryMessage{
+				{Role: RoleUser, Content: "q1"},
+				{Role: RoleAssistant, Content: "a1"},
+				{Role: RoleUser, Content: "q2"},
+				{Role: RoleUser, Content: "q2 image"},
+				{Role: RoleAssistant, Content: "a2"},
+			},
+			removed: 3,
+			left:    []string{"q1", "a1"},
+		},
+		{
+			name: "dangling user",
+			hist: []HistoryMessage{
+				{Role: RoleUser, Content: "q1"},
+				{Role: RoleAssistant, Content: "a1"},
+				{Role: RoleUser, Content: "q2"},
+			},
+			removed: 1,
+			left:    []string{"q1", "a1"},
+		},
+		{
+			name: "summary kept",
+			hist: []HistoryMessage{
+				{Role: RoleSystem, Content: "sum", IsSummary: true},
+				{Role: RoleAssistant, Content: "a1"},
+			},
+			removed: 1,
+			left:    []string{"sum"},
+		},
+		{name: "empty", removed: 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			initTestDB(t)
+			for i, m := range tc.hist {
+				m.When = int64(i + 1)
+				AddHistoryMessage("p", m)
+			}
+			removed, err := UndoLastExchange("p")
+			if err != nil || removed != tc.removed {
+				t.Fatalf("removed = %d, err = %v, want %d", removed, err, tc.removed)
+			}
+			hist, _ := LoadProjectHistory("p")
+			if len(hist) != len(tc.left) {
+				t.Fatalf("history = %+v, want %v", hist, tc.left)
+			}
+			for i, h := range hist {
+				if h.Content != tc.left[i] {
+					t.Fatalf("history[%d] = %q, want %q", i, h.Content, tc.left[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveLastHistoryMessages(t *testing.T) {
+	cases := []struct {
+		name    string
+		n       int
+		removed int
+		left    []string
+	}{
+		{"fewer", 2, 2, []string{"m1"}},
+		{"equal", 3, 3, nil},
+		{"more", 10, 3, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			initTestDB(t)
+			for i, c := range []string{"m1", "m2", "m3"} {
+				AddHistoryMessage("p", HistoryMessage{When: int64(i + 1), Content: c})
+			}
+			removed, err := RemoveLastHistoryMessages("p", tc.n)
+			if err != nil || removed != tc.removed {
+				t.Fatalf("removed = %d, err = %v, want %d", removed, err, tc.removed)
+			}
+			hist, _ := LoadProjectHistory("p")
+			if len(hist) != len(tc.left) {
+				t.Fatalf("history = %+v, want %v", hist, tc.left)
+			}
+			for i, h := range hist {
+				if h.Content != tc.left[i] {
+					t.Fatalf("history[%d] = %q, want %q", i, h.Content, tc.left[i])
+				}
+			}
+		})
+	}
+
+	t.Run("no history", func(t *testing.T) {
+		initTestDB(t)
+		if removed, err := RemoveLastHistoryMessages("none", 2); err != nil || removed != 0 {
+			t.Fatalf("removed = %d, err = %v", removed, err)
+		}
+	})
+}
+
+func TestGlobalStats(t *testing.T) {
+	initTestDB(t)
+	for _, p := range []string{"a", "b", "c"} {
+		if err := SaveProject(p); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+	}
+	MapTopic(1, 0, "a")
+	MapTopic(1, 2, "b")
+	for i := 0; i < 3; i++ {
+		AddHistoryMessage("a", HistoryMessage{When: int64(i), Content: "x"})
+	}
+	AddHistoryMessage("b", HistoryMessage{When: 1, Content: "y"})
+
+	st, err := GlobalStats()
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	if st.Projects != 3 || st.MappedTopics != 2 || st.HistoryMessages != 4 {
+		t.Fatalf("stats = %+v", st)
+	}
+	if st.DBSize <= 0 {
+		t.Fatalf("db size = %d", st.DBSize)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	initTestDB(t)
+	if err := SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	MapTopic(1, 2, "demo")
+	AddHistoryMessage("demo", HistoryMessage{When: 1, Content: "kept"})
+
+	var buf bytes.Buffer
+	if err := Snapshot(&buf); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	// changes after the snapshot are not part of it
+	AddHistoryMessage("demo", HistoryMessage{When: 2, Content: "later"})
+	Close()
+
+	path := filepath.Join(t.TempDir(), "restored.db")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("write snapshot: %v", err)
+	}
+	if err := Init(path); err != nil {
+		t.Fatalf("open snapshot: %v", err)
+	}
+	if ok, err := ProjectExists("demo"); err != nil || !ok {
+		t.Fatalf("project in snapshot = %v, %v", ok, err)
+	}
+	if proj, err := GetMappedProject(1, 2); err != nil || proj != "demo" {
+		t.Fatalf("mapping in snapshot = %q, %v", proj, err)
+	}
+	hist, err := LoadProjectHistory("demo")
+	if err != nil || len(hist) != 1 || hist[0].Content != "kept" {
+		t.Fatalf("history in snapshot = %+v, %v", hist, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	initTestDB(t)
+	if err := SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	big := strings.Repeat("x", 4096)
+	for i := 0; i < 500; i++ {
+		AddHistoryMessage("bulk", HistoryMessage{When: int64(i), Content: big})
+	}
+	AddHistoryMessage("demo", HistoryMessage{When: 1, Content: "kept"})
+	if _, err := ClearProjectHistory("bulk"); err != nil {
+		t.Fatalf("clear history: %v", err)
+	}
+	before, err := FileSize()
+	if err != nil {
+		t.Fatalf("size before: %v", err)
+	}
+
+	if err := Compact(Path() + ".compact"); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	after, err := FileSize()
+	if err != nil {
+		t.Fatalf("size after: %v", err)
+	}
+	if after >= before {
+		t.Fatalf("size after compaction = %d, want below %d", after, before)
+	}
+	if _, err := os.Stat(Path() + ".compact"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+	if ok, err := ProjectExists("demo"); err != nil || !ok {
+		t.Fatalf("project after compaction = %v, %v", ok, err)
+	}
+	hist, err := LoadProjectHistory("demo")
+	if err != nil || len(hist) != 1 || hist[0].Content != "kept" {
+		t.Fatalf("history after compaction = %+v, %v", hist, err)
+	}
+	// the database stays writable
+	AddHistoryMessage("demo", HistoryMessage{When: 2, Content: "later"})
+	if hist, _ := LoadProjectHistory("demo"); len(hist) != 2 {
+		t.Fatalf("history after write = %+v", hist)
+	}
+}
+
+func TestCompactConcurrentCalls(t *testing.T) {
+	initTestDB(t)
+	if err := SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// calls made during the compaction wait for it
+				if ok, err := ProjectExists("demo"); err != nil || !ok {
+					select {
+					case errs <- fmt.Errorf("project exists = %v, %v", ok, err):
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err := Compact(Path() + ".compact"); err != nil {
+			t.Fatalf("compact: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestMigrateLegacyProjects(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	old, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("open old db: %v", err)
+	}
+	err = old.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(bucketProjects))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("alpha"), []byte("enc-alpha")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("beta"), []byte("enc-beta")); err != nil {
+			return err
+		}
+		m, err := tx.CreateBucket([]byte(bucketMapping))
+		if err != nil {
+			return err
+		}
+		return m.Put([]byte("1:2"), []byte("alpha"))
+	})
+	if err != nil {
+		t.Fatalf("seed old db: %v", err)
+	}
+	old.Close()
+
+	if err := Init(path); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	t.Cleanup(func() { Close() })
+	names, err := ListProjects()
+	if err != nil || !reflect.DeepEqual(names, []string{"alpha", "beta"}) {
+		t.Fatalf("projects = %v, %v", names, err)
+	}
+	if proj, err := GetMappedProject(1, 2); err != nil || proj != "alpha" {
+		t.Fatalf("mapping = %q, %v", proj, err)
+	}
+	keys := map[string]string{}
+	db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(bucketProjects)).Get([]byte("alpha")); len(v) != 0 {
+			t.Errorf("project value = %q, want empty", v)
+		}
+		return tx.Bucket([]byte(bucketAPIKeys)).ForEach(func(k, v []byte) error {
+			keys[string(k)] = string(v)
+			return nil
+		})
+	})
+	if want := map[string]string{"alpha": "enc-alpha", "beta": "enc-beta"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("legacy keys = %v, want %v", keys, want)
+	}
+
+	// reopening does not migrate again
+	Close()
+	if err := Init(path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if ok, err := ProjectExists("beta"); err != nil || !ok {
+		t.Fatalf("project after reopen = %v, %v", ok, err)
+	}
+}
+
+func TestMigrateLegacyProjectsSkipsCurrentLayout(t *testing.T) {
+	initTestDB(t)
+	if err := SaveProject("demo"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := db.Update(migrateLegacyProjects); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, err := LoadProjectAPIKey("demo"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("api key for current layout: %v", err)
+	}
+}
+
+func TestRunMigrations(t *testing.T) {
+	initTestDB(t)
+	// start over from an unversioned database
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketMeta)).Delete([]byte(metaSchemaVersion))
+	})
+
+	var ran []int
+	step := func(n int) migration {
+		return func(tx *bolt.Tx) error {
+			ran = append(ran, n)
+			return nil
+		}
+	}
+	list := []migration{step(1), step(2)}
+	if err := db.Update(func(tx *bolt.Tx) error { return runMigrations(tx, list) }); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if !reflect.DeepEqual(ran, []int{1, 2}) {
+		t.Fatalf("ran = %v, want [1 2]", ran)
+	}
+	if v, err := SchemaVersion(); err != nil || v != 2 {
+		t.Fatalf("version = %d, %v, want 2", v, err)
+	}
+
+	// only migrations added since the last run are applied
+	ran = nil
+	list = append(list, step(3))
+	if err := db.Update(func(tx *bolt.Tx) error { return runMigrations(tx, list) }); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if !reflect.DeepEqual(ran, []int{3}) {
+		t.Fatalf("ran = %v, want [3]", ran)
+	}
+	if v, _ := SchemaVersion(); v != 3 {
+		t.Fatalf("version = %d, want 3", v)
+	}
+
+	// a failing migration leaves the version where it was
+	list = append(list, func(tx *bolt.Tx) error { return errors.New("boom") })
+	if err := db.Update(func(tx *bolt.Tx) error { return runMigrations(tx, list) }); err == nil {
+		t.Fatal("expected migration error")
+	}
+	if v, _ := SchemaVersion(); v != 3 {
+		t.Fatalf("version after failure = %d, want 3", v)
+	}
+
+	// a database from a newer version is rejected
+	if err := db.Update(func(tx *bolt.Tx) error { return runMigrations(tx, list[:2]) }); err == nil {
+		t.Fatal("expected error for a newer schema version")
+	}
+}
+
+func TestInitRecordsSchemaVersion(t *testing.T) {
+	initTestDB(t)
+	if v, err := SchemaVersion(); err != nil || v != len(migrations) {
+		t.Fatalf("version = %d, %v, want %d", v, err, len(migrations))
+	}
+}
+
+func TestMigrateErrorHistory(t *testing.T) {
+	initTestDB(t)
+	AddHistoryMessage("p", HistoryMessage{Role: RoleUser, When: 1, Content: "OpenAI error: quoted by the user"})
+	AddHistoryMessage("p", HistoryMessage{Role: RoleAssistant, When: 2, Content: "OpenAI error: boom"})
+	AddHistoryMessage("p", HistoryMessage{Role: RoleAssistant, When: 3, Content: "The model rejected the request: context too long."})
+	AddHistoryMessage("p", HistoryMessage{Role: RoleAssistant, When: 4, Content: "fine"})
+	if err := db.Update(migrateErrorHistory); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	hist, err := LoadProjectHistory("p")
+	if err != nil || len(hist) != 4 {
+		t.Fatalf("history = %v, %v", hist, err)
+	}
+	var flags []bool
+	for _, h := range hist {
+		flags = append(flags, h.IsError)
+	}
+	if want := []bool{false, true, true, false}; !reflect.DeepEqual(flags, want) {
+		t.Fatalf("error flags = %v, want %v", flags, want)
+	}
+}
+
+func TestMigrateReplyTopics(t *testing.T) {
+	initTestDB(t)
+	SaveProject("p")
+	SaveProject("q")
+	MapTopic(1, 3, "p")
+	MapTopic(2, 3, "p")
+	MapTopic(1, 4, "q")
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketReplyTopics)).Put([]byte("p"), []byte("7"))
+	})
+	if err := db.Update(migrateReplyTopics); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	for _, m := range []Mapping{{ChatID: 1, TopicID: 3}, {ChatID: 2, TopicID: 3}} {
+		if target, err := LoadReplyTopic(m.ChatID, m.TopicID); err != nil || target != 7 {
+			t.Fatalf("reply topic of %d:%d = %d, %v", m.ChatID, m.TopicID, target, err)
+		}
+	}
+	if _, err := LoadReplyTopic(1, 4); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unredirected project got a reply topic: %v", err)
+	}
+	if _, err := loadIntSetting(bucketReplyTopics, "p"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("project key left behind: %v", err)
+	}
+
+	// unmapping a topic drops its redirect
+	if err := UnmapTopic(1, 3); err != nil {
+		t.Fatalf("unmap: %v", err)
+	}
+	if _, err := LoadReplyTopic(1, 3); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("redirect survived unmapping: %v", err)
+	}
+
+	// older exports carry the redirect as a project setting
+	legacy := ConfigExport{
+		SchemaVersion: 2,
+		Projects:      []ProjectExport{{Name: "q", Settings: map[string]string{bucketReplyTopics: "8"}}},
+		Mappings:      []Mapping{{ChatID: 1, TopicID: 4, Project: "q"}},
+	}
+	if err := ImportConfig(legacy, false); err != nil {
+		t.Fatalf("import legacy export: %v", err)
+	}
+	if target, err := LoadReplyTopic(1, 4); err != nil || target != 8 {
+		t.Fatalf("legacy reply topic = %d, %v", target, err)
+	}
+}
+
+func TestMigrateDropSampling(t *testing.T) {
+	initTestDB(t)
+	db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"penalties", "seeds"} {
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("p"), []byte("1")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err := db.Update(migrateDropSampling); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{"penalties", "seeds"} {
+			if tx.Bucket([]byte(name)) != nil {
+				t.Fatalf("%s bucket left behind", name)
+			}
+		}
+		return nil
+	})
+	// running again on a database without the bucket is fine
+	if err := db.Update(migrateDropSampling); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+
+	// older exports may still carry the setting
+	old := ConfigExport{SchemaVersion: 3, Projects: []ProjectExport{{Name: "p", Settings: map[string]string{"penalties": `{"frequency":0.5}`, "seeds": "42"}}}}
+	if err := ImportConfig(old, false); err != nil {
+		t.Fatalf("import older export: %v", err)
+	}
+	old.SchemaVersion = len(migrations)
+	if err := ImportConfig(old, false); err == nil {
+		t.Fatal("dropped setting imported from a current export")
+	}
+}
+
+func TestCachedAnswerPruning(t *testing.T) {
+	initTestDB(t)
+	if err := SaveImageCacheTTL("p", 60); err != nil {
+		t.Fatalf("save ttl: %v", err)
+	}
+	count := func() int {
+		n := 0
+		db.View(func(tx *bolt.Tx) error {
+			if pb := tx.Bucket([]byte(bucketImageCache)).Bucket([]byte("p")); pb != nil {
+				n = pb.Stats().KeyN
+			}
+			return nil
+		})
+		return n
+	}
+
+	// an answer past the TTL is dropped by the next save
+	db.Update(func(tx *bolt.Tx) error {
+		pb, err := tx.Bucket([]byte(bucketImageCache)).CreateBucketIfNotExists([]byte("p"))
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(cachedAnswer{Reply: "old", Created: time.Now().Add(-2 * time.Hour).Unix()})
+		return pb.Put([]byte("old"), data)
+	})
+	if err := SaveCachedAnswer("p", "new", "fresh"); err != nil {
+		t.Fatalf("save answer: %v", err)
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("%d answers cached, want only the fresh one", n)
+	}
+
+	// the cache is capped
+	for i := 0; i < maxCachedAnswers+5; i++ {
+		if err := SaveCachedAnswer("p", strconv.Itoa(i), "r"); err != nil {
+			t.Fatalf("save answer: %v", err)
+		}
+	}
+	if n := count(); n != maxCachedAnswers {
+		t.Fatalf("%d answers cached, want %d", n, maxCachedAnswers)
+	}
+
+	// turning the cache off empties it
+	if err := SaveImageCacheTTL("p", 0); err != nil {
+		t.Fatalf("save ttl: %v", err)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("%d answers left with the cache off", n)
+	}
+}
+
+func TestSaveProjectExists(t *testing.T) {
+	initTestDB(t)
+	if err := SaveProject("p"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := SaveProjectModel("p", "custom"); err != nil {
+		t.Fatalf("save model: %v", err)
+	}
+	SetProjectDefaults(ProjectDefaults{Model: "gpt-4o"})
+	defer SetProjectDefaults(ProjectDefaults{})
+	if err := SaveProject("p"); !errors.Is(err, ErrProjectExists) {
+		t.Fatalf("save existing project = %v, want ErrProjectExists", err)
+	}
+	if model, _ := LoadProjectModel("p"); model != "custom" {
+		t.Fatalf("model = %q, want custom", model)
+	}
+}
+
+func TestMigrateSetupKeys(t *testing.T) {
+	initTestDB(t)
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketSetup)).Put([]byte("7"), []byte(`{"step":"topic","project":"p","chat_id":-100,"topic_id":3}`))
+	})
+	if err := db.Update(migrateSetupKeys); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	states, err := ListSetupStates()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	want := []SetupState{{Step: "topic", Project: "p", ChatID: -100, TopicID: 3, UserID: 7}}
+	if !reflect.DeepEqual(states, want) {
+		t.Fatalf("states = %+v, want %+v", states, want)
+	}
+	if err := DeleteSetupState(-100, 3, 7); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if states, _ := ListSetupStates(); len(states) != 0 {
+		t.Fatalf("state left behind: %+v", states)
+	}
+}
+
+func TestUserCurrentProject(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	if err := Init(path); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	t.Cleanup(func() { Close() })
+	for _, p := range []string{"alpha", "beta"} {
+		if err := SaveProject(p); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+	}
+	if _, err := GetUserCurrentProject(7); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unset current project: %v", err)
+	}
+	if err := SetUserCurrentProject(7, "alpha"); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	// the selection survives a restart
+	Close()
+	if err := Init(path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if proj, err := GetUserCurrentProject(7); err != nil || proj != "alpha" {
+		t.Fatalf("current project = %q, %v", proj, err)
+	}
+
+	// unmapped private chats fall back to it, groups and mapped topics do not
+	if proj, err := GetMappedProject(7, 0); err != nil || proj != "alpha" {
+		t.Fatalf("private chat project = %q, %v", proj, err)
+	}
+	if _, err := GetMappedProject(-100, 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("group chat: %v", err)
+	}
+	MapTopic(7, 0, "beta")
+	if proj, _ := GetMappedProject(7, 0); proj != "beta" {
+		t.Fatalf("mapped private chat project = %q, want beta", proj)
+	}
+
+	if err := SetUserCurrentProject(8, "gone"); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if _, err := GetMappedProject(8, 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing project: %v", err)
+	}
+	if err := SetUserCurrentProject(7, ""); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	if _, err := GetUserCurrentProject(7); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("cleared current project: %v", err)
+	}
+}
+
+func TestLoadersReturnErrNotFound(t *testing.T) {
+	initTestDB(t)
+
+	strLoaders := []struct {
+		name string
+		load func(string) (string, error)
+		def  string
+	}{
+		{"model", LoadProjectModel, ""},
+		{"summary model", LoadProjectSummaryModel, ""},
+		{"web search", LoadProjectWebSearch, "off"},
+		{"reasoning", LoadProjectReasoning, "medium"},
+		{"transcribe", LoadProjectTranscribe, "off"},
+		{"auto summarize", LoadProjectAutoSummarize, "off"},
+		{"busy mode", LoadProjectBusyMode, "queue"},
+		{"edit rerun", LoadProjectEditRerun, "off"},
+		{"typing", LoadProjectTyping, "on"},
+		{"voice reply", LoadProjectVoiceReply, "off"},
+		{"show reasoning", LoadProjectShowReasoning, "off"},
+		{"mention only", LoadProjectMentionOnly, "off"},
+		{"fallback", LoadProjectFallback, ""},
+		{"citations", LoadProjectCitations, "on"},
+		{"chunk numbers", LoadProjectChunkNumbers, "off"},
+		{"image detail", LoadProjectImageDetail, "auto"},
+		{"instruction role", LoadProjectInstructionRole, "system"},
+		{"inject time", LoadProjectInjectTime, "off"},
+		{"mirror language", LoadProjectMirrorLanguage, "off"},
+		{"assistant name", LoadAssistantName, ""},
+		{"meta format", LoadProjectMetaFormat, ""},
+		{"stickers", LoadProjectStickers, "off"},
+		{"animations", LoadProjectAnimations, "off"},
+		{"description", LoadProjectDescription, ""},
+		{"json mode", LoadProjectJSONMode, "off"},
+		{"json schema", LoadProjectJSONSchema, ""},
+		{"footer", LoadProjectFooter, ""},
+		{"api key", LoadProjectAPIKey, ""},
+		{"chaining", LoadProjectChaining, "off"},
+		{"last response id", LoadLastResponseID, ""},
+		{"instruction", LoadProjectInstruction, ""},
+	}
+	for _, l := range strLoaders {
+		v, err := l.load("missing")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: err = %v, want ErrNotFound", l.name, err)
+		}
+		if v != l.def {
+			t.Errorf("%s: value = %q, want default %q", l.name, v, l.def)
+		}
+	}
+
+	intLoaders := []struct {
+		name string
+		load func(string) (int, error)
+	}{
+		{"history limit", LoadHistoryLimit},
+		{"token budget", LoadTokenBudget},
+		{"image cache ttl", LoadImageCacheTTL},
+		{"history max len", LoadHistoryMaxLen},
+		{"image resize", LoadImageResize},
+		{"timeout", LoadProjectTimeout},
+		{"batch window", LoadProjectBatchWindow},
+		{"monthly budget", LoadProjectMonthlyBudget},
+		{"dedup window", LoadProjectDedupWindow},
+	}
+	for _, l := range intLoaders {
+		if v, err := l.load("missing"); !errors.Is(err, ErrNotFound) || v != 0 {
+			t.Errorf("%s: value = %d, err = %v", l.name, v, err)
+		}
+	}
+
+	if _, err := LoadProjectPreprocess("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("preprocess: err = %v, want ErrNotFound", err)
+	}
+	if _, err := GetMappedProject(1, 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("mapping: err = %v, want ErrNotFound", err)
+	}
+
+	// stored values are returned without error
+	SaveProjectWebSearch("p", "low")
+	if v, err := LoadProjectWebSearch("p"); err != nil || v != "low" {
+		t.Errorf("web search = %q, err = %v", v, err)
+	}
+	SaveProjectSummaryModel("p", "")
+	if v, err := LoadProjectSummaryModel("p"); err != nil || v != "" {
+		t.Errorf("summary model = %q, err = %v", v, err)
+	}
+	SaveHistoryLimit("p", 7)
+	if v, err := LoadHistoryLimit("p"); err != nil || v != 7 {
+		t.Errorf("history limit = %d, err = %v", v, err)
+	}
+}
+
+func TestProjectWelcome(t *testing.T) {
+	initTestDB(t)
+	if _, err := LoadProjectWelcome("demo"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("err = %v, want ErrNotFound", err)
+	}
+	if err := SaveProjectWelcome("demo", "Hello team"); err != nil {
+		t.Fatalf("save welcome: %v", err)
+	}
+	if v, err := LoadProjectWelcome("demo"); err != nil || v != "Hello team" {
+		t.Fatalf("welcome = %q, err = %v", v, err)
+	}
+}
+
+func TestAppendAudit(t *testing.T) {
+	initTestDB(t)
+	if got, err := LoadAudit("p"); err != nil || len(got) != 0 {
+		t.Fatalf("empty audit = %+v, %v", got, err)
+	}
+	AppendAudit("p", AuditEntry{When: 2, UserID: 1, Model: "m", Prompt: "q1", Reply: "a1"})
+	AppendAudit("p", AuditEntry{When: 2, UserID: 1, Model: "m", Prompt: "q2", Reply: "a2", IsError: true})
+	AppendAudit("other", AuditEntry{When: 1, Prompt: "x"})
+	SaveHistoryLimit("p", 1)
+	AddHistoryMessage("p", HistoryMessage{When: 1, Content: "h1"})
+	AddHistoryMessage("p", HistoryMessage{When: 2, Content: "h2"})
+	TrimProjectHistory("p", 1)
+
+	got, err := LoadAudit("p")
+	if err != nil {
+		t.Fatalf("load audit: %v", err)
+	}
+	if len(got) != 2 || got[0].Prompt != "q1" || got[1].Reply != "a2" || !got[1].IsError {
+		t.Fatalf("audit = %+v", got)
+	}
+}
+
+func TestFeedback(t *testing.T) {
+	initTestDB(t)
+	if _, err := LoadFeedback("p", 5); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := SaveFeedback("p", 5, "up"); err != nil {
+		t.Fatalf("save feedback: %v", err)
+	}
+	if err := SaveFeedback("p", 5, "down"); err != nil {
+		t.Fatalf("save feedback: %v", err)
+	}
+	SaveFeedback("q", 5, "up")
+	if got, err := LoadFeedback("p", 5); err != nil || got != "down" {
+		t.Fatalf("feedback = %q, %v", got, err)
+	}
+	if _, err := LoadFeedback("p", 6); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for unrated reply, got %v", err)
+	}
+}
+
+func TestListMappings(t *testing.T) {
+	initTestDB(t)
+	if got, err := ListMappings(); err != nil || len(got) != 0 {
+		t.Fatalf("empty mappings = %+v, %v", got, err)
+	}
+	MapTopic(-100, 5, "a")
+	MapTopic(-100, 6, "b")
+	MapTopic(42, 0, "a")
+
+	all, err := ListMappings()
+	if err != nil {
+		t.Fatalf("list mappings: %v", err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("mappings = %+v", all)
+	}
+	got, err := ListProjectMappings("a")
+	if err != nil {
+		t.Fatalf("list project mappings: %v", err)
+	}
+	want := []Mapping{{ChatID: -100, TopicID: 5, Project: "a"}, {ChatID: 42, TopicID: 0, Project: "a"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("project mappings = %+v, want %+v", got, want)
+	}
+	if got, _ := ListProjectMappings("none"); len(got) != 0 {
+		t.Fatalf("unexpected mappings for unknown project: %+v", got)
+	}
+}
+
+func TestLastResponseIDClearedWithHistory(t *testing.T) {
+	initTestDB(t)
+	if err := SaveProject("p"); err != nil {
+		t.Fatalf("save project: %v", err)
+	}
+	if err := AddHistoryMessage("p", HistoryMessage{When: 100, Content: "hi"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := SaveLastResponseID("p", "resp_1"); err != nil {
+		t.Fatalf("save id: %v", err)
+	}
+	if id, err := LoadLastResponseID("p"); err != nil || id != "resp_1" {
+		t.Fatalf("id = %q, %v", id, err)
+	}
+	if _, err := ClearProjectHistory("p"); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	if _, err := LoadLastResponseID("p"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("id kept after clear: %v", err)
+	}
+}
+
+func TestExportImportConfig(t *testing.T) {
+	initTestDB(t)
+	for _, p := range []string{"alpha", "beta"} {
+		if err := SaveProject(p); err != nil {
+			t.Fatalf("save project: %v", err)
+		}
+	}
+	SaveProjectModel("alpha", "gpt-5-mini")
+	SaveProjectInstruction("alpha", "Be brief.")
+	SaveHistoryLimit("beta", 20)
+	SaveProjectAPIKey("alpha", "enc-alpha")
+	MapTopic(-100, 5, "alpha")
+	MapTopic(42, 0, "beta")
+	SaveReplyTopic(-100, 5, 9)
+	AddHistoryMessage("alpha", HistoryMessage{When: 100, Content: "hi"})
+
+	plain, err := ExportConfig(false)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if plain.SchemaVersion != len(migrations) || len(plain.Projects) != 2 || len(plain.Mappings) != 2 {
+		t.Fatalf("export = %+v", plain)
+	}
+	if r := plain.Mappings[0].ReplyTopic; r == nil || *r != 9 || plain.Mappings[1].ReplyTopic != nil {
+		t.Fatalf("reply topics not exported with their mappings: %+v", plain.Mappings)
+	}
+	for _, p := range plain.Projects {
+		if p.APIKey != "" {
+			t.Fatalf("api key of %q exported without --with-keys", p.Name)
+		}
+	}
+	full, err := ExportConfig(true)
+	if err != nil {
+		t.Fatalf("export with keys: %v", err)
+	}
+	if full.Projects[0].APIKey != "enc-alpha" {
+		t.Fatalf("api key = %q", full.Projects[0].APIKey)
+	}
+	data, err := json.Marshal(full)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	// replace into a different configuration
+	Close()
+	initTestDB(t)
+	SaveProject("gamma")
+	MapTopic(7, 0, "gamma")
+	var cfg ConfigExport
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if err := ImportConfig(cfg, true); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	again, err := ExportConfig(true)
+	if err != nil {
+		t.Fatalf("export after import: %v", err)
+	}
+	if !reflect.DeepEqual(again, full) {
+		t.Fatalf("round trip = %+v, want %+v", again, full)
+	}
+	if n, _ := CountProjectHistory("alpha"); n != 0 {
+		t.Fatalf("history imported: %d messages", n)
+	}
+
+	// merge keeps what is not in the document
+	SaveProject("gamma")
+	MapTopic(7, 0, "gamma")
+	if err := ImportConfig(plain, false); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if names, _ := ListProjects(); !reflect.DeepEqual(names, []string{"alpha", "beta", "gamma"}) {
+		t.Fatalf("projects after merge = %v", names)
+	}
+	if proj, err := GetMappedProject(7, 0); err != nil || proj != "gamma" {
+		t.Fatalf("mapping after merge = %q, %v", proj, err)
+	}
+	if key, _ := LoadProjectAPIKey("alpha"); key != "enc-alpha" {
+		t.Fatalf("api key after merge = %q", key)
+	}
+
+	// invalid documents change nothing
+	bad := []ConfigExport{
+		{SchemaVersion: len(migrations) + 1},
+		{Projects: []ProjectExport{{Name: "x", Settings: map[string]string{"history": "1"}}}},
+		{Mappings: []Mapping{{ChatID: 9, Project: "missing"}}},
+	}
+	for i, c := range bad {
+		if err := ImportConfig(c, true); err == nil {
+			t.Fatalf("bad document %d imported", i)
+		}
+	}
+	if names, _ := ListProjects(); len(names) != 3 {
+		t.Fatalf("projects after rejected imports = %v", names)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	initTestDB(t)
+	if v, err := LoadMaintenance(); !errors.Is(err, ErrNotFound) || v != "off" {
+		t.Fatalf("default maintenance = %q, %v", v, err)
+	}
+	if _, err := LoadMaintenanceMessage(); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("default maintenance message: %v", err)
+	}
+	SaveMaintenance("on")
+	SaveMaintenanceMessage("Back at noon.")
+	if v, _ := LoadMaintenance(); v != "on" {
+		t.Fatalf("maintenance = %q", v)
+	}
+	if v, _ := LoadMaintenanceMessage(); v != "Back at noon." {
+		t.Fatalf("maintenance message = %q", v)
+	}
+}
+
+func TestProjectDescription(t *testing.T) {
+	initTestDB(t)
+	if err := SaveProjectDescription("p", "Support bot for the shop"); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if got, err := LoadProjectDescription("p"); err != nil || got != "Support bot for the shop" {
+		t.Fatalf("load = %q, %v", got, err)
+	}
+	if err := DeleteProjectDescription("p"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if got, err := LoadProjectDescription("p"); !errors.Is(err, ErrNotFound) || got != "" {
+		t.Fatalf("after delete = %q, %v", got, err)
+	}
+}
+
+func TestMonthlyUsage(t *testing.T) {
+	initTestDB(t)
+	if n, err := LoadMonthlyUsage("p", "2026-10"); !errors.Is(err, ErrNotFound) || n != 0 {
+		t.Fatalf("empty usage = %d, %v", n, err)
+	}
+	AddMonthlyUsage("p", "2026-10", 100)
+	if total, err := AddMonthlyUsage("p", "2026-10", 50); err != nil || total != 150 {
+		t.Fatalf("total = %d, %v", total, err)
+	}
+	AddMonthlyUsage("p", "2026-11", 7)
+	AddMonthlyUsage("other", "2026-10", 1000)
+	if n, _ := LoadMonthlyUsage("p", "2026-10"); n != 150 {
+		t.Fatalf("october usage = %d, want 150", n)
+	}
+	if n, _ := LoadMonthlyUsage("p", "2026-11"); n != 7 {
+		t.Fatalf("november usage = %d, want 7", n)
+	}
+}